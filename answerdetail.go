@@ -0,0 +1,69 @@
+/*************************************************************************
+ * Copyright 2017 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package gravwellcoredns
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// answer-detail-by-type levels, full is the default for every qtype
+const (
+	answerDetailFull  string = `full`
+	answerDetailCount string = `count`
+)
+
+// answerDetail holds the qtypes whose answers are summarized as a count rather than encoded
+type answerDetail struct {
+	count map[uint16]bool
+}
+
+// parseAnswerDetail parses answer-detail-by-type QTYPE:level arguments, returning the specs in
+// canonical form for the configuration and nil when every qtype is left at full
+func parseAnswerDetail(args []string) (ad *answerDetail, specs []string, err error) {
+	if len(args) == 0 {
+		return nil, nil, fmt.Errorf("answer-detail-by-type requires at least one QTYPE:level pair")
+	}
+	seen := map[uint16]bool{}
+	for _, arg := range args {
+		name, level, ok := strings.Cut(arg, `:`)
+		qt, known := dns.StringToType[strings.ToUpper(name)]
+		if !ok {
+			return nil, nil, fmt.Errorf("Invalid answer-detail-by-type %q, must be QTYPE:level", arg)
+		} else if !known {
+			return nil, nil, fmt.Errorf("Invalid answer-detail-by-type %q, unknown qtype %q", arg, name)
+		} else if seen[qt] {
+			return nil, nil, fmt.Errorf("Invalid answer-detail-by-type %q, %s is already set", arg, dns.TypeToString[qt])
+		}
+		seen[qt] = true
+		switch level = strings.ToLower(level); level {
+		case answerDetailFull:
+		case answerDetailCount:
+			if ad == nil {
+				ad = &answerDetail{count: map[uint16]bool{}}
+			}
+			ad.count[qt] = true
+		default:
+			return nil, nil, fmt.Errorf("Invalid answer-detail-by-type %q, the level must be %s or %s", arg, answerDetailFull, answerDetailCount)
+		}
+		specs = append(specs, dns.TypeToString[qt]+`:`+level)
+	}
+	return
+}
+
+// summarize reports whether answers to qs are counted rather than encoded, only the first
+// question is consulted since legitimate messages carry one
+func (ad *answerDetail) summarize(qs []dns.Question) bool {
+	if ad == nil || len(qs) == 0 {
+		return false
+	}
+	return ad.count[qs[0].Qtype]
+}
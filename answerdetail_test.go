@@ -0,0 +1,89 @@
+/*************************************************************************
+ * Copyright 2017 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package gravwellcoredns
+
+import (
+	"encoding/json"
+	"slices"
+	"testing"
+
+	"github.com/coredns/caddy"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/gravwell/gravwell/v3/ingest/entry"
+	"github.com/miekg/dns"
+)
+
+func TestParseAnswerDetail(t *testing.T) {
+	ad, specs, err := parseAnswerDetail([]string{`a:FULL`, `any:count`, `AXFR:count`})
+	if err != nil {
+		t.Fatal(err)
+	} else if !slices.Equal(specs, []string{`A:full`, `ANY:count`, `AXFR:count`}) {
+		t.Fatalf("bad specs %v", specs)
+	}
+	for qt, want := range map[uint16]bool{dns.TypeA: false, dns.TypeAAAA: false, dns.TypeANY: true, dns.TypeAXFR: true} {
+		if ad.summarize([]dns.Question{{Name: `example.com.`, Qtype: qt, Qclass: dns.ClassINET}}) != want {
+			t.Fatalf("bad detail for %s", dns.TypeToString[qt])
+		}
+	}
+	if ad, _, err = parseAnswerDetail([]string{`A:full`}); err != nil || ad != nil {
+		t.Fatal("all full should need no lookup", err)
+	}
+	for _, bad := range [][]string{nil, {`ANY`}, {`BOGUS:count`}, {`ANY:none`}, {`ANY:count`, `any:full`}} {
+		if _, _, err = parseAnswerDetail(bad); err == nil {
+			t.Fatalf("accepted answer-detail-by-type %v", bad)
+		}
+	}
+	//a qtype repeated on a second line is caught as well
+	if _, _, err = parseConfig(caddy.NewTestController("dns", `gravwell {
+	Ingest-Secret testing
+	Cleartext-Target 192.168.1.1:4024
+	Answer-Detail-By-Type ANY:count
+	Answer-Detail-By-Type AXFR:count ANY:full
+	}`)); err == nil {
+		t.Fatal("accepted a repeated qtype")
+	}
+}
+
+func TestAnswerDetail(t *testing.T) {
+	opts := testOpts
+	opts.logNegative = true
+	opts.answerDetail, _, _ = parseAnswerDetail([]string{`ANY:count`})
+	encode := func(qtype uint16, rrs ...dns.RR) (v dnsBase, question map[string]any) {
+		t.Helper()
+		bbs := jsonEncoder{}.Encode(entry.Now(), testLocal, testRemote, newIntrospectorFromMsg(testMsg(`example.com.`, qtype, rrs...), opts))
+		var raw struct {
+			Question map[string]any
+		}
+		if len(bbs) != 1 {
+			t.Fatalf("got %d records", len(bbs))
+		} else if err := json.Unmarshal(bbs[0], &v); err != nil {
+			t.Fatal(err)
+		} else if err = json.Unmarshal(bbs[0], &raw); err != nil {
+			t.Fatal(err)
+		}
+		return v, raw.Question
+	}
+	rrs := []dns.RR{
+		test.A(`example.com. 60 IN A 1.2.3.4`),
+		test.MX(`example.com. 60 IN MX 10 mail.example.com.`),
+		test.TXT(`example.com. 60 IN TXT "v=spf1 -all"`),
+	}
+	v, q := encode(dns.TypeANY, rrs...)
+	if v.AnswerCount != 3 || v.EventType != eventQuery {
+		t.Fatalf("ANY answers were not summarized: %+v", v)
+	} else if _, ok := q[`A`]; ok {
+		t.Fatal("summarized record carries an answer")
+	}
+	//other qtypes keep their answers
+	if v, q = encode(dns.TypeA, rrs[0]); v.AnswerCount != 0 || v.EventType != eventAnswer {
+		t.Fatalf("A answers were summarized: %+v", v)
+	} else if q[`A`] != `1.2.3.4` {
+		t.Fatalf("missing A answer %v", q)
+	}
+}
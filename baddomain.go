@@ -0,0 +1,229 @@
+/*************************************************************************
+ * Copyright 2017 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package gravwellcoredns
+
+import (
+	"bufio"
+	"fmt"
+	"hash/maphash"
+	"io"
+	"math"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	badDomainFalsePositive float64 = 0.01    // bloom filter false positive rate the bit array is sized for
+	badDomainExactMax      int     = 1 << 17 // lists up to this many names also keep an exact set
+)
+
+// bloomFilter is a fixed size bloom filter over strings.  The k probe positions come from two
+// seeded maphash values combined by double hashing, the seeds are per process which is fine
+// for a filter that only ever lives in memory.
+type bloomFilter struct {
+	bits   []uint64
+	m      uint64 // bit count
+	k      int
+	s1, s2 maphash.Seed
+}
+
+// newBloomFilter sizes a filter for n entries at the false positive rate p
+func newBloomFilter(n int, p float64) *bloomFilter {
+	n = max(n, 1)
+	m := uint64(math.Ceil(-float64(n) * math.Log(p) / (math.Ln2 * math.Ln2)))
+	m = max((m+63)&^63, 64)
+	return &bloomFilter{
+		bits: make([]uint64, m/64),
+		m:    m,
+		k:    max(int(math.Round(float64(m)/float64(n)*math.Ln2)), 1),
+		s1:   maphash.MakeSeed(),
+		s2:   maphash.MakeSeed(),
+	}
+}
+
+func (bf *bloomFilter) add(v string) {
+	h1, h2 := maphash.String(bf.s1, v), maphash.String(bf.s2, v)|1
+	for i := 0; i < bf.k; i++ {
+		b := (h1 + uint64(i)*h2) % bf.m
+		bf.bits[b/64] |= 1 << (b % 64)
+	}
+}
+
+func (bf *bloomFilter) test(v string) bool {
+	h1, h2 := maphash.String(bf.s1, v), maphash.String(bf.s2, v)|1
+	for i := 0; i < bf.k; i++ {
+		b := (h1 + uint64(i)*h2) % bf.m
+		if bf.bits[b/64]&(1<<(b%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// badDomainSet is a loaded bad-domain-list.  The bloom filter answers every lookup, a list small
+// enough to hold exactly also confirms each bloom hit so it never reports a false positive.
+type badDomainSet struct {
+	bloom *bloomFilter
+	exact map[string]struct{} // nil for lists over badDomainExactMax names
+	count int
+}
+
+// parseBadDomains reads a bad-domain-list, one domain name per line.  Blank lines and # comments
+// are skipped, names are lowercased and the trailing dot is optional.
+func parseBadDomains(r io.Reader) (*badDomainSet, error) {
+	var names []string
+	sc := bufio.NewScanner(r)
+	for n := 1; sc.Scan(); n++ {
+		line, _, _ := strings.Cut(sc.Text(), `#`)
+		flds := strings.Fields(line)
+		if len(flds) == 0 {
+			continue
+		} else if len(flds) != 1 {
+			return nil, fmt.Errorf("line %d: must be a single domain name", n)
+		}
+		name := normalizeBadDomain(flds[0])
+		if _, ok := dns.IsDomainName(name); !ok || name == `` {
+			return nil, fmt.Errorf("line %d: invalid domain name %q", n, flds[0])
+		}
+		names = append(names, name)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	bs := &badDomainSet{
+		bloom: newBloomFilter(len(names), badDomainFalsePositive),
+		count: len(names),
+	}
+	if len(names) <= badDomainExactMax {
+		bs.exact = make(map[string]struct{}, len(names))
+	}
+	for _, name := range names {
+		bs.bloom.add(name)
+		if bs.exact != nil {
+			bs.exact[name] = struct{}{}
+		}
+	}
+	return bs, nil
+}
+
+func normalizeBadDomain(name string) string {
+	return strings.ToLower(strings.TrimSuffix(name, `.`))
+}
+
+func loadBadDomains(p string) (*badDomainSet, error) {
+	fin, err := os.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	defer fin.Close()
+	bs, err := parseBadDomains(fin)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid bad-domain-list %s - %w", p, err)
+	}
+	return bs, nil
+}
+
+// contains reports whether the name or any domain it sits under is listed, so listing
+// example.com also flags www.example.com
+func (bs *badDomainSet) contains(name string) bool {
+	name = normalizeBadDomain(name)
+	for name != `` {
+		if bs.bloom.test(name) {
+			if bs.exact == nil {
+				return true
+			} else if _, ok := bs.exact[name]; ok {
+				return true
+			}
+		}
+		_, name, _ = strings.Cut(name, `.`)
+	}
+	return false
+}
+
+// badDomains serves KnownBad lookups from a bad-domain-list file and rereads the file on SIGHUP
+// in the same way as the country-cidr-map.  A file that fails to parse on reload is logged and
+// the previous set is kept.
+type badDomains struct {
+	path string
+	set  atomic.Pointer[badDomainSet]
+	sig  chan os.Signal
+	done chan struct{}
+	wg   sync.WaitGroup
+	lg   *pluginLogger
+}
+
+func newBadDomains(p string, lg *pluginLogger) (*badDomains, error) {
+	bs, err := loadBadDomains(p)
+	if err != nil {
+		return nil, err
+	}
+	bd := &badDomains{
+		path: p,
+		sig:  make(chan os.Signal, 1),
+		done: make(chan struct{}),
+		lg:   lg,
+	}
+	bd.set.Store(bs)
+	bd.logLoaded(`loaded`, bs)
+	signal.Notify(bd.sig, syscall.SIGHUP)
+	bd.wg.Add(1)
+	go bd.run()
+	return bd, nil
+}
+
+func (bd *badDomains) run() {
+	defer bd.wg.Done()
+	for {
+		select {
+		case <-bd.done:
+			return
+		case <-bd.sig:
+			bd.reload()
+		}
+	}
+}
+
+func (bd *badDomains) reload() {
+	bs, err := loadBadDomains(bd.path)
+	if err != nil {
+		bd.lg.Errorf("bad-domain-list reload failed, keeping the previous list: %v", err)
+		return
+	}
+	bd.set.Store(bs)
+	bd.logLoaded(`reloaded`, bs)
+}
+
+func (bd *badDomains) logLoaded(verb string, bs *badDomainSet) {
+	if bs.exact != nil {
+		bd.lg.Infof("%s bad-domain-list %s with %d names, matches are exact", verb, bd.path, bs.count)
+	} else {
+		bd.lg.Infof("%s bad-domain-list %s with %d names in %d KiB, about %g%% of lookups falsely match",
+			verb, bd.path, bs.count, len(bs.bloom.bits)/128, badDomainFalsePositive*100)
+	}
+}
+
+// knownBad reports whether a question name is on the list, a nil list matches nothing
+func (bd *badDomains) knownBad(name string) bool {
+	if bd == nil {
+		return false
+	}
+	return bd.set.Load().contains(name)
+}
+
+func (bd *badDomains) close() {
+	signal.Stop(bd.sig)
+	close(bd.done)
+	bd.wg.Wait()
+}
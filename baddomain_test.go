@@ -0,0 +1,148 @@
+/*************************************************************************
+ * Copyright 2017 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package gravwellcoredns
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/coredns/caddy"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/miekg/dns"
+)
+
+const testBadDomains = `# lab list
+evil.example
+Malware.Test.   # case and the trailing dot do not matter
+`
+
+func TestBloomFilter(t *testing.T) {
+	const n = 20000
+	bf := newBloomFilter(n, badDomainFalsePositive)
+	for i := 0; i < n; i++ {
+		bf.add(fmt.Sprintf("bad%d.example", i))
+	}
+	for i := 0; i < n; i++ {
+		if !bf.test(fmt.Sprintf("bad%d.example", i)) {
+			t.Fatalf("bad%d.example missing, a bloom filter has no false negatives", i)
+		}
+	}
+	var fp int
+	for i := 0; i < n; i++ {
+		if bf.test(fmt.Sprintf("good%d.example", i)) {
+			fp++
+		}
+	}
+	//sized for 1%, allow for variance
+	if rate := float64(fp) / n; rate > 3*badDomainFalsePositive {
+		t.Fatalf("false positive rate %g", rate)
+	}
+}
+
+func TestParseBadDomains(t *testing.T) {
+	bs, err := parseBadDomains(strings.NewReader(testBadDomains))
+	if err != nil {
+		t.Fatal(err)
+	} else if bs.count != 2 || bs.exact == nil {
+		t.Fatalf("bad set %d names, exact %v", bs.count, bs.exact != nil)
+	}
+	for name, exp := range map[string]bool{
+		`evil.example.`:         true,
+		`WWW.Evil.Example.`:     true,
+		`a.b.malware.test`:      true,
+		`notevil.example.`:      false,
+		`example.`:              false,
+		`malware.test.example.`: false,
+		`.`:                     false,
+	} {
+		if bs.contains(name) != exp {
+			t.Fatalf("%s matched %v, expected %v", name, !exp, exp)
+		}
+	}
+	for _, bad := range []string{
+		"evil.example extra\n",
+		"bad..example\n",
+	} {
+		if _, err = parseBadDomains(strings.NewReader(bad)); err == nil {
+			t.Fatalf("accepted %q", bad)
+		}
+	}
+}
+
+func TestBadDomains(t *testing.T) {
+	p := filepath.Join(t.TempDir(), `bad`)
+	if err := os.WriteFile(p, []byte(testBadDomains), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := parseConfig(caddy.NewTestController("dns", "gravwell {\n\tStdout-Sink true\n\tBad-Domain-List "+p+"\n}")); err != nil {
+		t.Fatal(err)
+	} else if _, _, err = parseConfig(caddy.NewTestController("dns", "gravwell {\n\tStdout-Sink true\n\tBad-Domain-List "+p+".missing\n}")); err == nil {
+		t.Fatal("accepted a missing bad-domain-list")
+	}
+	bd, err := newBadDomains(p, newPluginLogger(`off`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bd.close()
+
+	dw := &discardWriter{keep: true}
+	gh := gwHandler{
+		Next:          answerHandler(false),
+		im:            dw,
+		enc:           &jsonEncoder{},
+		encodeOptions: encodeOptions{maxQuestions: defaultMaxQuestions, badDomains: bd},
+	}
+	for _, name := range []string{`www.evil.example.`, `example.com.`} {
+		req := new(dns.Msg)
+		req.SetQuestion(name, dns.TypeA)
+		if _, err = gh.ServeDNS(context.Background(), &test.ResponseWriter{}, req); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var bad, good dnsBase
+	if err = json.Unmarshal(dw.ents[0].Data, &bad); err != nil {
+		t.Fatal(err)
+	} else if err = json.Unmarshal(dw.ents[1].Data, &good); err != nil {
+		t.Fatal(err)
+	} else if !bad.KnownBad || good.KnownBad {
+		t.Fatalf("KnownBad %v %v", bad.KnownBad, good.KnownBad)
+	}
+
+	//a SIGHUP rereads the file, a broken file keeps the previous list
+	if err = os.WriteFile(p, []byte("example.com\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	bd.sig <- syscall.SIGHUP
+	waitBadDomain(t, bd, `example.com.`)
+	if err = os.WriteFile(p, []byte("not a list\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	bd.sig <- syscall.SIGHUP
+	time.Sleep(50 * time.Millisecond)
+	if !bd.knownBad(`example.com.`) || bd.knownBad(`evil.example.`) {
+		t.Fatal("a bad reload replaced the list")
+	}
+}
+
+func waitBadDomain(t *testing.T, bd *badDomains, name string) {
+	t.Helper()
+	for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); time.Sleep(5 * time.Millisecond) {
+		if bd.knownBad(name) {
+			return
+		}
+	}
+	t.Fatalf("%s never matched", name)
+}
@@ -0,0 +1,225 @@
+/*************************************************************************
+ * Copyright 2017 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package gravwellcoredns
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"net/netip"
+
+	"github.com/gravwell/gravwell/v3/ingest/entry"
+	"github.com/miekg/dns"
+)
+
+// The binary encoding is a fixed layout little-endian record, one per question:
+//
+//	offset  size  field
+//	0       4     magic "GDNS"
+//	4       1     version, currently 2
+//	5       8     timestamp seconds since the epoch, signed
+//	13      4     timestamp nanoseconds
+//	17      1     proto, see binaryProto*
+//	18      1+n   local address length (0, 4, or 16) followed by the address bytes
+//	..      2     local port
+//	..      1+n   remote address length followed by the address bytes
+//	..      2     remote port
+//	..      2     qtype
+//	..      2     rcode
+//	..      2+n   qname length followed by the qname in presentation format
+//	..      1+n   version 2, EventType length followed by the EventType, see eventQuery
+//
+// Addresses that are not ip:port pairs are written with a zero length and port.  Later versions
+// only ever append fields, so a decoder reads the fields it knows and ignores anything after them.
+const (
+	binaryMagic   string = `GDNS`
+	binaryVersion byte   = 2
+
+	binaryProtoUnknown byte = 0
+	binaryProtoUDP     byte = 1
+	binaryProtoTCP     byte = 2
+
+	binaryHeaderSize int = len(binaryMagic) + 1 + 8 + 4 + 1
+)
+
+var errShortBinaryRecord = errors.New("binary record is truncated")
+
+// binaryRecord is the decoded form of a binary encoding record
+type binaryRecord struct {
+	Version byte
+	TS      entry.Timestamp
+	Proto   byte
+	Local   netip.AddrPort
+	Remote  netip.AddrPort
+	Qtype   uint16
+	Rcode   uint16
+	Qname   string
+	// EventType is empty for version 1 records
+	EventType string
+}
+
+type binaryEncoder struct{}
+
+func (b binaryEncoder) Encode(ts entry.Timestamp, local, remote net.Addr, tr *introspector) (bbs [][]byte) {
+	qs, _ := tr.questions()
+	for i, q := range qs {
+		bbs = append(bbs, newBinaryRecord(ts, local, remote, q, tr.rcode, tr.questionEvent(i)).MarshalBinaryAppend(nil))
+	}
+	return
+}
+
+func (b binaryEncoder) EncodeError(ts entry.Timestamp, l, r net.Addr, tr *introspector, err error) (bbs [][]byte) {
+	qs, _ := tr.requestQuestions()
+	for _, q := range qs {
+		bbs = append(bbs, newBinaryRecord(ts, l, r, q, dns.RcodeServerFailure, eventError).MarshalBinaryAppend(nil))
+	}
+	return
+}
+
+func (b binaryEncoder) Name() string {
+	return `binary`
+}
+
+func newBinaryRecord(ts entry.Timestamp, local, remote net.Addr, q dns.Question, rcode int, eventType string) binaryRecord {
+	br := binaryRecord{
+		Version:   binaryVersion,
+		TS:        ts,
+		Proto:     binaryProto(local),
+		Qtype:     q.Qtype,
+		Rcode:     uint16(rcode),
+		Qname:     q.Name,
+		EventType: eventType,
+	}
+	br.Local, _ = netip.ParseAddrPort(addrString(local))
+	br.Remote, _ = netip.ParseAddrPort(addrString(remote))
+	return br
+}
+
+func addrString(a net.Addr) string {
+	if a == nil {
+		return ``
+	}
+	return a.String()
+}
+
+func binaryProto(a net.Addr) byte {
+	if a == nil {
+		return binaryProtoUnknown
+	}
+	switch a.Network() {
+	case `udp`, `udp4`, `udp6`:
+		return binaryProtoUDP
+	case `tcp`, `tcp4`, `tcp6`:
+		return binaryProtoTCP
+	}
+	return binaryProtoUnknown
+}
+
+// MarshalBinaryAppend appends the encoded record to b, qnames longer than 65535 bytes are cut
+func (br binaryRecord) MarshalBinaryAppend(b []byte) []byte {
+	b = append(b, binaryMagic...)
+	b = append(b, binaryVersion)
+	b = binary.LittleEndian.AppendUint64(b, uint64(br.TS.Sec))
+	b = binary.LittleEndian.AppendUint32(b, uint32(br.TS.Nsec))
+	b = append(b, br.Proto)
+	b = appendBinaryAddr(b, br.Local)
+	b = appendBinaryAddr(b, br.Remote)
+	b = binary.LittleEndian.AppendUint16(b, br.Qtype)
+	b = binary.LittleEndian.AppendUint16(b, br.Rcode)
+	name := br.Qname
+	if len(name) > 0xffff {
+		name = name[:0xffff]
+	}
+	b = binary.LittleEndian.AppendUint16(b, uint16(len(name)))
+	b = append(b, name...)
+	//the EventType values are short constants, the cut only guards the length byte
+	et := br.EventType
+	if len(et) > 0xff {
+		et = et[:0xff]
+	}
+	b = append(b, byte(len(et)))
+	return append(b, et...)
+}
+
+func (br binaryRecord) MarshalBinary() ([]byte, error) {
+	return br.MarshalBinaryAppend(nil), nil
+}
+
+func appendBinaryAddr(b []byte, ap netip.AddrPort) []byte {
+	if !ap.IsValid() {
+		return append(b, 0, 0, 0)
+	}
+	ip := ap.Addr().WithZone(``)
+	ab := ip.AsSlice()
+	b = append(b, byte(len(ab)))
+	b = append(b, ab...)
+	return binary.LittleEndian.AppendUint16(b, ap.Port())
+}
+
+// UnmarshalBinary decodes a record of any version, fields added after version 2 are skipped
+func (br *binaryRecord) UnmarshalBinary(b []byte) (err error) {
+	if len(b) < binaryHeaderSize {
+		return errShortBinaryRecord
+	} else if string(b[:len(binaryMagic)]) != binaryMagic {
+		return errors.New("not a binary record, bad magic")
+	}
+	b = b[len(binaryMagic):]
+	if br.Version = b[0]; br.Version == 0 {
+		return errors.New("invalid binary record version 0")
+	}
+	br.TS.Sec = int64(binary.LittleEndian.Uint64(b[1:]))
+	br.TS.Nsec = int64(binary.LittleEndian.Uint32(b[9:]))
+	br.Proto = b[13]
+	b = b[14:]
+	if br.Local, b, err = readBinaryAddr(b); err != nil {
+		return
+	} else if br.Remote, b, err = readBinaryAddr(b); err != nil {
+		return
+	}
+	if len(b) < 6 {
+		return errShortBinaryRecord
+	}
+	br.Qtype = binary.LittleEndian.Uint16(b)
+	br.Rcode = binary.LittleEndian.Uint16(b[2:])
+	n := int(binary.LittleEndian.Uint16(b[4:]))
+	if b = b[6:]; len(b) < n {
+		return errShortBinaryRecord
+	}
+	br.Qname = string(b[:n])
+	br.EventType = ``
+	if b = b[n:]; br.Version >= 2 {
+		if len(b) < 1 || len(b) < 1+int(b[0]) {
+			return errShortBinaryRecord
+		}
+		br.EventType = string(b[1 : 1+int(b[0])])
+	}
+	return nil
+}
+
+func readBinaryAddr(b []byte) (ap netip.AddrPort, rest []byte, err error) {
+	if len(b) < 1 {
+		err = errShortBinaryRecord
+		return
+	}
+	n := int(b[0])
+	if n != 0 && n != 4 && n != 16 {
+		err = errors.New("invalid binary record address length")
+		return
+	} else if len(b) < 1+n+2 {
+		err = errShortBinaryRecord
+		return
+	}
+	port := binary.LittleEndian.Uint16(b[1+n:])
+	if n > 0 {
+		ip, _ := netip.AddrFromSlice(b[1 : 1+n])
+		ap = netip.AddrPortFrom(ip, port)
+	}
+	rest = b[1+n+2:]
+	return
+}
@@ -0,0 +1,99 @@
+/*************************************************************************
+ * Copyright 2017 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package gravwellcoredns
+
+import (
+	"errors"
+	"net/netip"
+	"testing"
+
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/gravwell/gravwell/v3/ingest/entry"
+	"github.com/miekg/dns"
+)
+
+func TestBinaryEncoder(t *testing.T) {
+	enc, err := getEncoder(`binary`, nil)
+	if err != nil {
+		t.Fatal(err)
+	} else if enc.Name() != `binary` {
+		t.Fatalf("bad name %s", enc.Name())
+	}
+	ts := entry.UnixTime(1700000000, 500000000)
+	m := testMsg(`example.com.`, dns.TypeAAAA, test.AAAA(`example.com. 60 IN AAAA 2001:db8::1`))
+	m.Rcode = dns.RcodeSuccess
+	bbs := enc.Encode(ts, testLocal, testRemote, newIntrospectorFromMsg(m, testOpts))
+	if len(bbs) != 1 {
+		t.Fatalf("expected 1 record, got %d", len(bbs))
+	} else if string(bbs[0][:4]) != binaryMagic || bbs[0][4] != binaryVersion {
+		t.Fatalf("bad header % x", bbs[0][:5])
+	}
+	var br binaryRecord
+	if err = br.UnmarshalBinary(bbs[0]); err != nil {
+		t.Fatal(err)
+	}
+	exp := binaryRecord{
+		Version:   binaryVersion,
+		TS:        ts,
+		Proto:     binaryProtoUDP,
+		Local:     netip.MustParseAddrPort(testLocal.addr),
+		Remote:    netip.MustParseAddrPort(testRemote.addr),
+		Qtype:     dns.TypeAAAA,
+		Rcode:     dns.RcodeSuccess,
+		Qname:     `example.com.`,
+		EventType: eventAnswer,
+	}
+	if br != exp {
+		t.Fatalf("bad round trip\n%+v\n%+v", br, exp)
+	}
+	//4 magic, version, 12 ts, proto, 7 local, 7 remote, qtype, rcode, 2+12 qname, 1+6 event type
+	if len(bbs[0]) != 4+1+12+1+7+7+2+2+2+len(`example.com.`)+1+len(eventAnswer) {
+		t.Fatalf("unexpected record size %d", len(bbs[0]))
+	}
+
+	//error records go out as SERVFAIL, IPv6 and non ip addresses survive the trip
+	local := staticAddr{network: `tcp`, addr: `[2001:db8::53]:853`}
+	remote := staticAddr{network: `unix`, addr: `/run/coredns.sock`}
+	bbs = enc.EncodeError(ts, local, remote, newIntrospectorFromMsg(m, testOpts), errors.New(`timeout`))
+	if err = br.UnmarshalBinary(bbs[0]); err != nil {
+		t.Fatal(err)
+	} else if br.Rcode != dns.RcodeServerFailure || br.Proto != binaryProtoTCP || br.Local != netip.MustParseAddrPort(local.addr) || br.Remote.IsValid() || br.EventType != eventError {
+		t.Fatalf("bad error record %+v", br)
+	}
+
+	//a future version with appended fields still decodes
+	future := append([]byte{}, bbs[0]...)
+	future[4] = binaryVersion + 1
+	future = append(future, 0xde, 0xad)
+	if err = br.UnmarshalBinary(future); err != nil {
+		t.Fatal(err)
+	} else if br.Version != binaryVersion+1 || br.Qname != `example.com.` {
+		t.Fatalf("bad future record %+v", br)
+	}
+
+	//version 1 records end at the qname and carry no event type
+	v1 := append([]byte{}, bbs[0][:len(bbs[0])-1-len(eventError)]...)
+	v1[4] = 1
+	if err = br.UnmarshalBinary(v1); err != nil {
+		t.Fatal(err)
+	} else if br.Version != 1 || br.Qname != `example.com.` || br.EventType != `` {
+		t.Fatalf("bad version 1 record %+v", br)
+	}
+
+	for i := 0; i < len(bbs[0]); i++ {
+		if err = br.UnmarshalBinary(bbs[0][:i]); err == nil {
+			t.Fatalf("decoded a record truncated to %d bytes", i)
+		}
+	}
+	bad := append([]byte{}, bbs[0]...)
+	bad[0] = 'X'
+	if err = br.UnmarshalBinary(bad); err == nil {
+		t.Fatal("decoded a record with a bad magic")
+	}
+}
@@ -0,0 +1,148 @@
+/*************************************************************************
+ * Copyright 2017 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package gravwellcoredns
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	connWatchInterval time.Duration = time.Second // the default stats-interval
+	hotWaitTimeout    time.Duration = time.Second // how long startup waits for indexer connections
+	hotPollInterval   time.Duration = 20 * time.Millisecond
+)
+
+// connCounter reports the number of live and failed indexer connections, satisfied by the ingest muxer
+type connCounter interface {
+	Hot() (int, error)
+	Dead() (int, error)
+}
+
+// connWatcher polls the muxer connection counts into the indexer_connections gauges and tracks
+// how long the set of live indexer connections has been unchanged.  The muxer does not expose
+// connection timestamps, so any change in the hot count, including a reconnect between polls
+// that changes the count, restarts the clock.
+type connWatcher struct {
+	hc    connCounter
+	since atomic.Int64 // unix nanos the current connection set came up, 0 when disconnected
+	hot   atomic.Int64
+	dead  atomic.Int64
+	last  int
+	done  chan struct{}
+	wg    sync.WaitGroup
+}
+
+func newConnWatcher(hc connCounter, interval time.Duration) *connWatcher {
+	cw := &connWatcher{
+		hc:   hc,
+		done: make(chan struct{}),
+	}
+	cw.poll(time.Now())
+	cw.wg.Add(1)
+	go cw.run(interval)
+	return cw
+}
+
+func (cw *connWatcher) run(interval time.Duration) {
+	defer cw.wg.Done()
+	tckr := time.NewTicker(interval)
+	defer tckr.Stop()
+	for {
+		select {
+		case <-cw.done:
+			return
+		case now := <-tckr.C:
+			cw.poll(now)
+		}
+	}
+}
+
+func (cw *connWatcher) poll(now time.Time) {
+	n, err := cw.hc.Hot()
+	if err != nil {
+		n = 0
+	}
+	d, err := cw.hc.Dead()
+	if err != nil {
+		d = 0
+	}
+	//the gauges are shared by every server block, so each watcher only adds its own change
+	indexerConnections.WithLabelValues(connStateHot).Add(float64(int64(n) - cw.hot.Swap(int64(n))))
+	indexerConnections.WithLabelValues(connStateDead).Add(float64(int64(d) - cw.dead.Swap(int64(d))))
+	if n == cw.last {
+		return
+	}
+	cw.last = n
+	if n == 0 {
+		cw.since.Store(0)
+	} else {
+		cw.since.Store(now.UnixNano())
+	}
+}
+
+// connectedFor is the time the current connections have been stable, 0 when disconnected
+func (cw *connWatcher) connectedFor() time.Duration {
+	if cw == nil {
+		return 0
+	}
+	since := cw.since.Load()
+	if since == 0 {
+		return 0
+	}
+	return time.Since(time.Unix(0, since))
+}
+
+// connections returns the hot and dead connection counts from the last poll
+func (cw *connWatcher) connections() (hot, dead int) {
+	if cw == nil {
+		return
+	}
+	return int(cw.hot.Load()), int(cw.dead.Load())
+}
+
+// hotWaiter is the part of the ingest muxer startup waits on
+type hotWaiter interface {
+	connCounter
+	WaitForHot(time.Duration) error
+}
+
+// waitForHot waits for the first indexer connection and then for n of them, sharing one timeout
+// so min-connections does not extend startup past it
+func waitForHot(hw hotWaiter, n int, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	if err := hw.WaitForHot(timeout); err != nil {
+		return err
+	}
+	return waitForConnections(hw, n, deadline)
+}
+
+// waitForConnections polls hc until at least n connections are hot, failing once deadline passes
+func waitForConnections(hc connCounter, n int, deadline time.Time) error {
+	for {
+		hot, err := hc.Hot()
+		if err != nil {
+			return err
+		} else if hot >= n {
+			return nil
+		} else if time.Now().After(deadline) {
+			return fmt.Errorf("only %d of the %d min-connections indexer connections came up in time", hot, n)
+		}
+		time.Sleep(hotPollInterval)
+	}
+}
+
+func (cw *connWatcher) close() {
+	close(cw.done)
+	cw.wg.Wait()
+	indexerConnections.WithLabelValues(connStateHot).Sub(float64(cw.hot.Swap(0)))
+	indexerConnections.WithLabelValues(connStateDead).Sub(float64(cw.dead.Swap(0)))
+}
@@ -0,0 +1,175 @@
+/*************************************************************************
+ * Copyright 2017 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package gravwellcoredns
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"os/signal"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+)
+
+// cidrTable is a longest prefix match table.  Prefixes are grouped by length and the client
+// address is masked to each length present, longest first, so a lookup costs at most one map
+// probe per distinct length rather than a walk over every prefix.
+type cidrTable struct {
+	bits     []int // prefix lengths present in prefixes, longest first
+	prefixes map[netip.Prefix]string
+}
+
+// parseCountryMap reads a country-cidr-map, one CIDR and ISO 3166 alpha-2 country code per
+// line separated by whitespace.  Blank lines and # comments are skipped, a CIDR with host bits
+// set is masked, and a CIDR listed twice is an error.
+func parseCountryMap(r io.Reader) (*cidrTable, error) {
+	ct := &cidrTable{prefixes: map[netip.Prefix]string{}}
+	sc := bufio.NewScanner(r)
+	for n := 1; sc.Scan(); n++ {
+		line, _, _ := strings.Cut(sc.Text(), `#`)
+		flds := strings.Fields(line)
+		if len(flds) == 0 {
+			continue
+		} else if len(flds) != 2 {
+			return nil, fmt.Errorf("line %d: must be a CIDR and a country code", n)
+		}
+		p, err := netip.ParsePrefix(flds[0])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", n, err)
+		}
+		p = p.Masked()
+		if !isCountryCode(flds[1]) {
+			return nil, fmt.Errorf("line %d: invalid country code %q, must be two letters", n, flds[1])
+		} else if _, ok := ct.prefixes[p]; ok {
+			return nil, fmt.Errorf("line %d: %s is listed more than once", n, p)
+		}
+		ct.prefixes[p] = strings.ToUpper(flds[1])
+		if !slices.Contains(ct.bits, p.Bits()) {
+			ct.bits = append(ct.bits, p.Bits())
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	slices.Sort(ct.bits)
+	slices.Reverse(ct.bits)
+	return ct, nil
+}
+
+func isCountryCode(v string) bool {
+	return len(v) == 2 && strings.IndexFunc(v, func(r rune) bool {
+		return (r < 'a' || r > 'z') && (r < 'A' || r > 'Z')
+	}) == -1
+}
+
+func loadCountryMap(p string) (*cidrTable, error) {
+	fin, err := os.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	defer fin.Close()
+	ct, err := parseCountryMap(fin)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid country-cidr-map %s - %w", p, err)
+	}
+	return ct, nil
+}
+
+// lookup returns the country of the longest matching prefix, empty when nothing matches
+func (ct *cidrTable) lookup(ip netip.Addr) string {
+	for _, b := range ct.bits {
+		if b > ip.BitLen() {
+			continue //an IPv6 length probing an IPv4 client
+		}
+		p, err := ip.Prefix(b)
+		if err != nil {
+			continue
+		}
+		if cc, ok := ct.prefixes[p]; ok {
+			return cc
+		}
+	}
+	return ``
+}
+
+// countryMap serves ClientCountry lookups from a country-cidr-map file and rereads the file on
+// SIGHUP, which CoreDNS itself ignores.  A file that fails to parse on reload is logged and the
+// previous table is kept.
+type countryMap struct {
+	path string
+	tbl  atomic.Pointer[cidrTable]
+	sig  chan os.Signal
+	done chan struct{}
+	wg   sync.WaitGroup
+	lg   *pluginLogger
+}
+
+func newCountryMap(p string, lg *pluginLogger) (*countryMap, error) {
+	ct, err := loadCountryMap(p)
+	if err != nil {
+		return nil, err
+	}
+	cm := &countryMap{
+		path: p,
+		sig:  make(chan os.Signal, 1),
+		done: make(chan struct{}),
+		lg:   lg,
+	}
+	cm.tbl.Store(ct)
+	signal.Notify(cm.sig, syscall.SIGHUP)
+	cm.wg.Add(1)
+	go cm.run()
+	return cm, nil
+}
+
+func (cm *countryMap) run() {
+	defer cm.wg.Done()
+	for {
+		select {
+		case <-cm.done:
+			return
+		case <-cm.sig:
+			cm.reload()
+		}
+	}
+}
+
+func (cm *countryMap) reload() {
+	ct, err := loadCountryMap(cm.path)
+	if err != nil {
+		cm.lg.Errorf("country-cidr-map reload failed, keeping the previous map: %v", err)
+		return
+	}
+	cm.tbl.Store(ct)
+	cm.lg.Infof("reloaded country-cidr-map %s with %d prefixes", cm.path, len(ct.prefixes))
+}
+
+// country returns the country of a client address, a nil map matches nothing
+func (cm *countryMap) country(addr net.Addr) string {
+	if cm == nil {
+		return ``
+	}
+	ip, ok := clientIP(addr)
+	if !ok {
+		return ``
+	}
+	return cm.tbl.Load().lookup(ip)
+}
+
+func (cm *countryMap) close() {
+	signal.Stop(cm.sig)
+	close(cm.done)
+	cm.wg.Wait()
+}
@@ -0,0 +1,131 @@
+/*************************************************************************
+ * Copyright 2017 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package gravwellcoredns
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/coredns/caddy"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/miekg/dns"
+)
+
+const testCountryMap = `# lab ranges
+10.0.0.0/8      us
+10.20.0.0/16    CA   # more specific than the /8
+10.20.30.40/32  MX
+2001:db8::/32   DE
+`
+
+func TestParseCountryMap(t *testing.T) {
+	ct, err := parseCountryMap(strings.NewReader(testCountryMap))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for ip, exp := range map[string]string{
+		`10.1.2.3`:     `US`,
+		`10.20.1.1`:    `CA`,
+		`10.20.30.40`:  `MX`,
+		`10.20.30.41`:  `CA`,
+		`192.168.1.1`:  ``,
+		`2001:db8::53`: `DE`,
+		`2001:db9::53`: ``,
+	} {
+		if cc := ct.lookup(netip.MustParseAddr(ip)); cc != exp {
+			t.Fatalf("%s matched %q, expected %q", ip, cc, exp)
+		}
+	}
+	for _, bad := range []string{
+		"10.0.0.0/8\n",
+		"10.0.0.0/8 US extra\n",
+		"10.0.0.0/33 US\n",
+		"10.0.0.0/8 USA\n",
+		"10.0.0.0/8 U1\n",
+		"10.0.0.0/8 US\n10.1.0.0/8 CA\n", //the same prefix once masked
+	} {
+		if _, err = parseCountryMap(strings.NewReader(bad)); err == nil {
+			t.Fatalf("accepted %q", bad)
+		}
+	}
+}
+
+func TestCountryMap(t *testing.T) {
+	p := filepath.Join(t.TempDir(), `countries`)
+	if err := os.WriteFile(p, []byte(testCountryMap), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := parseConfig(caddy.NewTestController("dns", "gravwell {\n\tStdout-Sink true\n\tCountry-CIDR-Map "+p+"\n}")); err != nil {
+		t.Fatal(err)
+	} else if _, _, err = parseConfig(caddy.NewTestController("dns", "gravwell {\n\tStdout-Sink true\n\tCountry-CIDR-Map "+p+".missing\n}")); err == nil {
+		t.Fatal("accepted a missing country-cidr-map")
+	}
+	cm, err := newCountryMap(p, newPluginLogger(`off`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cm.close()
+
+	//clients are matched on their real address, ahead of any masking
+	dw := &discardWriter{keep: true}
+	gh := gwHandler{
+		Next:          answerHandler(false),
+		im:            dw,
+		enc:           &jsonEncoder{},
+		countries:     cm,
+		mask:          ipMask{v4: 8},
+		encodeOptions: encodeOptions{maxQuestions: defaultMaxQuestions},
+	}
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+	rw := &test.ResponseWriter{RemoteIP: `10.20.30.40`}
+	if _, err = gh.ServeDNS(context.Background(), rw, req); err != nil {
+		t.Fatal(err)
+	}
+	var v dnsBase
+	if err = json.Unmarshal(dw.ents[0].Data, &v); err != nil {
+		t.Fatal(err)
+	} else if v.ClientCountry != `MX` {
+		t.Fatalf("bad ClientCountry %q", v.ClientCountry)
+	}
+
+	//a SIGHUP rereads the file, a broken file keeps the previous map
+	if err = os.WriteFile(p, []byte("10.0.0.0/8 GB\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	cm.sig <- syscall.SIGHUP
+	waitCountry(t, cm, `10.20.30.40`, `GB`)
+	if err = os.WriteFile(p, []byte("not a map\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	cm.sig <- syscall.SIGHUP
+	time.Sleep(50 * time.Millisecond)
+	if cc := cm.country(&net.UDPAddr{IP: net.ParseIP(`10.20.30.40`)}); cc != `GB` {
+		t.Fatalf("a bad reload replaced the map, got %q", cc)
+	}
+}
+
+func waitCountry(t *testing.T, cm *countryMap, ip, exp string) {
+	t.Helper()
+	addr := &net.UDPAddr{IP: net.ParseIP(ip), Port: 53}
+	for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); time.Sleep(5 * time.Millisecond) {
+		if cm.country(addr) == exp {
+			return
+		}
+	}
+	t.Fatalf("%s never matched %s", ip, exp)
+}
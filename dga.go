@@ -0,0 +1,115 @@
+/*************************************************************************
+ * Copyright 2017 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package gravwellcoredns
+
+import (
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+const (
+	defaultNXWindow time.Duration = time.Minute
+	nxMaxClients    int           = 16384 // clients tracked before the oldest are evicted
+)
+
+// nxTracker counts NXDOMAIN responses per client over a sliding window, a client with at
+// least threshold NXDOMAINs inside the window is a DGA suspect.  Each client keeps the times
+// of its last threshold NXDOMAINs in a ring, so the oldest entry tells whether the window is full.
+type nxTracker struct {
+	sync.Mutex
+	threshold int
+	window    time.Duration
+	clients   map[netip.Addr]*nxClient
+	lastSweep time.Time
+}
+
+type nxClient struct {
+	ring []time.Time
+	next int
+}
+
+func newNXTracker(threshold int, window time.Duration) *nxTracker {
+	return &nxTracker{
+		threshold: threshold,
+		window:    window,
+		clients:   map[netip.Addr]*nxClient{},
+	}
+}
+
+// clientIP pulls the address out of an ip:port client, ok is false for anything else
+func clientIP(addr net.Addr) (ip netip.Addr, ok bool) {
+	if addr == nil {
+		return
+	}
+	ap, err := netip.ParseAddrPort(addr.String())
+	if err != nil {
+		return
+	}
+	return ap.Addr().Unmap().WithZone(``), true
+}
+
+// observe records an NXDOMAIN when nx is set and reports whether the client is currently a suspect
+func (nt *nxTracker) observe(addr net.Addr, nx bool, now time.Time) bool {
+	ip, ok := clientIP(addr)
+	if !ok {
+		return false
+	}
+	nt.Lock()
+	defer nt.Unlock()
+	cl, ok := nt.clients[ip]
+	if !ok {
+		if !nx {
+			return false
+		}
+		nt.makeRoom(now)
+		cl = &nxClient{ring: make([]time.Time, 0, nt.threshold)}
+		nt.clients[ip] = cl
+	}
+	if nx {
+		if len(cl.ring) < nt.threshold {
+			cl.ring = append(cl.ring, now)
+		} else {
+			cl.ring[cl.next] = now
+			cl.next = (cl.next + 1) % nt.threshold
+		}
+	}
+	return len(cl.ring) == nt.threshold && now.Sub(cl.ring[cl.next]) <= nt.window
+}
+
+// makeRoom keeps the client map under nxMaxClients, clients with nothing inside the window go
+// first and when every client is active an arbitrary one is dropped.  Sweeps are limited to one
+// per window so a flood of new clients cannot turn every insert into a full scan.
+func (nt *nxTracker) makeRoom(now time.Time) {
+	if len(nt.clients) < nxMaxClients {
+		return
+	}
+	if now.Sub(nt.lastSweep) > nt.window {
+		nt.lastSweep = now
+		for ip, cl := range nt.clients {
+			if now.Sub(cl.newest()) > nt.window {
+				delete(nt.clients, ip)
+			}
+		}
+	}
+	for ip := range nt.clients {
+		if len(nt.clients) < nxMaxClients {
+			break
+		}
+		delete(nt.clients, ip)
+	}
+}
+
+func (cl *nxClient) newest() time.Time {
+	if len(cl.ring) < cap(cl.ring) || cl.next == 0 {
+		return cl.ring[len(cl.ring)-1]
+	}
+	return cl.ring[cl.next-1]
+}
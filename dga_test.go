@@ -0,0 +1,92 @@
+/*************************************************************************
+ * Copyright 2017 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package gravwellcoredns
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/miekg/dns"
+)
+
+func TestNXTracker(t *testing.T) {
+	nt := newNXTracker(5, time.Minute)
+	now := time.Now()
+	client := staticAddr{network: `udp`, addr: `10.0.0.1:40000`}
+	other := staticAddr{network: `udp`, addr: `10.0.0.2:40000`}
+	for i := 0; i < 4; i++ {
+		if nt.observe(client, true, now.Add(time.Duration(i)*time.Second)) {
+			t.Fatalf("suspect after %d NXDOMAINs", i+1)
+		}
+	}
+	if !nt.observe(client, true, now.Add(4*time.Second)) {
+		t.Fatal("not a suspect at the threshold")
+	} else if !nt.observe(client, false, now.Add(5*time.Second)) {
+		t.Fatal("answered requests from a suspect should be flagged")
+	} else if nt.observe(other, false, now) || nt.observe(other, true, now) {
+		t.Fatal("unrelated client flagged")
+	}
+	//the client port does not matter
+	if !nt.observe(staticAddr{network: `tcp`, addr: `10.0.0.1:53000`}, false, now.Add(5*time.Second)) {
+		t.Fatal("suspect keyed on the port")
+	}
+	//once the oldest NXDOMAINs age out of the window the flag clears
+	if nt.observe(client, false, now.Add(time.Minute+time.Second)) {
+		t.Fatal("flag did not clear after the window")
+	}
+	if _, ok := clientIP(staticAddr{network: `unix`, addr: `/run/dns.sock`}); ok {
+		t.Fatal("non ip client tracked")
+	}
+}
+
+func TestNXTrackerEviction(t *testing.T) {
+	nt := newNXTracker(2, time.Minute)
+	now := time.Now()
+	for i := 0; i < nxMaxClients+100; i++ {
+		nt.observe(staticAddr{network: `udp`, addr: fmt.Sprintf("10.%d.%d.1:53", i/256, i%256)}, true, now)
+	}
+	if len(nt.clients) > nxMaxClients {
+		t.Fatalf("tracker grew to %d clients", len(nt.clients))
+	}
+	//a sweep after the window drops every idle client
+	nt.observe(staticAddr{network: `udp`, addr: `192.168.0.1:53`}, true, now.Add(2*time.Minute))
+	if len(nt.clients) != 1 {
+		t.Fatalf("idle clients not swept, %d left", len(nt.clients))
+	}
+}
+
+func TestNXDomainSuspect(t *testing.T) {
+	dw := &discardWriter{keep: true}
+	gh := gwHandler{
+		Next:          answerHandler(true),
+		im:            dw,
+		enc:           &jsonEncoder{},
+		nx:            newNXTracker(2, time.Minute),
+		encodeOptions: encodeOptions{maxQuestions: defaultMaxQuestions},
+	}
+	for i := 0; i < 2; i++ {
+		req := new(dns.Msg)
+		req.SetQuestion(fmt.Sprintf("q%d.example.com.", i), dns.TypeA)
+		if _, err := gh.ServeDNS(context.Background(), &test.ResponseWriter{}, req); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i, exp := range []bool{false, true} {
+		var v struct{ DGASuspect bool }
+		if err := json.Unmarshal(dw.ents[i].Data, &v); err != nil {
+			t.Fatal(err)
+		} else if v.DGASuspect != exp {
+			t.Fatalf("entry %d DGASuspect %v != %v", i, v.DGASuspect, exp)
+		}
+	}
+}
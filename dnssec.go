@@ -0,0 +1,67 @@
+/*************************************************************************
+ * Copyright 2017 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package gravwellcoredns
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// dnssecRecord is the structured form of an RRSIG or DNSKEY answer so signature lifetimes and
+// keys can be searched and alerted on without parsing the presentation format.  Fields that
+// do not apply to the record type are left out.
+type dnssecRecord struct {
+	TypeCovered string `json:",omitempty"` // RRSIG only, the type of the signed RRset
+	Algorithm   string
+	KeyTag      uint16
+	Flags       uint16 `json:",omitempty"` // DNSKEY only, 257 for a key signing key
+	SignerName  string `json:",omitempty"` // RRSIG only
+	Inception   string `json:",omitempty"` // RRSIG only, RFC 3339 UTC
+	Expiration  string `json:",omitempty"`
+}
+
+// dnssecMeta returns the structured form of RRSIG and DNSKEY answers, nil for every other type
+func dnssecMeta(rr dns.RR) *dnssecRecord {
+	switch v := rr.(type) {
+	case *dns.RRSIG:
+		return &dnssecRecord{
+			TypeCovered: dns.Type(v.TypeCovered).String(),
+			Algorithm:   dnssecAlgorithm(v.Algorithm),
+			KeyTag:      v.KeyTag,
+			SignerName:  v.SignerName,
+			Inception:   rrsigTime(v.Inception),
+			Expiration:  rrsigTime(v.Expiration),
+		}
+	case *dns.DNSKEY:
+		return &dnssecRecord{
+			Algorithm: dnssecAlgorithm(v.Algorithm),
+			KeyTag:    v.KeyTag(),
+			Flags:     v.Flags,
+		}
+	}
+	return nil
+}
+
+// dnssecAlgorithm is the mnemonic of a DNSSEC algorithm number, e.g. ECDSAP256SHA256, or the
+// number itself when the dns package does not know it
+func dnssecAlgorithm(alg uint8) string {
+	if s, ok := dns.AlgorithmToString[alg]; ok {
+		return s
+	}
+	return strconv.Itoa(int(alg))
+}
+
+// rrsigTime formats an RRSIG timestamp.  The wire value is seconds since the epoch modulo 2^32
+// (RFC 4034 section 3.1.5), read here as falling in 1970-2106 rather than by serial number
+// arithmetic around the current time so a record always encodes the same way.
+func rrsigTime(t uint32) string {
+	return time.Unix(int64(t), 0).UTC().Format(time.RFC3339)
+}
@@ -0,0 +1,67 @@
+/*************************************************************************
+ * Copyright 2017 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package gravwellcoredns
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/gravwell/gravwell/v3/ingest/entry"
+	"github.com/miekg/dns"
+)
+
+func TestDNSSECMeta(t *testing.T) {
+	sig, err := dns.NewRR(`example.com. 300 IN RRSIG A 13 2 300 20261101000000 20261011000000 12345 example.com. c2lnbmF0dXJl`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := &dnssecRecord{
+		TypeCovered: `A`,
+		Algorithm:   `ECDSAP256SHA256`,
+		KeyTag:      12345,
+		SignerName:  `example.com.`,
+		Inception:   `2026-10-11T00:00:00Z`,
+		Expiration:  `2026-11-01T00:00:00Z`,
+	}
+	if got := dnssecMeta(sig); !reflect.DeepEqual(got, exp) {
+		t.Fatalf("bad RRSIG metadata %+v", got)
+	}
+
+	key, err := dns.NewRR(`example.com. 300 IN DNSKEY 257 3 13 mdsswUyr3DPW132mOi8V9xESWE8jTo0dxCjjnopKl+GqJxpVXckHAeF+KkxLbxILfDLUT0rAK9iUzy1L53eKGQ==`)
+	if err != nil {
+		t.Fatal(err)
+	} else if got := dnssecMeta(key); got == nil || got.KeyTag != key.(*dns.DNSKEY).KeyTag() || got.Flags != 257 || got.Algorithm != `ECDSAP256SHA256` || got.SignerName != `` {
+		t.Fatalf("bad DNSKEY metadata %+v", got)
+	}
+	if dnssecMeta(test.A(`example.com. 60 IN A 1.2.3.4`)) != nil {
+		t.Fatal("metadata for an A record")
+	} else if dnssecAlgorithm(9) != `9` {
+		t.Fatalf("bad unassigned algorithm %q", dnssecAlgorithm(9))
+	}
+
+	m := testMsg(`example.com.`, dns.TypeA, sig)
+	for _, enc := range []encoder{jsonEncoder{}, jsonEncoder{perAnswer: true}} {
+		var v struct{ DNSSEC *dnssecRecord }
+		if err := json.Unmarshal(enc.Encode(entry.Now(), testLocal, testRemote, newIntrospectorFromMsg(m, testOpts))[0], &v); err != nil {
+			t.Fatal(err)
+		} else if !reflect.DeepEqual(v.DNSSEC, exp) {
+			t.Fatalf("%s: bad DNSSEC %+v", enc.Name(), v.DNSSEC)
+		}
+	}
+	//plain answers carry no DNSSEC object
+	bb := jsonEncoder{}.Encode(entry.Now(), testLocal, testRemote, newIntrospectorFromMsg(testMsg(`example.com.`, dns.TypeA, test.A(`example.com. 60 IN A 1.2.3.4`)), testOpts))[0]
+	var raw map[string]any
+	if err = json.Unmarshal(bb, &raw); err != nil {
+		t.Fatal(err)
+	} else if _, ok := raw[`DNSSEC`]; ok {
+		t.Fatalf("DNSSEC on an A answer: %s", bb)
+	}
+}
@@ -0,0 +1,60 @@
+/*************************************************************************
+ * Copyright 2017 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package gravwellcoredns
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+
+	"github.com/miekg/dns"
+)
+
+// maxEDNSOptions bounds the options emitted per message by include-edns-options, a client
+// padding its OPT record with junk options should not be able to inflate every record
+const maxEDNSOptions int = 16
+
+// ednsOption is the generic form of an EDNS0 option, the wire format option data in hex
+type ednsOption struct {
+	Code    uint16 `json:"code"`
+	DataHex string `json:"data_hex"`
+}
+
+// optRdataOffset is where the rdata starts in a packed OPT record: the root owner name,
+// type, class, ttl, and rdlength
+const optRdataOffset int = 1 + 2 + 2 + 4 + 2
+
+// ednsOptions returns the options in the OPT record of m in wire order, nil when m has no OPT
+// record.  The dns package does not export option packing, so the OPT record is packed whole
+// and the code, length, data triples walked out of its rdata.
+func ednsOptions(m *dns.Msg) (r []ednsOption) {
+	if m == nil {
+		return
+	}
+	opt := m.IsEdns0()
+	if opt == nil || len(opt.Option) == 0 {
+		return
+	}
+	buf := make([]byte, dns.Len(opt))
+	n, err := dns.PackRR(opt, buf, 0, nil, false)
+	if err != nil || n < optRdataOffset {
+		return
+	}
+	for b := buf[optRdataOffset:n]; len(b) >= 4 && len(r) < maxEDNSOptions; {
+		l := int(binary.BigEndian.Uint16(b[2:]))
+		if len(b) < 4+l {
+			break
+		}
+		r = append(r, ednsOption{
+			Code:    binary.BigEndian.Uint16(b),
+			DataHex: hex.EncodeToString(b[4 : 4+l]),
+		})
+		b = b[4+l:]
+	}
+	return
+}
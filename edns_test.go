@@ -0,0 +1,80 @@
+/*************************************************************************
+ * Copyright 2017 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package gravwellcoredns
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/gravwell/gravwell/v3/ingest/entry"
+	"github.com/miekg/dns"
+)
+
+func TestEDNSOptions(t *testing.T) {
+	req := testMsg(`example.com.`, dns.TypeA)
+	req.SetEdns0(1232, false)
+	opt := req.IsEdns0()
+	opt.Option = append(opt.Option,
+		&dns.EDNS0_COOKIE{Code: dns.EDNS0COOKIE, Cookie: `0102030405060708`},
+		&dns.EDNS0_LOCAL{Code: 65001, Data: []byte{0xde, 0xad}},
+	)
+	resp := testMsg(`example.com.`, dns.TypeA)
+	resp.SetEdns0(1232, false)
+	resp.IsEdns0().Option = append(resp.IsEdns0().Option, &dns.EDNS0_NSID{Code: dns.EDNS0NSID, Nsid: `6e7331`})
+
+	opts := testOpts
+	opts.ednsOptions = true
+	is := newIntrospectorFromMsg(resp, opts)
+	is.req = req
+	ts := entry.FromStandard(time.Now())
+	var v struct {
+		RequestEDNSOptions  []ednsOption
+		ResponseEDNSOptions []ednsOption
+	}
+	if err := json.Unmarshal(jsonEncoder{}.Encode(ts, testLocal, testRemote, is)[0], &v); err != nil {
+		t.Fatal(err)
+	}
+	expReq := []ednsOption{{Code: dns.EDNS0COOKIE, DataHex: `0102030405060708`}, {Code: 65001, DataHex: `dead`}}
+	if len(v.RequestEDNSOptions) != 2 || v.RequestEDNSOptions[0] != expReq[0] || v.RequestEDNSOptions[1] != expReq[1] {
+		t.Fatalf("bad request options %+v", v.RequestEDNSOptions)
+	} else if len(v.ResponseEDNSOptions) != 1 || v.ResponseEDNSOptions[0] != (ednsOption{Code: dns.EDNS0NSID, DataHex: `6e7331`}) {
+		t.Fatalf("bad response options %+v", v.ResponseEDNSOptions)
+	}
+	var e struct{ EDNSOptions []ednsOption }
+	if err := json.Unmarshal(jsonEncoder{}.EncodeError(ts, testLocal, testRemote, is, errors.New(`timeout`))[0], &e); err != nil {
+		t.Fatal(err)
+	} else if len(e.EDNSOptions) != 2 {
+		t.Fatalf("bad error record options %+v", e.EDNSOptions)
+	}
+
+	//off by default
+	is = newIntrospectorFromMsg(resp, testOpts)
+	is.req = req
+	v.RequestEDNSOptions, v.ResponseEDNSOptions = nil, nil
+	if err := json.Unmarshal(jsonEncoder{}.Encode(ts, testLocal, testRemote, is)[0], &v); err != nil {
+		t.Fatal(err)
+	} else if v.RequestEDNSOptions != nil || v.ResponseEDNSOptions != nil {
+		t.Fatalf("options emitted without include-edns-options: %+v", v)
+	}
+
+	//capped
+	for i := 0; i < 2*maxEDNSOptions; i++ {
+		opt.Option = append(opt.Option, &dns.EDNS0_PADDING{})
+	}
+	if r := ednsOptions(req); len(r) != maxEDNSOptions {
+		t.Fatalf("options not capped: %d", len(r))
+	} else if r[maxEDNSOptions-1] != (ednsOption{Code: dns.EDNS0PADDING}) {
+		t.Fatalf("bad padding option %+v", r[maxEDNSOptions-1])
+	}
+	if r := ednsOptions(testMsg(`example.com.`, dns.TypeA)); r != nil {
+		t.Fatalf("options from a message without OPT: %+v", r)
+	}
+}
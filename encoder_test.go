@@ -0,0 +1,634 @@
+/*************************************************************************
+ * Copyright 2017 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package gravwellcoredns
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/gravwell/gravwell/v3/ingest/entry"
+	"github.com/miekg/dns"
+)
+
+// staticAddr is a synthetic net.Addr so encoder tests do not need real sockets
+type staticAddr struct {
+	network, addr string
+}
+
+func (a staticAddr) Network() string { return a.network }
+func (a staticAddr) String() string  { return a.addr }
+
+var (
+	testLocal  = staticAddr{network: `udp`, addr: `192.168.0.1:53`}
+	testRemote = staticAddr{network: `udp`, addr: `10.0.0.1:40000`}
+	testOpts   = encodeOptions{maxQuestions: defaultMaxQuestions}
+)
+
+func testMsg(name string, qtype uint16, answers ...dns.RR) *dns.Msg {
+	req := new(dns.Msg)
+	req.SetQuestion(name, qtype)
+	req.RecursionDesired = true
+	m := new(dns.Msg)
+	m.SetReply(req)
+	m.RecursionAvailable = true
+	m.Answer = answers
+	return m
+}
+
+func TestJSONEncoderPaths(t *testing.T) {
+	ts := entry.Now()
+	enc := jsonEncoder{}
+
+	//questions only
+	var q dnsQuestion
+	bbs := enc.Encode(ts, testLocal, testRemote, newIntrospectorFromMsg(testMsg(`example.com.`, dns.TypeMX), testOpts))
+	if len(bbs) != 1 {
+		t.Fatalf("expected 1 record, got %d", len(bbs))
+	} else if err := json.Unmarshal(bbs[0], &q); err != nil {
+		t.Fatal(err)
+	} else if q.Question.Hdr.Name != `example.com.` || q.Question.Hdr.Qtype != dns.TypeMX {
+		t.Fatalf("bad question %+v", q.Question)
+	} else if q.Proto != `udp` || q.Local != testLocal.addr || q.Remote != testRemote.addr {
+		t.Fatalf("bad addresses %+v", q.dnsBase)
+	} else if !q.RecursionDesired || !q.RecursionAvailable {
+		t.Fatalf("bad recursion flags %+v", q.dnsBase)
+	}
+
+	//answers
+	var a struct {
+		dnsBase
+		Question struct {
+			Hdr dns.RR_Header
+			A   string
+		}
+	}
+	bbs = enc.Encode(ts, testLocal, testRemote, newIntrospectorFromMsg(testMsg(`example.com.`, dns.TypeA, test.A(`example.com. 60 IN A 1.2.3.4`)), testOpts))
+	if len(bbs) != 1 {
+		t.Fatalf("expected 1 record, got %d", len(bbs))
+	} else if err := json.Unmarshal(bbs[0], &a); err != nil {
+		t.Fatal(err)
+	} else if a.Question.A != `1.2.3.4` || a.Question.Hdr.Ttl != 60 {
+		t.Fatalf("bad answer %+v", a.Question)
+	}
+
+	//errors
+	var e errAnswer
+	bbs = enc.EncodeError(ts, testLocal, testRemote, newIntrospectorFromMsg(testMsg(`example.com.`, dns.TypeA), testOpts), errors.New(`upstream timeout`))
+	if len(bbs) != 1 {
+		t.Fatalf("expected 1 record, got %d", len(bbs))
+	} else if err := json.Unmarshal(bbs[0], &e); err != nil {
+		t.Fatal(err)
+	} else if e.Error != `upstream timeout` || e.Question.Name != `example.com.` || e.Remote != testRemote.addr {
+		t.Fatalf("bad error record %+v", e)
+	}
+}
+
+func TestTextEncoderPaths(t *testing.T) {
+	ts := entry.Now()
+	enc := textEncoder{}
+	prefix := strings.Join([]string{ts.String(), `udp`, testLocal.addr, testRemote.addr}, ` `) + ` `
+
+	tests := []struct {
+		name string
+		m    *dns.Msg
+		err  error
+		exp  string
+	}{
+		{`questions`, testMsg(`example.com.`, dns.TypeMX), nil, ";example.com.\tIN\t MX EventType=query"},
+		{`answers`, testMsg(`example.com.`, dns.TypeA, test.A(`example.com. 60 IN A 1.2.3.4`)), nil, "example.com.\t60\tIN\tA\t1.2.3.4 EventType=answer"},
+		{`error`, testMsg(`example.com.`, dns.TypeA), errors.New(`boom`), ";example.com.\tIN\t A EventType=error"},
+	}
+	for _, tt := range tests {
+		is := newIntrospectorFromMsg(tt.m, testOpts)
+		var bbs [][]byte
+		if tt.err != nil {
+			bbs = enc.EncodeError(ts, testLocal, testRemote, is, tt.err)
+		} else {
+			bbs = enc.Encode(ts, testLocal, testRemote, is)
+		}
+		if len(bbs) != 1 {
+			t.Fatalf("%s: expected 1 line, got %d", tt.name, len(bbs))
+		} else if string(bbs[0]) != prefix+tt.exp {
+			t.Fatalf("%s: bad line\n%q\n%q", tt.name, bbs[0], prefix+tt.exp)
+		}
+	}
+}
+
+func TestExtendedErrors(t *testing.T) {
+	m := testMsg(`example.com.`, dns.TypeA)
+	m.Rcode = dns.RcodeServerFailure
+
+	//absent EDE yields nothing
+	bb := jsonEncoder{}.Encode(entry.Now(), testLocal, testRemote, newIntrospectorFromMsg(m, testOpts))[0]
+	if strings.Contains(string(bb), `ExtendedError`) {
+		t.Fatalf("extended errors emitted without an option: %s", bb)
+	}
+
+	m.SetEdns0(4096, true)
+	opt := m.IsEdns0()
+	opt.Option = append(opt.Option,
+		&dns.EDNS0_EDE{InfoCode: dns.ExtendedErrorCodeDNSBogus},
+		&dns.EDNS0_EDE{InfoCode: dns.ExtendedErrorCodeBlocked, ExtraText: `blocked by policy`},
+	)
+	var v dnsBase
+	if err := json.Unmarshal(jsonEncoder{}.Encode(entry.Now(), testLocal, testRemote, newIntrospectorFromMsg(m, testOpts))[0], &v); err != nil {
+		t.Fatal(err)
+	}
+	if len(v.ExtendedErrorCode) != 2 || v.ExtendedErrorCode[0] != dns.ExtendedErrorCodeDNSBogus || v.ExtendedErrorCode[1] != dns.ExtendedErrorCodeBlocked {
+		t.Fatalf("bad extended error codes %v", v.ExtendedErrorCode)
+	} else if len(v.ExtendedErrorText) != 2 || v.ExtendedErrorText[0] != `DNSSEC Bogus` || v.ExtendedErrorText[1] != `blocked by policy` {
+		t.Fatalf("bad extended error text %q", v.ExtendedErrorText)
+	}
+}
+
+func TestQnameWire(t *testing.T) {
+	m := testMsg(`a\.b.example.com.`, dns.TypeTXT)
+	if bb := (jsonEncoder{}).Encode(entry.Now(), testLocal, testRemote, newIntrospectorFromMsg(m, testOpts))[0]; strings.Contains(string(bb), `QnameWire`) {
+		t.Fatalf("wire qname emitted when disabled: %s", bb)
+	}
+
+	opts := testOpts
+	opts.qnameWire = true
+	is := newIntrospectorFromMsg(m, opts)
+	var v dnsQuestion
+	exp := `03612e62076578616d706c6503636f6d00` //the escaped dot is part of the first label
+	if err := json.Unmarshal(jsonEncoder{}.Encode(entry.Now(), testLocal, testRemote, is)[0], &v); err != nil {
+		t.Fatal(err)
+	} else if v.QnameWire != exp {
+		t.Fatalf("bad wire qname %s != %s", v.QnameWire, exp)
+	} else if v.Question.Hdr.Name != `a\.b.example.com.` {
+		t.Fatalf("bad presentation qname %s", v.Question.Hdr.Name)
+	}
+	var e errAnswer
+	if err := json.Unmarshal(jsonEncoder{}.EncodeError(entry.Now(), testLocal, testRemote, is, errors.New(`boom`))[0], &e); err != nil {
+		t.Fatal(err)
+	} else if e.QnameWire != exp {
+		t.Fatalf("bad error record wire qname %s", e.QnameWire)
+	}
+}
+
+func TestCNAMEChain(t *testing.T) {
+	cname := func(s string) dns.RR {
+		rr, err := dns.NewRR(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return rr
+	}
+	m := testMsg(`www.example.com.`, dns.TypeA,
+		cname(`www.example.com. 300 IN CNAME edge.cdn.net.`),
+		cname(`edge.cdn.net. 60 IN CNAME pop1.cdn.net.`),
+		test.A(`pop1.cdn.net. 20 IN A 1.2.3.4`),
+		test.A(`pop1.cdn.net. 20 IN A 1.2.3.5`),
+	)
+	var v dnsBase
+	if err := json.Unmarshal(jsonEncoder{}.Encode(entry.Now(), testLocal, testRemote, newIntrospectorFromMsg(m, testOpts))[0], &v); err != nil {
+		t.Fatal(err)
+	}
+	if exp := []string{`www.example.com.`, `edge.cdn.net.`, `pop1.cdn.net.`}; strings.Join(v.CNAMEChain, ` `) != strings.Join(exp, ` `) {
+		t.Fatalf("bad chain %v", v.CNAMEChain)
+	} else if strings.Join(v.FinalAnswers, ` `) != `1.2.3.4 1.2.3.5` {
+		t.Fatalf("bad final answers %v", v.FinalAnswers)
+	}
+
+	//unaliased names have no chain
+	if chain, final := cnameChain(`pop1.cdn.net.`, m.Answer); chain != nil || final != nil {
+		t.Fatalf("chain for an unaliased name %v %v", chain, final)
+	}
+
+	//loops and runaway chains are bounded
+	loop := []dns.RR{cname(`a.example.com. 300 IN CNAME b.example.com.`), cname(`b.example.com. 300 IN CNAME a.example.com.`)}
+	if chain, _ := cnameChain(`a.example.com.`, loop); len(chain) != 3 {
+		t.Fatalf("bad loop chain %v", chain)
+	}
+	var long []dns.RR
+	for i := 0; i < 100; i++ {
+		long = append(long, cname(fmt.Sprintf("h%d.example.com. 300 IN CNAME h%d.example.com.", i, i+1)))
+	}
+	if chain, _ := cnameChain(`h0.example.com.`, long); len(chain) != maxCNAMEChain {
+		t.Fatalf("chain not bounded, %d links", len(chain))
+	}
+}
+
+func TestResolvedIP(t *testing.T) {
+	cname, err := dns.NewRR(`www.example.com. 300 IN CNAME edge.cdn.net.`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		name string
+		m    *dns.Msg
+		exp  string
+	}{
+		{`A`, testMsg(`example.com.`, dns.TypeA, test.A(`example.com. 60 IN A 1.2.3.4`), test.A(`example.com. 60 IN A 1.2.3.5`)), `1.2.3.4`},
+		{`AAAA`, testMsg(`example.com.`, dns.TypeAAAA, test.AAAA(`example.com. 60 IN AAAA 2001:db8::1`)), `2001:db8::1`},
+		{`CNAME then A`, testMsg(`www.example.com.`, dns.TypeA, cname, test.A(`edge.cdn.net. 60 IN A 1.2.3.6`)), `1.2.3.6`},
+		{`CNAME only`, testMsg(`www.example.com.`, dns.TypeA, cname), ``},
+		{`MX`, testMsg(`example.com.`, dns.TypeMX, test.MX(`example.com. 60 IN MX 10 mail.example.com.`)), ``},
+	} {
+		for _, enc := range []encoder{jsonEncoder{}, jsonEncoder{perAnswer: true}} {
+			var v dnsBase
+			if err := json.Unmarshal(enc.Encode(entry.Now(), testLocal, testRemote, newIntrospectorFromMsg(tt.m, testOpts))[0], &v); err != nil {
+				t.Fatal(err)
+			} else if v.ResolvedIP != tt.exp {
+				t.Fatalf("%s %s: ResolvedIP %q != %q", tt.name, enc.Name(), v.ResolvedIP, tt.exp)
+			}
+		}
+	}
+}
+
+func TestCoalesceAnswers(t *testing.T) {
+	m := testMsg(`example.com.`, dns.TypeA,
+		test.A(`example.com. 300 IN A 1.2.3.4`),
+		test.A(`example.com. 60 IN A 1.2.3.4`),
+		test.A(`EXAMPLE.com. 120 IN A 1.2.3.4`),
+		test.A(`example.com. 300 IN A 1.2.3.5`),
+	)
+	opts := testOpts
+	opts.coalesce = true
+	enc := jsonEncoder{perAnswer: true}
+	bbs := enc.Encode(entry.Now(), testLocal, testRemote, newIntrospectorFromMsg(m, opts))
+	if len(bbs) != 2 {
+		t.Fatalf("expected 2 coalesced records, got %d", len(bbs))
+	}
+	var v struct {
+		Count int
+		RR    struct{ Hdr dns.RR_Header }
+	}
+	if err := json.Unmarshal(bbs[0], &v); err != nil {
+		t.Fatal(err)
+	} else if v.Count != 3 || v.RR.Hdr.Ttl != 60 {
+		t.Fatalf("bad coalesced record, count %d ttl %d: %s", v.Count, v.RR.Hdr.Ttl, bbs[0])
+	} else if m.Answer[0].Header().Ttl != 300 {
+		t.Fatal("coalescing modified the response")
+	}
+	if err := json.Unmarshal(bbs[1], &v); err != nil {
+		t.Fatal(err)
+	} else if v.Count != 1 {
+		t.Fatalf("bad count for a unique answer %d", v.Count)
+	}
+
+	//off by default, every answer is its own record without a Count
+	bbs = enc.Encode(entry.Now(), testLocal, testRemote, newIntrospectorFromMsg(m, testOpts))
+	if len(bbs) != 4 {
+		t.Fatalf("expected 4 records, got %d", len(bbs))
+	} else if bytes.Contains(bbs[0], []byte(`"Count"`)) {
+		t.Fatalf("Count emitted without coalesce-answers %s", bbs[0])
+	}
+}
+
+func TestStripFQDNDot(t *testing.T) {
+	cname, err := dns.NewRR(`www.example.com. 300 IN CNAME edge.cdn.net.`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := testMsg(`www.example.com.`, dns.TypeA, cname, test.A(`edge.cdn.net. 60 IN A 1.2.3.4`))
+	opts := testOpts
+	opts.stripDot = true
+	var v struct {
+		dnsBase
+		Question dns.Question
+		RR       struct{ Hdr dns.RR_Header }
+	}
+	enc := jsonEncoder{perAnswer: true}
+	bbs := enc.Encode(entry.Now(), testLocal, testRemote, newIntrospectorFromMsg(m, opts))
+	if err = json.Unmarshal(bbs[1], &v); err != nil {
+		t.Fatal(err)
+	} else if v.Question.Name != `www.example.com` || v.RR.Hdr.Name != `edge.cdn.net` {
+		t.Fatalf("names not stripped %q %q", v.Question.Name, v.RR.Hdr.Name)
+	} else if strings.Join(v.CNAMEChain, ` `) != `www.example.com edge.cdn.net` || strings.Join(v.FinalAnswers, ` `) != `1.2.3.4` {
+		t.Fatalf("bad chain with stripped names %v %v", v.CNAMEChain, v.FinalAnswers)
+	}
+	if m.Question[0].Name != `www.example.com.` || m.Answer[1].Header().Name != `edge.cdn.net.` {
+		t.Fatal("stripping modified the message")
+	}
+	if bb := (textEncoder{}).Encode(entry.Now(), testLocal, testRemote, newIntrospectorFromMsg(m, opts))[0]; !bytes.Contains(bb, []byte("www.example.com\t")) {
+		t.Fatalf("text owner not stripped %s", bb)
+	}
+
+	//redacted answers keep the placeholder once their owners are stripped
+	opts.redact = true
+	for _, enc := range []encoder{jsonEncoder{perAnswer: true}, textEncoder{}} {
+		bbs = enc.Encode(entry.Now(), testLocal, testRemote, newIntrospectorFromMsg(m, opts))
+		if bb := bbs[len(bbs)-1]; !bytes.Contains(bb, []byte(redactedRdata)) || bytes.Contains(bb, []byte(`1.2.3.4`)) {
+			t.Fatalf("redaction lost stripping owner dots %s", bb)
+		} else if bytes.Contains(bb, []byte(`edge.cdn.net.`)) {
+			t.Fatalf("redacted owner not stripped %s", bb)
+		}
+	}
+	opts.redact = false
+
+	//the root stays a dot
+	root := testMsg(`.`, dns.TypeNS)
+	bbs = jsonEncoder{}.Encode(entry.Now(), testLocal, testRemote, newIntrospectorFromMsg(root, opts))
+	var q struct{ Question struct{ Hdr dns.Question } }
+	if err = json.Unmarshal(bbs[0], &q); err != nil {
+		t.Fatal(err)
+	} else if q.Question.Hdr.Name != `.` {
+		t.Fatalf("bad root name %q", q.Question.Hdr.Name)
+	}
+}
+
+func TestWireSizes(t *testing.T) {
+	req := new(dns.Msg)
+	req.SetQuestion(`example.com.`, dns.TypeA)
+	var answers []dns.RR
+	for i := 0; i < 20; i++ {
+		answers = append(answers, test.A(fmt.Sprintf("example.com. 60 IN A 10.0.0.%d", i)))
+	}
+	tr := newIntrospector(&test.ResponseWriter{}, req)
+	tr.encodeOptions = testOpts
+	tr.capture(testMsg(`example.com.`, dns.TypeA, answers...))
+
+	//header 12, question 13+4, uncompressed answers 13+10+4 each
+	const reqBytes, respBytes = 29, 12 + 17 + 20*27
+	var v struct {
+		dnsBase
+	}
+	bbs := jsonEncoder{}.Encode(entry.Now(), testLocal, testRemote, tr)
+	if len(bbs) == 0 {
+		t.Fatal("no records")
+	} else if err := json.Unmarshal(bbs[0], &v); err != nil {
+		t.Fatal(err)
+	} else if v.RequestBytes != reqBytes || v.ResponseBytes != respBytes {
+		t.Fatalf("bad sizes %d/%d", v.RequestBytes, v.ResponseBytes)
+	} else if v.AmplificationFactor != float64(respBytes)/reqBytes {
+		t.Fatalf("bad amplification factor %v", v.AmplificationFactor)
+	}
+
+	//there is no real request when encoding a bare response, so no factor
+	tr = newIntrospectorFromMsg(testMsg(`example.com.`, dns.TypeA), testOpts)
+	if b := newBase(entry.Now(), testLocal, testRemote, tr); b.RequestBytes != 0 || b.ResponseBytes != 29 || b.AmplificationFactor != 0 {
+		t.Fatalf("bad bare response sizes %+v", b)
+	}
+}
+
+func TestNormalizeAnswerOrder(t *testing.T) {
+	rrs := func(order ...int) (r []dns.RR) {
+		all := []dns.RR{
+			test.CNAME(`www.example.com. 60 IN CNAME example.com.`),
+			test.A(`example.com. 60 IN A 10.0.0.2`),
+			test.A(`example.com. 60 IN A 10.0.0.1`),
+			test.AAAA(`example.com. 60 IN AAAA ::1`),
+		}
+		for _, i := range order {
+			r = append(r, all[i])
+		}
+		return
+	}
+	opts := testOpts
+	opts.sortAnswers = true
+	ts := entry.Now()
+	var first string
+	for _, order := range [][]int{{0, 1, 2, 3}, {3, 2, 1, 0}, {2, 0, 3, 1}} {
+		m := testMsg(`www.example.com.`, dns.TypeA, rrs(order...)...)
+		orig := fmt.Sprint(m.Answer)
+		var out []string
+		for _, name := range []string{`json`, `json-per-answer`, `text`, `passivedns`} {
+			enc, err := getEncoder(name, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, bb := range enc.Encode(ts, testLocal, testRemote, newIntrospectorFromMsg(m, opts)) {
+				out = append(out, string(bb))
+			}
+		}
+		if fmt.Sprint(m.Answer) != orig {
+			t.Fatal("normalization modified the response")
+		} else if first == `` {
+			first = strings.Join(out, "\n")
+		} else if v := strings.Join(out, "\n"); v != first {
+			t.Fatalf("order %v encoded differently:\n%s\n%s", order, v, first)
+		}
+	}
+
+	//type first, then rdata
+	got := sortAnswers(rrs(3, 1, 0, 2))
+	if got[0].Header().Rrtype != dns.TypeA || got[0].(*dns.A).A.String() != `10.0.0.1` || got[1].(*dns.A).A.String() != `10.0.0.2` {
+		t.Fatalf("bad order %v", got)
+	} else if got[2].Header().Rrtype != dns.TypeCNAME || got[3].Header().Rrtype != dns.TypeAAAA {
+		t.Fatalf("bad order %v", got)
+	}
+}
+
+func TestEmitEmptyQuestion(t *testing.T) {
+	m := new(dns.Msg)
+	m.Response = true
+	m.Rcode = dns.RcodeFormatError
+	ts := entry.Now()
+	for _, enc := range []encoder{jsonEncoder{}, jsonEncoder{perAnswer: true}, textEncoder{}} {
+		if bbs := enc.Encode(ts, testLocal, testRemote, newIntrospectorFromMsg(m, testOpts)); len(bbs) != 0 {
+			t.Fatalf("%s emitted %d records without emit-empty-question", enc.Name(), len(bbs))
+		}
+	}
+
+	opts := testOpts
+	opts.emptyQuestion = true
+	is := newIntrospectorFromMsg(m, opts)
+	for _, enc := range []encoder{jsonEncoder{}, jsonEncoder{perAnswer: true}} {
+		var v dnsNoQuestion
+		if bbs := enc.Encode(ts, testLocal, testRemote, is); len(bbs) != 1 {
+			t.Fatalf("%s expected 1 record, got %d", enc.Name(), len(bbs))
+		} else if err := json.Unmarshal(bbs[0], &v); err != nil {
+			t.Fatal(err)
+		} else if !v.NoQuestion || v.Rcode != `FORMERR` || v.Remote != testRemote.addr {
+			t.Fatalf("%s bad record %+v", enc.Name(), v)
+		}
+	}
+	var e errAnswer
+	if bbs := (jsonEncoder{}).EncodeError(ts, testLocal, testRemote, is, errors.New(`timeout`)); len(bbs) != 1 {
+		t.Fatalf("expected 1 error record, got %d", len(bbs))
+	} else if err := json.Unmarshal(bbs[0], &e); err != nil {
+		t.Fatal(err)
+	} else if !e.NoQuestion || e.Error != `timeout` {
+		t.Fatalf("bad error record %+v", e)
+	}
+	if bbs := (textEncoder{}).Encode(ts, testLocal, testRemote, is); len(bbs) != 1 || !strings.HasSuffix(string(bbs[0]), ` NOQUESTION FORMERR EventType=noquestion`) {
+		t.Fatalf("bad text records %q", bbs)
+	}
+}
+
+func TestMaxTXTBytes(t *testing.T) {
+	long := &dns.TXT{
+		Hdr: dns.RR_Header{Name: `sel._domainkey.example.com.`, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 300},
+		Txt: []string{strings.Repeat(`a`, 255), strings.Repeat(`b`, 255), strings.Repeat(`c`, 100)},
+	}
+	short := test.TXT(`example.com. 300 IN TXT "v=spf1 -all"`)
+	m := testMsg(`example.com.`, dns.TypeTXT, long, short)
+	opts := testOpts
+	opts.maxTXTBytes = 300
+	var v struct {
+		RR struct{ Txt []string }
+	}
+	bbs := jsonEncoder{perAnswer: true}.Encode(entry.Now(), testLocal, testRemote, newIntrospectorFromMsg(m, opts))
+	if len(bbs) != 2 {
+		t.Fatalf("expected 2 records, got %d", len(bbs))
+	} else if err := json.Unmarshal(bbs[0], &v); err != nil {
+		t.Fatal(err)
+	} else if len(v.RR.Txt) != 3 || v.RR.Txt[0] != long.Txt[0] || v.RR.Txt[1] != strings.Repeat(`b`, 45) || v.RR.Txt[2] != txtTruncatedMarker {
+		t.Fatalf("bad truncated TXT %q", v.RR.Txt)
+	} else if err := json.Unmarshal(bbs[1], &v); err != nil {
+		t.Fatal(err)
+	} else if len(v.RR.Txt) != 1 || v.RR.Txt[0] != `v=spf1 -all` {
+		t.Fatalf("short TXT was altered %q", v.RR.Txt)
+	}
+	//the response is untouched
+	if len(long.Txt) != 3 || len(long.Txt[2]) != 100 || m.Answer[0] != long {
+		t.Fatal("response TXT was modified")
+	}
+	if got := truncateTXT(m.Answer, 1024); &got[0] != &m.Answer[0] {
+		t.Fatal("answers within the limit were copied")
+	}
+}
+
+func TestEventType(t *testing.T) {
+	nx := testMsg(`nope.example.com.`, dns.TypeA)
+	nx.Rcode = dns.RcodeNameError
+	upd := new(dns.Msg)
+	upd.SetUpdate(`example.com.`)
+	upd.Insert([]dns.RR{test.A(`host.example.com. 60 IN A 1.2.3.4`)})
+	resp := new(dns.Msg)
+	resp.SetReply(upd)
+	empty := new(dns.Msg)
+	empty.Response = true
+
+	negOpts, emptyOpts := testOpts, testOpts
+	negOpts.logNegative = true
+	emptyOpts.emptyQuestion = true
+	ts := entry.Now()
+	for _, tt := range []struct {
+		name string
+		enc  encoder
+		m    *dns.Msg
+		opts encodeOptions
+		exp  string
+	}{
+		{`query`, jsonEncoder{}, testMsg(`example.com.`, dns.TypeMX), testOpts, eventQuery},
+		{`answer`, jsonEncoder{}, testMsg(`example.com.`, dns.TypeA, test.A(`example.com. 60 IN A 1.2.3.4`)), testOpts, eventAnswer},
+		{`answer per answer`, jsonEncoder{perAnswer: true}, testMsg(`example.com.`, dns.TypeA, test.A(`example.com. 60 IN A 1.2.3.4`)), testOpts, eventAnswer},
+		{`negative`, jsonEncoder{}, nx, negOpts, eventNegative},
+		{`negative without log-negative`, jsonEncoder{}, nx, testOpts, eventQuery},
+		{`update`, jsonEncoder{}, resp, testOpts, eventUpdate},
+		{`no question`, jsonEncoder{}, empty, emptyOpts, eventNoQuestion},
+	} {
+		var v struct{ EventType string }
+		if err := json.Unmarshal(tt.enc.Encode(ts, testLocal, testRemote, newIntrospectorFromMsg(tt.m, tt.opts))[0], &v); err != nil {
+			t.Fatal(err)
+		} else if v.EventType != tt.exp {
+			t.Fatalf("%s: EventType %q != %q", tt.name, v.EventType, tt.exp)
+		}
+	}
+
+	//errors win over updates, and hec events carry the same body
+	var v struct{ EventType string }
+	if err := json.Unmarshal(jsonEncoder{}.EncodeError(ts, testLocal, testRemote, newIntrospectorFromMsg(resp, testOpts), errors.New(`timeout`))[0], &v); err != nil {
+		t.Fatal(err)
+	} else if v.EventType != eventError {
+		t.Fatalf("error EventType %q", v.EventType)
+	}
+	var ev struct{ Event struct{ EventType string } }
+	if err := json.Unmarshal(hecEncoder{}.Encode(ts, testLocal, testRemote, newIntrospectorFromMsg(testMsg(`example.com.`, dns.TypeMX), testOpts))[0], &ev); err != nil {
+		t.Fatal(err)
+	} else if ev.Event.EventType != eventQuery {
+		t.Fatalf("hec EventType %q", ev.Event.EventType)
+	}
+}
+
+func TestSectionSizes(t *testing.T) {
+	var answers []dns.RR
+	for i := 0; i < 4; i++ {
+		answers = append(answers, test.A(fmt.Sprintf("www.example.com. 60 IN A 10.0.0.%d", i)))
+	}
+	m := testMsg(`www.example.com.`, dns.TypeA, answers...)
+	m.Ns = []dns.RR{test.NS(`example.com. 300 IN NS ns1.example.com.`), test.NS(`example.com. 300 IN NS ns2.example.com.`)}
+	m.Extra = []dns.RR{test.A(`ns1.example.com. 300 IN A 10.1.0.1`)}
+	m.SetEdns0(1232, true)
+	opts := testOpts
+	opts.sectionSizes = true
+	var v dnsBase
+	for _, compress := range []bool{false, true} {
+		m.Compress = compress
+		if err := json.Unmarshal(jsonEncoder{}.Encode(entry.Now(), testLocal, testRemote, newIntrospectorFromMsg(m, opts))[0], &v); err != nil {
+			t.Fatal(err)
+		}
+		//question 17+4, answers 17+10+4, NS 13+10+17, glue 17+10+4, OPT 1+10
+		if v.QuestionBytes != 21 || v.AnswerBytes != 4*31 || v.AuthorityBytes != 2*40 || v.AdditionalBytes != 31+11 {
+			t.Fatalf("bad section sizes %d/%d/%d/%d", v.QuestionBytes, v.AnswerBytes, v.AuthorityBytes, v.AdditionalBytes)
+		}
+		sum := 12 + v.QuestionBytes + v.AnswerBytes + v.AuthorityBytes + v.AdditionalBytes
+		if !compress && sum != v.ResponseBytes {
+			t.Fatalf("uncompressed sections sum to %d, message is %d", sum, v.ResponseBytes)
+		} else if compress && (sum <= v.ResponseBytes || v.ResponseBytes < sum/2) {
+			t.Fatalf("compressed message of %d bytes is not approximated by %d", v.ResponseBytes, sum)
+		}
+	}
+
+	//off by default, and an empty section is left out
+	v = dnsBase{}
+	m = testMsg(`example.com.`, dns.TypeMX)
+	if err := json.Unmarshal(jsonEncoder{}.Encode(entry.Now(), testLocal, testRemote, newIntrospectorFromMsg(m, testOpts))[0], &v); err != nil {
+		t.Fatal(err)
+	} else if v.QuestionBytes != 0 {
+		t.Fatalf("section sizes without include-section-sizes %+v", v)
+	}
+	if b := newBase(entry.Now(), testLocal, testRemote, newIntrospectorFromMsg(m, opts)); b.QuestionBytes != 17 || b.AnswerBytes != 0 {
+		t.Fatalf("bad sizes for a message without answers %d/%d", b.QuestionBytes, b.AnswerBytes)
+	}
+}
+
+func TestAnswerHash(t *testing.T) {
+	a := test.A(`cdn.example.com. 60 IN A 1.2.3.4`)
+	b := test.A(`cdn.example.com. 60 IN A 1.2.3.5`)
+	opts := testOpts
+	opts.hashAnswers = true
+	hash := func(rrs ...dns.RR) string {
+		t.Helper()
+		var v dnsBase
+		if err := json.Unmarshal(jsonEncoder{}.Encode(entry.Now(), testLocal, testRemote, newIntrospectorFromMsg(testMsg(`cdn.example.com.`, dns.TypeA, rrs...), opts))[0], &v); err != nil {
+			t.Fatal(err)
+		}
+		return v.AnswerHash
+	}
+	h := hash(a, b)
+	if h == `` {
+		t.Fatal("no AnswerHash")
+	} else if hash(b, a) != h {
+		t.Fatal("AnswerHash depends on answer order")
+	} else if hash(test.A(`CDN.example.com. 12 IN A 1.2.3.4`), test.A(`cdn.example.com. 7 IN A 1.2.3.5`)) != h {
+		t.Fatal("AnswerHash depends on TTL or owner case")
+	} else if hash(a, test.A(`cdn.example.com. 60 IN A 1.2.3.6`)) == h {
+		t.Fatal("AnswerHash did not change with the answer data")
+	} else if hash() != `` {
+		t.Fatal("AnswerHash without answers")
+	}
+	//the whole set is hashed, ahead of the max-answers bound
+	opts.maxAnswers = 1
+	if hash(a, b) != h {
+		t.Fatal("AnswerHash changed with max-answers-per-query")
+	}
+	//a hash of redacted rdata would confirm a guess at it
+	opts.redact = true
+	if v := hash(a, b); v != `` {
+		t.Fatalf("AnswerHash %q with redact-answers", v)
+	}
+	opts.redact = false
+	opts.redactQtypes, _, _ = parseRedactQtypes([]string{`A`})
+	if v := hash(a, b); v != `` {
+		t.Fatalf("AnswerHash %q with response-redact-qtype", v)
+	}
+	opts = testOpts
+	if hash(a, b) != `` {
+		t.Fatal("AnswerHash without include-answer-hash")
+	}
+}
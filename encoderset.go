@@ -0,0 +1,96 @@
+/*************************************************************************
+ * Copyright 2017 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package gravwellcoredns
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/gravwell/gravwell/v3/ingest"
+	"github.com/gravwell/gravwell/v3/ingest/entry"
+)
+
+// taggedEncoder is one encoding in an encoderSet, with an optional tag overriding the default
+type taggedEncoder struct {
+	encoder
+	tag string
+	tg  entry.EntryTag // resolved from tag during setup
+}
+
+// encoderSet runs several encodings over each request in configuration order, used when the
+// encoding directive is repeated or an encoding carries its own tag
+type encoderSet []taggedEncoder
+
+func (es encoderSet) Encode(ts entry.Timestamp, local, remote net.Addr, tr *introspector) (bbs [][]byte) {
+	for _, te := range es {
+		bbs = append(bbs, te.Encode(ts, local, remote, tr)...)
+	}
+	return
+}
+
+func (es encoderSet) EncodeError(ts entry.Timestamp, l, r net.Addr, tr *introspector, err error) (bbs [][]byte) {
+	for _, te := range es {
+		bbs = append(bbs, te.EncodeError(ts, l, r, tr, err)...)
+	}
+	return
+}
+
+func (es encoderSet) Name() string {
+	names := make([]string, 0, len(es))
+	for _, te := range es {
+		if te.tag != `` {
+			names = append(names, te.encoder.Name()+`:`+te.tag)
+		} else {
+			names = append(names, te.encoder.Name())
+		}
+	}
+	return strings.Join(names, `,`)
+}
+
+// resolveTags looks up the muxer tag for every encoding that carries one
+func (es encoderSet) resolveTags(im *ingest.IngestMuxer) (err error) {
+	for i := range es {
+		if es[i].tag == `` {
+			continue
+		} else if es[i].tg, err = im.GetTag(es[i].tag); err != nil {
+			return fmt.Errorf("failed to resolve encoding tag %q - %w", es[i].tag, err)
+		}
+	}
+	return
+}
+
+// encodingTag strips the generic tag option out of an encoding block, the rest of the block
+// belongs to the encoder
+func encodingTag(block [][]string) (rest [][]string, tag string, err error) {
+	for _, opt := range block {
+		if opt[0] != `tag` {
+			rest = append(rest, opt)
+			continue
+		} else if len(opt) != 2 {
+			return nil, ``, errors.New("encoding tag requires a single tag name")
+		} else if err = ingest.CheckTag(opt[1]); err != nil {
+			return nil, ``, fmt.Errorf("invalid encoding tag %q - %v", opt[1], err)
+		}
+		tag = opt[1]
+	}
+	return
+}
+
+// eachEncoder calls fn for every encoder, descending into encoder sets
+func eachEncoder(enc encoder, fn func(encoder)) {
+	if es, ok := enc.(encoderSet); ok {
+		for _, te := range es {
+			fn(te.encoder)
+		}
+		return
+	}
+	fn(enc)
+}
@@ -0,0 +1,85 @@
+/*************************************************************************
+ * Copyright 2017 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package gravwellcoredns
+
+import (
+	"bytes"
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/coredns/caddy"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/miekg/dns"
+)
+
+const multiEncodingBase = testConfigBase + "\tTag dns\n"
+
+func TestMultipleEncodings(t *testing.T) {
+	cfg, enc, err := parseConfig(caddy.NewTestController("dns", multiEncodingBase+"\tEncoding json\n\tEncoding text {\n\t\ttag dns-text\n\t}\n}"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	es, ok := enc.(encoderSet)
+	if !ok || len(es) != 2 {
+		t.Fatalf("expected an encoder set of 2, got %T", enc)
+	} else if cfg.Encoder != `json,text:dns-text` {
+		t.Fatalf("bad encoder summary %s", cfg.Encoder)
+	} else if !reflect.DeepEqual(cfg.tags(), []string{`dns`, `dns-text`}) {
+		t.Fatalf("bad tags %v", cfg.tags())
+	}
+
+	//a single untagged encoding is unchanged
+	if _, enc, err = parseConfig(caddy.NewTestController("dns", multiEncodingBase+"\tEncoding text\n}")); err != nil {
+		t.Fatal(err)
+	} else if _, ok = enc.(*textEncoder); !ok {
+		t.Fatalf("single encoding wrapped in a set %T", enc)
+	}
+
+	for _, bad := range []string{
+		"\tEncoding json\n\tEncoding json\n}",
+		"\tEncoding json\n\tEncoding nope\n}",
+		"\tEncoding json {\n\t\ttag\n\t}\n}",
+		"\tEncoding json {\n\t\ttag bad*tag\n\t}\n}",
+	} {
+		if _, _, err = parseConfig(caddy.NewTestController("dns", multiEncodingBase+bad)); err == nil {
+			t.Fatalf("accepted bad config %q", bad)
+		}
+	}
+	//the same encoding may be repeated to different tags
+	if _, _, err = parseConfig(caddy.NewTestController("dns", multiEncodingBase+"\tEncoding json\n\tEncoding json {\n\t\ttag dns-copy\n\t}\n}")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestEncoderSetServeDNS(t *testing.T) {
+	dw := &discardWriter{keep: true}
+	gh := gwHandler{
+		Next: answerHandler(false),
+		im:   dw,
+		tag:  1,
+		enc: encoderSet{
+			{encoder: &jsonEncoder{}},
+			{encoder: &textEncoder{}, tag: `dns-text`, tg: 2},
+		},
+		encodeOptions: encodeOptions{maxQuestions: defaultMaxQuestions},
+	}
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+	if _, err := gh.ServeDNS(context.Background(), &test.ResponseWriter{}, req); err != nil {
+		t.Fatal(err)
+	}
+	if len(dw.ents) != 2 {
+		t.Fatalf("expected 2 entries, got %d", len(dw.ents))
+	} else if dw.ents[0].Tag != 1 || !bytes.HasPrefix(dw.ents[0].Data, []byte(`{`)) {
+		t.Fatalf("bad json entry %d %s", dw.ents[0].Tag, dw.ents[0].Data)
+	} else if dw.ents[1].Tag != 2 || bytes.HasPrefix(dw.ents[1].Data, []byte(`{`)) {
+		t.Fatalf("bad text entry %d %s", dw.ents[1].Tag, dw.ents[1].Data)
+	}
+}
@@ -0,0 +1,103 @@
+/*************************************************************************
+ * Copyright 2017 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package gravwellcoredns
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	defaultErrorLogInterval time.Duration = 10 * time.Second
+	errorLogMaxClasses      int           = 64  // distinct classes tracked, the rest share one
+	errorLogMaxClassLen     int           = 160 // class keys are cut so a huge message cannot bloat the map
+	errorLogOtherClass      string        = `other`
+)
+
+// errorLog reports write failures at most once per interval for each class of error, so an
+// indexer outage produces one line per failure mode rather than one per dropped entry.  The
+// line that ends a quiet period carries the count of failures suppressed since the last one.
+type errorLog struct {
+	interval time.Duration
+	lg       *pluginLogger
+	mtx      sync.Mutex
+	classes  map[string]*errorClass
+	now      func() time.Time
+}
+
+type errorClass struct {
+	last       time.Time
+	suppressed int
+}
+
+func newErrorLog(interval time.Duration, lg *pluginLogger) *errorLog {
+	return &errorLog{
+		interval: interval,
+		lg:       lg,
+		classes:  map[string]*errorClass{},
+		now:      time.Now,
+	}
+}
+
+// log reports err unless its class was already reported within the interval, a nil log or
+// error does nothing and the return value is whether a line was written
+func (el *errorLog) log(err error) bool {
+	if el == nil || err == nil {
+		return false
+	}
+	key := errorClassKey(err)
+	now := el.now()
+	el.mtx.Lock()
+	ec, ok := el.classes[key]
+	if !ok {
+		if len(el.classes) >= errorLogMaxClasses {
+			key = errorLogOtherClass
+			ec = el.classes[key]
+		}
+		if ec == nil {
+			ec = &errorClass{}
+			el.classes[key] = ec
+		}
+	}
+	if !ec.last.IsZero() && now.Sub(ec.last) < el.interval {
+		ec.suppressed++
+		el.mtx.Unlock()
+		return false
+	}
+	suppressed := ec.suppressed
+	ec.last, ec.suppressed = now, 0
+	el.mtx.Unlock()
+	if suppressed > 0 {
+		el.lg.Errorf("ingest write failed: %v (%d similar failures suppressed in the last %v)", err, suppressed, el.interval)
+	} else {
+		el.lg.Errorf("ingest write failed: %v", err)
+	}
+	return true
+}
+
+// errorClassKey is the message of the first error a joined error carries, the fanout writer
+// joins one error per failing sink and a single failing sink should always map to one class
+func errorClassKey(err error) string {
+	for {
+		je, ok := err.(interface{ Unwrap() []error })
+		if !ok {
+			break
+		}
+		errs := je.Unwrap()
+		if len(errs) == 0 {
+			break
+		}
+		err = errs[0]
+	}
+	key := err.Error()
+	if len(key) > errorLogMaxClassLen {
+		key = key[:errorLogMaxClassLen]
+	}
+	return key
+}
@@ -0,0 +1,66 @@
+/*************************************************************************
+ * Copyright 2017 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package gravwellcoredns
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/coredns/caddy"
+	"github.com/gravwell/gravwell/v3/ingest"
+)
+
+func TestErrorLog(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	el := newErrorLog(10*time.Second, newPluginLogger(`off`))
+	el.now = func() time.Time { return now }
+
+	refused := errors.New("dial tcp 10.0.0.1:4023: connect: connection refused")
+	if !el.log(ingest.ErrWriteTimeout) || !el.log(refused) {
+		t.Fatal("first failure of each class was not logged")
+	}
+	//every entry failing the same way inside the interval is one class
+	for i := 0; i < 100; i++ {
+		if el.log(ingest.ErrWriteTimeout) || el.log(refused) {
+			t.Fatal("repeat failure logged inside the interval")
+		}
+	}
+	if c := el.classes[ingest.ErrWriteTimeout.Error()]; c.suppressed != 100 {
+		t.Fatalf("suppressed %d, expected 100", c.suppressed)
+	}
+	now = now.Add(10 * time.Second)
+	if !el.log(ingest.ErrWriteTimeout) {
+		t.Fatal("failure after the interval was not logged")
+	} else if c := el.classes[ingest.ErrWriteTimeout.Error()]; c.suppressed != 0 {
+		t.Fatal("suppressed count not reset")
+	}
+
+	//one failing sink of a fanout is keyed by its own error
+	if k := errorClassKey(errors.Join(refused, errors.New("http-sink returned 503"))); k != refused.Error() {
+		t.Fatalf("bad joined class %q", k)
+	}
+	//the class map is bounded, the overflow shares one class
+	for i := 0; i < 2*errorLogMaxClasses; i++ {
+		el.log(fmt.Errorf("failure %d", i))
+	}
+	if len(el.classes) > errorLogMaxClasses+1 {
+		t.Fatalf("%d classes tracked", len(el.classes))
+	}
+	if (*errorLog)(nil).log(refused) || el.log(nil) {
+		t.Fatal("nil log or error logged")
+	}
+
+	if cfg, _, err := parseConfig(caddy.NewTestController("dns", "gravwell {\n\tStdout-Sink true\n}")); err != nil || cfg.ErrorLogInterval != defaultErrorLogInterval {
+		t.Fatal("bad default error-log-interval", err)
+	} else if _, _, err = parseConfig(caddy.NewTestController("dns", "gravwell {\n\tStdout-Sink true\n\tError-Log-Interval 10ms\n}")); err == nil {
+		t.Fatal("accepted an error-log-interval under 1s")
+	}
+}
@@ -0,0 +1,85 @@
+/*************************************************************************
+ * Copyright 2017 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package gravwellcoredns
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// SERVFAIL buckets emitted as FailureReason
+const (
+	failureDNSSECBogus     string = `dnssec-bogus`
+	failureUpstreamTimeout string = `upstream-timeout`
+	failureFiltered        string = `filtered`
+	failureOther           string = `other`
+)
+
+// edeFailureReasons maps EDNS0 extended error codes (RFC 8914) to a SERVFAIL bucket,
+// codes that are not listed are bucketed as other
+var edeFailureReasons = map[uint16]string{
+	dns.ExtendedErrorCodeUnsupportedDNSKEYAlgorithm:  failureDNSSECBogus,
+	dns.ExtendedErrorCodeUnsupportedDSDigestType:     failureDNSSECBogus,
+	dns.ExtendedErrorCodeDNSSECIndeterminate:         failureDNSSECBogus,
+	dns.ExtendedErrorCodeDNSBogus:                    failureDNSSECBogus,
+	dns.ExtendedErrorCodeSignatureExpired:            failureDNSSECBogus,
+	dns.ExtendedErrorCodeSignatureNotYetValid:        failureDNSSECBogus,
+	dns.ExtendedErrorCodeDNSKEYMissing:               failureDNSSECBogus,
+	dns.ExtendedErrorCodeRRSIGsMissing:               failureDNSSECBogus,
+	dns.ExtendedErrorCodeNoZoneKeyBitSet:             failureDNSSECBogus,
+	dns.ExtendedErrorCodeNSECMissing:                 failureDNSSECBogus,
+	dns.ExtendedErrorCodeSignatureExpiredBeforeValid: failureDNSSECBogus,
+	dns.ExtendedErrorCodeNoReachableAuthority:        failureUpstreamTimeout,
+	dns.ExtendedErrorCodeNetworkError:                failureUpstreamTimeout,
+	dns.ExtendedErrorCodeForgedAnswer:                failureFiltered,
+	dns.ExtendedErrorCodeBlocked:                     failureFiltered,
+	dns.ExtendedErrorCodeCensored:                    failureFiltered,
+	dns.ExtendedErrorCodeFiltered:                    failureFiltered,
+	dns.ExtendedErrorCodeProhibited:                  failureFiltered,
+	dns.ExtendedErrorCodeUnableToConformToPolicy:     failureFiltered,
+}
+
+// failureReason buckets a SERVFAIL, other rcodes have no reason.  The first extended error
+// code with a known bucket wins, without one the plugin chain error is inspected for timeouts
+// and unreachable upstreams.
+func failureReason(rcode int, edeCodes []uint16, err error) string {
+	if rcode != dns.RcodeServerFailure {
+		return ``
+	}
+	for _, code := range edeCodes {
+		if r, ok := edeFailureReasons[code]; ok {
+			return r
+		}
+	}
+	if upstreamFailure(err) {
+		return failureUpstreamTimeout
+	}
+	return failureOther
+}
+
+// upstreamFailure is true for errors that mean an upstream did not answer in time or could not
+// be reached, e.g. the forward plugin's "no healthy proxies"
+func upstreamFailure(err error) bool {
+	if err == nil {
+		return false
+	}
+	var ne net.Error
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, os.ErrDeadlineExceeded) {
+		return true
+	} else if errors.As(err, &ne) && ne.Timeout() {
+		return true
+	}
+	msg := strings.ToLower(err.Error())
+	return strings.Contains(msg, `timeout`) || strings.Contains(msg, `no healthy`) || strings.Contains(msg, `connection refused`)
+}
@@ -0,0 +1,79 @@
+/*************************************************************************
+ * Copyright 2017 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package gravwellcoredns
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/coredns/coredns/plugin"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/miekg/dns"
+)
+
+func TestFailureReason(t *testing.T) {
+	for _, tc := range []struct {
+		rcode int
+		ede   []uint16
+		err   error
+		want  string
+	}{
+		{dns.RcodeSuccess, nil, nil, ``},
+		{dns.RcodeNameError, []uint16{dns.ExtendedErrorCodeBlocked}, nil, ``},
+		{dns.RcodeServerFailure, nil, nil, failureOther},
+		{dns.RcodeServerFailure, []uint16{dns.ExtendedErrorCodeDNSBogus}, nil, failureDNSSECBogus},
+		{dns.RcodeServerFailure, []uint16{dns.ExtendedErrorCodeSignatureExpired}, nil, failureDNSSECBogus},
+		{dns.RcodeServerFailure, []uint16{dns.ExtendedErrorCodeNoReachableAuthority}, nil, failureUpstreamTimeout},
+		{dns.RcodeServerFailure, []uint16{dns.ExtendedErrorCodeNetworkError}, nil, failureUpstreamTimeout},
+		{dns.RcodeServerFailure, []uint16{dns.ExtendedErrorCodeFiltered}, nil, failureFiltered},
+		{dns.RcodeServerFailure, []uint16{dns.ExtendedErrorCodeProhibited}, nil, failureFiltered},
+		//unmapped codes are skipped in favour of a later mapped one
+		{dns.RcodeServerFailure, []uint16{dns.ExtendedErrorCodeOther, dns.ExtendedErrorCodeBlocked}, nil, failureFiltered},
+		{dns.RcodeServerFailure, []uint16{dns.ExtendedErrorCodeNotReady}, nil, failureOther},
+		//heuristics without an extended error
+		{dns.RcodeServerFailure, nil, context.DeadlineExceeded, failureUpstreamTimeout},
+		{dns.RcodeServerFailure, nil, fmt.Errorf("forward: %w", os.ErrDeadlineExceeded), failureUpstreamTimeout},
+		{dns.RcodeServerFailure, nil, errors.New("read udp 10.0.0.1:53: i/o timeout"), failureUpstreamTimeout},
+		{dns.RcodeServerFailure, nil, errors.New("no healthy proxies"), failureUpstreamTimeout},
+		{dns.RcodeServerFailure, nil, errors.New("plugin/foo: bad things"), failureOther},
+		//an extended error beats the error heuristic
+		{dns.RcodeServerFailure, []uint16{dns.ExtendedErrorCodeDNSBogus}, context.DeadlineExceeded, failureDNSSECBogus},
+	} {
+		if got := failureReason(tc.rcode, tc.ede, tc.err); got != tc.want {
+			t.Fatalf("rcode %d ede %v err %v: got %q expected %q", tc.rcode, tc.ede, tc.err, got, tc.want)
+		}
+	}
+}
+
+func TestFailureReasonServeDNS(t *testing.T) {
+	dw := &discardWriter{keep: true}
+	gh := gwHandler{
+		Next: plugin.HandlerFunc(func(ctx context.Context, w dns.ResponseWriter, r *dns.Msg) (int, error) {
+			return dns.RcodeServerFailure, errors.New("no healthy proxies")
+		}),
+		im:            dw,
+		enc:           &jsonEncoder{},
+		encodeOptions: testOpts,
+	}
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+	gh.ServeDNS(context.Background(), &test.ResponseWriter{}, req)
+	var v errAnswer
+	if len(dw.ents) != 1 {
+		t.Fatalf("expected 1 entry, got %d", len(dw.ents))
+	} else if err := json.Unmarshal(dw.ents[0].Data, &v); err != nil {
+		t.Fatal(err)
+	} else if v.FailureReason != failureUpstreamTimeout {
+		t.Fatalf("bad FailureReason %q", v.FailureReason)
+	}
+}
@@ -0,0 +1,135 @@
+/*************************************************************************
+ * Copyright 2017 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package gravwellcoredns
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+const (
+	filterModeAllow string = `allow`
+	filterModeDeny  string = `deny`
+)
+
+type portRange struct {
+	lo, hi int
+}
+
+func (pr portRange) String() string {
+	if pr.lo == pr.hi {
+		return strconv.Itoa(pr.lo)
+	}
+	return fmt.Sprintf("%d-%d", pr.lo, pr.hi)
+}
+
+// parsePortRange parses a single port or an inclusive lo-hi range
+func parsePortRange(v string) (pr portRange, err error) {
+	lo, hi, isRange := strings.Cut(v, `-`)
+	if pr.lo, err = parsePort(lo); err != nil {
+		return
+	}
+	pr.hi = pr.lo
+	if isRange {
+		if pr.hi, err = parsePort(hi); err != nil {
+			return
+		} else if pr.hi < pr.lo {
+			err = fmt.Errorf("invalid port range %q, %d is greater than %d", v, pr.lo, pr.hi)
+		}
+	}
+	return
+}
+
+func parsePort(v string) (p int, err error) {
+	if p, err = strconv.Atoi(strings.TrimSpace(v)); err != nil || p < 1 || p > 65535 {
+		err = fmt.Errorf("invalid port %q, must be 1-65535", v)
+	}
+	return
+}
+
+// portFilter decides whether a request should be logged based on the client source port.
+// In allow mode only matching ports are logged, in deny mode matching ports are dropped.
+type portFilter struct {
+	allow  bool
+	ranges []portRange
+}
+
+func newPortFilter(mode string, ports []string) (pf *portFilter, err error) {
+	if len(ports) == 0 {
+		return
+	}
+	pf = &portFilter{
+		allow: mode == filterModeAllow,
+	}
+	for _, v := range ports {
+		var pr portRange
+		if pr, err = parsePortRange(v); err != nil {
+			return nil, err
+		}
+		pf.ranges = append(pf.ranges, pr)
+	}
+	return
+}
+
+// match returns the first range that contains port
+func (pf *portFilter) match(port int) (portRange, bool) {
+	for _, pr := range pf.ranges {
+		if port >= pr.lo && port <= pr.hi {
+			return pr, true
+		}
+	}
+	return portRange{}, false
+}
+
+// keep returns true if a request from the given address should be logged, a nil filter keeps everything
+func (pf *portFilter) keep(a net.Addr) bool {
+	keep, _ := pf.decide(a)
+	return keep
+}
+
+// decide is keep along with the rule behind the decision for filter-debug, the matching range
+// or, for an allow filter nothing matched, the bare mode.  A deny filter keeping a port it does
+// not list and addresses without a port are not decided by any rule.
+func (pf *portFilter) decide(a net.Addr) (keep bool, rule string) {
+	if pf == nil {
+		return true, ``
+	}
+	port, ok := addrPort(a)
+	if !ok {
+		return true, ``
+	}
+	mode := filterModeDeny
+	if pf.allow {
+		mode = filterModeAllow
+	}
+	if pr, ok := pf.match(port); ok {
+		return pf.allow, `client-port-filter ` + mode + ` ` + pr.String()
+	} else if pf.allow {
+		return false, `client-port-filter ` + mode
+	}
+	return true, ``
+}
+
+// addrPort extracts the port from a network address
+func addrPort(a net.Addr) (int, bool) {
+	switch v := a.(type) {
+	case *net.UDPAddr:
+		return v.Port, true
+	case *net.TCPAddr:
+		return v.Port, true
+	}
+	_, p, err := net.SplitHostPort(a.String())
+	if err != nil {
+		return 0, false
+	}
+	port, err := strconv.Atoi(p)
+	return port, err == nil
+}
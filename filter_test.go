@@ -0,0 +1,86 @@
+/*************************************************************************
+ * Copyright 2017 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package gravwellcoredns
+
+import (
+	"net"
+	"testing"
+)
+
+func TestParsePortRange(t *testing.T) {
+	for _, v := range []string{`53`, `1-65535`, `1024-2048`, `5353-5353`} {
+		if _, err := parsePortRange(v); err != nil {
+			t.Fatalf("failed to parse %q: %v", v, err)
+		}
+	}
+	for _, v := range []string{``, `0`, `65536`, `-1`, `10-`, `-10`, `2048-1024`, `a-b`, `1-2-3`} {
+		if _, err := parsePortRange(v); err == nil {
+			t.Fatalf("failed to catch bad port range %q", v)
+		}
+	}
+}
+
+func TestPortFilter(t *testing.T) {
+	udp := func(p int) net.Addr { return &net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: p} }
+	tcp := func(p int) net.Addr { return &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: p} }
+
+	//nil filters keep everything
+	var pf *portFilter
+	if !pf.keep(udp(53)) {
+		t.Fatal("nil filter dropped a request")
+	}
+
+	pf, err := newPortFilter(filterModeDeny, []string{`53`, `40000-40010`})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pf.keep(udp(53)) || pf.keep(tcp(40005)) || pf.keep(udp(40010)) {
+		t.Fatal("deny filter kept a matching port")
+	} else if !pf.keep(udp(40011)) || !pf.keep(tcp(1024)) {
+		t.Fatal("deny filter dropped a non-matching port")
+	}
+
+	if pf, err = newPortFilter(filterModeAllow, []string{`1024-65535`}); err != nil {
+		t.Fatal(err)
+	}
+	if !pf.keep(udp(1024)) || !pf.keep(udp(65535)) {
+		t.Fatal("allow filter dropped a matching port")
+	} else if pf.keep(udp(53)) {
+		t.Fatal("allow filter kept a non-matching port")
+	}
+}
+
+func TestPortFilterRule(t *testing.T) {
+	udp := func(p int) net.Addr { return &net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: p} }
+	allow, err := newPortFilter(filterModeAllow, []string{`53`, `40000-40010`})
+	if err != nil {
+		t.Fatal(err)
+	}
+	deny, err := newPortFilter(filterModeDeny, []string{`1-1023`})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		pf   *portFilter
+		port int
+		keep bool
+		rule string
+	}{
+		{allow, 40005, true, `client-port-filter allow 40000-40010`},
+		{allow, 53, true, `client-port-filter allow 53`},
+		{allow, 1024, false, `client-port-filter allow`},
+		{deny, 53, false, `client-port-filter deny 1-1023`},
+		{deny, 1024, true, ``},
+		{nil, 53, true, ``},
+	} {
+		if keep, rule := tt.pf.decide(udp(tt.port)); keep != tt.keep || rule != tt.rule {
+			t.Fatalf("port %d: got %v %q expected %v %q", tt.port, keep, rule, tt.keep, tt.rule)
+		}
+	}
+}
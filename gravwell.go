@@ -9,18 +9,29 @@
 package gravwellcoredns
 
 import (
+	"bytes"
+	"cmp"
+	"encoding/binary"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"hash/fnv"
+	"io/fs"
 	"net"
+	"os"
 	"path/filepath"
+	"slices"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/coredns/caddy"
 	"github.com/coredns/coredns/core/dnsserver"
 	"github.com/coredns/coredns/plugin"
+	"github.com/coredns/coredns/plugin/metadata"
+	clog "github.com/coredns/coredns/plugin/pkg/log"
 	"github.com/google/uuid"
 	"github.com/gravwell/gravwell/v3/ingest"
 	"github.com/gravwell/gravwell/v3/ingest/config"
@@ -33,39 +44,673 @@ import (
 const (
 	coreDNSPackageName string = `gravwell`
 	defaultTag         string = `dns`
+
+	// legitimate messages carry a single question, anything beyond this is ignored when encoding
+	defaultMaxQuestions int = 64
+
+	// metadata labels read from the request context after the rest of the chain has run,
+	// the acl plugin (or any policy plugin) can publish these via the metadata plugin
+	aclActionMetadataKey string = `acl/action`
+	aclPolicyMetadataKey string = `acl/policy`
+	// serving zone origin, and the source name of a synthesized wildcard answer which the
+	// file and cache plugins publish
+	zoneMetadataKey     string = `zone/origin`
+	wildcardMetadataKey string = `zone/wildcard`
+	// cache result, a cache plugin that publishes this should set it to hit or miss
+	cacheStatusMetadataKey string = `cache/status`
+	cacheStatusHit         string = `hit`
+	// set to true or false by a plugin that knows whether it synthesized the response
+	synthesizedMetadataKey string = `response/synthesized`
+	// published by a blocklist or RPZ style plugin that rewrote or refused the query, the
+	// reason names the list or rule and implies blocked when blocked is not set
+	blockedMetadataKey     string = `blocklist/blocked`
+	blockReasonMetadataKey string = `blocklist/reason`
+	// receive timestamp in unix nanoseconds, published by whatever plugin accepted the request
+	receivedMetadataKey string = `gravwell/received`
+
+	// ingester-uuid sentinel, a fresh UUID is generated each time the muxers start
+	ingesterUUIDAuto string = `auto`
 )
 
+var log = clog.NewWithPlugin(coreDNSPackageName)
+
 func init() {
 	caddy.RegisterPlugin(coreDNSPackageName, caddy.Plugin{
 		ServerType: `dns`,
 		Action:     setup,
 	})
+	caddy.RegisterEventHook(coreDNSPackageName, func(ev caddy.EventName, _ interface{}) error {
+		if ev == caddy.InstanceStartupEvent {
+			commitPending()
+		}
+		return nil
+	})
 }
 
 type cfgType struct {
 	config.IngestConfig
-	Tag          string
-	Encoder      string
-	WriteTimeout time.Duration
+	Tag                   string
+	DefaultTag            string // fallback for Tag when the block leaves it out, empty uses defaultTag
+	Encoder               string
+	WriteTimeout          time.Duration
+	IngestDeadline        time.Duration
+	KafkaBrokers          []string
+	KafkaTopic            string
+	SyslogRemote          string // udp:// or tcp:// URL
+	UnixSink              string // path of a UNIX stream socket
+	StdoutSink            bool
+	HTTPSink              string   // http:// or https:// URL entries are POSTed to
+	HTTPSinkHeaders       []string // canonical Name: value pairs, see parseHTTPSinkHeader
+	HTTPSinkRetries       int
+	MaxConcurrentWrites   int // 0 is unbounded
+	MinConnections        int // indexer connections startup waits for, 0 is any one
+	OnDisconnectCache     bool
+	CacheMaxAge           time.Duration
+	MaxQuestions          int
+	MaxAnswers            int
+	AnswerHead            int // answers encoded in full, the rest are only counted; 0 is off
+	MaxTXTBytes           int // 0 is unbounded
+	HeartbeatInterval     time.Duration
+	ErrorLogInterval      time.Duration // each class of write failure is logged at most once per interval
+	LifecycleMarkers      bool          // write plugin_start and plugin_stop records, default true
+	NTPCheckServer        string        // host:port, empty is off
+	CountryCIDRMap        string        // path of a CIDR to country code file, empty is off
+	BadDomainList         string        // path of a known-bad domain file, empty is off
+	NTPCheckInterval      time.Duration
+	StatsInterval         time.Duration // muxer connection poll period
+	ShadowMode            bool          // encode and count, but never write
+	SkipCacheHits         bool
+	LogErrors             bool // write records for requests the plugin chain failed, default true
+	QueueDepth            int
+	QueueWarnPercent      int
+	ClientPortFilter      []string
+	ClientPortMode        string
+	IncludeRawFlags       bool
+	QnameWire             bool
+	RegisteredDomain      bool
+	TunnelQnameLength     int
+	TunnelLabelCount      int
+	TunnelEntropy         float64
+	RedactAnswers         bool
+	IngesterUUIDFile      string
+	TargetPriority        map[string]int // only populated when a target carries a priority
+	RcodeTags             map[string]string
+	AuditTag              string            // receives every request regardless of filters, empty is off
+	TagEncoders           map[string]string // tag-on-rcode tags carrying their own encoding
+	MetadataKeys          []string          // include-metadata labels
+	LogWindow             []string          // log-window range and optional timezone, nil is always on
+	EncodingTags          []string          // tags named in encoding blocks
+	TextPrefix            string
+	TextSuffix            string
+	IncludeSequence       bool
+	NormalizeAnswerOrder  bool
+	IncludeAnswerHash     bool
+	AnswerDetail          []string // answer-detail-by-type QTYPE:level pairs, see parseAnswerDetail
+	ResponseRedactQtypes  []string // qtypes whose answers are redacted, see parseRedactQtypes
+	CoalesceAnswers       bool
+	IncludeEDNSOptions    bool
+	EmitEmptyQuestion     bool
+	IncludeSectionSizes   bool
+	FilterDebug           bool
+	LogTiming             string // empty is post
+	StripFQDNDot          bool
+	IncludeServerBlock    bool
+	IncludeNextPlugin     bool
+	SlowOutlierPercentile float64 // 0 is off
+	SampleRate            float64 // fraction of requests kept, 0 keeps everything
+	SampleKey             string
+	NXDomainThreshold     int // NXDOMAINs per client inside NXDomainWindow before DGASuspect, 0 is off
+	NXDomainWindow        time.Duration
+	ClientQPSHalflife     time.Duration // 0 is off
+	MaskClientIPv4        int           // prefix bits of IPv4 client addresses to keep, 0 is off
+	MaskClientIPv6        int
+	AnswerFormat          string
+	TimestampJSON         string
+	LogNegative           bool
+	ServerHost            string
+}
+
+const (
+	answerFormatFull  string = `full`
+	answerFormatRdata string = `rdata`
+)
+
+// encodeOptions controls how records are shaped and is shared by every encoder,
+// the zero value encodes everything with no limits
+type encodeOptions struct {
+	maxQuestions  int // zero means unbounded
+	maxAnswers    int // zero means unbounded, the tighter of max-answers-per-query and answer-head
+	maxTXTBytes   int // TXT rdata bytes kept per answer, zero means unbounded
+	answerFormat  string
+	logNegative   bool
+	serverHost    string // NSID fallback when the response does not carry one
+	rawFlags      bool
+	qnameWire     bool // also emit the packed qname
+	regDomain     bool // emit the eTLD+1 of the question name
+	tunnel        tunnelThresholds
+	badDomains    *badDomains   // bad-domain-list, set when the sinks start
+	redact        bool          // replace answer rdata with a placeholder
+	sortAnswers   bool          // order answers by type then rdata
+	serverBlock   string        // keys of the server block the plugin instance is in, empty unless include-server-block
+	nextPlugin    string        // Name of the next plugin in the chain, empty unless include-next-plugin
+	tsFormat      string        // timestamp-json, empty for the default encoding
+	coalesce      bool          // collapse identical answers into one json-per-answer record with a Count
+	stripDot      bool          // drop the trailing dot from question and answer owner names
+	ednsOptions   bool          // emit every request and response EDNS0 option generically
+	emptyQuestion bool          // emit a NoQuestion record for messages without a question
+	sectionSizes  bool          // emit the uncompressed wire size of each response section
+	hashAnswers   bool          // emit AnswerHash over the whole answer set
+	answerDetail  *answerDetail // qtypes whose answers are only counted, nil when all are full
+	redactQtypes  *redactQtypes // qtypes whose answers are redacted, nil unless response-redact-qtype
+}
+
+// String summarizes the effective configuration for logging, secrets are always redacted
+func (c cfgType) String() string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "tag=%s encoder=%s", c.Tag, c.Encoder)
+	fmt.Fprintf(&sb, " cleartext-targets=%v ciphertext-targets=%v", c.Cleartext_Backend_Target, c.Encrypted_Backend_Target)
+	if len(c.TargetPriority) > 0 {
+		fmt.Fprintf(&sb, " target-priority=%v", c.TargetPriority)
+	}
+	if len(c.KafkaBrokers) > 0 {
+		fmt.Fprintf(&sb, " kafka-brokers=%v kafka-topic=%s", c.KafkaBrokers, c.KafkaTopic)
+	}
+	if c.SyslogRemote != `` {
+		fmt.Fprintf(&sb, " syslog-remote=%s", redactURL(c.SyslogRemote))
+	}
+	if c.MaxConcurrentWrites > 0 {
+		fmt.Fprintf(&sb, " max-concurrent-writes=%d", c.MaxConcurrentWrites)
+	}
+	if c.MinConnections > 0 {
+		fmt.Fprintf(&sb, " min-connections=%d", c.MinConnections)
+	}
+	if c.UnixSink != `` {
+		fmt.Fprintf(&sb, " unix-sink=%s", c.UnixSink)
+	}
+	if c.StdoutSink {
+		sb.WriteString(" stdout-sink=true")
+	}
+	if c.HTTPSink != `` {
+		//header values are usually credentials, only the names are logged
+		names := make([]string, 0, len(c.HTTPSinkHeaders))
+		for _, v := range c.HTTPSinkHeaders {
+			n, _, _ := strings.Cut(v, `:`)
+			names = append(names, n)
+		}
+		fmt.Fprintf(&sb, " http-sink=%s http-sink-headers=%v http-sink-retries=%d", redactURL(c.HTTPSink), names, c.HTTPSinkRetries)
+	}
+	if len(c.RcodeTags) > 0 {
+		fmt.Fprintf(&sb, " tag-on-rcode=%v", c.RcodeTags)
+	}
+	if c.DefaultTag != `` {
+		fmt.Fprintf(&sb, " default-tag=%s", c.DefaultTag)
+	}
+	if c.AuditTag != `` {
+		fmt.Fprintf(&sb, " audit-tag=%s", c.AuditTag)
+	}
+	if len(c.LogWindow) > 0 {
+		fmt.Fprintf(&sb, " log-window=%s", strings.Join(c.LogWindow, ` `))
+	}
+	if len(c.MetadataKeys) > 0 {
+		fmt.Fprintf(&sb, " include-metadata=%v", c.MetadataKeys)
+	}
+	if len(c.TagEncoders) > 0 {
+		fmt.Fprintf(&sb, " tag-encoders=%v", c.TagEncoders)
+	}
+	if c.Ingest_Secret != `` {
+		sb.WriteString(" ingest-secret=<redacted>")
+	}
+	fmt.Fprintf(&sb, " insecure-novalidate-tls=%v compression=%v", c.Insecure_Skip_TLS_Verify, c.Enable_Compression)
+	if c.Ingester_UUID != `` {
+		fmt.Fprintf(&sb, " ingester-uuid=%s", c.Ingester_UUID)
+	}
+	if c.Label != `` {
+		fmt.Fprintf(&sb, " label=%q", c.Label)
+	}
+	if c.Ingest_Cache_Path != `` {
+		fmt.Fprintf(&sb, " cache-path=%s cache-mode=%s max-cache-size-mb=%d", c.Ingest_Cache_Path, c.Cache_Mode, c.Max_Ingest_Cache/(1024*1024))
+		if c.Cache_Depth > 0 {
+			fmt.Fprintf(&sb, " cache-depth=%d", c.Cache_Depth)
+		}
+		if c.CacheMaxAge > 0 {
+			fmt.Fprintf(&sb, " cache-max-age=%v", c.CacheMaxAge)
+		}
+	} else {
+		sb.WriteString(" cache=disabled")
+	}
+	if c.WriteTimeout > 0 {
+		fmt.Fprintf(&sb, " write-timeout=%v", c.WriteTimeout)
+	}
+	if c.IngestDeadline > 0 {
+		fmt.Fprintf(&sb, " ingest-deadline=%v", c.IngestDeadline)
+	}
+	if c.QueueDepth > 0 {
+		fmt.Fprintf(&sb, " ingest-queue-depth=%d queue-warn-percent=%d", c.QueueDepth, c.QueueWarnPercent)
+	}
+	if len(c.ClientPortFilter) > 0 {
+		fmt.Fprintf(&sb, " filter-client-port=%s%v", c.ClientPortMode, c.ClientPortFilter)
+	}
+	fmt.Fprintf(&sb, " max-questions=%d", c.MaxQuestions)
+	if c.SkipCacheHits {
+		sb.WriteString(" skip-cache-hits=true")
+	}
+	if !c.LogErrors {
+		sb.WriteString(" log-errors=false")
+	}
+	if c.HeartbeatInterval > 0 {
+		fmt.Fprintf(&sb, " heartbeat-interval=%v", c.HeartbeatInterval)
+	}
+	fmt.Fprintf(&sb, " error-log-interval=%v", c.ErrorLogInterval)
+	if !c.LifecycleMarkers {
+		sb.WriteString(" lifecycle-markers=false")
+	}
+	if c.CountryCIDRMap != `` {
+		fmt.Fprintf(&sb, " country-cidr-map=%s", c.CountryCIDRMap)
+	}
+	if c.BadDomainList != `` {
+		fmt.Fprintf(&sb, " bad-domain-list=%s", c.BadDomainList)
+	}
+	if c.NTPCheckServer != `` {
+		fmt.Fprintf(&sb, " ntp-check-server=%s ntp-check-interval=%v", c.NTPCheckServer, c.NTPCheckInterval)
+	}
+	if c.ShadowMode {
+		sb.WriteString(" shadow-mode=true")
+	}
+	if c.StatsInterval != connWatchInterval {
+		fmt.Fprintf(&sb, " stats-interval=%v", c.StatsInterval)
+	}
+	if c.MaxAnswers > 0 {
+		fmt.Fprintf(&sb, " max-answers-per-query=%d", c.MaxAnswers)
+	}
+	if c.AnswerHead > 0 {
+		fmt.Fprintf(&sb, " answer-head=%d", c.AnswerHead)
+	}
+	if c.MaxTXTBytes > 0 {
+		fmt.Fprintf(&sb, " max-txt-bytes=%d", c.MaxTXTBytes)
+	}
+	if c.AnswerFormat != `` {
+		fmt.Fprintf(&sb, " answer-format=%s", c.AnswerFormat)
+	}
+	if c.TimestampJSON != `` {
+		fmt.Fprintf(&sb, " timestamp-json=%s", c.TimestampJSON)
+	}
+	if c.LogNegative {
+		sb.WriteString(" log-negative=true")
+	}
+	if c.ServerHost != `` {
+		fmt.Fprintf(&sb, " server-host=%s", c.ServerHost)
+	}
+	if c.IncludeRawFlags {
+		sb.WriteString(" include-raw-flags=true")
+	}
+	if c.QnameWire {
+		sb.WriteString(" qname-wire=true")
+	}
+	if c.RegisteredDomain {
+		sb.WriteString(" registered-domain=true")
+	}
+	if t := c.encodeOptions().tunnel; t.enabled() {
+		fmt.Fprintf(&sb, " tunnel-qname-length=%d tunnel-label-count=%d tunnel-entropy=%g", t.length, t.labels, t.entropy)
+	}
+	if c.RedactAnswers {
+		sb.WriteString(" redact-answers=true")
+	}
+	if c.TextPrefix != `` || c.TextSuffix != `` {
+		fmt.Fprintf(&sb, " text-prefix=%q text-suffix=%q", c.TextPrefix, c.TextSuffix)
+	}
+	if c.IncludeSequence {
+		sb.WriteString(" include-sequence=true")
+	}
+	if c.NormalizeAnswerOrder {
+		sb.WriteString(" normalize-answer-order=true")
+	}
+	if c.IncludeAnswerHash {
+		sb.WriteString(" include-answer-hash=true")
+	}
+	if len(c.AnswerDetail) > 0 {
+		fmt.Fprintf(&sb, " answer-detail-by-type=%v", c.AnswerDetail)
+	}
+	if len(c.ResponseRedactQtypes) > 0 {
+		fmt.Fprintf(&sb, " response-redact-qtype=%s", strings.Join(c.ResponseRedactQtypes, `,`))
+	}
+	if c.CoalesceAnswers {
+		sb.WriteString(" coalesce-answers=true")
+	}
+	if c.StripFQDNDot {
+		sb.WriteString(" strip-fqdn-dot=true")
+	}
+	if c.IncludeEDNSOptions {
+		sb.WriteString(" include-edns-options=true")
+	}
+	if c.EmitEmptyQuestion {
+		sb.WriteString(" emit-empty-question=true")
+	}
+	if c.IncludeSectionSizes {
+		sb.WriteString(" include-section-sizes=true")
+	}
+	if c.FilterDebug {
+		sb.WriteString(" filter-debug=true")
+	}
+	if c.LogTiming != `` {
+		fmt.Fprintf(&sb, " log-timing=%s", c.LogTiming)
+	}
+	if c.IncludeServerBlock {
+		sb.WriteString(" include-server-block=true")
+	}
+	if c.IncludeNextPlugin {
+		sb.WriteString(" include-next-plugin=true")
+	}
+	if c.SlowOutlierPercentile > 0 {
+		fmt.Fprintf(&sb, " slow-outlier-percentile=%g", c.SlowOutlierPercentile)
+	}
+	if c.SampleRate > 0 {
+		fmt.Fprintf(&sb, " sample-rate=%g sample-key=%s", c.SampleRate, c.SampleKey)
+	}
+	if c.ClientQPSHalflife > 0 {
+		fmt.Fprintf(&sb, " client-qps-halflife=%v", c.ClientQPSHalflife)
+	}
+	if c.NXDomainThreshold > 0 {
+		fmt.Fprintf(&sb, " nxdomain-threshold=%d nxdomain-window=%v", c.NXDomainThreshold, c.NXDomainWindow)
+	}
+	if c.MaskClientIPv4 > 0 || c.MaskClientIPv6 > 0 {
+		fmt.Fprintf(&sb, " mask-client-ip=%d mask-client-ip6=%d", c.MaskClientIPv4, c.MaskClientIPv6)
+	}
+	return sb.String()
+}
+
+// gravwellTargets is true when any indexer targets are configured, a Kafka or syslog only config has none
+func (c cfgType) gravwellTargets() bool {
+	return len(c.Cleartext_Backend_Target) > 0 || len(c.Encrypted_Backend_Target) > 0
+}
+
+// addRcodeTag parses a tag-on-rcode <rcode> <tag> [encoding] directive
+func (c *cfgType) addRcodeTag(args []string) error {
+	if len(args) != 2 && len(args) != 3 {
+		return fmt.Errorf("tag-on-rcode requires an rcode, a tag, and an optional encoding")
+	}
+	rcode := strings.ToUpper(args[0])
+	if _, ok := dns.StringToRcode[rcode]; !ok {
+		return fmt.Errorf("tag-on-rcode unknown rcode %q", args[0])
+	} else if err := ingest.CheckTag(args[1]); err != nil {
+		return fmt.Errorf("invalid tag %q - %v", args[1], err)
+	}
+	if c.RcodeTags == nil {
+		c.RcodeTags = map[string]string{}
+	}
+	c.RcodeTags[rcode] = args[1]
+	if len(args) == 3 {
+		enc, err := getEncoder(args[2], nil)
+		if err != nil {
+			return fmt.Errorf("tag-on-rcode encoding %q - %v", args[2], err)
+		}
+		if prev, ok := c.TagEncoders[args[1]]; ok && prev != enc.Name() {
+			return fmt.Errorf("tag-on-rcode tag %q may only have one encoding, got %s and %s", args[1], prev, enc.Name())
+		} else if c.TagEncoders == nil {
+			c.TagEncoders = map[string]string{}
+		}
+		c.TagEncoders[args[1]] = enc.Name()
+	}
+	return nil
+}
+
+// addMetadataKeys parses an include-metadata <label> [label...] directive, it may be repeated
+func (c *cfgType) addMetadataKeys(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("include-metadata requires at least one metadata label")
+	}
+	for _, v := range args {
+		if !metadata.IsLabel(v) {
+			return fmt.Errorf("include-metadata invalid label %q, must be of the form plugin/name", v)
+		} else if !slices.Contains(c.MetadataKeys, v) {
+			c.MetadataKeys = append(c.MetadataKeys, v)
+		}
+	}
+	return nil
+}
+
+// rcodeEncoders builds the encoders named on tag-on-rcode directives keyed by rcode, rcodes
+// sharing a tag share an encoder so the tag gets one sequence rather than one per rcode
+func (c cfgType) rcodeEncoders() (r map[int]encoder, err error) {
+	byTag := map[string]encoder{}
+	for tg, name := range c.TagEncoders {
+		if byTag[tg], err = getEncoder(name, nil); err != nil {
+			return
+		}
+		c.configureEncoder(byTag[tg])
+	}
+	for rcode, tg := range c.RcodeTags {
+		if enc, ok := byTag[tg]; ok {
+			if r == nil {
+				r = map[int]encoder{}
+			}
+			r[dns.StringToRcode[rcode]] = enc
+		}
+	}
+	return
+}
+
+// configureEncoder applies the global encoder settings, reporting whether the encoder took
+// the text delimiters and sequence numbers
+func (c cfgType) configureEncoder(enc encoder) (text, seq bool) {
+	eachEncoder(enc, func(e encoder) {
+		switch v := e.(type) {
+		case *textEncoder:
+			if c.TextPrefix != `` || c.TextSuffix != `` {
+				v.prefix, v.suffix, text = c.TextPrefix, c.TextSuffix, true
+			}
+		case *jsonEncoder:
+			if c.IncludeSequence {
+				//each encoding counts on its own, the count is per encoding and not per tag
+				v.seq, seq = new(atomic.Uint64), true
+			}
+		case *hecEncoder:
+			if c.IncludeSequence {
+				v.seq, seq = new(atomic.Uint64), true
+			}
+		}
+	})
+	return
+}
+
+// tags returns every tag the plugin may write to, the default tag is always first
+func (c cfgType) tags() (r []string) {
+	r = []string{c.Tag}
+	if c.AuditTag != `` {
+		r = append(r, c.AuditTag)
+	}
+	for _, tg := range c.RcodeTags {
+		if !slices.Contains(r, tg) {
+			r = append(r, tg)
+		}
+	}
+	for _, tg := range c.EncodingTags {
+		if !slices.Contains(r, tg) {
+			r = append(r, tg)
+		}
+	}
+	slices.Sort(r[1:])
+	return
+}
+
+// resolveRcodeTags maps the tag-on-rcode directives to muxer tags
+func resolveRcodeTags(im *ingest.IngestMuxer, rcodeTags map[string]string) (r map[int]entry.EntryTag, err error) {
+	for rcode, name := range rcodeTags {
+		var tg entry.EntryTag
+		if tg, err = im.GetTag(name); err != nil {
+			return nil, fmt.Errorf("failed to resolve tag-on-rcode tag %q - %w", name, err)
+		}
+		if r == nil {
+			r = map[int]entry.EntryTag{}
+		}
+		r[dns.StringToRcode[rcode]] = tg
+	}
+	return
+}
+
+func (c *cfgType) setTargetPriority(target string, priority int) {
+	if priority == 0 && c.TargetPriority == nil {
+		return
+	} else if c.TargetPriority == nil {
+		c.TargetPriority = map[string]int{}
+	}
+	c.TargetPriority[target] = priority
+}
+
+// redactQtypes builds the response-redact-qtype lookup, the qtypes were validated by parseConfig
+func (c cfgType) redactQtypes() *redactQtypes {
+	if len(c.ResponseRedactQtypes) == 0 {
+		return nil
+	}
+	rq, _, _ := parseRedactQtypes(c.ResponseRedactQtypes)
+	return rq
+}
+
+// answerDetail builds the answer-detail-by-type lookup, the specs were validated by parseConfig
+func (c cfgType) answerDetail() *answerDetail {
+	if len(c.AnswerDetail) == 0 {
+		return nil
+	}
+	ad, _, _ := parseAnswerDetail(c.AnswerDetail)
+	return ad
+}
+
+// sinkKey is the configuration running sinks are shared by, the filters are left out as each
+// instance applies its own, see applyFilters
+func (c cfgType) sinkKey() cfgType {
+	c.ClientPortMode, c.ClientPortFilter, c.LogWindow = ``, nil, nil
+	c.SampleRate, c.SampleKey = 0, ``
+	c.SkipCacheHits, c.LogErrors, c.FilterDebug = false, false, false
+	return c
+}
+
+// applyFilters sets the per instance filters on a handler, editing a filter keeps the sinks
+func (c cfgType) applyFilters(gh *gwHandler) (err error) {
+	if gh.ports, err = newPortFilter(c.ClientPortMode, c.ClientPortFilter); err != nil {
+		return
+	}
+	gh.window = nil
+	if len(c.LogWindow) > 0 {
+		gh.window, _ = parseLogWindow(c.LogWindow) //validated by parseConfig
+	}
+	gh.sample = nil
+	if c.SampleRate > 0 {
+		gh.sample = newSampler(c.SampleRate, c.SampleKey)
+	}
+	gh.skipCacheHits, gh.skipErrors, gh.filterDebug = c.SkipCacheHits, !c.LogErrors, c.FilterDebug
+	return
+}
+
+// answerBound is the tighter of max-answers-per-query and answer-head, both keep the leading
+// answers and count the rest
+func (c cfgType) answerBound() int {
+	if c.AnswerHead > 0 && (c.MaxAnswers == 0 || c.AnswerHead < c.MaxAnswers) {
+		return c.AnswerHead
+	}
+	return c.MaxAnswers
+}
+
+func (c cfgType) encodeOptions() encodeOptions {
+	return encodeOptions{
+		maxQuestions: c.MaxQuestions,
+		maxAnswers:   c.answerBound(),
+		maxTXTBytes:  c.MaxTXTBytes,
+		answerFormat: c.AnswerFormat,
+		tsFormat:     c.TimestampJSON,
+		logNegative:  c.LogNegative,
+		serverHost:   c.ServerHost,
+		rawFlags:     c.IncludeRawFlags,
+		qnameWire:    c.QnameWire,
+		regDomain:    c.RegisteredDomain,
+		tunnel: tunnelThresholds{
+			length:  c.TunnelQnameLength,
+			labels:  c.TunnelLabelCount,
+			entropy: c.TunnelEntropy,
+		},
+		redact:        c.RedactAnswers,
+		sortAnswers:   c.NormalizeAnswerOrder,
+		hashAnswers:   c.IncludeAnswerHash,
+		answerDetail:  c.answerDetail(),
+		redactQtypes:  c.redactQtypes(),
+		coalesce:      c.CoalesceAnswers,
+		stripDot:      c.StripFQDNDot,
+		ednsOptions:   c.IncludeEDNSOptions,
+		emptyQuestion: c.EmitEmptyQuestion,
+		sectionSizes:  c.IncludeSectionSizes,
+	}
 }
 
 // Callback functionto encode DNS Request/Response
 type encoder interface {
 	Encode(entry.Timestamp, net.Addr, net.Addr, *introspector) [][]byte
-	EncodeError(entry.Timestamp, net.Addr, net.Addr, *dns.Msg, error) [][]byte
+	EncodeError(entry.Timestamp, net.Addr, net.Addr, *introspector, error) [][]byte
 	Name() string
 }
 
 func parseConfig(c *caddy.Controller) (conf cfgType, enc encoder, err error) {
+	var encs []taggedEncoder
 	conf.IngestConfig = config.IngestConfig{
 		Log_Level:                `INFO`,
 		Ingester_Name:            `coredns`,
 		Insecure_Skip_TLS_Verify: false,
 	}
+	conf.LogErrors = true
+	conf.LifecycleMarkers = true
+	var httpRetriesSet bool
 	for c.Next() {
 		for c.NextBlock() {
 			var arg, val string
-			if arg, val, err = getArgLine(c); err != nil {
+			var block [][]string
+			//directives that take several arguments
+			switch strings.ToLower(c.Val()) {
+			case `tag-on-rcode`:
+				if err = conf.addRcodeTag(c.RemainingArgs()); err != nil {
+					return
+				}
+				continue
+			case `log-window`:
+				args := c.RemainingArgs()
+				if _, err = parseLogWindow(args); err != nil {
+					return
+				}
+				conf.LogWindow = args
+				continue
+			case `include-metadata`:
+				if err = conf.addMetadataKeys(c.RemainingArgs()); err != nil {
+					return
+				}
+				continue
+			case `answer-detail-by-type`:
+				//parsed with any earlier directive so a qtype repeated across lines is caught
+				args := c.RemainingArgs()
+				if len(args) == 0 {
+					err = fmt.Errorf("answer-detail-by-type requires at least one QTYPE:level pair")
+					return
+				} else if _, conf.AnswerDetail, err = parseAnswerDetail(append(conf.AnswerDetail, args...)); err != nil {
+					return
+				}
+				continue
+			case `response-redact-qtype`:
+				//parsed with any earlier directive so a qtype repeated across lines is caught
+				args := c.RemainingArgs()
+				if len(args) == 0 {
+					err = fmt.Errorf("response-redact-qtype requires at least one qtype")
+					return
+				} else if _, conf.ResponseRedactQtypes, err = parseRedactQtypes(append(conf.ResponseRedactQtypes, args...)); err != nil {
+					return
+				}
+				continue
+			case `http-sink-header`:
+				var hdr string
+				if hdr, err = parseHTTPSinkHeader(c.RemainingArgs()); err != nil {
+					return
+				}
+				conf.HTTPSinkHeaders = append(conf.HTTPSinkHeaders, hdr)
+				continue
+			}
+			if arg, val, block, err = getDirective(c); err != nil {
+				return
+			} else if block != nil && arg != `encoding` {
+				err = fmt.Errorf("%s does not take a block", arg)
 				return
 			}
 			switch arg {
@@ -80,29 +725,86 @@ func parseConfig(c *caddy.Controller) (conf cfgType, enc encoder, err error) {
 			case `max-cache-size-mb`:
 				var v int
 				if v, err = strconv.Atoi(val); err != nil || v < 0 {
-					err = fmt.Errorf("Invalid max cache size: %v", err)
+					err = fmt.Errorf("Invalid max cache size %q", val)
+					return
 				}
 				conf.Max_Ingest_Cache = v * 1024 * 1024
+			case `cache-depth`:
+				if conf.Cache_Depth, err = strconv.Atoi(val); err != nil || conf.Cache_Depth < 0 {
+					err = fmt.Errorf("Invalid cache depth %q", val)
+					return
+				}
 			case `ingest-secret`:
 				conf.Ingest_Secret = val
 			case `ingester-uuid`:
 				var guid uuid.UUID
-				if guid, err = uuid.Parse(val); err != nil {
+				if strings.EqualFold(val, ingesterUUIDAuto) {
+					//generated when the muxers start so an unchanged reload keeps it
+					conf.Ingester_UUID = ingesterUUIDAuto
+					break
+				} else if guid, err = uuid.Parse(val); err != nil {
 					err = fmt.Errorf("invalid ingester-uuid %q - %v", val, err)
 					return
 				}
 				conf.Ingester_UUID = guid.String()
+			case `ingester-uuid-file`:
+				conf.IngesterUUIDFile = filepath.Clean(val)
 			case `cleartext-target`:
-				if _, _, err = net.SplitHostPort(val); err != nil {
+				var tgt string
+				var prio int
+				if tgt, prio, err = parseTarget(val); err != nil {
 					return
-				} else {
-					conf.Cleartext_Backend_Target = append(conf.Cleartext_Backend_Target, val)
 				}
+				conf.Cleartext_Backend_Target = append(conf.Cleartext_Backend_Target, tgt)
+				conf.setTargetPriority(tgt, prio)
 			case `ciphertext-target`:
+				var tgt string
+				var prio int
+				if tgt, prio, err = parseTarget(val); err != nil {
+					return
+				}
+				conf.Encrypted_Backend_Target = append(conf.Encrypted_Backend_Target, tgt)
+				conf.setTargetPriority(tgt, prio)
+			case `kafka-broker`:
 				if _, _, err = net.SplitHostPort(val); err != nil {
 					return
-				} else {
-					conf.Encrypted_Backend_Target = append(conf.Encrypted_Backend_Target, val)
+				}
+				conf.KafkaBrokers = append(conf.KafkaBrokers, val)
+			case `kafka-topic`:
+				conf.KafkaTopic = val
+			case `syslog-remote`:
+				if _, _, err = parseSyslogRemote(val); err != nil {
+					return
+				}
+				conf.SyslogRemote = val
+			case `max-concurrent-writes`:
+				if conf.MaxConcurrentWrites, err = strconv.Atoi(val); err != nil || conf.MaxConcurrentWrites < 1 {
+					err = fmt.Errorf("Invalid max-concurrent-writes %q, must be a positive integer", val)
+					return
+				}
+			case `min-connections`:
+				if conf.MinConnections, err = strconv.Atoi(val); err != nil || conf.MinConnections < 1 {
+					err = fmt.Errorf("Invalid min-connections %q, must be a positive integer", val)
+					return
+				}
+			case `unix-sink`:
+				if conf.UnixSink, err = parseUnixSink(val); err != nil {
+					return
+				}
+			case `http-sink`:
+				if conf.HTTPSink, err = parseHTTPSink(val); err != nil {
+					return
+				}
+			case `http-sink-retries`:
+				if conf.HTTPSinkRetries, err = strconv.Atoi(val); err != nil || conf.HTTPSinkRetries < 0 {
+					err = fmt.Errorf("Invalid http-sink-retries %q, must be a non-negative integer", val)
+					return
+				}
+				httpRetriesSet = true
+			case `stdout-sink`:
+				if conf.StdoutSink, err = strconv.ParseBool(val); err != nil {
+					err = fmt.Errorf("Unknown gravwell stdout-sink argument %s - %v", val, err)
+					return
 				}
 			case `insecure-novalidate-tls`:
 				if conf.Insecure_Skip_TLS_Verify, err = strconv.ParseBool(val); err != nil {
@@ -115,10 +817,35 @@ func parseConfig(c *caddy.Controller) (conf cfgType, enc encoder, err error) {
 					return
 				}
 				conf.Tag = val
+			case `default-tag`:
+				if err = ingest.CheckTag(val); err != nil {
+					err = fmt.Errorf("invalid default-tag %q - %v", val, err)
+					return
+				}
+				conf.DefaultTag = val
+			case `audit-tag`:
+				if err = ingest.CheckTag(val); err != nil {
+					err = fmt.Errorf("invalid audit-tag %q - %v", val, err)
+					return
+				}
+				conf.AuditTag = val
 			case `encoding`:
-				if enc, err = getEncoder(val); err != nil {
+				var te taggedEncoder
+				if block, te.tag, err = encodingTag(block); err != nil {
+					return
+				} else if te.encoder, err = getEncoder(val, block); err != nil {
 					return
 				}
+				for _, v := range encs {
+					if v.encoder.Name() == te.encoder.Name() && v.tag == te.tag {
+						err = fmt.Errorf("Duplicate %s encoding, repeated encodings need distinct tags", val)
+						return
+					}
+				}
+				encs = append(encs, te)
+				if te.tag != `` && !slices.Contains(conf.EncodingTags, te.tag) {
+					conf.EncodingTags = append(conf.EncodingTags, te.tag)
+				}
 			case `label`:
 				conf.Label = val
 			case `enable-compression`:
@@ -126,232 +853,1891 @@ func parseConfig(c *caddy.Controller) (conf cfgType, enc encoder, err error) {
 					err = fmt.Errorf("Unknown gravwell enable-compression argument %s - %v", val, err)
 					return
 				}
-			case `write-timeout`:
-				if conf.WriteTimeout, err = time.ParseDuration(val); err != nil {
-					err = fmt.Errorf("Invalid write-timeout %s %w", val, err)
+			case `on-disconnect-cache`:
+				if conf.OnDisconnectCache, err = strconv.ParseBool(val); err != nil {
+					err = fmt.Errorf("Unknown gravwell on-disconnect-cache argument %s - %v", val, err)
 					return
 				}
-			default:
-				err = fmt.Errorf("Unknown gravwell configuration directive %s", arg)
-				return
-			}
-		}
-	}
-	if (conf.Cache_Depth > 0 || conf.Max_Ingest_Cache > 0) && conf.Ingest_Cache_Path == "" {
-		err = fmt.Errorf("Max-Cache-Size-MB may not be set without an active cache location")
-	}
-	if conf.Tag == `` {
-		conf.Tag = defaultTag
-	}
-	if len(conf.Cleartext_Backend_Target) == 0 && len(conf.Encrypted_Backend_Target) == 0 {
-		err = fmt.Errorf("Invalid targets, at least one must be specified")
-	}
-	if len(conf.Ingest_Secret) == 0 {
-		err = fmt.Errorf("Invalid Ingest-Auth.  An auth token is required")
-	}
-	if enc == nil {
-		//default to the JSON encoder
-		enc = &jsonEncoder{}
-	}
-	conf.Encoder = enc.Name()
-	return
-}
-
-// setup the plugin
-func setup(c *caddy.Controller) error {
-	cfg, enc, err := parseConfig(c)
-	if err != nil {
-		return err
-	}
-	conns, err := cfg.Targets()
-	if err != nil {
-		return err
-	}
-
-	icfg := ingest.UniformMuxerConfig{
-		IngestStreamConfig: cfg.IngestStreamConfig,
-		Destinations:       conns,
-		Tags:               []string{cfg.Tag},
-		Auth:               cfg.Secret(),
-		VerifyCert:         !cfg.InsecureSkipTLSVerification(),
-		IngesterName:       `coredns`,
-		IngesterVersion:    version.GetVersion(),
-		IngesterUUID:       cfg.Ingester_UUID,
-		IngesterLabel:      cfg.Label,
-		CacheDepth:         cfg.Cache_Depth,
-		CachePath:          cfg.Ingest_Cache_Path,
-		CacheSize:          cfg.Max_Ingest_Cache,
-		CacheMode:          cfg.Cache_Mode,
-	}
-	im, err := ingest.NewUniformMuxer(icfg)
-	if err != nil {
-		return err
-	}
-	if err = im.Start(); err != nil {
-		return err
-	}
-	if err = im.WaitForHot(time.Second); err != nil {
-		return err
-	}
-	tg, err := im.GetTag(cfg.Tag)
-	if err != nil {
-		return err
-	}
-	if err = im.SetRawConfiguration(cfg); err != nil {
-		return err
+			case `cache-max-age`:
+				if conf.CacheMaxAge, err = time.ParseDuration(val); err != nil {
+					err = fmt.Errorf("Invalid cache-max-age %s %w", val, err)
+					return
+				} else if conf.CacheMaxAge <= 0 {
+					err = fmt.Errorf("Invalid cache-max-age %s, must be positive", val)
+					return
+				}
+			case `max-questions`:
+				if conf.MaxQuestions, err = strconv.Atoi(val); err != nil || conf.MaxQuestions <= 0 {
+					err = fmt.Errorf("Invalid max-questions %q, must be a positive integer", val)
+					return
+				}
+			case `log-errors`:
+				if conf.LogErrors, err = strconv.ParseBool(val); err != nil {
+					err = fmt.Errorf("Unknown gravwell log-errors argument %s - %v", val, err)
+					return
+				}
+			case `skip-cache-hits`:
+				if conf.SkipCacheHits, err = strconv.ParseBool(val); err != nil {
+					err = fmt.Errorf("Unknown gravwell skip-cache-hits argument %s - %v", val, err)
+					return
+				}
+			case `heartbeat-interval`:
+				if conf.HeartbeatInterval, err = time.ParseDuration(val); err != nil || conf.HeartbeatInterval < time.Second {
+					err = fmt.Errorf("Invalid heartbeat-interval %q, must be a duration of at least 1s", val)
+					return
+				}
+			case `lifecycle-markers`:
+				if conf.LifecycleMarkers, err = strconv.ParseBool(val); err != nil {
+					err = fmt.Errorf("Unknown gravwell lifecycle-markers argument %s - %v", val, err)
+					return
+				}
+			case `error-log-interval`:
+				if conf.ErrorLogInterval, err = time.ParseDuration(val); err != nil || conf.ErrorLogInterval < time.Second {
+					err = fmt.Errorf("Invalid error-log-interval %q, must be a duration of at least 1s", val)
+					return
+				}
+			case `ntp-check-server`:
+				if conf.NTPCheckServer, err = parseNTPServer(val); err != nil {
+					return
+				}
+			case `country-cidr-map`:
+				//loaded again when the sinks start, this catches a bad file before then
+				if _, err = loadCountryMap(val); err != nil {
+					return
+				}
+				conf.CountryCIDRMap = val
+			case `bad-domain-list`:
+				//loaded again when the sinks start, this catches a bad file before then
+				if _, err = loadBadDomains(val); err != nil {
+					return
+				}
+				conf.BadDomainList = val
+			case `ntp-check-interval`:
+				if conf.NTPCheckInterval, err = time.ParseDuration(val); err != nil || conf.NTPCheckInterval < time.Second {
+					err = fmt.Errorf("Invalid ntp-check-interval %q, must be a duration of at least 1s", val)
+					return
+				}
+			case `shadow-mode`:
+				if conf.ShadowMode, err = strconv.ParseBool(val); err != nil {
+					err = fmt.Errorf("Unknown gravwell shadow-mode argument %s - %v", val, err)
+					return
+				}
+			case `stats-interval`:
+				if conf.StatsInterval, err = time.ParseDuration(val); err != nil || conf.StatsInterval < time.Second {
+					err = fmt.Errorf("Invalid stats-interval %q, must be a duration of at least 1s", val)
+					return
+				}
+			case `max-answers-per-query`:
+				if conf.MaxAnswers, err = strconv.Atoi(val); err != nil || conf.MaxAnswers <= 0 {
+					err = fmt.Errorf("Invalid max-answers-per-query %q, must be a positive integer", val)
+					return
+				}
+			case `answer-head`:
+				if conf.AnswerHead, err = strconv.Atoi(val); err != nil || conf.AnswerHead <= 0 {
+					err = fmt.Errorf("Invalid answer-head %q, must be a positive integer", val)
+					return
+				}
+			case `max-txt-bytes`:
+				if conf.MaxTXTBytes, err = strconv.Atoi(val); err != nil || conf.MaxTXTBytes <= 0 {
+					err = fmt.Errorf("Invalid max-txt-bytes %q, must be a positive integer", val)
+					return
+				}
+			case `answer-format`:
+				switch v := strings.ToLower(val); v {
+				case answerFormatFull, answerFormatRdata:
+					conf.AnswerFormat = v
+				default:
+					err = fmt.Errorf("Invalid answer-format %q, must be %s or %s", val, answerFormatFull, answerFormatRdata)
+					return
+				}
+			case `timestamp-json`:
+				switch v := strings.ToLower(val); v {
+				case timestampUnixMilli, timestampRFC3339, timestampNanoseconds:
+					conf.TimestampJSON = v
+				default:
+					err = fmt.Errorf("Invalid timestamp-json %q, must be %s, %s, or %s", val, timestampUnixMilli, timestampRFC3339, timestampNanoseconds)
+					return
+				}
+			case `log-negative`:
+				if conf.LogNegative, err = strconv.ParseBool(val); err != nil {
+					err = fmt.Errorf("Unknown gravwell log-negative argument %s - %v", val, err)
+					return
+				}
+			case `server-host`:
+				conf.ServerHost = val
+			case `mask-client-ip`:
+				if conf.MaskClientIPv4, err = parseMaskBits(arg, val, 32); err != nil {
+					return
+				}
+			case `mask-client-ip6`:
+				if conf.MaskClientIPv6, err = parseMaskBits(arg, val, 128); err != nil {
+					return
+				}
+			case `include-answer-hash`:
+				if conf.IncludeAnswerHash, err = strconv.ParseBool(val); err != nil {
+					err = fmt.Errorf("Unknown gravwell include-answer-hash argument %s - %v", val, err)
+					return
+				}
+			case `normalize-answer-order`:
+				if conf.NormalizeAnswerOrder, err = strconv.ParseBool(val); err != nil {
+					err = fmt.Errorf("Unknown gravwell normalize-answer-order argument %s - %v", val, err)
+					return
+				}
+			case `strip-fqdn-dot`:
+				if conf.StripFQDNDot, err = strconv.ParseBool(val); err != nil {
+					err = fmt.Errorf("Unknown gravwell strip-fqdn-dot argument %s - %v", val, err)
+					return
+				}
+			case `include-edns-options`:
+				if conf.IncludeEDNSOptions, err = strconv.ParseBool(val); err != nil {
+					err = fmt.Errorf("Unknown gravwell include-edns-options argument %s - %v", val, err)
+					return
+				}
+			case `include-section-sizes`:
+				if conf.IncludeSectionSizes, err = strconv.ParseBool(val); err != nil {
+					err = fmt.Errorf("Unknown gravwell include-section-sizes argument %s - %v", val, err)
+					return
+				}
+			case `emit-empty-question`:
+				if conf.EmitEmptyQuestion, err = strconv.ParseBool(val); err != nil {
+					err = fmt.Errorf("Unknown gravwell emit-empty-question argument %s - %v", val, err)
+					return
+				}
+			case `log-timing`:
+				if conf.LogTiming, err = parseLogTiming(val); err != nil {
+					return
+				}
+			case `filter-debug`:
+				if conf.FilterDebug, err = strconv.ParseBool(val); err != nil {
+					err = fmt.Errorf("Unknown gravwell filter-debug argument %s - %v", val, err)
+					return
+				}
+			case `coalesce-answers`:
+				if conf.CoalesceAnswers, err = strconv.ParseBool(val); err != nil {
+					err = fmt.Errorf("Unknown gravwell coalesce-answers argument %s - %v", val, err)
+					return
+				}
+			case `include-next-plugin`:
+				if conf.IncludeNextPlugin, err = strconv.ParseBool(val); err != nil {
+					err = fmt.Errorf("Unknown gravwell include-next-plugin argument %s - %v", val, err)
+					return
+				}
+			case `include-server-block`:
+				if conf.IncludeServerBlock, err = strconv.ParseBool(val); err != nil {
+					err = fmt.Errorf("Unknown gravwell include-server-block argument %s - %v", val, err)
+					return
+				}
+			case `slow-outlier-percentile`:
+				if conf.SlowOutlierPercentile, err = parsePercentile(val); err != nil {
+					return
+				}
+			case `sample-rate`:
+				if conf.SampleRate, err = strconv.ParseFloat(val, 64); err != nil || !(conf.SampleRate > 0 && conf.SampleRate <= 1) {
+					err = fmt.Errorf("Invalid sample-rate %q, must be greater than 0 and at most 1", val)
+					return
+				}
+			case `sample-key`:
+				if conf.SampleKey, err = parseSampleKey(val); err != nil {
+					return
+				}
+			case `client-qps-halflife`:
+				if conf.ClientQPSHalflife, err = time.ParseDuration(val); err != nil || conf.ClientQPSHalflife < time.Second {
+					err = fmt.Errorf("Invalid client-qps-halflife %q, must be a duration of at least 1s", val)
+					return
+				}
+			case `nxdomain-threshold`:
+				if conf.NXDomainThreshold, err = strconv.Atoi(val); err != nil || conf.NXDomainThreshold < 1 {
+					err = fmt.Errorf("Invalid nxdomain-threshold %q, must be a positive integer", val)
+					return
+				}
+			case `nxdomain-window`:
+				if conf.NXDomainWindow, err = time.ParseDuration(val); err != nil || conf.NXDomainWindow < time.Second {
+					err = fmt.Errorf("Invalid nxdomain-window %q, must be a duration of at least 1s", val)
+					return
+				}
+			case `include-sequence`:
+				if conf.IncludeSequence, err = strconv.ParseBool(val); err != nil {
+					err = fmt.Errorf("Unknown gravwell include-sequence argument %s - %v", val, err)
+					return
+				}
+			case `ingest-queue-depth`:
+				if conf.QueueDepth, err = strconv.Atoi(val); err != nil || conf.QueueDepth < 0 {
+					err = fmt.Errorf("Invalid ingest-queue-depth %q, must be a non-negative integer", val)
+					return
+				}
+			case `queue-warn-percent`:
+				if conf.QueueWarnPercent, err = strconv.Atoi(val); err != nil || conf.QueueWarnPercent < 1 || conf.QueueWarnPercent > 100 {
+					err = fmt.Errorf("Invalid queue-warn-percent %q, must be between 1 and 100", val)
+					return
+				}
+			case `filter-client-port`:
+				if _, err = parsePortRange(val); err != nil {
+					return
+				}
+				conf.ClientPortFilter = append(conf.ClientPortFilter, val)
+			case `filter-client-port-mode`:
+				switch v := strings.ToLower(val); v {
+				case filterModeAllow, filterModeDeny:
+					conf.ClientPortMode = v
+				default:
+					err = fmt.Errorf("Invalid filter-client-port-mode %q, must be %s or %s", val, filterModeAllow, filterModeDeny)
+					return
+				}
+			case `tunnel-qname-length`:
+				if conf.TunnelQnameLength, err = strconv.Atoi(val); err != nil || conf.TunnelQnameLength <= 0 {
+					err = fmt.Errorf("Invalid tunnel-qname-length %q, must be a positive integer", val)
+					return
+				}
+			case `tunnel-label-count`:
+				if conf.TunnelLabelCount, err = strconv.Atoi(val); err != nil || conf.TunnelLabelCount <= 0 {
+					err = fmt.Errorf("Invalid tunnel-label-count %q, must be a positive integer", val)
+					return
+				}
+			case `tunnel-entropy`:
+				if conf.TunnelEntropy, err = strconv.ParseFloat(val, 64); err != nil || conf.TunnelEntropy <= 0 || conf.TunnelEntropy > 8 {
+					err = fmt.Errorf("Invalid tunnel-entropy %q, must be between 0 and 8 bits per character", val)
+					return
+				}
+			case `registered-domain`:
+				if conf.RegisteredDomain, err = strconv.ParseBool(val); err != nil {
+					err = fmt.Errorf("Unknown gravwell registered-domain argument %s - %v", val, err)
+					return
+				}
+			case `qname-wire`:
+				if conf.QnameWire, err = strconv.ParseBool(val); err != nil {
+					err = fmt.Errorf("Unknown gravwell qname-wire argument %s - %v", val, err)
+					return
+				}
+			case `include-raw-flags`:
+				if conf.IncludeRawFlags, err = strconv.ParseBool(val); err != nil {
+					err = fmt.Errorf("Unknown gravwell include-raw-flags argument %s - %v", val, err)
+					return
+				}
+			case `redact-answers`:
+				if conf.RedactAnswers, err = strconv.ParseBool(val); err != nil {
+					err = fmt.Errorf("Unknown gravwell redact-answers argument %s - %v", val, err)
+					return
+				}
+			case `text-prefix`:
+				if conf.TextPrefix, err = unescapeTextDelim(arg, val); err != nil {
+					return
+				}
+			case `text-suffix`:
+				if conf.TextSuffix, err = unescapeTextDelim(arg, val); err != nil {
+					return
+				}
+			case `ingest-deadline`:
+				if conf.IngestDeadline, err = time.ParseDuration(val); err != nil || conf.IngestDeadline <= 0 {
+					err = fmt.Errorf("Invalid ingest-deadline %q, must be a positive duration", val)
+					return
+				}
+			case `write-timeout`:
+				if conf.WriteTimeout, err = time.ParseDuration(val); err != nil {
+					err = fmt.Errorf("Invalid write-timeout %s %w", val, err)
+					return
+				}
+			case `tcp-keepalive`, `conn-idle-timeout`:
+				//the ingest muxer owns its dialer and always enables keepalives on indexer connections
+				err = fmt.Errorf("%s is not supported, the ingest muxer manages indexer connection keepalives internally", arg)
+				return
+			case `tls-server-name`:
+				//the muxer builds its own tls.Config, the server name is always the target host
+				err = fmt.Errorf("%s is not supported, the ingest muxer sends the Ciphertext-Target host as the TLS server name", arg)
+				return
+			default:
+				err = fmt.Errorf("Unknown gravwell configuration directive %s", arg)
+				return
+			}
+		}
+	}
+	if conf.Ingest_Cache_Path == "" {
+		for _, v := range []struct {
+			name string
+			set  bool
+		}{
+			{`Max-Cache-Size-MB`, conf.Max_Ingest_Cache > 0},
+			{`Cache-Depth`, conf.Cache_Depth > 0},
+			{`On-Disconnect-Cache`, conf.OnDisconnectCache},
+			{`Cache-Max-Age`, conf.CacheMaxAge > 0},
+		} {
+			if v.set {
+				err = fmt.Errorf("%s may not be set without an Ingest-Cache-Path", v.name)
+				return
+			}
+		}
+	} else if conf.OnDisconnectCache {
+		//only engage the cache when all indexer connections are down
+		conf.Cache_Mode = ingest.CacheModeFail
+	}
+	if conf.IngesterUUIDFile != `` && conf.Ingester_UUID != `` {
+		//the file is read, or created, when the muxer starts so parsing never touches the disk
+		err = fmt.Errorf("Ingester-UUID and Ingester-UUID-File are mutually exclusive")
+		return
+	}
+	if conf.Tag == `` {
+		if conf.Tag = conf.DefaultTag; conf.Tag == `` {
+			conf.Tag = defaultTag
+		}
+	}
+	if conf.AuditTag != `` {
+		//the audit feed must stay separate from the filtered feeds
+		used := conf.AuditTag == conf.Tag || slices.Contains(conf.EncodingTags, conf.AuditTag)
+		for _, tg := range conf.RcodeTags {
+			used = used || tg == conf.AuditTag
+		}
+		if used {
+			err = fmt.Errorf("Audit-Tag %q may not also be used by Tag, Tag-On-Rcode, or an Encoding", conf.AuditTag)
+		}
+	}
+	if conf.MaxQuestions == 0 {
+		conf.MaxQuestions = defaultMaxQuestions
+	}
+	if conf.ClientPortMode != `` && len(conf.ClientPortFilter) == 0 {
+		err = fmt.Errorf("Filter-Client-Port-Mode may not be set without any Filter-Client-Port directives")
+	} else if conf.ClientPortMode == `` && len(conf.ClientPortFilter) > 0 {
+		conf.ClientPortMode = filterModeDeny
+	}
+	if conf.IngestDeadline > 0 && conf.QueueDepth > 0 {
+		err = fmt.Errorf("Ingest-Deadline may not be combined with Ingest-Queue-Depth, queued writes never block the DNS path")
+	}
+	if conf.QueueWarnPercent > 0 && conf.QueueDepth == 0 {
+		err = fmt.Errorf("Queue-Warn-Percent may not be set without an Ingest-Queue-Depth")
+	} else if conf.QueueWarnPercent == 0 {
+		conf.QueueWarnPercent = defaultQueueWarnPercent
+	}
+	if conf.LogTiming == logTimingPre && conf.SkipCacheHits {
+		err = fmt.Errorf("Skip-Cache-Hits requires responses and may not be used with Log-Timing pre")
+	}
+	if conf.NTPCheckInterval > 0 && conf.NTPCheckServer == `` {
+		err = fmt.Errorf("NTP-Check-Interval may not be set without an NTP-Check-Server")
+	} else if conf.NTPCheckServer != `` && conf.NTPCheckInterval == 0 {
+		conf.NTPCheckInterval = defaultNTPInterval
+	}
+	if conf.SampleKey != `` && conf.SampleRate == 0 {
+		err = fmt.Errorf("Sample-Key may not be set without a Sample-Rate")
+	} else if conf.SampleRate > 0 && conf.SampleKey == `` {
+		conf.SampleKey = sampleKeyQuery
+	}
+	if conf.NXDomainWindow > 0 && conf.NXDomainThreshold == 0 {
+		err = fmt.Errorf("NXDomain-Window may not be set without an NXDomain-Threshold")
+	} else if conf.NXDomainThreshold > 0 && conf.NXDomainWindow == 0 {
+		conf.NXDomainWindow = defaultNXWindow
+	}
+	if conf.ErrorLogInterval == 0 {
+		conf.ErrorLogInterval = defaultErrorLogInterval
+	}
+	if conf.StatsInterval == 0 {
+		conf.StatsInterval = connWatchInterval
+	}
+	if (len(conf.KafkaBrokers) > 0) != (conf.KafkaTopic != ``) {
+		err = fmt.Errorf("Kafka-Broker and Kafka-Topic must be set together")
+	}
+	if conf.HTTPSink == `` {
+		if len(conf.HTTPSinkHeaders) > 0 || httpRetriesSet {
+			err = fmt.Errorf("HTTP-Sink-Header and HTTP-Sink-Retries require an HTTP-Sink")
+		}
+	} else if !httpRetriesSet {
+		conf.HTTPSinkRetries = defaultHTTPSinkRetries
+	}
+	if conf.ShadowMode {
+		//nothing is ever sent, so targets and the secret are optional
+	} else if !conf.gravwellTargets() {
+		if len(conf.KafkaBrokers) == 0 && conf.SyslogRemote == `` && conf.UnixSink == `` && !conf.StdoutSink && conf.HTTPSink == `` {
+			err = fmt.Errorf("Invalid targets, at least one must be specified")
+		} else if len(conf.RcodeTags) > 0 {
+			err = fmt.Errorf("Tag-On-Rcode requires a Gravwell target")
+		} else if conf.AuditTag != `` {
+			err = fmt.Errorf("Audit-Tag requires a Gravwell target")
+		} else if conf.MinConnections > 0 {
+			err = fmt.Errorf("Min-Connections requires a Gravwell target")
+		}
+	} else if len(conf.Ingest_Secret) == 0 {
+		err = fmt.Errorf("Invalid Ingest-Auth.  An auth token is required")
+	} else if n := len(conf.Cleartext_Backend_Target) + len(conf.Encrypted_Backend_Target); conf.MinConnections > n {
+		err = fmt.Errorf("Min-Connections %d exceeds the %d configured targets", conf.MinConnections, n)
+	}
+	switch {
+	case len(encs) == 0:
+		//default to the JSON encoder
+		enc = &jsonEncoder{}
+	case len(encs) == 1 && encs[0].tag == ``:
+		enc = encs[0].encoder
+	default:
+		enc = encoderSet(encs)
+	}
+	text, seq := conf.configureEncoder(enc)
+	for _, name := range conf.TagEncoders {
+		//tag-on-rcode encodings count toward the checks, setup builds the real ones
+		te, _ := getEncoder(name, nil)
+		t, s := conf.configureEncoder(te)
+		text, seq = text || t, seq || s
+	}
+	if (conf.TextPrefix != `` || conf.TextSuffix != ``) && !text {
+		err = fmt.Errorf("Text-Prefix and Text-Suffix require the text encoding")
+	}
+	if conf.IncludeSequence && !seq {
+		err = fmt.Errorf("Include-Sequence requires a json, json-per-answer, or hec encoding")
+	}
+	conf.Encoder = enc.Name()
+	return
+}
+
+// unescapeTextDelim rejects values containing the text encoder delimiter unless it is escaped with a backslash
+func unescapeTextDelim(name, v string) (string, error) {
+	for i := 0; i < len(v); i++ {
+		if v[i] == textDelim[0] && (i == 0 || v[i-1] != '\\') {
+			return ``, fmt.Errorf("%s may not contain an unescaped delimiter %q", name, textDelim)
+		}
+	}
+	return strings.ReplaceAll(v, `\`+textDelim, textDelim), nil
+}
+
+// setup the plugin
+func setup(c *caddy.Controller) error {
+	start, err := setupInstance(c)
+	if err != nil {
+		return err
+	}
+	//sinks start with the servers rather than while the Corefile is set up, so a reload that
+	//fails on a later block or plugin never takes a reference to them
+	c.OnStartup(start)
+	//runs on this instance when a reload away from it fails after the new instance started sinks
+	c.OnRestartFailed(releasePending)
+	return nil
+}
+
+// setupInstance parses a gravwell block and adds its handler to the chain, the returned start
+// acquires the sinks and completes the handler
+func setupInstance(c *caddy.Controller) (start func() error, err error) {
+	cfg, enc, err := parseConfig(c)
+	if err != nil {
+		return nil, err
+	}
+	lg := newPluginLogger(cfg.Log_Level)
+	lg.Infof("starting with %v", cfg)
+	rcodeEncs, err := cfg.rcodeEncoders()
+	if err != nil {
+		return nil, err
+	}
+	var serverBlock string
+	if cfg.IncludeServerBlock {
+		//sinks may be shared by identical blocks, the block name belongs to this instance
+		serverBlock = serverBlockName(c.ServerBlockKeys)
+	}
+
+	var filters gwHandler
+	if err = cfg.applyFilters(&filters); err != nil {
+		return nil, err
+	}
+
+	h := &gwHandler{}
+	start = func() error {
+		as, err := acquireSinks(cfg, lg)
+		if err != nil {
+			return err
+		}
+		if es, ok := enc.(encoderSet); ok && as.primary != nil {
+			if err = es.resolveTags(as.primary); err != nil {
+				return err //released with the rest of the failed startup
+			}
+		}
+		c.OnShutdown(as.release)
+		gh := as.gh
+		//the chain is built before the servers start, keep what mid filled in
+		gh.Next, gh.nextPlugin = h.Next, h.nextPlugin
+		gh.enc, gh.rcodeEncs, gh.serverBlock = enc, rcodeEncs, serverBlock
+		gh.ports, gh.window, gh.sample = filters.ports, filters.window, filters.sample
+		gh.skipCacheHits, gh.skipErrors, gh.filterDebug = filters.skipCacheHits, filters.skipErrors, filters.filterDebug
+		*h = gh
+		return nil
+	}
+
+	dcfg := dnsserver.GetConfig(c)
+	mid := func(next plugin.Handler) plugin.Handler {
+		h.Next = next
+		//what runs after gravwell decides which metadata, cache status for one, is available
+		lg.Infof("server block %s: %s", serverBlockName(c.ServerBlockKeys), chainPosition(next))
+		if cfg.IncludeNextPlugin {
+			h.nextPlugin = nextPluginName(next)
+		}
+		return h
+	}
+	dcfg.AddPlugin(mid)
+	return start, nil
+}
+
+const serverBlockDelim string = `,`
+
+// nextPluginName is the Name of the plugin after gravwell, empty when gravwell is last
+func nextPluginName(next plugin.Handler) string {
+	if next == nil {
+		return ``
+	}
+	return next.Name()
+}
+
+// chainPosition describes where gravwell runs, the compiled directive order decides the order
+// plugins run in regardless of their order in the Corefile
+func chainPosition(next plugin.Handler) string {
+	pos := `is not in the compiled directive order`
+	if i := slices.Index(dnsserver.Directives, coreDNSPackageName); i >= 0 {
+		pos = fmt.Sprintf("is directive %d of %d", i+1, len(dnsserver.Directives))
+	}
+	return fmt.Sprintf("gravwell %s, the next plugin is %s", pos, cmp.Or(nextPluginName(next), `none`))
+}
+
+// serverBlockName joins every key of a server block, e.g. example.com:53,example.org:53
+func serverBlockName(keys []string) string {
+	return strings.Join(keys, serverBlockDelim)
+}
+
+// newMuxer builds and starts an ingest muxer for a set of destinations
+func newMuxer(cfg cfgType, conns []string, cache bool, lg *pluginLogger) (im *ingest.IngestMuxer, err error) {
+	icfg := ingest.UniformMuxerConfig{
+		IngestStreamConfig: cfg.IngestStreamConfig,
+		Destinations:       conns,
+		Tags:               cfg.tags(),
+		Auth:               cfg.Secret(),
+		VerifyCert:         !cfg.InsecureSkipTLSVerification(),
+		IngesterName:       `coredns`,
+		IngesterVersion:    version.GetVersion(),
+		IngesterUUID:       cfg.Ingester_UUID,
+		IngesterLabel:      cfg.Label,
+		Logger:             lg,
+	}
+	if cache {
+		icfg.CacheDepth = cfg.Cache_Depth
+		icfg.CachePath = cfg.Ingest_Cache_Path
+		icfg.CacheSize = cfg.Max_Ingest_Cache
+		icfg.CacheMode = cfg.Cache_Mode
+	}
+	if im, err = ingest.NewUniformMuxer(icfg); err != nil {
+		return
+	} else if err = im.Start(); err != nil {
+		im.Close()
+		return nil, err
+	} else if err = im.SetRawConfiguration(cfg); err != nil {
+		im.Close()
+		return nil, err
+	}
+	return
+}
+
+// startMuxers brings up a muxer per target priority, returning the writer for the handler and
+// the primary muxer that tags are resolved against
+func startMuxers(cfg cfgType, lg *pluginLogger) (im entryWriter, primary *ingest.IngestMuxer, err error) {
+	var tiers [][]string
+	if tiers, err = cfg.targetTiers(); err != nil {
+		return
+	}
+	var tm tieredMuxer
+	defer func() {
+		//nothing is handed back on failure, so close every muxer started so far
+		if err != nil {
+			tm.Close()
+			im, primary = nil, nil
+		}
+	}()
+	if len(tiers) == 1 {
+		if primary, err = newMuxer(cfg, tiers[0], true, lg); err != nil {
+			return
+		}
+		tm.tiers = append(tm.tiers, primary)
+		if err = waitForHot(primary, cfg.MinConnections, hotWaitTimeout); err != nil {
+			return
+		}
+		im = primary
+		return
+	}
+	for i, conns := range tiers {
+		//only the primary tier caches, otherwise the muxers would share a cache path
+		var mux *ingest.IngestMuxer
+		if mux, err = newMuxer(cfg, conns, i == 0, lg); err != nil {
+			return
+		}
+		tm.tiers = append(tm.tiers, mux)
+	}
+	for i, mux := range tm.tiers {
+		//a tier with fewer targets than min-connections needs all of them
+		if err = waitForHot(mux, min(cfg.MinConnections, len(tiers[i])), hotWaitTimeout); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return
+	}
+	im, primary = tm, tm.tiers[0]
+	return
+}
+
+type gwHandler struct {
+	Next          plugin.Handler
+	im            entryWriter
+	tag           entry.EntryTag
+	rcodeTags     map[int]entry.EntryTag // tag-on-rcode overrides, nil when unused
+	audit         bool                   // copy every request to auditTag, ahead of the filters
+	auditTag      entry.EntryTag
+	enc           encoder
+	rcodeEncs     map[int]encoder // tag-on-rcode encodings, nil when every rcode uses enc
+	to            time.Duration
+	deadline      time.Duration   // ceiling on the time spent writing all entries for a request
+	q             *writeQueue     // nil when writes are synchronous
+	ports         *portFilter     // nil when all client ports are logged
+	sample        *sampler        // nil when every request is logged
+	window        *logWindow      // nil when requests are logged at any time of day
+	skipCacheHits bool            // drop requests a cache plugin reported as hits
+	skipErrors    bool            // drop requests the plugin chain returned an error for, log-errors false
+	filterDebug   bool            // log requests the filters would drop, marked with the rule
+	timing        string          // log-timing, empty is post
+	mask          ipMask          // client address masking, zero when off
+	latency       *latencyTracker // nil unless slow-outlier-percentile
+	nx            *nxTracker      // nil unless nxdomain-threshold
+	qps           *qpsTracker     // nil unless client-qps-halflife
+	clock         *clockChecker   // nil unless ntp-check-server
+	errlog        *errorLog       // throttled write failure log, nil logs nothing
+	countries     *countryMap     // nil unless country-cidr-map
+	metadataKeys  []string        // include-metadata labels
+	encodeOptions
+}
+
+func (gh gwHandler) String() string {
+	return coreDNSPackageName
+}
+
+func (gh gwHandler) Name() string {
+	return coreDNSPackageName
+}
+
+func (gh gwHandler) ServeDNS(ctx context.Context, rw dns.ResponseWriter, r *dns.Msg) (c int, err error) {
+	ts := entry.Now()
+	local := rw.LocalAddr()
+	remote := rw.RemoteAddr()
+	//requests the filters drop are still encoded for the audit tag, but only for it
+	inWindow := gh.window.contains(ts.StandardTime())
+	if !inWindow && !gh.audit && !gh.filterDebug {
+		//outside the log-window nothing is recorded
+		return gh.Next.ServeDNS(ctx, rw, r)
+	}
+	//handed down the chain as the writer and not pooled, plugins such as cache keep the writer
+	//for prefetch and serve-stale goroutines that outlive the request
+	is := newIntrospector(rw, r)
+	is.encodeOptions = gh.encodeOptions
+	keep := inWindow || gh.debugKeep(is, gh.window.String())
+	is.clockOffset = gh.clock.offsetMS()
+	//the real client, before any masking
+	is.clientCountry = gh.countries.country(remote)
+	is.tlsVersion, is.tlsCipher = clientTLS(rw)
+	is.readQueueDelay(ctx, ts)
+	portKeep, portRule := gh.ports.decide(remote)
+	//the real client, masking must not merge clients into one sampling decision
+	sampled := gh.sample.keep(rw.RemoteAddr())
+	if gh.timing != `` {
+		if gh.timing == logTimingBoth {
+			is.eventID = newEventID()
+		}
+		//the audit tag sees the request record ahead of the filters, like the post record
+		if preKeep := inWindow && portKeep && sampled; preKeep || gh.audit {
+			gh.logRequest(ts, local, gh.mask.mask(remote), is, preKeep)
+		}
+		if gh.timing == logTimingPre {
+			//nothing is recorded from the response, so there is no need to capture it
+			return gh.Next.ServeDNS(ctx, rw, r)
+		}
+	}
+	start := time.Now()
+	c, err = gh.Next.ServeDNS(ctx, is, r)
+	if gh.latency != nil {
+		is.slowOutlier = gh.latency.observe(time.Since(start))
+	}
+	if gh.qps != nil {
+		//every query counts toward the rate, including ones filtered out below
+		is.clientQPS = gh.qps.observe(rw.RemoteAddr(), time.Now())
+	}
+	if portKeep && gh.filterDebug && is.filterRule == `` {
+		is.filterRule = portRule
+	}
+	if keep = keep && (portKeep || gh.debugKeep(is, portRule)); !keep && !gh.audit {
+		return
+	}
+	if keep = keep && (sampled || gh.debugKeep(is, gh.sample.String())); !keep && !gh.audit {
+		return
+	}
+	is.readMetadata(ctx)
+	is.metadata = metadataValues(ctx, gh.metadataKeys)
+	if keep = keep && (!(gh.skipCacheHits && is.cacheHit()) || gh.debugKeep(is, `skip-cache-hits`)); !keep && !gh.audit {
+		return
+	}
+	//the error is still returned to the server, only the record is dropped
+	if keep = keep && (!(gh.skipErrors && err != nil) || gh.debugKeep(is, `log-errors false`)); !keep && !gh.audit {
+		return
+	}
+	remote = gh.mask.mask(remote)
+	rcode := is.rcode
+	if err != nil || !plugin.ClientWrite(c) {
+		//nothing was written to the client, the server will answer with the returned code
+		rcode = c
+	}
+	is.failure = failureReason(rcode, is.edeCodes, err)
+	if gh.nx != nil {
+		//track the real client, remote may have been masked
+		is.dgaSuspect = gh.nx.observe(rw.RemoteAddr(), rcode == dns.RcodeNameError, time.Now())
+	}
+	bbs, tags := gh.encode(ts, local, remote, is, rcode, err)
+	bbs, tags = gh.withAudit(bbs, tags, keep)
+	gh.writeEntries(ts, bbs, tags)
+	return
+}
+
+// withAudit appends a copy of every entry for the audit tag, when the filters dropped the
+// request only the audit copies are returned
+func (gh gwHandler) withAudit(bbs [][]byte, tags []entry.EntryTag, keep bool) ([][]byte, []entry.EntryTag) {
+	if !gh.audit {
+		return bbs, tags
+	}
+	n := len(bbs)
+	for i := 0; i < n; i++ {
+		bbs, tags = append(bbs, bbs[i]), append(tags, gh.auditTag)
+	}
+	if !keep {
+		bbs, tags = bbs[n:], tags[n:]
+	}
+	return bbs, tags
+}
+
+// logRequest writes the log-timing pre record for a request before it is handed to the plugin
+// chain, the record describes the request alone and shares the EventID of its post record.
+// Only the audit copy is written when the filters dropped the request.
+func (gh gwHandler) logRequest(ts entry.Timestamp, local, remote net.Addr, is *introspector, keep bool) {
+	pre := newIntrospectorFromMsg(is.req, gh.encodeOptions)
+	pre.pre = true
+	pre.eventID = is.eventID
+	pre.clockOffset = is.clockOffset
+	pre.clientCountry = is.clientCountry
+	pre.tlsVersion, pre.tlsCipher = is.tlsVersion, is.tlsCipher
+	pre.queueDelay = is.queueDelay
+	pre.reqBytes, pre.respBytes = is.reqBytes, 0
+	pre.sections = nil
+	bbs, tags := gh.encode(ts, local, remote, pre, dns.RcodeSuccess, nil)
+	bbs, tags = gh.withAudit(bbs, tags, keep)
+	gh.writeEntries(ts, bbs, tags)
+}
+
+// encode produces the entries for a request and the tag of each, a tag-on-rcode encoding
+// replaces the untagged encodings for its rcode.  log-timing pre records use the default tag.
+func (gh gwHandler) encode(ts entry.Timestamp, local, remote net.Addr, is *introspector, rcode int, err error) (bbs [][]byte, tags []entry.EntryTag) {
+	tag := gh.tag
+	var rcEnc encoder
+	var hasRcEnc bool
+	if !is.pre {
+		tag = gh.tagFor(rcode)
+		rcEnc, hasRcEnc = gh.rcodeEncs[rcode]
+	}
+	encode := func(enc encoder, tg entry.EntryTag) {
+		var encoded [][]byte
+		if err != nil {
+			encoded = enc.EncodeError(ts, local, remote, is, err)
+		} else {
+			encoded = enc.Encode(ts, local, remote, is)
+		}
+		for _, bb := range encoded {
+			bbs = append(bbs, bb)
+			tags = append(tags, tg)
+		}
+	}
+	if hasRcEnc && gh.enc == nil {
+		encode(rcEnc, tag)
+	} else if gh.enc == nil {
+		bb, lerr := is.req.Pack()
+		if lerr != nil {
+			bb = []byte(fmt.Sprintf("ERROR: Failed to pack DNS response: %v", lerr))
+		}
+		bbs, tags = append(bbs, bb), append(tags, tag)
+	} else if es, ok := gh.enc.(encoderSet); ok {
+		var rcDone bool
+		for _, te := range es {
+			if te.tag != `` {
+				encode(te.encoder, te.tg)
+			} else if !hasRcEnc {
+				encode(te.encoder, tag)
+			} else if !rcDone {
+				//the tag-on-rcode encoding replaces every encoding writing to the rcode tag
+				encode(rcEnc, tag)
+				rcDone = true
+			}
+		}
+	} else if hasRcEnc {
+		encode(rcEnc, tag)
+	} else {
+		encode(gh.enc, tag)
+	}
+	return
+}
+
+// writeEntries writes or queues the entries for a request, within ingest-deadline when set
+func (gh gwHandler) writeEntries(ts entry.Timestamp, bbs [][]byte, tags []entry.EntryTag) {
+	var deadline time.Time
+	if gh.deadline > 0 {
+		deadline = time.Now().Add(gh.deadline)
+	}
+	//entries are written one at a time rather than with WriteBatch, which reports no count of
+	//what landed, so written, failed, and dropped entries are always accounted exactly
+	for i, bb := range bbs {
+		ent := &entry.Entry{
+			TS:   ts,
+			Tag:  tags[i],
+			Data: bb,
+		}
+		if gh.q != nil {
+			gh.q.push(ent)
+		} else if err := gh.writeBefore(ent, deadline); droppedAll(err) {
+			//this and every remaining entry for the request is dropped
+			droppedEntries.Add(float64(len(bbs) - i))
+			gh.errlog.log(err)
+			return
+		} else if err != nil {
+			//some sinks took the entry, the rest counted their own drop
+			gh.errlog.log(err)
+		}
+	}
+}
+
+// debugKeep is consulted when a filter would drop a request, with filter-debug the request is
+// kept and the first rule that would have dropped it recorded, replacing any rule that kept it
+func (gh gwHandler) debugKeep(is *introspector, rule string) bool {
+	if !gh.filterDebug {
+		return false
+	}
+	if !is.filterDropped {
+		is.filterRule, is.filterDropped = rule, true
+	}
+	return true
+}
+
+// tagFor selects the tag for a response code, falling back to the default tag
+func (gh gwHandler) tagFor(rcode int) entry.EntryTag {
+	if tg, ok := gh.rcodeTags[rcode]; ok {
+		return tg
+	}
+	return gh.tag
+}
+
+// write hands a single entry to the ingest muxer, honoring the write timeout
+func (gh gwHandler) write(ent *entry.Entry) error {
+	if gh.to > 0 {
+		return gh.im.WriteEntryTimeout(ent, gh.to)
+	}
+	return gh.im.WriteEntry(ent)
+}
+
+// writeLogged is write with failures reported through the throttled error log, for the
+// background writers that have nobody to return the error to
+func (gh gwHandler) writeLogged(ent *entry.Entry) error {
+	err := gh.write(ent)
+	gh.errlog.log(err)
+	return err
+}
+
+// writeBefore writes an entry that must be handed to the muxer before deadline, a zero deadline
+// falls back to write.  The tighter of the remaining deadline and the write timeout wins.
+func (gh gwHandler) writeBefore(ent *entry.Entry, deadline time.Time) error {
+	if deadline.IsZero() {
+		return gh.write(ent)
+	}
+	to := time.Until(deadline)
+	if to <= 0 {
+		return ingest.ErrWriteTimeout
+	} else if gh.to > 0 && gh.to < to {
+		to = gh.to
+	}
+	return gh.im.WriteEntryTimeout(ent, to)
+}
+
+// loadOrCreateUUID reads a persisted ingester UUID, generating and persisting a new one if the file does not exist
+func loadOrCreateUUID(p string) (string, error) {
+	bb, err := os.ReadFile(p)
+	if err == nil {
+		guid, err := uuid.Parse(strings.TrimSpace(string(bb)))
+		if err != nil {
+			return ``, fmt.Errorf("Invalid ingester UUID in %s - %w", p, err)
+		}
+		return guid.String(), nil
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return ``, fmt.Errorf("Failed to read ingester-uuid-file %s - %w", p, err)
+	}
+	guid := uuid.New()
+	if err = os.MkdirAll(filepath.Dir(p), 0750); err != nil {
+		return ``, fmt.Errorf("Failed to create ingester-uuid-file directory %s - %w", filepath.Dir(p), err)
+	} else if err = os.WriteFile(p, []byte(guid.String()+"\n"), 0640); err != nil {
+		return ``, fmt.Errorf("Failed to write ingester-uuid-file %s - %w", p, err)
+	}
+	return guid.String(), nil
+}
+
+// checkCacheDir makes sure the ingest cache directory exists and is writable, the muxer
+// would otherwise only fail once it first needs to cache
+func checkCacheDir(p string) error {
+	if err := os.MkdirAll(p, 0750); err != nil {
+		return fmt.Errorf("Ingest-Cache-Path %s could not be created - %w", p, err)
+	}
+	f, err := os.CreateTemp(p, `.writetest`)
+	if err != nil {
+		return fmt.Errorf("Ingest-Cache-Path %s is not writable - %w", p, err)
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
+
+// muxerCacheFiles are the entries the ingest muxer keeps under its cache path, the entry and
+// block caches and the tag map.  Nothing else in the directory belongs to the muxer.
+var muxerCacheFiles = []string{`e`, `b`, `tagcache`}
+
+// pruneStaleCache removes the cache files a previous run left behind if none of them has been
+// modified within maxAge.  The muxer replays a cache in its entirety, so aging is all or nothing.
+func pruneStaleCache(p string, maxAge time.Duration) error {
+	var newest time.Time
+	var found []string
+	for _, name := range muxerCacheFiles {
+		fp := filepath.Join(p, name)
+		err := filepath.WalkDir(fp, func(_ string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if fi, err := d.Info(); err == nil && fi.ModTime().After(newest) {
+				newest = fi.ModTime()
+			}
+			return nil
+		})
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		} else if err != nil {
+			return fmt.Errorf("Failed to inspect ingest cache %s - %w", fp, err)
+		}
+		found = append(found, fp)
+	}
+	if len(found) == 0 || time.Since(newest) <= maxAge {
+		return nil
+	}
+	for _, fp := range found {
+		if err := os.RemoveAll(fp); err != nil {
+			return fmt.Errorf("Failed to remove stale ingest cache %s - %w", fp, err)
+		}
+	}
+	return nil
+}
+
+func testLogLevel(v string) error {
+	v = strings.TrimSpace(strings.ToLower(v))
+	switch v {
+	case `error`:
+	case `warn`:
+	case `info`:
+	case `off`:
+	default:
+		return errors.New("Invalid log level")
+	}
+	return nil
+}
+
+type introspector struct {
+	dns.ResponseWriter
+	encodeOptions
+	req            *dns.Msg
+	q              []dns.Question
+	a              []dns.RR
+	droppedAnswers int  // answers beyond the max-answers-per-query or answer-head bound
+	rd             bool // recursion desired, from the request
+	ra             bool // recursion available, from the response
+	aa             bool // authoritative answer, from the response
+	rcode          int
+	ns             []dns.RR
+	nsid           string
+	hdr            dns.MsgHdr
+	edeCodes       []uint16 // EDNS0 extended errors, parallel with edeTexts
+	edeTexts       []string
+	respOpts       []ednsOption      // every response EDNS0 option, only with include-edns-options
+	failure        string            // SERVFAIL bucket, see failureReason
+	slowOutlier    bool              // the plugin chain took longer than the rolling slow-outlier-percentile
+	dgaSuspect     bool              // the client crossed the nxdomain-threshold
+	clientQPS      float64           // decayed query rate of the client, see client-qps-halflife
+	metadata       map[string]string // include-metadata values, nil when none were found
+	filterRule     string            // filter-debug, the rule that kept or would have dropped the request
+	clockOffset    *float64          // milliseconds from the last ntp-check-server check, nil when unknown
+	clientCountry  string            // country-cidr-map match for the real client address
+	tlsVersion     string            // DoT and DoH client TLS version, empty for plain transports
+	tlsCipher      string
+	pre            bool          // a log-timing pre record, built from the request alone
+	eventID        string        // shared by the pre and post records with log-timing both
+	filterDropped  bool          // filter-debug, filterRule would have dropped the request
+	reqBytes       int           // wire length of the request, 0 when there is no real request
+	respBytes      int           // wire length of the response as written by the plugin chain
+	answerHash     string        // include-answer-hash, empty when off or there are no answers
+	answerCount    int           // answers summarized by answer-detail-by-type, i.a is then empty
+	sections       *sectionSizes // include-section-sizes, nil when off
+
+	aclAction  string
+	aclPolicy  string
+	cacheStat  string
+	zone       string
+	wildcard   string
+	synthetic  *bool // nil when no plugin said either way
+	blocked    bool
+	blockWhy   string
+	queueDelay *int64 // nanoseconds between receipt and handler entry, nil when unknown
+}
+
+func newIntrospector(rw dns.ResponseWriter, r *dns.Msg) *introspector {
+	return &introspector{
+		ResponseWriter: rw,
+		req:            r,
+		rd:             r.RecursionDesired,
+		reqBytes:       r.Len(),
+	}
+}
+
+// newIntrospectorFromMsg builds an introspector directly from a response as if it had been
+// written through the plugin chain, the response also stands in for the request.  There is
+// no underlying ResponseWriter, so the result may only be handed to encoders.
+func newIntrospectorFromMsg(m *dns.Msg, opts encodeOptions) *introspector {
+	i := &introspector{
+		encodeOptions: opts,
+		req:           m,
+		rd:            m.RecursionDesired,
+	}
+	i.capture(m)
+	return i
+}
+
+// questions returns the response questions bounded by the configured maximum and
+// whether any questions were dropped to satisfy the bound
+func (i *introspector) questions() ([]dns.Question, bool) {
+	return i.boundQuestions(i.q)
+}
+
+// requestQuestions returns the request questions, bounded in the same way as questions
+func (i *introspector) requestQuestions() ([]dns.Question, bool) {
+	if i.req == nil {
+		return nil, false
+	}
+	return i.boundQuestions(i.req.Question)
+}
+
+// answerString formats an answer according to the configured answer-format
+func (i *introspector) answerString(rr dns.RR) string {
+	if i.answerFormat == answerFormatRdata {
+		return answerRdata(rr)
+	}
+	return rr.String()
+}
+
+// questionFields populates the record fields derived from the question name
+func (i *introspector) questionFields(b *dnsBase, name string) {
+	b.QnameWire = i.wireName(name)
+	b.RegisteredDomain = i.registeredDomain(name)
+	b.PossibleTunnel = i.tunnel.match(name)
+	b.KnownBad = i.badDomains.knownBad(name)
+	b.CNAMEChain, b.FinalAnswers = cnameChain(name, i.a)
+	if i.stripDot {
+		for j := range b.CNAMEChain {
+			b.CNAMEChain[j] = stripFQDNDot(b.CNAMEChain[j])
+		}
+	}
+}
+
+// registeredDomain returns the eTLD+1 of a question name when registered-domain is enabled
+func (i *introspector) registeredDomain(name string) string {
+	if !i.regDomain {
+		return ``
+	}
+	return registeredDomain(name)
+}
+
+// wireName returns the hex encoded wire format of a name when qname-wire is enabled, names
+// that cannot be packed are left empty
+func (i *introspector) wireName(name string) string {
+	if !i.qnameWire {
+		return ``
+	}
+	name = dns.Fqdn(name) //strip-fqdn-dot names
+	buf := make([]byte, len(name)+2)
+	off, err := dns.PackDomainName(name, buf, 0, nil, false)
+	if err != nil {
+		return ``
+	}
+	return hex.EncodeToString(buf[:off])
+}
+
+// sectionSizes is the uncompressed wire size of each section of a response, the 12 byte header
+// is not part of any section.  Name compression only ever shrinks a message, so the sections
+// plus the header are an upper bound on ResponseBytes and equal it when nothing compressed.
+type sectionSizes struct {
+	question   int
+	answer     int
+	authority  int
+	additional int // includes the OPT record
+}
+
+func newSectionSizes(m *dns.Msg) *sectionSizes {
+	ss := &sectionSizes{
+		answer:     rrBytes(m.Answer),
+		authority:  rrBytes(m.Ns),
+		additional: rrBytes(m.Extra),
+	}
+	buf := make([]byte, 256) //the longest wire format name is 255 bytes
+	for _, q := range m.Question {
+		if off, err := dns.PackDomainName(dns.Fqdn(q.Name), buf, 0, nil, false); err == nil {
+			ss.question += off + 4 //qtype and qclass
+		}
+	}
+	return ss
+}
+
+func rrBytes(rrs []dns.RR) (n int) {
+	for _, rr := range rrs {
+		n += dns.Len(rr)
+	}
+	return
+}
+
+// serverID returns the NSID of the answering server, falling back to the configured server-host
+func (i *introspector) serverID() string {
+	if i.nsid != `` {
+		return i.nsid
+	}
+	return i.serverHost
+}
+
+// negative returns true if negative responses are being logged and the response is
+// a NXDOMAIN or a NODATA (NOERROR with no answers)
+func (i *introspector) negative() bool {
+	if !i.logNegative || i.pre || len(i.a) > 0 || i.answerCount > 0 {
+		return false
+	}
+	return i.rcode == dns.RcodeNameError || i.rcode == dns.RcodeSuccess
+}
+
+// soa returns the SOA from the authority section of a response, if present
+func (i *introspector) soa() *dns.SOA {
+	for _, rr := range i.ns {
+		if v, ok := rr.(*dns.SOA); ok {
+			return v
+		}
+	}
+	return nil
+}
+
+func (i *introspector) boundQuestions(qs []dns.Question) (r []dns.Question, truncated bool) {
+	r = qs
+	if i.maxQuestions > 0 && len(qs) > i.maxQuestions {
+		r, truncated = qs[:i.maxQuestions], true
+	}
+	if i.stripDot && len(r) > 0 {
+		//copied, the questions belong to the messages
+		r = slices.Clone(r)
+		for j := range r {
+			r[j].Name = stripFQDNDot(r[j].Name)
+		}
+	}
+	return
+}
+
+// stripFQDNDot removes the trailing dot from a name, the root is left as a lone dot
+func stripFQDNDot(name string) string {
+	if name == `.` {
+		return name
+	}
+	return strings.TrimSuffix(name, `.`)
+}
+
+// stripOwnerDots copies answers with the trailing dot removed from their owner names
+func stripOwnerDots(rrs []dns.RR) (r []dns.RR) {
+	r = make([]dns.RR, 0, len(rrs))
+	for _, rr := range rrs {
+		if v, ok := rr.(*redactedRR); ok {
+			//dns.Copy only knows the embedded ANY and would lose the placeholder
+			rr = &redactedRR{ANY: &dns.ANY{Hdr: v.Hdr}, Rdata: v.Rdata}
+		} else {
+			rr = dns.Copy(rr)
+		}
+		rr.Header().Name = stripFQDNDot(rr.Header().Name)
+		r = append(r, rr)
+	}
+	return
+}
+
+// readMetadata pulls any metadata published by downstream plugins out of the request context
+func (i *introspector) readMetadata(ctx context.Context) {
+	i.aclAction = metadataValue(ctx, aclActionMetadataKey)
+	i.aclPolicy = metadataValue(ctx, aclPolicyMetadataKey)
+	i.cacheStat = metadataValue(ctx, cacheStatusMetadataKey)
+	i.zone = metadataValue(ctx, zoneMetadataKey)
+	i.wildcard = metadataValue(ctx, wildcardMetadataKey)
+	i.blockWhy = metadataValue(ctx, blockReasonMetadataKey)
+	if v, err := strconv.ParseBool(metadataValue(ctx, blockedMetadataKey)); err == nil {
+		i.blocked = v
+	} else {
+		i.blocked = i.blockWhy != ``
+	}
+	i.synthetic = nil
+	if v, err := strconv.ParseBool(metadataValue(ctx, synthesizedMetadataKey)); err == nil {
+		i.synthetic = &v
+	} else if slices.Contains(i.edeCodes, dns.ExtendedErrorCodeSynthesized) {
+		//RFC 8914 Synthesized, the response says so itself
+		v = true
+		i.synthetic = &v
+	}
+}
+
+// cacheHit is true only when a cache plugin explicitly reported a hit
+func (i *introspector) cacheHit() bool {
+	return strings.EqualFold(i.cacheStat, cacheStatusHit)
+}
+
+// readQueueDelay computes the delay between the request being received and reaching this handler
+func (i *introspector) readQueueDelay(ctx context.Context, now entry.Timestamp) {
+	v := metadataValue(ctx, receivedMetadataKey)
+	if v == `` {
+		return
+	}
+	ns, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		return
+	}
+	d := now.StandardTime().UnixNano() - ns
+	if d < 0 {
+		d = 0 //clock adjustments
+	}
+	i.queueDelay = &d
+}
+
+// metadataValues pulls the include-metadata labels out of the context, labels that are
+// missing or empty are left out and nil is returned when nothing matched
+func metadataValues(ctx context.Context, labels []string) (r map[string]string) {
+	for _, l := range labels {
+		if v := metadataValue(ctx, l); v != `` {
+			if r == nil {
+				r = make(map[string]string, len(labels))
+			}
+			r[l] = v
+		}
+	}
+	return
+}
+
+func metadataValue(ctx context.Context, label string) (v string) {
+	if f := metadata.ValueFunc(ctx, label); f != nil {
+		v = f()
+	}
+	return
+}
+
+func (i *introspector) Write(b []byte) (int, error) {
+	return i.ResponseWriter.Write(b)
+}
+
+func (i *introspector) WriteMsg(m *dns.Msg) error {
+	i.capture(m)
+	return i.ResponseWriter.WriteMsg(m)
+}
+
+// capture records everything the encoders need from a response
+func (i *introspector) capture(m *dns.Msg) {
+	i.q = m.Question
+	i.a = m.Answer
+	i.respBytes = m.Len()
+	redacted := i.redact || i.redactQtypes.redacts(m.Question)
+	i.answerHash = ``
+	if i.hashAnswers && !redacted {
+		//the whole answer set, ahead of max-answers-per-query.  A redacted record carries no
+		//hash, it would still let a reader confirm a guess at the rdata.
+		i.answerHash = hashAnswers(m.Answer)
+	}
+	i.sections = nil
+	if i.sectionSizes {
+		i.sections = newSectionSizes(m)
+	}
+	i.answerCount = 0
+	if i.answerDetail.summarize(m.Question) && len(i.a) > 0 {
+		//counted rather than encoded by every encoding
+		i.answerCount, i.a = len(i.a), nil
+	}
+	if i.sortAnswers {
+		//sorted before the max-answers bound so identical responses keep identical answers
+		i.a = sortAnswers(i.a)
+	}
+	i.droppedAnswers = 0
+	if i.maxAnswers > 0 && len(i.a) > i.maxAnswers {
+		i.droppedAnswers = len(i.a) - i.maxAnswers
+		i.a = i.a[:i.maxAnswers]
+	}
+	if redacted {
+		i.a = redactAnswers(i.a)
+	} else if i.maxTXTBytes > 0 {
+		i.a = truncateTXT(i.a, i.maxTXTBytes)
+	}
+	if i.stripDot && len(i.a) > 0 {
+		i.a = stripOwnerDots(i.a)
+	}
+	i.ra = m.RecursionAvailable
+	i.aa = m.Authoritative
+	i.rcode = m.Rcode
+	i.ns = m.Ns
+	i.hdr = m.MsgHdr
+	i.nsid = ``
+	i.edeCodes, i.edeTexts = nil, nil
+	i.respOpts = nil
+	if i.ednsOptions {
+		i.respOpts = ednsOptions(m)
+	}
+	if opt := m.IsEdns0(); opt != nil {
+		for _, o := range opt.Option {
+			switch v := o.(type) {
+			case *dns.EDNS0_NSID:
+				i.nsid = decodeNSID(v.Nsid)
+			case *dns.EDNS0_EDE:
+				i.edeCodes = append(i.edeCodes, v.InfoCode)
+				i.edeTexts = append(i.edeTexts, edeText(v))
+			}
+		}
+	}
+	i.failure = failureReason(m.Rcode, i.edeCodes, nil)
+}
+
+// configurableEncoder is implemented by encoders that accept options in an encoding block
+type configurableEncoder interface {
+	setOption(name string, args []string) error
+}
+
+// getEncoder resolves an encoder by name and applies any options from its block, e.g.
+//
+//	encoding json {
+//		field-map Remote Client
+//		style pretty
+//	}
+func getEncoder(t string, opts [][]string) (enc encoder, err error) {
+	t = strings.TrimSpace(strings.ToLower(t))
+	switch t {
+	case `text`:
+		enc = &textEncoder{}
+	case `hec`:
+		enc = &hecEncoder{}
+	case `passivedns`:
+		enc = &passiveDNSEncoder{}
+	case `zeek`:
+		enc = &zeekEncoder{}
+	case `binary`:
+		enc = &binaryEncoder{}
+	case `json-per-answer`:
+		enc = &jsonEncoder{perAnswer: true}
+	case `json`:
+		fallthrough
+	case ``:
+		enc = &jsonEncoder{}
+	default:
+		return nil, fmt.Errorf("Unknown encoding type")
+	}
+	if len(opts) == 0 {
+		return
+	}
+	ce, ok := enc.(configurableEncoder)
+	if !ok {
+		return nil, fmt.Errorf("%s encoding does not take any options", enc.Name())
+	}
+	for _, opt := range opts {
+		if err = ce.setOption(opt[0], opt[1:]); err != nil {
+			return nil, fmt.Errorf("Invalid %s encoding option %s - %w", enc.Name(), opt[0], err)
+		}
+	}
+	return
+}
+
+const (
+	textDelim      string = ` `
+	textNoQuestion string = `NOQUESTION` // in place of the question with emit-empty-question
+	textEventType  string = `EventType=` // key of the last field on every line
+)
+
+type textEncoder struct {
+	prefix, suffix string // written verbatim around every line
+}
+
+func (t textEncoder) line(ts entry.Timestamp, local, remote net.Addr, v, eventType string) []byte {
+	buf := getBuffer()
+	defer putBuffer(buf)
+	buf.WriteString(t.prefix)
+	for i, f := range []string{ts.String(), local.Network(), local.String(), remote.String(), v, textEventType + eventType} {
+		if i > 0 {
+			buf.WriteString(textDelim)
+		}
+		buf.WriteString(f)
 	}
+	buf.WriteString(t.suffix)
+	return bytes.Clone(buf.Bytes())
+}
 
-	dcfg := dnsserver.GetConfig(c)
-	mid := func(next plugin.Handler) plugin.Handler {
-		return gwHandler{
-			Next: next,
-			im:   im,
-			tag:  tg,
-			enc:  enc,
-			to:   cfg.WriteTimeout,
+func (t textEncoder) Encode(ts entry.Timestamp, local, remote net.Addr, tr *introspector) (bb [][]byte) {
+	var dt string
+	qs, _ := tr.questions()
+	for i := range qs {
+		if i < len(tr.a) {
+			dt = tr.answerString(tr.a[i])
+		} else if tr.negative() {
+			dt = fmt.Sprintf("%s %s", qs[i].String(), dns.RcodeToString[tr.rcode])
+			if soa := tr.soa(); soa != nil {
+				dt += " " + soa.String()
+			}
+		} else {
+			dt = qs[i].String()
 		}
+		bb = append(bb, t.line(ts, local, remote, dt, tr.questionEvent(i)))
 	}
-	dcfg.AddPlugin(mid)
-	return nil
+	if len(qs) == 0 && tr.emptyQuestion {
+		bb = append(bb, t.line(ts, local, remote, textNoQuestion+textDelim+dns.RcodeToString[tr.rcode], tr.eventType(eventNoQuestion)))
+	}
+	return
 }
 
-type gwHandler struct {
-	Next plugin.Handler
-	im   *ingest.IngestMuxer
-	tag  entry.EntryTag
-	enc  encoder
-	to   time.Duration
+func (t textEncoder) EncodeError(ts entry.Timestamp, l, r net.Addr, tr *introspector, err error) (bb [][]byte) {
+	qs, _ := tr.requestQuestions()
+	for _, q := range qs {
+		bb = append(bb, t.line(ts, l, r, q.String(), eventError))
+	}
+	if len(qs) == 0 && tr.emptyQuestion {
+		bb = append(bb, t.line(ts, l, r, textNoQuestion, eventError))
+	}
+	return
 }
 
-func (gh gwHandler) String() string {
-	return coreDNSPackageName
+func (t textEncoder) Name() string {
+	return `text`
 }
 
-func (gh gwHandler) Name() string {
-	return coreDNSPackageName
+const pdnsDelim string = `||`
+
+// passiveDNSEncoder emits the classic passivedns layout, one line per unique answer:
+//
+//	timestamp||client||server||class||qname||qtype||answer||ttl||count
+//
+// Identical answers are collapsed into a single line with a count, responses without
+// answers emit the question with the response code in place of the answer.
+type passiveDNSEncoder struct{}
+
+type pdnsAnswer struct {
+	class, name, qtype, answer string
 }
 
-func (gh gwHandler) ServeDNS(ctx context.Context, rw dns.ResponseWriter, r *dns.Msg) (c int, err error) {
-	var bbs [][]byte
-	var lerr error
-	ts := entry.Now()
-	local := rw.LocalAddr()
-	remote := rw.RemoteAddr()
-	is := &introspector{
-		ResponseWriter: rw,
+func (p passiveDNSEncoder) Encode(ts entry.Timestamp, local, remote net.Addr, tr *introspector) (bb [][]byte) {
+	if len(tr.a) == 0 {
+		rcode := dns.RcodeToString[tr.rcode]
+		qs, _ := tr.questions()
+		for i, q := range qs {
+			bb = append(bb, p.line(ts, local, remote, dns.ClassToString[q.Qclass], q.Name, dns.TypeToString[q.Qtype], rcode, 0, 1, tr.questionEvent(i)))
+		}
+		return
 	}
-	c, err = gh.Next.ServeDNS(ctx, is, r)
-	if gh.enc == nil {
-		var bb []byte
-		if bb, lerr = r.Pack(); lerr != nil {
-			bb = []byte(fmt.Sprintf("ERROR: Failed to pack DNS response: %v", err))
-		}
-		bbs = append(bbs, bb)
-	} else if err != nil {
-		bbs = gh.enc.EncodeError(ts, local, remote, r, err)
-	} else {
-		bbs = gh.enc.Encode(ts, local, remote, is)
-	}
-	for _, bb := range bbs {
-		if gh.to > 0 {
-			ent := entry.Entry{
-				TS:   ts,
-				Tag:  gh.tag,
-				Data: bb,
-			}
-			if lerr = gh.im.WriteEntryTimeout(&ent, gh.to); lerr != nil {
-				return
-			}
-		} else {
-			if lerr = gh.im.Write(ts, gh.tag, bb); lerr != nil {
-				return
-			}
+	var order []pdnsAnswer
+	counts := map[pdnsAnswer]int{}
+	ttls := map[pdnsAnswer]uint32{}
+	for _, rr := range tr.a {
+		hdr := rr.Header()
+		k := pdnsAnswer{
+			class:  dns.ClassToString[hdr.Class],
+			name:   hdr.Name,
+			qtype:  dns.TypeToString[hdr.Rrtype],
+			answer: rdata(rr),
+		}
+		if _, ok := counts[k]; !ok {
+			order = append(order, k)
+			ttls[k] = hdr.Ttl
 		}
+		counts[k]++
 	}
+	et := tr.eventType(eventAnswer)
+	for _, k := range order {
+		bb = append(bb, p.line(ts, local, remote, k.class, k.name, k.qtype, k.answer, ttls[k], counts[k], et))
+	}
+	return
+}
 
+func (p passiveDNSEncoder) EncodeError(ts entry.Timestamp, l, r net.Addr, tr *introspector, err error) (bb [][]byte) {
+	rcode := dns.RcodeToString[dns.RcodeServerFailure]
+	qs, _ := tr.requestQuestions()
+	for _, q := range qs {
+		bb = append(bb, p.line(ts, l, r, dns.ClassToString[q.Qclass], q.Name, dns.TypeToString[q.Qtype], rcode, 0, 1, eventError))
+	}
 	return
 }
 
-func testLogLevel(v string) error {
-	v = strings.TrimSpace(strings.ToLower(v))
-	switch v {
-	case `error`:
-	case `warn`:
-	case `info`:
-	case `off`:
-	default:
-		return errors.New("Invalid log level")
+func (p passiveDNSEncoder) Name() string {
+	return `passivedns`
+}
+
+// line is the classic passivedns layout with the EventType appended as a trailing column
+func (p passiveDNSEncoder) line(ts entry.Timestamp, local, remote net.Addr, class, name, qtype, answer string, ttl uint32, count int, eventType string) []byte {
+	return []byte(strings.Join([]string{
+		epochString(ts),
+		addrHost(remote),
+		addrHost(local),
+		class,
+		name,
+		qtype,
+		answer,
+		strconv.FormatUint(uint64(ttl), 10),
+		strconv.Itoa(count),
+		eventType,
+	}, pdnsDelim))
+}
+
+// epochString formats a timestamp as fractional unix seconds with microsecond precision
+func epochString(ts entry.Timestamp) string {
+	t := ts.StandardTime()
+	return fmt.Sprintf("%d.%06d", t.Unix(), t.Nanosecond()/1000)
+}
+
+// addrHost returns just the host portion of an address, dropping any port
+func addrHost(a net.Addr) string {
+	s := a.String()
+	if h, _, err := net.SplitHostPort(s); err == nil {
+		return h
 	}
-	return nil
+	return s
 }
 
-type introspector struct {
-	dns.ResponseWriter
-	q []dns.Question
-	a []dns.RR
+// rdata returns the presentation format of an RR without the owner, TTL, class, and type prefix
+func rdata(rr dns.RR) string {
+	return strings.TrimPrefix(rr.String(), rr.Header().String())
 }
 
-func (i *introspector) Write(b []byte) (int, error) {
-	return i.ResponseWriter.Write(b)
+const redactedRdata string = `REDACTED`
+
+// redactedRR stands in for an answer when redact-answers is enabled, only the header survives
+type redactedRR struct {
+	*dns.ANY
+	Rdata string
 }
 
-func (i *introspector) WriteMsg(m *dns.Msg) error {
-	i.q = m.Question
-	i.a = m.Answer
-	return i.ResponseWriter.WriteMsg(m)
+func (r *redactedRR) String() string {
+	return r.Hdr.String() + r.Rdata
 }
 
-func getEncoder(t string) (encoder, error) {
-	t = strings.TrimSpace(strings.ToLower(t))
-	switch t {
-	case `text`:
-		return &textEncoder{}, nil
-	case `json`:
-		fallthrough
-	case ``:
-		return &jsonEncoder{}, nil
+// hashAnswers is a 64 bit FNV-1a hash in hex over the answers in normalize-answer-order order,
+// empty when there are none.  Only the lowercased owner, class, type, and rdata are hashed, so
+// the hash is stable across TTL countdown and RR order and changes when the answer data does.
+func hashAnswers(rrs []dns.RR) string {
+	if len(rrs) == 0 {
+		return ``
+	}
+	h := fnv.New64a()
+	var b [4]byte
+	for _, rr := range sortAnswers(rrs) {
+		hdr := rr.Header()
+		h.Write([]byte(strings.ToLower(hdr.Name)))
+		binary.BigEndian.PutUint16(b[:], hdr.Class)
+		binary.BigEndian.PutUint16(b[2:], hdr.Rrtype)
+		h.Write(b[:])
+		//the rdata in presentation format, the header string carries the TTL
+		h.Write([]byte(strings.TrimPrefix(rr.String(), hdr.String())))
+		h.Write([]byte{0})
+	}
+	return strconv.FormatUint(h.Sum64(), 16)
+}
+
+// sortAnswers returns a copy of the answers ordered by type, then rdata, then owner name so
+// responses that differ only in RR order encode identically
+func sortAnswers(rrs []dns.RR) []dns.RR {
+	if len(rrs) < 2 {
+		return rrs
 	}
-	return nil, fmt.Errorf("Unknown encoding type")
+	r := slices.Clone(rrs)
+	slices.SortStableFunc(r, func(a, b dns.RR) int {
+		if d := cmp.Compare(a.Header().Rrtype, b.Header().Rrtype); d != 0 {
+			return d
+		} else if d = strings.Compare(answerRdata(a), answerRdata(b)); d != 0 {
+			return d
+		}
+		return strings.Compare(strings.ToLower(a.Header().Name), strings.ToLower(b.Header().Name))
+	})
+	return r
 }
 
-type textEncoder struct{}
+// txtTruncatedMarker is appended as a final string to TXT answers cut by max-txt-bytes
+const txtTruncatedMarker string = `[truncated]`
 
-func (t textEncoder) Encode(ts entry.Timestamp, local, remote net.Addr, tr *introspector) (bb [][]byte) {
-	var dt string
-	for i := range tr.q {
-		if i < len(tr.a) {
-			dt = tr.a[i].String()
-		} else {
-			dt = tr.q[i].String()
+// truncateTXT cuts the strings of TXT answers to at most max bytes of text in total and marks
+// the cut ones, answers within the limit are shared and cut answers are copies so the
+// response is untouched
+func truncateTXT(rrs []dns.RR, max int) (r []dns.RR) {
+	var cut bool
+	r = rrs
+	for i, rr := range rrs {
+		txt, ok := rr.(*dns.TXT)
+		if !ok {
+			continue
+		}
+		var n int
+		for _, v := range txt.Txt {
+			n += len(v)
 		}
-		bb = append(bb, []byte(fmt.Sprintf("%s %s %s %s %v", ts.String(),
-			local.Network(), local.String(), remote.String(), dt)))
+		if n <= max {
+			continue
+		}
+		if !cut {
+			r = append([]dns.RR(nil), rrs...)
+			cut = true
+		}
+		t := &dns.TXT{Hdr: txt.Hdr}
+		left := max
+		for _, v := range txt.Txt {
+			if len(v) > left {
+				v = v[:left]
+			}
+			if len(v) > 0 {
+				t.Txt = append(t.Txt, v)
+			}
+			if left -= len(v); left == 0 {
+				break
+			}
+		}
+		t.Txt = append(t.Txt, txtTruncatedMarker)
+		r[i] = t
 	}
 	return
 }
 
-func (t textEncoder) EncodeError(ts entry.Timestamp, l, r net.Addr, msg *dns.Msg, err error) (bb [][]byte) {
-	for _, q := range msg.Question {
-		bb = append(bb, []byte(fmt.Sprintf("%s %s %s %s %v", ts.String(),
-			l.Network(), l.String(), r.String(), q.String())))
+// redactAnswers copies the answer headers so counts, names, types, and TTLs are still logged
+// without any of the resolved data
+func redactAnswers(rrs []dns.RR) (r []dns.RR) {
+	for _, rr := range rrs {
+		r = append(r, &redactedRR{ANY: &dns.ANY{Hdr: *rr.Header()}, Rdata: redactedRdata})
 	}
 	return
 }
 
-func (t textEncoder) Name() string {
-	return `text`
+// headerFlags reconstructs the 16 bit flags word of a DNS header, most significant bit first:
+//
+//	QR(15) OPCODE(14-11) AA(10) TC(9) RD(8) RA(7) Z(6) AD(5) CD(4) RCODE(3-0)
+//
+// Only the low 4 bits of an extended rcode fit in the header, the remainder lives in the OPT record.
+func headerFlags(h dns.MsgHdr) (f uint16) {
+	bit := func(set bool, pos uint) {
+		if set {
+			f |= 1 << pos
+		}
+	}
+	bit(h.Response, 15)
+	f |= uint16(h.Opcode&0xf) << 11
+	bit(h.Authoritative, 10)
+	bit(h.Truncated, 9)
+	bit(h.RecursionDesired, 8)
+	bit(h.RecursionAvailable, 7)
+	bit(h.Zero, 6)
+	bit(h.AuthenticatedData, 5)
+	bit(h.CheckingDisabled, 4)
+	f |= uint16(h.Rcode & 0xf)
+	return
+}
+
+// edeText returns the extra text of an extended error, falling back to the registered name of the code
+func edeText(e *dns.EDNS0_EDE) string {
+	if e.ExtraText != `` {
+		return e.ExtraText
+	} else if v, ok := dns.ExtendedErrorCodeToString[e.InfoCode]; ok {
+		return v
+	}
+	return strconv.Itoa(int(e.InfoCode))
+}
+
+// decodeNSID turns the hex encoded NSID into a string when it is printable, otherwise the hex is returned as is
+func decodeNSID(v string) string {
+	b, err := hex.DecodeString(v)
+	if err != nil || len(b) == 0 {
+		return v
+	}
+	for _, c := range b {
+		if c < 0x20 || c > 0x7e {
+			return v
+		}
+	}
+	return string(b)
+}
+
+// answerRdata extracts just the record data for common types, uncommon types fall
+// back to the full presentation format
+func answerRdata(rr dns.RR) string {
+	switch v := rr.(type) {
+	case *dns.A:
+		return v.A.String()
+	case *dns.AAAA:
+		return v.AAAA.String()
+	case *dns.CNAME:
+		return v.Target
+	case *dns.NS:
+		return v.Ns
+	case *dns.PTR:
+		return v.Ptr
+	case *dns.MX:
+		return fmt.Sprintf("%d %s", v.Preference, v.Mx)
+	case *dns.SRV:
+		return fmt.Sprintf("%d %d %d %s", v.Priority, v.Weight, v.Port, v.Target)
+	case *dns.TXT:
+		return strings.Join(v.Txt, ``)
+	case *redactedRR:
+		return v.Rdata
+	}
+	return rr.String()
 }
 
+// EventType values, every JSON record carries exactly one so consumers can branch on it, text
+// lines end in an EventType=value field and binary records carry it from version 2
+const (
+	eventQuery       string = `query`      // a question answered with no records
+	eventAnswer      string = `answer`     // a question and an answer record
+	eventNegative    string = `negative`   // an NXDOMAIN or NODATA response with log-negative
+	eventError       string = `error`      // the plugin chain failed, there is no response
+	eventUpdate      string = `update`     // any record for an UPDATE message that did not fail
+	eventNoQuestion  string = `noquestion` // a message without a question, see emit-empty-question
+	eventHeartbeat   string = `heartbeat`
+	eventRequest     string = `request`      // a log-timing pre record, written before the plugin chain runs
+	eventPluginStart string = `plugin_start` // lifecycle-markers, logging began
+	eventPluginStop  string = `plugin_stop`
+)
+
 type dnsBase struct {
-	TS     entry.Timestamp
-	Proto  string
-	Local  string
-	Remote string
+	TS                  recordTime
+	EventType           string
+	EventID             string `json:",omitempty"` // shared by the pre and post records with log-timing both
+	Proto               string
+	Local               string
+	Remote              string
+	RecursionDesired    bool
+	RecursionAvailable  bool
+	Authoritative       bool
+	ACLAction           string            `json:",omitempty"`
+	ACLPolicy           string            `json:",omitempty"`
+	CacheStatus         string            `json:",omitempty"`
+	Zone                string            `json:",omitempty"`
+	Wildcard            string            `json:",omitempty"`
+	Truncated           bool              `json:",omitempty"`
+	DroppedAnswers      int               `json:",omitempty"` // answers beyond max-answers-per-query or answer-head, also sets Truncated
+	NSID                string            `json:",omitempty"`
+	RawFlags            *uint16           `json:",omitempty"` // response header flags word, see headerFlags
+	QueueDelayNS        *int64            `json:",omitempty"`
+	ExtendedErrorCode   []uint16          `json:",omitempty"` // EDNS0 extended error codes, parallel with ExtendedErrorText
+	ExtendedErrorText   []string          `json:",omitempty"`
+	RequestEDNSOptions  []ednsOption      `json:",omitempty"` // every request OPT option, see include-edns-options
+	ResponseEDNSOptions []ednsOption      `json:",omitempty"`
+	QnameWire           string            `json:",omitempty"` // hex of the uncompressed wire format question name
+	RegisteredDomain    string            `json:",omitempty"` // eTLD+1 of the question name, see registeredDomain
+	PossibleTunnel      bool              `json:",omitempty"` // the qname exceeded a tunnel-* threshold
+	KnownBad            bool              `json:",omitempty"` // the qname or a parent is on the bad-domain-list
+	CNAMEChain          []string          `json:",omitempty"` // the question name followed by each CNAME target
+	FinalAnswers        []string          `json:",omitempty"` // rdata of the records at the end of the CNAME chain
+	ResolvedIP          string            `json:",omitempty"` // address of the first A or AAAA answer
+	AnswerHash          string            `json:",omitempty"` // include-answer-hash, see hashAnswers
+	AnswerCount         int               `json:",omitempty"` // answers left out by answer-detail-by-type count
+	RequestBytes        int               `json:",omitempty"`
+	ResponseBytes       int               `json:",omitempty"`
+	AmplificationFactor float64           `json:",omitempty"` // ResponseBytes / RequestBytes
+	Seq                 uint64            `json:",omitempty"` // per encoding record counter, see include-sequence
+	ServerBlock         string            `json:",omitempty"` // comma separated keys of the server block
+	NextPlugin          string            `json:",omitempty"` // include-next-plugin, the plugin gravwell hands requests to
+	FailureReason       string            `json:",omitempty"` // SERVFAIL bucket, see failureReason
+	SlowOutlier         bool              `json:",omitempty"` // slower than the rolling slow-outlier-percentile
+	DGASuspect          bool              `json:",omitempty"` // the client crossed the nxdomain-threshold
+	ClientQPS           float64           `json:",omitempty"` // decayed query rate of the client
+	Metadata            map[string]string `json:",omitempty"` // include-metadata labels and their values
+	Synthetic           *bool             `json:",omitempty"` // from response/synthesized, nil when unknown
+	Blocked             bool              `json:",omitempty"` // a blocklist plugin rewrote or refused the query
+	BlockReason         string            `json:",omitempty"` // the list or rule from blocklist/reason
+	FilterRule          string            `json:",omitempty"` // filter-debug, the rule that kept or would have dropped the request
+	FilterDropped       bool              `json:",omitempty"` // filter-debug, FilterRule would have dropped the request
+	ClockOffsetMS       *float64          `json:",omitempty"` // local clock offset from ntp-check-server, nil when unknown
+	ClientCountry       string            `json:",omitempty"` // country-cidr-map longest prefix match
+	ClientTLSVersion    string            `json:",omitempty"` // DoT and DoH only, e.g. TLS 1.3
+	ClientCipher        string            `json:",omitempty"`
+	QuestionBytes       int               `json:",omitempty"` // include-section-sizes, uncompressed wire size of the section
+	AnswerBytes         int               `json:",omitempty"`
+	AuthorityBytes      int               `json:",omitempty"`
+	AdditionalBytes     int               `json:",omitempty"`
+}
+
+func newBase(ts entry.Timestamp, local, remote net.Addr, tr *introspector) dnsBase {
+	base := dnsBase{
+		TS:                 recordTime{Timestamp: ts, format: tr.tsFormat},
+		EventID:            tr.eventID,
+		Proto:              local.Network(),
+		Local:              local.String(),
+		Remote:             remote.String(),
+		RecursionDesired:   tr.rd,
+		RecursionAvailable: tr.ra,
+		Authoritative:      tr.aa,
+		ACLAction:          tr.aclAction,
+		ACLPolicy:          tr.aclPolicy,
+		CacheStatus:        tr.cacheStat,
+		Zone:               tr.zone,
+		Wildcard:           tr.wildcard,
+		NSID:               tr.serverID(),
+		QueueDelayNS:       tr.queueDelay,
+		DroppedAnswers:     tr.droppedAnswers,
+		ExtendedErrorCode:  tr.edeCodes,
+		ExtendedErrorText:  tr.edeTexts,
+		Truncated:          tr.droppedAnswers > 0,
+		RequestBytes:       tr.reqBytes,
+		ServerBlock:        tr.serverBlock,
+		NextPlugin:         tr.nextPlugin,
+		FailureReason:      tr.failure,
+		SlowOutlier:        tr.slowOutlier,
+		DGASuspect:         tr.dgaSuspect,
+		ClientQPS:          tr.clientQPS,
+		Metadata:           tr.metadata,
+		Synthetic:          tr.synthetic,
+		Blocked:            tr.blocked,
+		BlockReason:        tr.blockWhy,
+		FilterRule:         tr.filterRule,
+		FilterDropped:      tr.filterDropped,
+		ClockOffsetMS:      tr.clockOffset,
+		ClientCountry:      tr.clientCountry,
+		ClientTLSVersion:   tr.tlsVersion,
+		ClientCipher:       tr.tlsCipher,
+		ResponseBytes:      tr.respBytes,
+		ResolvedIP:         resolvedIP(tr.a),
+		AnswerHash:         tr.answerHash,
+		AnswerCount:        tr.answerCount,
+	}
+	if tr.reqBytes > 0 {
+		base.AmplificationFactor = float64(tr.respBytes) / float64(tr.reqBytes)
+	}
+	if tr.rawFlags {
+		f := headerFlags(tr.hdr)
+		base.RawFlags = &f
+	}
+	if ss := tr.sections; ss != nil {
+		base.QuestionBytes, base.AnswerBytes = ss.question, ss.answer
+		base.AuthorityBytes, base.AdditionalBytes = ss.authority, ss.additional
+	}
+	if tr.ednsOptions {
+		base.RequestEDNSOptions = ednsOptions(tr.req)
+		base.ResponseEDNSOptions = tr.respOpts
+	}
+	return base
 }
 
 type dnsAnswer struct {
 	dnsBase
 	Question dns.RR
+	Answer   string        `json:",omitempty"` // populated when answer-format is rdata
+	SVCB     *svcbRecord   `json:",omitempty"` // SVCB and HTTPS parameters by key name
+	DNSSEC   *dnssecRecord `json:",omitempty"` // RRSIG and DNSKEY metadata
+}
+
+// dnsAnswerRR is emitted by the json-per-answer encoding, one per answer RR
+type dnsAnswerRR struct {
+	dnsBase
+	Question dns.Question
+	RR       dns.RR
+	Answer   string        `json:",omitempty"` // populated when answer-format is rdata
+	Count    int           `json:",omitempty"` // identical answers in this record, only with coalesce-answers
+	SVCB     *svcbRecord   `json:",omitempty"` // SVCB and HTTPS parameters by key name
+	DNSSEC   *dnssecRecord `json:",omitempty"` // RRSIG and DNSKEY metadata
 }
 
 type dnsQuestion struct {
@@ -361,80 +2747,483 @@ type dnsQuestion struct {
 	}
 }
 
-type jsonEncoder struct{}
+// dnsNegative is emitted in place of a dnsQuestion for NXDOMAIN and NODATA responses when log-negative is enabled
+type dnsNegative struct {
+	dnsBase
+	Question struct {
+		Hdr dns.Question
+	}
+	Negative bool
+	Rcode    string
+	SOA      *dns.SOA `json:",omitempty"`
+}
+
+// dnsNoQuestion stands in for the per question records of a message with an empty question
+// section when emit-empty-question is enabled, otherwise such messages produce no records
+type dnsNoQuestion struct {
+	dnsBase
+	NoQuestion bool
+	Rcode      string
+}
+
+const (
+	jsonStyleNDJSON string = `ndjson`
+	jsonStylePretty string = `pretty`
+)
+
+type jsonEncoder struct {
+	fieldMap  map[string]string // top level field renames
+	pretty    bool
+	perAnswer bool           // one record per answer RR rather than per question
+	seq       *atomic.Uint64 // record counter, nil unless include-sequence
+}
+
+// nextSeq returns the next record sequence number, 0 (and so omitted) when sequencing is off
+func (j jsonEncoder) nextSeq() uint64 {
+	if j.seq == nil {
+		return 0
+	}
+	return j.seq.Add(1)
+}
+
+func (j *jsonEncoder) setOption(name string, args []string) error {
+	switch name {
+	case `field-map`:
+		if len(args) != 2 {
+			return errors.New("field-map requires a field name and a new name")
+		}
+		if j.fieldMap == nil {
+			j.fieldMap = map[string]string{}
+		}
+		j.fieldMap[args[0]] = args[1]
+	case `style`:
+		if len(args) != 1 {
+			return errors.New("style requires a single argument")
+		}
+		switch strings.ToLower(args[0]) {
+		case jsonStyleNDJSON:
+			j.pretty = false
+		case jsonStylePretty:
+			j.pretty = true
+		default:
+			return fmt.Errorf("unknown style %q, must be %s or %s", args[0], jsonStyleNDJSON, jsonStylePretty)
+		}
+	default:
+		return errors.New("unknown option")
+	}
+	return nil
+}
 
 func (j jsonEncoder) Encode(ts entry.Timestamp, local, remote net.Addr, tr *introspector) (bbs [][]byte) {
-	var bb []byte
-	var err error
-	base := dnsBase{
-		TS:     ts,
-		Proto:  local.Network(),
-		Local:  local.String(),
-		Remote: remote.String(),
+	for _, v := range j.records(ts, local, remote, tr) {
+		bbs = append(bbs, j.format(j.body(ts, v)))
+	}
+	return
+}
+
+// body marshals a record, applying any field renames
+func (j jsonEncoder) body(ts entry.Timestamp, v interface{}) (bb []byte) {
+	bb = marshalRecord(ts, v)
+	if len(j.fieldMap) == 0 {
+		return
+	}
+	var m map[string]json.RawMessage
+	if err := json.Unmarshal(bb, &m); err != nil {
+		return
+	}
+	for from, to := range j.fieldMap {
+		if fv, ok := m[from]; ok {
+			delete(m, from)
+			m[to] = fv
+		}
+	}
+	return marshalRecord(ts, m)
+}
+
+// format applies the configured output style to a marshalled record
+func (j jsonEncoder) format(bb []byte) []byte {
+	if j.pretty {
+		buf := getBuffer()
+		defer putBuffer(buf)
+		if err := json.Indent(buf, bb, ``, `  `); err == nil {
+			return bytes.Clone(buf.Bytes())
+		}
+	}
+	return bb
+}
+
+// records builds the JSON objects for a request/response pair, one per question
+func (j jsonEncoder) records(ts entry.Timestamp, local, remote net.Addr, tr *introspector) (recs []interface{}) {
+	base := newBase(ts, local, remote, tr)
+	qs, truncated := tr.questions()
+	base.Truncated = base.Truncated || truncated
+	if j.perAnswer && len(qs) > 0 && len(tr.a) > 0 {
+		return j.answerRecords(base, qs, tr)
+	} else if len(qs) == 0 && tr.emptyQuestion {
+		base.Seq = j.nextSeq()
+		base.EventType = tr.eventType(eventNoQuestion)
+		return append(recs, dnsNoQuestion{
+			dnsBase:    base,
+			NoQuestion: true,
+			Rcode:      dns.RcodeToString[tr.rcode],
+		})
 	}
-	for i := range tr.q {
-		if i >= len(tr.a) {
+	for i := range qs {
+		tr.questionFields(&base, qs[i].Name)
+		base.Seq = j.nextSeq()
+		if tr.negative() {
+			base.EventType = tr.eventType(eventNegative)
+			dnsn := dnsNegative{
+				dnsBase:  base,
+				Negative: true,
+				Rcode:    dns.RcodeToString[tr.rcode],
+				SOA:      tr.soa(),
+			}
+			dnsn.Question.Hdr = qs[i]
+			recs = append(recs, dnsn)
+		} else if i >= len(tr.a) {
+			base.EventType = tr.eventType(eventQuery)
 			dnsq := dnsQuestion{
 				dnsBase: base,
 			}
-			dnsq.Question.Hdr = tr.q[i]
-			bb, err = json.Marshal(dnsq)
+			dnsq.Question.Hdr = qs[i]
+			recs = append(recs, dnsq)
 		} else {
+			base.EventType = tr.eventType(eventAnswer)
 			dnsa := dnsAnswer{
 				dnsBase:  base,
 				Question: tr.a[i],
+				SVCB:     svcbParams(tr.a[i]),
+				DNSSEC:   dnssecMeta(tr.a[i]),
 			}
-			bb, err = json.Marshal(dnsa)
+			if tr.answerFormat == answerFormatRdata {
+				dnsa.Answer = answerRdata(tr.a[i])
+			}
+			recs = append(recs, dnsa)
 		}
-		if err != nil {
-			bb = []byte(fmt.Sprintf("%s ERROR JSON marshal: %v", ts, err))
+	}
+	return
+}
+
+// questionEvent is the EventType of the record for question n, as the JSON encoder assigns it
+func (i *introspector) questionEvent(n int) string {
+	if i.negative() {
+		return i.eventType(eventNegative)
+	} else if n >= len(i.a) {
+		return i.eventType(eventQuery)
+	}
+	return i.eventType(eventAnswer)
+}
+
+// eventType is kind unless the message is a dynamic update, which is reported as one whatever
+// the shape of the record
+func (i *introspector) eventType(kind string) string {
+	if i.pre {
+		return eventRequest
+	} else if i.hdr.Opcode == dns.OpcodeUpdate {
+		return eventUpdate
+	}
+	return kind
+}
+
+// resolvedIP returns the address of the first A or AAAA answer, empty when there is none
+func resolvedIP(answers []dns.RR) string {
+	for _, rr := range answers {
+		switch v := rr.(type) {
+		case *dns.A:
+			return v.A.String()
+		case *dns.AAAA:
+			return v.AAAA.String()
+		}
+	}
+	return ``
+}
+
+// maxCNAMEChain bounds chain walks, resolvers give up well before this
+const maxCNAMEChain int = 16
+
+// cnameChain follows CNAMEs from name through the answers, returning the names along the way and
+// the rdata of the non-CNAME records at the end.  Nothing is returned when name is not aliased.
+// Loops and chains beyond maxCNAMEChain stop the walk.
+func cnameChain(name string, answers []dns.RR) (chain, final []string) {
+	seen := map[string]bool{}
+	cur := name
+	for len(chain) < maxCNAMEChain && !seen[strings.ToLower(stripFQDNDot(cur))] {
+		seen[strings.ToLower(stripFQDNDot(cur))] = true
+		var next string
+		for _, rr := range answers {
+			if c, ok := rr.(*dns.CNAME); ok && sameName(c.Hdr.Name, cur) {
+				next = c.Target
+				break
+			}
+		}
+		if next == `` {
+			break
+		}
+		if len(chain) == 0 {
+			chain = append(chain, cur)
+		}
+		chain = append(chain, next)
+		cur = next
+	}
+	if len(chain) == 0 {
+		return
+	}
+	for _, rr := range answers {
+		if _, ok := rr.(*dns.CNAME); !ok && sameName(rr.Header().Name, cur) {
+			final = append(final, answerRdata(rr))
+		}
+	}
+	return
+}
+
+// sameName compares names case insensitively, ignoring a trailing dot so names trimmed by
+// strip-fqdn-dot still match the CNAME targets they came from
+func sameName(a, b string) bool {
+	return strings.EqualFold(strings.TrimSuffix(a, `.`), strings.TrimSuffix(b, `.`))
+}
+
+// answerRecords builds one JSON object per answer RR, each tagged with the question that produced it
+func (j jsonEncoder) answerRecords(base dnsBase, qs []dns.Question, tr *introspector) (recs []interface{}) {
+	base.EventType = tr.eventType(eventAnswer)
+	rrs, counts := tr.a, []int(nil)
+	if tr.coalesce {
+		rrs, counts = coalesceAnswers(tr.a)
+	}
+	for i, rr := range rrs {
+		dnsa := dnsAnswerRR{
+			dnsBase:  base,
+			Question: answerQuestion(qs, rr),
+			RR:       rr,
+			SVCB:     svcbParams(rr),
+			DNSSEC:   dnssecMeta(rr),
+		}
+		if counts != nil {
+			dnsa.Count = counts[i]
+		}
+		tr.questionFields(&dnsa.dnsBase, dnsa.Question.Name)
+		dnsa.Seq = j.nextSeq()
+		if tr.answerFormat == answerFormatRdata {
+			dnsa.Answer = answerRdata(rr)
+		}
+		recs = append(recs, dnsa)
+	}
+	return
+}
+
+// coalesceAnswers collapses answers with the same owner, class, type, and rdata into the first
+// of them carrying the lowest TTL of the group, counts holds the size of each group
+func coalesceAnswers(rrs []dns.RR) (r []dns.RR, counts []int) {
+	type key struct {
+		name         string
+		class, qtype uint16
+		rdata        string
+	}
+	idx := make(map[key]int, len(rrs))
+	for _, rr := range rrs {
+		hdr := rr.Header()
+		k := key{name: strings.ToLower(hdr.Name), class: hdr.Class, qtype: hdr.Rrtype, rdata: answerRdata(rr)}
+		if i, ok := idx[k]; ok {
+			if counts[i]++; hdr.Ttl < r[i].Header().Ttl {
+				//copy so the response sent to the client is untouched
+				r[i] = dns.Copy(r[i])
+				r[i].Header().Ttl = hdr.Ttl
+			}
+			continue
 		}
-		bbs = append(bbs, bb)
+		idx[k] = len(r)
+		r = append(r, rr)
+		counts = append(counts, 1)
 	}
 	return
 }
 
+// answerQuestion returns the question matching the owner name of an answer, falling back to the first
+// question for answers further down a CNAME chain
+func answerQuestion(qs []dns.Question, rr dns.RR) dns.Question {
+	for _, q := range qs {
+		if strings.EqualFold(q.Name, rr.Header().Name) {
+			return q
+		}
+	}
+	return qs[0]
+}
+
 func (j jsonEncoder) Name() string {
+	if j.perAnswer {
+		return `json-per-answer`
+	}
 	return `json`
 }
 
 type errAnswer struct {
-	TS       entry.Timestamp
-	Proto    string
-	Local    string
-	Remote   string
-	Question dns.Question
-	Error    string
+	TS               recordTime
+	EventType        string
+	EventID          string `json:",omitempty"`
+	Proto            string
+	Local            string
+	Remote           string
+	Question         dns.Question
+	NoQuestion       bool `json:",omitempty"` // the request had no question, see emit-empty-question
+	Error            string
+	Truncated        bool              `json:",omitempty"`
+	QnameWire        string            `json:",omitempty"`
+	RegisteredDomain string            `json:",omitempty"`
+	PossibleTunnel   bool              `json:",omitempty"`
+	KnownBad         bool              `json:",omitempty"`
+	Seq              uint64            `json:",omitempty"`
+	ServerBlock      string            `json:",omitempty"`
+	FailureReason    string            `json:",omitempty"`
+	SlowOutlier      bool              `json:",omitempty"`
+	DGASuspect       bool              `json:",omitempty"`
+	ClientQPS        float64           `json:",omitempty"`
+	Metadata         map[string]string `json:",omitempty"`
+	EDNSOptions      []ednsOption      `json:",omitempty"` // request OPT options, see include-edns-options
+	FilterRule       string            `json:",omitempty"`
+	FilterDropped    bool              `json:",omitempty"`
+	ClockOffsetMS    *float64          `json:",omitempty"`
+	ClientCountry    string            `json:",omitempty"`
+	ClientTLSVersion string            `json:",omitempty"`
+	ClientCipher     string            `json:",omitempty"`
+}
+
+func (j jsonEncoder) EncodeError(ts entry.Timestamp, l, r net.Addr, tr *introspector, err error) (bbs [][]byte) {
+	for _, v := range j.errRecords(ts, l, r, tr, err) {
+		bbs = append(bbs, j.format(j.body(ts, v)))
+	}
+	return
 }
 
-func (j jsonEncoder) EncodeError(ts entry.Timestamp, l, r net.Addr, msg *dns.Msg, err error) (bbs [][]byte) {
-	var bb []byte
+// errRecords builds the JSON objects for a failed request, one per question
+func (j jsonEncoder) errRecords(ts entry.Timestamp, l, r net.Addr, tr *introspector, err error) (recs []interface{}) {
+	qs, truncated := tr.requestQuestions()
 	a := errAnswer{
-		TS:     ts,
-		Proto:  l.Network(),
-		Local:  l.String(),
-		Remote: r.String(),
-		Error:  err.Error(),
-	}
-	var lerr error
-	for _, q := range msg.Question {
+		TS:               recordTime{Timestamp: ts, format: tr.tsFormat},
+		EventType:        eventError,
+		EventID:          tr.eventID,
+		Proto:            l.Network(),
+		Local:            l.String(),
+		Remote:           r.String(),
+		Error:            err.Error(),
+		Truncated:        truncated,
+		ServerBlock:      tr.serverBlock,
+		FailureReason:    tr.failure,
+		SlowOutlier:      tr.slowOutlier,
+		DGASuspect:       tr.dgaSuspect,
+		ClientQPS:        tr.clientQPS,
+		Metadata:         tr.metadata,
+		FilterRule:       tr.filterRule,
+		FilterDropped:    tr.filterDropped,
+		ClockOffsetMS:    tr.clockOffset,
+		ClientCountry:    tr.clientCountry,
+		ClientTLSVersion: tr.tlsVersion,
+		ClientCipher:     tr.tlsCipher,
+	}
+	if tr.ednsOptions {
+		a.EDNSOptions = ednsOptions(tr.req)
+	}
+	if len(qs) == 0 && tr.emptyQuestion {
+		a.NoQuestion = true
+		a.Seq = j.nextSeq()
+		return append(recs, a)
+	}
+	for _, q := range qs {
 		a.Question = q
-		if bb, lerr = json.Marshal(a); lerr != nil {
-			bb = []byte(fmt.Sprintf("%s ERROR JSON marshal: %v", ts, lerr))
-		}
-		bbs = append(bbs, bb)
+		a.QnameWire = tr.wireName(q.Name)
+		a.RegisteredDomain = tr.registeredDomain(q.Name)
+		a.PossibleTunnel = tr.tunnel.match(q.Name)
+		a.KnownBad = tr.badDomains.knownBad(q.Name)
+		a.Seq = j.nextSeq()
+		recs = append(recs, a)
+	}
+	return
+}
+
+func marshalRecord(ts entry.Timestamp, v interface{}) (bb []byte) {
+	var err error
+	if bb, err = json.Marshal(v); err != nil {
+		bb = []byte(fmt.Sprintf("%s ERROR JSON marshal: %v", ts, err))
+	}
+	return
+}
+
+const hecSourcetype string = `coredns:dns`
+
+// hecEvent is the Splunk HTTP Event Collector envelope, the event body is identical to the json encoder
+type hecEvent struct {
+	Time       float64         `json:"time"`
+	Event      json.RawMessage `json:"event"`
+	Sourcetype string          `json:"sourcetype"`
+}
+
+type hecEncoder struct {
+	jsonEncoder
+}
+
+func (h hecEncoder) Encode(ts entry.Timestamp, local, remote net.Addr, tr *introspector) (bbs [][]byte) {
+	for _, v := range h.records(ts, local, remote, tr) {
+		bbs = append(bbs, h.format(marshalRecord(ts, newHecEvent(ts, h.body(ts, v)))))
+	}
+	return
+}
+
+func (h hecEncoder) EncodeError(ts entry.Timestamp, l, r net.Addr, tr *introspector, err error) (bbs [][]byte) {
+	for _, v := range h.errRecords(ts, l, r, tr, err) {
+		bbs = append(bbs, h.format(marshalRecord(ts, newHecEvent(ts, h.body(ts, v)))))
 	}
 	return
 }
 
+func (h hecEncoder) Name() string {
+	return `hec`
+}
+
+func newHecEvent(ts entry.Timestamp, v json.RawMessage) hecEvent {
+	return hecEvent{
+		Time:       float64(ts.StandardTime().UnixNano()) / 1e9,
+		Event:      v,
+		Sourcetype: hecSourcetype,
+	}
+}
+
 func getArgLine(c *caddy.Controller) (name, value string, err error) {
+	var block [][]string
+	if name, value, block, err = getDirective(c); err == nil && block != nil {
+		err = fmt.Errorf("%s does not take a block", name)
+	}
+	return
+}
+
+// getDirective reads a directive with a single argument and an optional block of
+// sub-directives, each line in the block is returned lowercased name first
+func getDirective(c *caddy.Controller) (name, value string, block [][]string, err error) {
 	name = strings.ToLower(c.Val())
 	if !c.NextArg() {
 		err = fmt.Errorf("Missing argument to %s", name)
+		return
 	}
 	value = c.Val()
-	if c.NextArg() {
+	if !c.NextArg() {
+		return
+	} else if c.Val() != `{` {
 		err = fmt.Errorf("%s only takes one argument", name)
+		return
+	}
+	block = [][]string{}
+	for c.Next() {
+		if c.Val() == `}` {
+			return
+		}
+		line := []string{strings.ToLower(c.Val())}
+		for c.NextArg() {
+			if c.Val() == `}` {
+				block = append(block, line)
+				return
+			}
+			line = append(line, c.Val())
+		}
+		block = append(block, line)
 	}
+	err = fmt.Errorf("Unterminated %s block", name)
 	return
 }
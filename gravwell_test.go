@@ -9,12 +9,40 @@
 package gravwellcoredns
 
 import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/coredns/caddy"
+	"github.com/coredns/coredns/core/dnsserver"
+	"github.com/coredns/coredns/plugin"
+	"github.com/coredns/coredns/plugin/metadata"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/google/uuid"
+	"github.com/gravwell/gravwell/v3/ingest"
+	"github.com/gravwell/gravwell/v3/ingest/entry"
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 )
 
+// testConfigBase is an open gravwell block with the minimum a config needs, tests append
+// directives and the closing brace
+const testConfigBase = "gravwell {\n\tIngest-Secret foo\n\tCleartext-Target 10.0.0.1:4023\n"
+
 const (
 	goodConfig = `gravwell {
 	Ingest-Secret testing
@@ -115,6 +143,34 @@ const (
 	max-cache-size-mb -1
 	}`
 
+	badCache3Config = `gravwell {
+	Ingest-Secret testing
+	Cleartext-Target 192.168.1.1:4024
+	ingest-cache-path /tmp/dns.cache
+	max-cache-size-mb foobar
+	Tag dns
+	}`
+
+	goodCacheDepthConfig = `gravwell {
+	Ingest-Secret testing
+	Cleartext-Target 192.168.1.1:4024
+	ingest-cache-path /tmp/dns.cache
+	cache-depth 512
+	}`
+
+	badCacheDepthConfig = `gravwell {
+	Ingest-Secret testing
+	Cleartext-Target 192.168.1.1:4024
+	cache-depth 512
+	}`
+
+	badCacheDepth2Config = `gravwell {
+	Ingest-Secret testing
+	Cleartext-Target 192.168.1.1:4024
+	ingest-cache-path /tmp/dns.cache
+	cache-depth -1
+	}`
+
 	badWriteTimeoutConfig = `gravwell {
 	Ingest-Secret testing
 	Cleartext-Target 192.168.1.1:4024
@@ -123,6 +179,42 @@ const (
 	Write-Timeout foobar
 	}`
 
+	goodDisconnectCacheConfig = `gravwell {
+	Ingest-Secret testing
+	Cleartext-Target 192.168.1.1:4024
+	Tag dns
+	ingest-cache-path /tmp/dns.cache
+	on-disconnect-cache true
+	cache-max-age 1h
+	}`
+
+	badDisconnectCacheConfig = `gravwell {
+	Ingest-Secret testing
+	Cleartext-Target 192.168.1.1:4024
+	Tag dns
+	on-disconnect-cache true
+	}`
+
+	badCacheMaxAgeConfig = `gravwell {
+	Ingest-Secret testing
+	Cleartext-Target 192.168.1.1:4024
+	Tag dns
+	ingest-cache-path /tmp/dns.cache
+	cache-max-age -5m
+	}`
+
+	goodMaxQuestionsConfig = `gravwell {
+	Ingest-Secret testing
+	Cleartext-Target 192.168.1.1:4024
+	max-questions 4
+	}`
+
+	badMaxQuestionsConfig = `gravwell {
+	Ingest-Secret testing
+	Cleartext-Target 192.168.1.1:4024
+	max-questions 0
+	}`
+
 	goodWriteTimeoutConfig = `gravwell {
 	Ingest-Secret testing
 	Cleartext-Target 192.168.1.1:4024
@@ -151,6 +243,139 @@ func TestPlay(t *testing.T) {
 	}
 }
 
+func TestParseConfigDirectives(t *testing.T) {
+	tests := []struct {
+		name  string
+		lines string // appended to testConfigBase ahead of the closing brace
+		ok    bool
+		check func(cfgType) bool // optional, on accepted configs
+	}{
+		{`stats-interval default`, "", true, func(c cfgType) bool { return c.StatsInterval == connWatchInterval }},
+		{`stats-interval`, "\tStats-Interval 30s\n", true, func(c cfgType) bool { return c.StatsInterval == 30*time.Second }},
+		{`stats-interval too short`, "\tStats-Interval 100ms\n", false, nil},
+		{`stats-interval negative`, "\tStats-Interval -1s\n", false, nil},
+		{`stats-interval not a duration`, "\tStats-Interval soon\n", false, nil},
+
+		{`log-window`, "\tLog-Window 20:00-04:00 Europe/Berlin\n", true, func(c cfgType) bool { return len(c.LogWindow) == 2 }},
+		{`log-window without an end`, "\tLog-Window 20:00\n", false, nil},
+
+		{`mask-client-ip`, "\tMask-Client-IP 24\n\tMask-Client-IP6 56\n", true, func(c cfgType) bool {
+			return c.MaskClientIPv4 == 24 && c.MaskClientIPv6 == 56
+		}},
+		{`mask-client-ip zero`, "\tMask-Client-IP 0\n", false, nil},
+		{`mask-client-ip too long`, "\tMask-Client-IP 33\n", false, nil},
+		{`mask-client-ip slash`, "\tMask-Client-IP /24\n", false, nil},
+		{`mask-client-ip6 too long`, "\tMask-Client-IP6 129\n", false, nil},
+
+		{`ntp-check-server`, "\tNTP-Check-Server pool.ntp.org\n", true, func(c cfgType) bool {
+			return c.NTPCheckServer == `pool.ntp.org:123` && c.NTPCheckInterval == defaultNTPInterval
+		}},
+		{`ntp-check-interval`, "\tNTP-Check-Server 10.0.0.5:1123\n\tNTP-Check-Interval 1m\n", true, func(c cfgType) bool {
+			return c.NTPCheckServer == `10.0.0.5:1123` && c.NTPCheckInterval == time.Minute
+		}},
+		{`ntp-check-interval without a server`, "\tNTP-Check-Interval 1m\n", false, nil},
+		{`ntp-check-interval too short`, "\tNTP-Check-Server pool.ntp.org\n\tNTP-Check-Interval 10ms\n", false, nil},
+
+		{`client-qps-halflife`, "\tClient-QPS-Halflife 30s\n", true, func(c cfgType) bool { return c.ClientQPSHalflife == 30*time.Second }},
+		{`client-qps-halflife too short`, "\tClient-QPS-Halflife 10ms\n", false, nil},
+		{`client-qps-halflife not a duration`, "\tClient-QPS-Halflife fast\n", false, nil},
+
+		{`sample-rate`, "\tSample-Rate 0.5\n", true, func(c cfgType) bool { return c.SampleRate == 0.5 && c.SampleKey == sampleKeyQuery }},
+		{`sample-key`, "\tSample-Rate 0.5\n\tSample-Key Client\n", true, func(c cfgType) bool {
+			return c.SampleRate == 0.5 && c.SampleKey == sampleKeyClient
+		}},
+		{`sample-rate zero`, "\tSample-Rate 0\n", false, nil},
+		{`sample-rate above one`, "\tSample-Rate 1.5\n", false, nil},
+		{`sample-rate NaN`, "\tSample-Rate NaN\n", false, nil},
+		{`sample-key unknown`, "\tSample-Rate 0.5\n\tSample-Key qname\n", false, nil},
+		{`sample-key without a rate`, "\tSample-Key client\n", false, nil},
+
+		{`max-concurrent-writes`, "\tMax-Concurrent-Writes 64\n", true, func(c cfgType) bool { return c.MaxConcurrentWrites == 64 }},
+		{`max-concurrent-writes zero`, "\tMax-Concurrent-Writes 0\n", false, nil},
+
+		{`answer-head`, "\tAnswer-Head 3\n", true, func(c cfgType) bool { return c.AnswerHead == 3 }},
+		{`answer-head zero`, "\tAnswer-Head 0\n", false, nil},
+		{`answer-head not a number`, "\tAnswer-Head few\n", false, nil},
+
+		{`timestamp-json`, "\tTimestamp-JSON UnixMilli\n", true, func(c cfgType) bool { return c.encodeOptions().tsFormat == timestampUnixMilli }},
+		{`timestamp-json unknown`, "\tTimestamp-JSON epoch\n", false, nil},
+
+		{`nxdomain-threshold`, "\tNXDomain-Threshold 50\n", true, func(c cfgType) bool {
+			return c.NXDomainThreshold == 50 && c.NXDomainWindow == defaultNXWindow
+		}},
+		{`nxdomain-window`, "\tNXDomain-Threshold 10\n\tNXDomain-Window 30s\n", true, func(c cfgType) bool { return c.NXDomainWindow == 30*time.Second }},
+		{`nxdomain-threshold zero`, "\tNXDomain-Threshold 0\n", false, nil},
+		{`nxdomain-threshold not a number`, "\tNXDomain-Threshold lots\n", false, nil},
+		{`nxdomain-window too short`, "\tNXDomain-Threshold 10\n\tNXDomain-Window 10ms\n", false, nil},
+		{`nxdomain-window without a threshold`, "\tNXDomain-Window 30s\n", false, nil},
+
+		{`include-metadata`, "\tInclude-Metadata kubernetes/client-namespace geoip/city/name\n\tInclude-Metadata custom/team kubernetes/client-namespace\n", true, func(c cfgType) bool {
+			return reflect.DeepEqual(c.MetadataKeys, []string{`kubernetes/client-namespace`, `geoip/city/name`, `custom/team`})
+		}},
+		{`include-metadata empty`, "\tInclude-Metadata\n", false, nil},
+		{`include-metadata without a plugin`, "\tInclude-Metadata nolabel\n", false, nil},
+		{`include-metadata empty plugin`, "\tInclude-Metadata /name\n", false, nil},
+
+		{`target priorities`, "\tCiphertext-Target 10.0.0.2:4024/5\n\tCleartext-Target 10.0.0.3:4023/-1\n", true, func(c cfgType) bool {
+			tiers, err := c.targetTiers()
+			return err == nil && reflect.DeepEqual(tiers, [][]string{{`tls://10.0.0.2:4024`}, {`tcp://10.0.0.1:4023`}, {`tcp://10.0.0.3:4023`}})
+		}},
+		{`targets without priorities`, "\tCleartext-Target 10.0.0.3:4023\n", true, func(c cfgType) bool {
+			//no priorities is a single tier
+			tiers, err := c.targetTiers()
+			return err == nil && len(tiers) == 1 && len(tiers[0]) == 2
+		}},
+		{`target priority not a number`, "\tCleartext-Target 10.0.0.3:4023/high\n", false, nil},
+		{`target priority fractional`, "\tCleartext-Target 10.0.0.3:4023/1.5\n", false, nil},
+		{`target priority without a port`, "\tCleartext-Target 10.0.0.3/1\n", false, nil},
+
+		{`tag-on-rcode`, "\tTag dns\n\tTag-On-Rcode servfail dns-errors\n\tTag-On-Rcode REFUSED dns-errors\n\tTag-On-Rcode NXDOMAIN dns-nx\n", true, func(c cfgType) bool {
+			return reflect.DeepEqual(c.tags(), []string{`dns`, `dns-errors`, `dns-nx`}) && c.RcodeTags[`SERVFAIL`] == `dns-errors`
+		}},
+		{`tag-on-rcode unknown rcode`, "\tTag-On-Rcode NOTANRCODE dns-errors\n", false, nil},
+		{`tag-on-rcode without a tag`, "\tTag-On-Rcode SERVFAIL\n", false, nil},
+		{`tag-on-rcode unknown encoding`, "\tTag-On-Rcode SERVFAIL dns errors\n", false, nil},
+		{`tag-on-rcode bad tag`, "\tTag-On-Rcode SERVFAIL bad*tag\n", false, nil},
+		{`tag-on-rcode encoding`, "\tTag dns\n\tTag-On-Rcode NXDOMAIN dns-nx text\n\tTag-On-Rcode REFUSED dns-nx TEXT\n", true, func(c cfgType) bool {
+			return c.TagEncoders[`dns-nx`] == `text`
+		}},
+		{`tag-on-rcode encoding not registered`, "\tTag-On-Rcode NXDOMAIN dns-nx nosuchencoding\n", false, nil},
+		{`tag-on-rcode conflicting encodings`, "\tTag-On-Rcode NXDOMAIN dns-nx text\n\tTag-On-Rcode REFUSED dns-nx json\n", false, nil},
+		{`tag-on-rcode extra argument`, "\tTag-On-Rcode NXDOMAIN dns-nx text extra\n", false, nil},
+		//text-prefix is satisfied by a tag-on-rcode text encoding
+		{`tag-on-rcode text-prefix`, "\tTag dns\n\tTag-On-Rcode NXDOMAIN dns-nx text\n\tText-Prefix <dns>\n", true, nil},
+
+		{`audit-tag`, "\tTag dns\n\tAudit-Tag dns-audit\n\tTag-On-Rcode SERVFAIL dns-errors\n", true, func(c cfgType) bool {
+			return reflect.DeepEqual(c.tags(), []string{`dns`, `dns-audit`, `dns-errors`})
+		}},
+		{`audit-tag is the main tag`, "\tTag dns\n\tAudit-Tag dns\n", false, nil},
+		{`audit-tag is an rcode tag`, "\tAudit-Tag dns-errors\n\tTag-On-Rcode SERVFAIL dns-errors\n", false, nil},
+		{`audit-tag bad tag`, "\tAudit-Tag bad*tag\n", false, nil},
+
+		{`log-timing pre with audit-tag`, "\tLog-Timing pre\n\tAudit-Tag dns-audit\n", true, nil},
+		{`log-timing post`, "\tLog-Timing POST\n", true, func(c cfgType) bool { return c.LogTiming == `` }},
+		{`log-timing unknown`, "\tLog-Timing during\n", false, nil},
+		{`log-timing pre with skip-cache-hits`, "\tLog-Timing pre\n\tSkip-Cache-Hits true\n", false, nil},
+
+		//the deadline cannot be combined with the async queue
+		{`ingest-deadline with a queue`, "\tIngest-Deadline 50ms\n\tIngest-Queue-Depth 10\n", false, nil},
+		{`include-sequence without json`, "\tInclude-Sequence true\n\tEncoding text\n", false, nil},
+	}
+	for _, tt := range tests {
+		cfg, _, err := parseConfig(caddy.NewTestController("dns", testConfigBase+tt.lines+"}"))
+		if !tt.ok {
+			if err == nil {
+				t.Fatalf("%s: accepted %q", tt.name, tt.lines)
+			}
+			continue
+		} else if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		} else if tt.check != nil && !tt.check(cfg) {
+			t.Fatalf("%s: bad config %+v", tt.name, cfg)
+		}
+	}
+}
+
 func TestSetupGravwell(t *testing.T) {
 
 	//test empty config
@@ -188,6 +413,37 @@ func TestSetupGravwell(t *testing.T) {
 		t.Fatal("Failed to set default on missing tag")
 	}
 
+	//check default-tag replaces the fallback but not an explicit tag
+	c = caddy.NewTestController("dns", `gravwell {
+	Ingest-Secret testing
+	Cleartext-Target 192.168.1.3:4024
+	Default-Tag dns_logs
+	}`)
+	if cfg, _, err := parseConfig(c); err != nil {
+		t.Fatal(err)
+	} else if cfg.Tag != `dns_logs` {
+		t.Fatalf("default-tag not used for a missing tag: %q", cfg.Tag)
+	}
+	c = caddy.NewTestController("dns", `gravwell {
+	Ingest-Secret testing
+	Cleartext-Target 192.168.1.3:4024
+	Default-Tag dns_logs
+	Tag dns
+	}`)
+	if cfg, _, err := parseConfig(c); err != nil {
+		t.Fatal(err)
+	} else if cfg.Tag != `dns` {
+		t.Fatalf("default-tag overrode tag: %q", cfg.Tag)
+	}
+	c = caddy.NewTestController("dns", `gravwell {
+	Ingest-Secret testing
+	Cleartext-Target 192.168.1.3:4024
+	Default-Tag dns!logs
+	}`)
+	if _, _, err := parseConfig(c); err == nil {
+		t.Fatal("Missed invalid default-tag")
+	}
+
 	//check bad log level
 	c = caddy.NewTestController("dns", badLogLevelConfig)
 	if _, _, err := parseConfig(c); err == nil {
@@ -241,6 +497,124 @@ func TestSetupGravwell(t *testing.T) {
 	if _, _, err := parseConfig(c); err == nil {
 		t.Fatal("Missed bad cache config")
 	}
+	c = caddy.NewTestController("dns", badCache3Config)
+	if _, _, err := parseConfig(c); err == nil {
+		t.Fatal("Missed bad cache config followed by a good directive")
+	}
+
+	//check cache depth
+	c = caddy.NewTestController("dns", goodCacheDepthConfig)
+	if conf, _, err := parseConfig(c); err != nil {
+		t.Fatal(err)
+	} else if conf.Cache_Depth != 512 {
+		t.Fatalf("bad cache depth %d", conf.Cache_Depth)
+	}
+	for _, v := range []string{badCacheDepthConfig, badCacheDepth2Config} {
+		if _, _, err := parseConfig(caddy.NewTestController("dns", v)); err == nil {
+			t.Fatalf("Missed bad cache depth config %s", v)
+		}
+	}
+
+	//check disconnect only caching
+	c = caddy.NewTestController("dns", goodDisconnectCacheConfig)
+	if conf, _, err := parseConfig(c); err != nil {
+		t.Fatal(err)
+	} else if conf.Cache_Mode != ingest.CacheModeFail || conf.CacheMaxAge != time.Hour {
+		t.Fatalf("bad disconnect cache config: %q %v", conf.Cache_Mode, conf.CacheMaxAge)
+	}
+	c = caddy.NewTestController("dns", badDisconnectCacheConfig)
+	if _, _, err := parseConfig(c); err == nil {
+		t.Fatal("Missed disconnect cache without a cache path")
+	}
+	c = caddy.NewTestController("dns", badCacheMaxAgeConfig)
+	if _, _, err := parseConfig(c); err == nil {
+		t.Fatal("Missed bad cache max age")
+	}
+
+	//check question limits
+	c = caddy.NewTestController("dns", goodMaxQuestionsConfig)
+	if conf, _, err := parseConfig(c); err != nil {
+		t.Fatal(err)
+	} else if conf.MaxQuestions != 4 {
+		t.Fatalf("bad max questions %d", conf.MaxQuestions)
+	}
+	c = caddy.NewTestController("dns", badMaxQuestionsConfig)
+	if _, _, err := parseConfig(c); err == nil {
+		t.Fatal("Missed bad max questions")
+	}
+	c = caddy.NewTestController("dns", goodConfig)
+	if conf, _, err := parseConfig(c); err != nil {
+		t.Fatal(err)
+	} else if conf.MaxQuestions != defaultMaxQuestions {
+		t.Fatalf("bad default max questions %d", conf.MaxQuestions)
+	}
+
+	//check unsupported connection tuning is rejected
+	c = caddy.NewTestController("dns", `gravwell {
+	Ingest-Secret testing
+	Cleartext-Target 192.168.1.1:4024
+	tcp-keepalive 30s
+	}`)
+	if _, _, err := parseConfig(c); err == nil {
+		t.Fatal("Missed unsupported tcp-keepalive")
+	}
+	c = caddy.NewTestController("dns", `gravwell {
+	Ingest-Secret testing
+	Ciphertext-Target 192.168.1.1:4024
+	tls-server-name indexer.example.com
+	}`)
+	if _, _, err := parseConfig(c); err == nil {
+		t.Fatal("Missed unsupported tls-server-name")
+	}
+
+	//check the ingest queue
+	c = caddy.NewTestController("dns", `gravwell {
+	Ingest-Secret testing
+	Cleartext-Target 192.168.1.1:4024
+	ingest-queue-depth 1024
+	queue-warn-percent 90
+	}`)
+	if conf, _, err := parseConfig(c); err != nil {
+		t.Fatal(err)
+	} else if conf.QueueDepth != 1024 || conf.QueueWarnPercent != 90 {
+		t.Fatalf("bad queue config %d %d", conf.QueueDepth, conf.QueueWarnPercent)
+	}
+	c = caddy.NewTestController("dns", `gravwell {
+	Ingest-Secret testing
+	Cleartext-Target 192.168.1.1:4024
+	queue-warn-percent 90
+	}`)
+	if _, _, err := parseConfig(c); err == nil {
+		t.Fatal("Missed queue-warn-percent without a queue")
+	}
+	c = caddy.NewTestController("dns", `gravwell {
+	Ingest-Secret testing
+	Cleartext-Target 192.168.1.1:4024
+	ingest-queue-depth 1024
+	queue-warn-percent 101
+	}`)
+	if _, _, err := parseConfig(c); err == nil {
+		t.Fatal("Missed bad queue-warn-percent")
+	}
+
+	//check client port filters
+	c = caddy.NewTestController("dns", `gravwell {
+	Ingest-Secret testing
+	Cleartext-Target 192.168.1.1:4024
+	filter-client-port 53
+	filter-client-port 40000-40100
+	}`)
+	if conf, _, err := parseConfig(c); err != nil {
+		t.Fatal(err)
+	} else if len(conf.ClientPortFilter) != 2 || conf.ClientPortMode != filterModeDeny {
+		t.Fatalf("bad client port filter %v %q", conf.ClientPortFilter, conf.ClientPortMode)
+	}
+	for _, bad := range []string{"filter-client-port 0", "filter-client-port 100-10", "filter-client-port-mode allow", "filter-client-port 53\n\tfilter-client-port-mode maybe"} {
+		c = caddy.NewTestController("dns", "gravwell {\n\tIngest-Secret testing\n\tCleartext-Target 192.168.1.1:4024\n\t"+bad+"\n}")
+		if _, _, err := parseConfig(c); err == nil {
+			t.Fatalf("Missed bad client port filter %q", bad)
+		}
+	}
 
 	//check timeouts
 	c = caddy.NewTestController("dns", badWriteTimeoutConfig)
@@ -254,3 +628,1735 @@ func TestSetupGravwell(t *testing.T) {
 		t.Fatalf("Missed write timeout %v != %v", conf.WriteTimeout, 900*time.Millisecond)
 	}
 }
+
+func TestHecEncoder(t *testing.T) {
+	ts := entry.UnixTime(1700000000, 500000000)
+	local := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 53}
+	remote := &net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 40000}
+	rr, err := dns.NewRR("example.com. 300 IN A 1.2.3.4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	is := &introspector{
+		q: []dns.Question{{Name: "example.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET}},
+		a: []dns.RR{rr},
+	}
+	enc, err := getEncoder(`hec`, nil)
+	if err != nil {
+		t.Fatal(err)
+	} else if enc.Name() != `hec` {
+		t.Fatalf("bad encoder name %q", enc.Name())
+	}
+	bbs := enc.Encode(ts, local, remote, is)
+	if len(bbs) != 1 {
+		t.Fatalf("invalid record count %d", len(bbs))
+	}
+	var ev struct {
+		Time       float64
+		Sourcetype string
+		Event      json.RawMessage
+	}
+	if err = json.Unmarshal(bbs[0], &ev); err != nil {
+		t.Fatal(err)
+	}
+	if ev.Time != 1700000000.5 {
+		t.Fatalf("bad HEC time %v", ev.Time)
+	} else if ev.Sourcetype != hecSourcetype {
+		t.Fatalf("bad HEC sourcetype %q", ev.Sourcetype)
+	}
+	//the event body must match the json encoder output exactly
+	if jbbs := (jsonEncoder{}).Encode(ts, local, remote, is); string(jbbs[0]) != string(ev.Event) {
+		t.Fatalf("HEC event body mismatch:\n%s\n%s", jbbs[0], ev.Event)
+	}
+}
+
+func TestPruneStaleCache(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), `cache`)
+	//missing caches are not an error
+	if err := pruneStaleCache(dir, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	fp := filepath.Join(dir, `tagcache`)
+	if err := os.WriteFile(fp, []byte("test"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	//the directory may be shared, only the muxer's own files are considered or removed
+	other := filepath.Join(dir, `other.db`)
+	if err := os.WriteFile(other, []byte("test"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	//fresh caches are left alone
+	if err := pruneStaleCache(dir, time.Hour); err != nil {
+		t.Fatal(err)
+	} else if _, err = os.Stat(fp); err != nil {
+		t.Fatal("fresh cache was removed", err)
+	}
+
+	//stale caches are removed, a fresh unrelated file does not keep them
+	old := time.Now().Add(-2 * time.Hour)
+	if err := os.Chtimes(fp, old, old); err != nil {
+		t.Fatal(err)
+	}
+	if err := pruneStaleCache(dir, time.Hour); err != nil {
+		t.Fatal(err)
+	} else if _, err = os.Stat(fp); !os.IsNotExist(err) {
+		t.Fatal("stale cache was not removed", err)
+	} else if _, err = os.Stat(other); err != nil {
+		t.Fatal("pruning removed a file the muxer does not own", err)
+	}
+
+	//a path is pruned once per process and never while running sinks use it
+	if err := os.WriteFile(fp, []byte("test"), 0600); err != nil {
+		t.Fatal(err)
+	} else if err = os.Chtimes(fp, old, old); err != nil {
+		t.Fatal(err)
+	}
+	cfg := mustParse(t, "gravwell {\n\tStdout-Sink true\n\tLifecycle-Markers false\n}")
+	cfg.Ingest_Cache_Path, cfg.CacheMaxAge = dir, time.Hour
+	active.Lock()
+	active.sinks = append(active.sinks, &activeSinks{cfg: cfg})
+	as, err := startSinks(cfg, nil)
+	active.sinks = active.sinks[:len(active.sinks)-1]
+	active.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	} else if _, err = os.Stat(fp); err != nil {
+		t.Fatal("pruned a cache in use by running sinks", err)
+	}
+	as.release()
+	active.Lock()
+	as, err = startSinks(cfg, nil)
+	active.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	} else if _, err = os.Stat(fp); err != nil {
+		t.Fatal("pruned a cache after process start", err)
+	}
+	as.release()
+	active.Lock()
+	delete(active.pruned, dir)
+	active.Unlock()
+}
+
+func TestRecursionFlags(t *testing.T) {
+	rw := &test.ResponseWriter{}
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+	req.RecursionDesired = true
+
+	//non-recursive server answering a recursive query
+	resp := new(dns.Msg)
+	resp.SetReply(req)
+	resp.RecursionAvailable = false
+	resp.Answer = append(resp.Answer, test.A("example.com. 300 IN A 1.2.3.4"))
+
+	is := newIntrospector(rw, req)
+	if err := is.WriteMsg(resp); err != nil {
+		t.Fatal(err)
+	}
+	bbs := jsonEncoder{}.Encode(entry.Now(), rw.LocalAddr(), rw.RemoteAddr(), is)
+	if len(bbs) != 1 {
+		t.Fatalf("invalid record count %d", len(bbs))
+	}
+	var v dnsBase
+	if err := json.Unmarshal(bbs[0], &v); err != nil {
+		t.Fatal(err)
+	}
+	if !v.RecursionDesired || v.RecursionAvailable {
+		t.Fatalf("bad recursion flags: RD=%v RA=%v", v.RecursionDesired, v.RecursionAvailable)
+	}
+}
+
+func TestPassiveDNSEncoder(t *testing.T) {
+	ts := entry.UnixTime(1700000000, 500000000)
+	local := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 53}
+	remote := &net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 40000}
+	is := &introspector{
+		q: []dns.Question{{Name: "example.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET}},
+		a: []dns.RR{
+			test.A("example.com. 300 IN A 1.2.3.4"),
+			test.A("example.com. 300 IN A 5.6.7.8"),
+			test.A("example.com. 300 IN A 1.2.3.4"),
+		},
+	}
+	enc, err := getEncoder(`passivedns`, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bbs := enc.Encode(ts, local, remote, is)
+	exp := []string{
+		`1700000000.500000||10.0.0.1||127.0.0.1||IN||example.com.||A||1.2.3.4||300||2||answer`,
+		`1700000000.500000||10.0.0.1||127.0.0.1||IN||example.com.||A||5.6.7.8||300||1||answer`,
+	}
+	if len(bbs) != len(exp) {
+		t.Fatalf("invalid record count %d != %d", len(bbs), len(exp))
+	}
+	for i := range exp {
+		if string(bbs[i]) != exp[i] {
+			t.Fatalf("bad passivedns line:\n%s\n%s", bbs[i], exp[i])
+		}
+	}
+
+	//negative responses carry the rcode in place of the answer
+	is.a = nil
+	is.rcode = dns.RcodeNameError
+	if bbs = enc.Encode(ts, local, remote, is); len(bbs) != 1 {
+		t.Fatalf("invalid record count %d", len(bbs))
+	} else if s := string(bbs[0]); s != `1700000000.500000||10.0.0.1||127.0.0.1||IN||example.com.||A||NXDOMAIN||0||1||query` {
+		t.Fatalf("bad passivedns negative line %s", s)
+	}
+	is.logNegative = true
+	is.req = &dns.Msg{Question: is.q}
+	is.maxQuestions = defaultMaxQuestions
+	if s := string(enc.Encode(ts, local, remote, is)[0]); !strings.HasSuffix(s, `||NXDOMAIN||0||1||negative`) {
+		t.Fatalf("bad passivedns log-negative line %s", s)
+	} else if s = string(enc.EncodeError(ts, local, remote, is, errors.New(`timeout`))[0]); !strings.HasSuffix(s, `||SERVFAIL||0||1||error`) {
+		t.Fatalf("bad passivedns error line %s", s)
+	}
+}
+
+func TestACLMetadata(t *testing.T) {
+	ts := entry.Now()
+	local := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 53}
+	remote := &net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 40000}
+	q := []dns.Question{{Name: "example.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET}}
+
+	//no metadata means no fields
+	is := &introspector{q: q}
+	is.readMetadata(context.Background())
+	bbs := jsonEncoder{}.Encode(ts, local, remote, is)
+	if len(bbs) != 1 {
+		t.Fatalf("invalid record count %d", len(bbs))
+	} else if bytes.Contains(bbs[0], []byte(`ACL`)) {
+		t.Fatalf("ACL fields present without metadata: %s", bbs[0])
+	}
+
+	ctx := metadata.ContextWithMetadata(context.Background())
+	metadata.SetValueFunc(ctx, aclActionMetadataKey, func() string { return `block` })
+	metadata.SetValueFunc(ctx, aclPolicyMetadataKey, func() string { return `internal-only` })
+	is = &introspector{q: q}
+	is.readMetadata(ctx)
+	var v dnsBase
+	if err := json.Unmarshal(jsonEncoder{}.Encode(ts, local, remote, is)[0], &v); err != nil {
+		t.Fatal(err)
+	} else if v.ACLAction != `block` || v.ACLPolicy != `internal-only` {
+		t.Fatalf("bad ACL fields: %q %q", v.ACLAction, v.ACLPolicy)
+	}
+}
+
+func TestIncludeMetadata(t *testing.T) {
+	ctx := metadata.ContextWithMetadata(context.Background())
+	metadata.SetValueFunc(ctx, `kubernetes/client-namespace`, func() string { return `payments` })
+	metadata.SetValueFunc(ctx, `custom/team`, func() string { return `` })
+	dw := &discardWriter{keep: true}
+	gh := gwHandler{
+		Next:          answerHandler(false),
+		im:            dw,
+		enc:           &jsonEncoder{},
+		metadataKeys:  []string{`kubernetes/client-namespace`, `geoip/city/name`, `custom/team`},
+		encodeOptions: encodeOptions{maxQuestions: defaultMaxQuestions},
+	}
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+	if _, err := gh.ServeDNS(ctx, &test.ResponseWriter{}, req); err != nil {
+		t.Fatal(err)
+	}
+	var v dnsBase
+	if err := json.Unmarshal(dw.ents[0].Data, &v); err != nil {
+		t.Fatal(err)
+	} else if exp := map[string]string{`kubernetes/client-namespace`: `payments`}; !reflect.DeepEqual(v.Metadata, exp) {
+		//missing and empty labels are left out
+		t.Fatalf("bad metadata %v != %v", v.Metadata, exp)
+	}
+
+	//nothing matched, no field at all
+	dw.ents = nil
+	if _, err := gh.ServeDNS(context.Background(), &test.ResponseWriter{}, req); err != nil {
+		t.Fatal(err)
+	} else if bytes.Contains(dw.ents[0].Data, []byte(`Metadata`)) {
+		t.Fatalf("Metadata present without any values: %s", dw.ents[0].Data)
+	}
+}
+
+func TestMaxQuestions(t *testing.T) {
+	ts := entry.Now()
+	local := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 53}
+	remote := &net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 40000}
+	req := new(dns.Msg)
+	for i := 0; i < 1000; i++ {
+		req.Question = append(req.Question, dns.Question{Name: fmt.Sprintf("host%d.example.com.", i), Qtype: dns.TypeA, Qclass: dns.ClassINET})
+	}
+	is := newIntrospector(&test.ResponseWriter{}, req)
+	is.maxQuestions = 8
+	is.q = req.Question
+
+	if bbs := (textEncoder{}).Encode(ts, local, remote, is); len(bbs) != 8 {
+		t.Fatalf("text encoder did not honor question limit: %d", len(bbs))
+	}
+	bbs := jsonEncoder{}.Encode(ts, local, remote, is)
+	if len(bbs) != 8 {
+		t.Fatalf("json encoder did not honor question limit: %d", len(bbs))
+	}
+	var v dnsBase
+	if err := json.Unmarshal(bbs[0], &v); err != nil {
+		t.Fatal(err)
+	} else if !v.Truncated {
+		t.Fatal("truncated flag not set")
+	}
+	bbs = jsonEncoder{}.EncodeError(ts, local, remote, is, errors.New("test"))
+	if len(bbs) != 8 {
+		t.Fatalf("json error encoder did not honor question limit: %d", len(bbs))
+	}
+	var ea errAnswer
+	if err := json.Unmarshal(bbs[0], &ea); err != nil {
+		t.Fatal(err)
+	} else if !ea.Truncated {
+		t.Fatal("truncated flag not set on error")
+	}
+
+	//below the limit nothing is flagged
+	is.q = req.Question[:2]
+	v = dnsBase{}
+	if err := json.Unmarshal(jsonEncoder{}.Encode(ts, local, remote, is)[0], &v); err != nil {
+		t.Fatal(err)
+	} else if v.Truncated {
+		t.Fatal("truncated flag set below limit")
+	}
+}
+
+func TestAnswerFormat(t *testing.T) {
+	tsts := []struct {
+		rr  string
+		exp string
+	}{
+		{"example.com. 300 IN A 1.2.3.4", "1.2.3.4"},
+		{"example.com. 300 IN AAAA dead::beef", "dead::beef"},
+		{"example.com. 300 IN MX 10 mail.example.com.", "10 mail.example.com."},
+		{`example.com. 300 IN TXT "v=spf1 " "-all"`, "v=spf1 -all"},
+	}
+	ts := entry.Now()
+	local := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 53}
+	remote := &net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 40000}
+	for _, tst := range tsts {
+		rr, err := dns.NewRR(tst.rr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v := answerRdata(rr); v != tst.exp {
+			t.Fatalf("bad rdata %q != %q", v, tst.exp)
+		}
+		is := &introspector{
+			q: []dns.Question{{Name: "example.com.", Qtype: rr.Header().Rrtype, Qclass: dns.ClassINET}},
+			a: []dns.RR{rr},
+		}
+		//full is the default
+		if bb := (textEncoder{}).Encode(ts, local, remote, is)[0]; !bytes.HasSuffix(bb, []byte(rr.String()+" EventType=answer")) {
+			t.Fatalf("text encoder did not emit full answer: %s", bb)
+		}
+		is.answerFormat = answerFormatRdata
+		if bb := (textEncoder{}).Encode(ts, local, remote, is)[0]; !bytes.HasSuffix(bb, []byte(" "+tst.exp+" EventType=answer")) {
+			t.Fatalf("text encoder did not emit rdata: %s", bb)
+		}
+		var v struct{ Answer string }
+		if err = json.Unmarshal(jsonEncoder{}.Encode(ts, local, remote, is)[0], &v); err != nil {
+			t.Fatal(err)
+		} else if v.Answer != tst.exp {
+			t.Fatalf("json encoder did not emit rdata: %q", v.Answer)
+		}
+	}
+
+	//uncommon types fall back to the full presentation format
+	rr := test.SOA("example.com. 300 IN SOA ns.example.com. admin.example.com. 1 2 3 4 5")
+	if v := answerRdata(rr); v != rr.String() {
+		t.Fatalf("bad fallback rdata %q", v)
+	}
+
+	c := caddy.NewTestController("dns", `gravwell {
+	Ingest-Secret testing
+	Cleartext-Target 192.168.1.1:4024
+	answer-format RDATA
+	}`)
+	if conf, _, err := parseConfig(c); err != nil {
+		t.Fatal(err)
+	} else if conf.AnswerFormat != answerFormatRdata {
+		t.Fatalf("bad answer format %q", conf.AnswerFormat)
+	}
+	c = caddy.NewTestController("dns", `gravwell {
+	Ingest-Secret testing
+	Cleartext-Target 192.168.1.1:4024
+	answer-format wire
+	}`)
+	if _, _, err := parseConfig(c); err == nil {
+		t.Fatal("Missed bad answer format")
+	}
+}
+
+func TestConfigSummary(t *testing.T) {
+	c := caddy.NewTestController("dns", `gravwell {
+	Ingest-Secret SuperSecretToken
+	Cleartext-Target 192.168.1.1:4024
+	Ciphertext-Target 192.168.1.2:4024
+	Tag dns
+	Encoding text
+	ingest-cache-path /tmp/dns.cache
+	}`)
+	cfg, _, err := parseConfig(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := cfg.String()
+	if strings.Contains(s, `SuperSecretToken`) {
+		t.Fatalf("config summary leaked the ingest secret: %s", s)
+	}
+	for _, want := range []string{`tag=dns`, `encoder=text`, `192.168.1.1:4024`, `192.168.1.2:4024`, `cache-path=/tmp/dns.cache`, `<redacted>`} {
+		if !strings.Contains(s, want) {
+			t.Fatalf("config summary missing %q: %s", want, s)
+		}
+	}
+}
+
+func TestLogNegative(t *testing.T) {
+	ts := entry.Now()
+	local := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 53}
+	remote := &net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 40000}
+	req := new(dns.Msg)
+	req.SetQuestion("nope.example.com.", dns.TypeA)
+	resp := new(dns.Msg)
+	resp.SetRcode(req, dns.RcodeNameError)
+	resp.Ns = []dns.RR{test.SOA("example.com. 300 IN SOA ns.example.com. admin.example.com. 1 2 3 4 5")}
+
+	is := newIntrospector(&test.ResponseWriter{}, req)
+	if err := is.WriteMsg(resp); err != nil {
+		t.Fatal(err)
+	}
+
+	//disabled we get the standard question record
+	bb := jsonEncoder{}.Encode(ts, local, remote, is)[0]
+	if bytes.Contains(bb, []byte(`Negative`)) {
+		t.Fatalf("negative record emitted when disabled: %s", bb)
+	}
+
+	is.logNegative = true
+	var v dnsNegative
+	if err := json.Unmarshal(jsonEncoder{}.Encode(ts, local, remote, is)[0], &v); err != nil {
+		t.Fatal(err)
+	}
+	if !v.Negative || v.Rcode != `NXDOMAIN` || v.Question.Hdr.Name != `nope.example.com.` {
+		t.Fatalf("bad negative record: %+v", v)
+	} else if v.SOA == nil || v.SOA.Ns != `ns.example.com.` {
+		t.Fatalf("missing SOA authority: %+v", v.SOA)
+	}
+	if bb = (textEncoder{}).Encode(ts, local, remote, is)[0]; !bytes.Contains(bb, []byte(`NXDOMAIN`)) {
+		t.Fatalf("text encoder missing rcode: %s", bb)
+	}
+
+	//responses with answers are not negative
+	resp.SetReply(req)
+	resp.Answer = []dns.RR{test.A("nope.example.com. 300 IN A 1.2.3.4")}
+	if err := is.WriteMsg(resp); err != nil {
+		t.Fatal(err)
+	} else if is.negative() {
+		t.Fatal("positive answer flagged as negative")
+	}
+}
+
+func FuzzParseConfig(f *testing.F) {
+	for _, v := range []string{
+		goodConfig, goodConfig2, missingTagConfig, badLogLevelConfig, missingEncoderConfig,
+		missingSecretConfig, badTargetConfig, badTarget2Config, badTarget3Config,
+		goodCacheConfig, goodCache2Config, badCacheConfig, badCache2Config, badCache3Config,
+		goodCacheDepthConfig, badCacheDepthConfig, badCacheDepth2Config,
+		badWriteTimeoutConfig, goodWriteTimeoutConfig, goodDisconnectCacheConfig,
+		"gravwell", "gravwell {", "gravwell {\n}", "gravwell {\n\ttag\n}", "gravwell {\n\t\"\" \"\"\n}",
+		"gravwell {\n\tTag \"dns #not a comment\"\n}", "gravwell {\n\tencoding {\n}\n}",
+	} {
+		f.Add(v)
+	}
+	f.Fuzz(func(t *testing.T, cfg string) {
+		//we only care that the parser never panics
+		c := caddy.NewTestController("dns", cfg)
+		parseConfig(c)
+	})
+}
+
+func TestNSID(t *testing.T) {
+	ts := entry.Now()
+	local := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 53}
+	remote := &net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 40000}
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+	resp := new(dns.Msg)
+	resp.SetReply(req)
+	resp.Answer = []dns.RR{test.A("example.com. 300 IN A 1.2.3.4")}
+
+	//absent NSID yields nothing
+	is := newIntrospector(&test.ResponseWriter{}, req)
+	if err := is.WriteMsg(resp); err != nil {
+		t.Fatal(err)
+	} else if bb := (jsonEncoder{}).Encode(ts, local, remote, is)[0]; bytes.Contains(bb, []byte(`NSID`)) {
+		t.Fatalf("NSID emitted without an option: %s", bb)
+	}
+
+	//the server-host fallback is used when there is no NSID
+	is.serverHost = `dns-fallback`
+	var v dnsBase
+	if err := json.Unmarshal(jsonEncoder{}.Encode(ts, local, remote, is)[0], &v); err != nil {
+		t.Fatal(err)
+	} else if v.NSID != `dns-fallback` {
+		t.Fatalf("bad fallback NSID %q", v.NSID)
+	}
+
+	resp.SetEdns0(4096, false)
+	opt := resp.IsEdns0()
+	opt.Option = append(opt.Option, &dns.EDNS0_NSID{Code: dns.EDNS0NSID, Nsid: hex.EncodeToString([]byte(`dns-us-east-1`))})
+	if err := is.WriteMsg(resp); err != nil {
+		t.Fatal(err)
+	} else if err = json.Unmarshal(jsonEncoder{}.Encode(ts, local, remote, is)[0], &v); err != nil {
+		t.Fatal(err)
+	} else if v.NSID != `dns-us-east-1` {
+		t.Fatalf("bad NSID %q", v.NSID)
+	}
+
+	//binary identifiers are left hex encoded
+	if v := decodeNSID(`00ff`); v != `00ff` {
+		t.Fatalf("bad binary NSID %q", v)
+	}
+}
+
+func TestEncoderBlock(t *testing.T) {
+	c := caddy.NewTestController("dns", `gravwell {
+	Ingest-Secret testing
+	Cleartext-Target 192.168.1.1:4024
+	Encoding json {
+		field-map Remote Client
+		style pretty
+	}
+	Tag dns
+	}`)
+	cfg, enc, err := parseConfig(c)
+	if err != nil {
+		t.Fatal(err)
+	} else if cfg.Tag != `dns` {
+		t.Fatalf("directive after the encoding block was lost: %q", cfg.Tag)
+	}
+	je, ok := enc.(*jsonEncoder)
+	if !ok {
+		t.Fatalf("bad encoder type %T", enc)
+	} else if !je.pretty || je.fieldMap[`Remote`] != `Client` {
+		t.Fatalf("encoder options not applied: %+v", je)
+	}
+	is := &introspector{
+		q: []dns.Question{{Name: "example.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET}},
+	}
+	local := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 53}
+	remote := &net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 40000}
+	bb := enc.Encode(entry.Now(), local, remote, is)[0]
+	var v map[string]interface{}
+	if err = json.Unmarshal(bb, &v); err != nil {
+		t.Fatal(err)
+	} else if _, ok := v[`Remote`]; ok {
+		t.Fatalf("field was not renamed: %s", bb)
+	} else if v[`Client`] != remote.String() {
+		t.Fatalf("renamed field is missing: %s", bb)
+	} else if !bytes.Contains(bb, []byte("\n  ")) {
+		t.Fatalf("pretty style not applied: %s", bb)
+	}
+
+	//single line blocks work too
+	c = caddy.NewTestController("dns", `gravwell {
+	Ingest-Secret testing
+	Cleartext-Target 192.168.1.1:4024
+	Encoding hec { style ndjson }
+	}`)
+	if _, enc, err = parseConfig(c); err != nil {
+		t.Fatal(err)
+	} else if enc.Name() != `hec` {
+		t.Fatalf("bad encoder %s", enc.Name())
+	}
+
+	for _, bad := range []string{
+		"Encoding json {\n\t\tstyle yaml\n\t}",
+		"Encoding json {\n\t\tfield-map Remote\n\t}",
+		"Encoding json {\n\t\tnotanoption true\n\t}",
+		"Encoding text {\n\t\tstyle pretty\n\t}",
+		"Tag dns {\n\t\tstyle pretty\n\t}",
+	} {
+		c = caddy.NewTestController("dns", "gravwell {\n\tIngest-Secret testing\n\tCleartext-Target 192.168.1.1:4024\n\t"+bad+"\n}")
+		if _, _, err = parseConfig(c); err == nil {
+			t.Fatalf("Missed bad encoding block %q", bad)
+		}
+	}
+}
+
+func TestRawFlags(t *testing.T) {
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+	req.RecursionDesired = true
+	resp := new(dns.Msg)
+	resp.SetRcode(req, dns.RcodeNameError)
+	resp.Authoritative = true
+	resp.RecursionAvailable = true
+	resp.AuthenticatedData = true
+
+	//the reconstructed word must match the packed header exactly
+	bb, err := resp.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f, exp := headerFlags(resp.MsgHdr), binary.BigEndian.Uint16(bb[2:4]); f != exp {
+		t.Fatalf("bad header flags %016b != %016b", f, exp)
+	}
+
+	is := newIntrospector(&test.ResponseWriter{}, req)
+	if err = is.WriteMsg(resp); err != nil {
+		t.Fatal(err)
+	}
+	local := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 53}
+	remote := &net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 40000}
+	if bb = (jsonEncoder{}).Encode(entry.Now(), local, remote, is)[0]; bytes.Contains(bb, []byte(`RawFlags`)) {
+		t.Fatalf("raw flags emitted when disabled: %s", bb)
+	}
+	is.rawFlags = true
+	var v dnsBase
+	if err = json.Unmarshal(jsonEncoder{}.Encode(entry.Now(), local, remote, is)[0], &v); err != nil {
+		t.Fatal(err)
+	} else if v.RawFlags == nil || *v.RawFlags != headerFlags(resp.MsgHdr) {
+		t.Fatalf("bad raw flags %v", v.RawFlags)
+	}
+}
+
+func TestIngesterUUIDFile(t *testing.T) {
+	p := filepath.Join(t.TempDir(), `lib`, `uuid`)
+	cfg := "gravwell {\n\tIngest-Secret testing\n\tCleartext-Target 192.168.1.1:4024\n\tingester-uuid-file " + p + "\n}"
+
+	//parsing has no side effects, the file is created when the muxer starts
+	c := caddy.NewTestController("dns", cfg)
+	conf, _, err := parseConfig(c)
+	if err != nil {
+		t.Fatal(err)
+	} else if conf.IngesterUUIDFile != p || conf.Ingester_UUID != `` {
+		t.Fatalf("bad uuid file config %q %q", conf.IngesterUUIDFile, conf.Ingester_UUID)
+	} else if _, err = os.Stat(filepath.Dir(p)); !os.IsNotExist(err) {
+		t.Fatal("parsing created the ingester-uuid-file directory", err)
+	}
+
+	//first start generates and persists
+	id, err := loadOrCreateUUID(p)
+	if err != nil {
+		t.Fatal(err)
+	} else if _, err = uuid.Parse(id); err != nil {
+		t.Fatalf("bad generated UUID %q", id)
+	}
+
+	//restarts reuse the persisted value
+	if id2, err := loadOrCreateUUID(p); err != nil {
+		t.Fatal(err)
+	} else if id2 != id {
+		t.Fatalf("UUID changed across restarts %s != %s", id2, id)
+	}
+
+	//garbage in the file is an error rather than silently replaced
+	if err = os.WriteFile(p, []byte("not a uuid"), 0600); err != nil {
+		t.Fatal(err)
+	} else if _, err = loadOrCreateUUID(p); err == nil {
+		t.Fatal("Missed invalid persisted UUID")
+	}
+
+	//unwritable locations are an error
+	if err = os.WriteFile(p, nil, 0600); err != nil {
+		t.Fatal(err)
+	} else if _, err = loadOrCreateUUID(filepath.Join(p, `uuid`)); err == nil {
+		t.Fatal("Missed unwritable UUID file")
+	}
+
+	//explicit UUIDs and files conflict
+	c = caddy.NewTestController("dns", "gravwell {\n\tIngest-Secret testing\n\tCleartext-Target 192.168.1.1:4024\n\tingester-uuid f775a9c6-c1a9-11ec-bf85-67747390939e\n\tingester-uuid-file "+p+"\n}")
+	if _, _, err = parseConfig(c); err == nil {
+		t.Fatal("Missed conflicting ingester UUID directives")
+	}
+
+	//a cache setting without a cache path is not masked by a later directive
+	c = caddy.NewTestController("dns", "gravwell {\n\tIngest-Secret testing\n\tCleartext-Target 192.168.1.1:4024\n\tMax-Cache-Size-MB 10\n\tingester-uuid-file "+p+"\n}")
+	if _, _, err = parseConfig(c); err == nil {
+		t.Fatal("Missed Max-Cache-Size-MB without an Ingest-Cache-Path")
+	}
+}
+
+func TestIngesterUUIDAuto(t *testing.T) {
+	base := "gravwell {\n\tIngest-Secret testing\n\tCleartext-Target 192.168.1.1:4024\n"
+	for _, v := range []string{`auto`, `AUTO`} {
+		conf, _, err := parseConfig(caddy.NewTestController("dns", base+"\tingester-uuid "+v+"\n}"))
+		if err != nil {
+			t.Fatal(err)
+		} else if conf.Ingester_UUID != ingesterUUIDAuto {
+			t.Fatalf("bad auto sentinel %q", conf.Ingester_UUID)
+		}
+	}
+	a, b := resolveIngesterUUID(ingesterUUIDAuto, nil), resolveIngesterUUID(ingesterUUIDAuto, nil)
+	if _, err := uuid.Parse(a); err != nil {
+		t.Fatalf("bad generated UUID %q", a)
+	} else if a == b {
+		t.Fatal("auto generated the same UUID twice")
+	} else if v := resolveIngesterUUID(`f775a9c6-c1a9-11ec-bf85-67747390939e`, nil); v != `f775a9c6-c1a9-11ec-bf85-67747390939e` {
+		t.Fatalf("explicit UUID replaced with %q", v)
+	}
+
+	//anything else that is not a UUID is still a typo
+	if _, _, err := parseConfig(caddy.NewTestController("dns", base+"\tingester-uuid automatic\n}")); err == nil {
+		t.Fatal("accepted an invalid ingester-uuid")
+	}
+}
+
+func TestQueueDelay(t *testing.T) {
+	now := entry.Now()
+	local := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 53}
+	remote := &net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 40000}
+	q := []dns.Question{{Name: "example.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET}}
+
+	//no receive timestamp means no field
+	is := &introspector{q: q}
+	is.readQueueDelay(metadata.ContextWithMetadata(context.Background()), now)
+	if bb := (jsonEncoder{}).Encode(now, local, remote, is)[0]; bytes.Contains(bb, []byte(`QueueDelayNS`)) {
+		t.Fatalf("queue delay emitted without a receive timestamp: %s", bb)
+	}
+
+	ctx := metadata.ContextWithMetadata(context.Background())
+	recv := now.StandardTime().Add(-5 * time.Millisecond).UnixNano()
+	metadata.SetValueFunc(ctx, receivedMetadataKey, func() string { return strconv.FormatInt(recv, 10) })
+	is = &introspector{q: q}
+	is.readQueueDelay(ctx, now)
+	var v dnsBase
+	if err := json.Unmarshal(jsonEncoder{}.Encode(now, local, remote, is)[0], &v); err != nil {
+		t.Fatal(err)
+	} else if v.QueueDelayNS == nil || *v.QueueDelayNS != int64(5*time.Millisecond) {
+		t.Fatalf("bad queue delay %v", v.QueueDelayNS)
+	}
+}
+
+func TestTextPrefixSuffix(t *testing.T) {
+	base := "gravwell {\n\tIngest-Secret foo\n\tCleartext-Target 127.0.0.1:4023\n\tTag dns\n\tEncoding text\n"
+	c := caddy.NewTestController("dns", base+"\tText-Prefix \"DNS:\\ \"\n\tText-Suffix ;\n}")
+	cfg, enc, err := parseConfig(c)
+	if err != nil {
+		t.Fatal(err)
+	} else if cfg.TextPrefix != `DNS: ` || cfg.TextSuffix != `;` {
+		t.Fatalf("bad prefix/suffix %q %q", cfg.TextPrefix, cfg.TextSuffix)
+	}
+
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+	resp := new(dns.Msg)
+	resp.SetReply(req)
+	resp.Answer = []dns.RR{test.A("example.com. 300 IN A 1.2.3.4")}
+	is := newIntrospector(&test.ResponseWriter{}, req)
+	if err = is.WriteMsg(resp); err != nil {
+		t.Fatal(err)
+	}
+	local := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 53}
+	remote := &net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 40000}
+	if bb := enc.Encode(entry.Now(), local, remote, is)[0]; !bytes.HasPrefix(bb, []byte(`DNS: `)) || !bytes.HasSuffix(bb, []byte(`;`)) {
+		t.Fatalf("bad text line %q", bb)
+	}
+
+	for _, bad := range []string{
+		"\tText-Prefix \"DNS: \"\n}", //unescaped delimiter
+		"\tText-Suffix \" x\"\n}",    //leading unescaped delimiter
+	} {
+		if _, _, err = parseConfig(caddy.NewTestController("dns", base+bad)); err == nil {
+			t.Fatalf("accepted bad config %q", bad)
+		}
+	}
+	//not the text encoder
+	bad := "gravwell {\n\tIngest-Secret foo\n\tCleartext-Target 127.0.0.1:4023\n\tEncoding json\n\tText-Prefix x\n}"
+	if _, _, err = parseConfig(caddy.NewTestController("dns", bad)); err == nil {
+		t.Fatalf("accepted bad config %q", bad)
+	}
+}
+
+func TestJSONPerAnswer(t *testing.T) {
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+	resp := new(dns.Msg)
+	resp.SetReply(req)
+	resp.Answer = []dns.RR{
+		test.A("example.com. 300 IN A 1.2.3.1"),
+		test.A("example.com. 300 IN A 1.2.3.2"),
+		test.A("example.com. 300 IN A 1.2.3.3"),
+		test.A("example.com. 300 IN A 1.2.3.4"),
+	}
+	is := newIntrospector(&test.ResponseWriter{}, req)
+	if err := is.WriteMsg(resp); err != nil {
+		t.Fatal(err)
+	}
+	enc, err := getEncoder(`json-per-answer`, nil)
+	if err != nil {
+		t.Fatal(err)
+	} else if enc.Name() != `json-per-answer` {
+		t.Fatalf("bad encoder name %s", enc.Name())
+	}
+	local := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 53}
+	remote := &net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 40000}
+	bbs := enc.Encode(entry.Now(), local, remote, is)
+	if len(bbs) != 4 {
+		t.Fatalf("expected 4 records, got %d", len(bbs))
+	}
+	for i, bb := range bbs {
+		var v struct {
+			Question dns.Question
+			RR       struct{ A string }
+		}
+		if err = json.Unmarshal(bb, &v); err != nil {
+			t.Fatal(err)
+		} else if v.Question.Name != `example.com.` || v.Question.Qtype != dns.TypeA {
+			t.Fatalf("bad question on record %d: %s", i, bb)
+		} else if exp := fmt.Sprintf("1.2.3.%d", i+1); v.RR.A != exp {
+			t.Fatalf("bad answer on record %d: %s != %s", i, v.RR.A, exp)
+		}
+	}
+
+	//no answers falls back to the question record
+	resp.Answer = nil
+	if err = is.WriteMsg(resp); err != nil {
+		t.Fatal(err)
+	} else if bbs = enc.Encode(entry.Now(), local, remote, is); len(bbs) != 1 {
+		t.Fatalf("expected 1 question record, got %d", len(bbs))
+	}
+}
+
+func TestStartMuxersCleanup(t *testing.T) {
+	//no tier comes hot, every muxer that was started must be closed again
+	for _, targets := range []string{"127.0.0.1:1", "127.0.0.1:1/1\n\tCleartext-Target 127.0.0.1:2/2"} {
+		cfg, _, err := parseConfig(caddy.NewTestController("dns", "gravwell {\n\tIngest-Secret foo\n\tCleartext-Target "+targets+"\n}"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if im, primary, err := startMuxers(cfg, newPluginLogger(`off`)); err == nil {
+			t.Fatalf("started muxers for %q", targets)
+		} else if im != nil || primary != nil {
+			t.Fatalf("failed start returned muxers for %q", targets)
+		}
+		for deadline := time.Now().Add(2 * time.Second); muxerGoroutines() > 0; time.Sleep(5 * time.Millisecond) {
+			if time.Now().After(deadline) {
+				t.Fatalf("%d muxer goroutines left running for %q", muxerGoroutines(), targets)
+			}
+		}
+	}
+}
+
+// muxerGoroutines counts the goroutines running ingest muxer code, the state reporter is left
+// out as it only notices a close after its ten second sleep
+func muxerGoroutines() (n int) {
+	buf := make([]byte, 1<<20)
+	buf = buf[:runtime.Stack(buf, true)]
+	for _, g := range bytes.Split(buf, []byte("\n\n")) {
+		if bytes.Contains(g, []byte(`gravwell/v3/ingest.`)) && !bytes.Contains(g, []byte(`stateReportRoutine`)) {
+			n++
+		}
+	}
+	return
+}
+
+func TestRedactAnswers(t *testing.T) {
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+	resp := new(dns.Msg)
+	resp.SetReply(req)
+	resp.Answer = []dns.RR{
+		test.A("example.com. 300 IN A 1.2.3.4"),
+		test.A("example.com. 300 IN A 1.2.3.5"),
+	}
+	is := newIntrospector(&test.ResponseWriter{}, req)
+	is.redact = true
+	if err := is.WriteMsg(resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Answer[0].(*dns.A).A.String() != `1.2.3.4` {
+		t.Fatal("redaction modified the response sent to the client")
+	}
+	local := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 53}
+	remote := &net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 40000}
+	for _, name := range []string{`json`, `json-per-answer`, `text`, `hec`, `passivedns`, `zeek`} {
+		enc, err := getEncoder(name, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, format := range []string{``, answerFormatRdata} {
+			is.answerFormat = format
+			for _, bb := range enc.Encode(entry.Now(), local, remote, is) {
+				if bytes.Contains(bb, []byte(`1.2.3.`)) {
+					t.Fatalf("%s leaked rdata: %s", name, bb)
+				}
+			}
+		}
+	}
+
+	//the type and count survive
+	is.answerFormat = ``
+	var v struct{ RR struct{ Hdr dns.RR_Header } }
+	enc, _ := getEncoder(`json-per-answer`, nil)
+	bbs := enc.Encode(entry.Now(), local, remote, is)
+	if len(bbs) != 2 {
+		t.Fatalf("expected 2 records, got %d", len(bbs))
+	} else if err := json.Unmarshal(bbs[0], &v); err != nil {
+		t.Fatal(err)
+	} else if v.RR.Hdr.Rrtype != dns.TypeA || v.RR.Hdr.Ttl != 300 {
+		t.Fatalf("bad redacted header %+v", v.RR.Hdr)
+	} else if !bytes.Contains(bbs[0], []byte(redactedRdata)) {
+		t.Fatalf("missing placeholder %s", bbs[0])
+	}
+}
+
+func TestTagOnRcode(t *testing.T) {
+	gh := gwHandler{tag: 0, rcodeTags: map[int]entry.EntryTag{dns.RcodeServerFailure: 1}}
+	if gh.tagFor(dns.RcodeServerFailure) != 1 || gh.tagFor(dns.RcodeSuccess) != 0 {
+		t.Fatal("bad tag selection")
+	}
+}
+
+func TestTagOnRcodeEncoding(t *testing.T) {
+	cfg := mustParse(t, testConfigBase+"\tTag dns\n\tTag-On-Rcode NXDOMAIN dns-nx text\n\tTag-On-Rcode REFUSED dns-nx TEXT\n}")
+	encs, err := cfg.rcodeEncoders()
+	if err != nil {
+		t.Fatal(err)
+	} else if len(encs) != 2 || encs[dns.RcodeNameError] != encs[dns.RcodeRefused] {
+		t.Fatalf("rcodes sharing a tag should share an encoder %v", encs)
+	}
+
+	//NXDOMAIN goes out as text on its own tag, everything else falls back to json
+	dw := &discardWriter{keep: true}
+	gh := gwHandler{
+		im:            dw,
+		tag:           0,
+		rcodeTags:     map[int]entry.EntryTag{dns.RcodeNameError: 1},
+		enc:           &jsonEncoder{},
+		rcodeEncs:     encs,
+		encodeOptions: encodeOptions{maxQuestions: defaultMaxQuestions},
+	}
+	for _, nx := range []bool{false, true} {
+		gh.Next = answerHandler(nx)
+		req := new(dns.Msg)
+		req.SetQuestion("example.com.", dns.TypeA)
+		if _, err = gh.ServeDNS(context.Background(), &test.ResponseWriter{}, req); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(dw.ents) != 2 {
+		t.Fatalf("expected 2 entries, got %d", len(dw.ents))
+	} else if dw.ents[0].Tag != 0 || !json.Valid(dw.ents[0].Data) {
+		t.Fatalf("default entry not json on the default tag: %d %s", dw.ents[0].Tag, dw.ents[0].Data)
+	} else if dw.ents[1].Tag != 1 || json.Valid(dw.ents[1].Data) || !bytes.Contains(dw.ents[1].Data, []byte(textDelim)) {
+		t.Fatalf("NXDOMAIN entry not text on the rcode tag: %d %s", dw.ents[1].Tag, dw.ents[1].Data)
+	}
+}
+
+func TestAuditTag(t *testing.T) {
+	if _, _, err := parseConfig(caddy.NewTestController("dns", "gravwell {\n\tKafka-Broker 127.0.0.1:9092\n\tKafka-Topic dns\n\tAudit-Tag dns-audit\n}")); err == nil {
+		t.Fatal("accepted an audit tag without a Gravwell target")
+	}
+
+	//the port filter drops everything from the test client, the audit tag still sees it
+	pf, err := newPortFilter(filterModeDeny, []string{`40212`})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dw := &discardWriter{keep: true}
+	gh := gwHandler{
+		Next:          answerHandler(false),
+		im:            dw,
+		tag:           1,
+		audit:         true,
+		auditTag:      2,
+		enc:           &jsonEncoder{},
+		encodeOptions: encodeOptions{maxQuestions: defaultMaxQuestions},
+	}
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+	if _, err = gh.ServeDNS(context.Background(), &test.ResponseWriter{}, req); err != nil {
+		t.Fatal(err)
+	} else if len(dw.ents) != 2 || dw.ents[0].Tag != 1 || dw.ents[1].Tag != 2 || !bytes.Equal(dw.ents[0].Data, dw.ents[1].Data) {
+		t.Fatalf("expected identical main and audit entries, got %d", len(dw.ents))
+	}
+	dw.ents = nil
+	gh.ports = pf
+	if _, err = gh.ServeDNS(context.Background(), &test.ResponseWriter{}, req); err != nil {
+		t.Fatal(err)
+	} else if len(dw.ents) != 1 || dw.ents[0].Tag != 2 {
+		t.Fatalf("filtered request should only reach the audit tag %+v", dw.ents)
+	}
+}
+
+func TestMaxAnswers(t *testing.T) {
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeAXFR)
+	resp := new(dns.Msg)
+	resp.SetReply(req)
+	for i := 0; i < 5000; i++ {
+		resp.Answer = append(resp.Answer, test.A(fmt.Sprintf("h%d.example.com. 300 IN A 10.0.%d.%d", i, i/256, i%256)))
+	}
+	is := newIntrospector(&test.ResponseWriter{}, req)
+	is.maxAnswers = 100
+	if err := is.WriteMsg(resp); err != nil {
+		t.Fatal(err)
+	} else if len(resp.Answer) != 5000 {
+		t.Fatal("bounding answers modified the response")
+	}
+	local := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 53}
+	remote := &net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 40000}
+
+	enc, _ := getEncoder(`json-per-answer`, nil)
+	bbs := enc.Encode(entry.Now(), local, remote, is)
+	if len(bbs) != 100 {
+		t.Fatalf("expected 100 records, got %d", len(bbs))
+	}
+	var v dnsBase
+	if err := json.Unmarshal(bbs[0], &v); err != nil {
+		t.Fatal(err)
+	} else if !v.Truncated || v.DroppedAnswers != 4900 {
+		t.Fatalf("bad truncation summary %+v", v)
+	}
+	if bbs = (&passiveDNSEncoder{}).Encode(entry.Now(), local, remote, is); len(bbs) != 100 {
+		t.Fatalf("expected 100 passivedns records, got %d", len(bbs))
+	}
+
+	//under the bound nothing is flagged
+	resp.Answer = resp.Answer[:10]
+	if err := is.WriteMsg(resp); err != nil {
+		t.Fatal(err)
+	}
+	v = dnsBase{}
+	if err := json.Unmarshal(enc.Encode(entry.Now(), local, remote, is)[0], &v); err != nil {
+		t.Fatal(err)
+	} else if v.Truncated || v.DroppedAnswers != 0 {
+		t.Fatalf("untruncated response flagged %+v", v)
+	}
+}
+
+// TestAnswerHead checks answer-head keeps the leading answers in full detail and counts the
+// remainder, with normalize-answer-order the head is taken from the sorted answers
+func TestAnswerHead(t *testing.T) {
+	var rrs []dns.RR
+	for i := 0; i < 8; i++ {
+		rrs = append(rrs, test.A(fmt.Sprintf("cdn.example.com. 60 IN A 192.0.2.%d", 10-i)))
+	}
+	m := testMsg(`cdn.example.com.`, dns.TypeA, rrs...)
+	for _, tc := range []struct {
+		lines string
+		head  []string
+	}{
+		{"\tAnswer-Head 3\n", []string{`192.0.2.10`, `192.0.2.9`, `192.0.2.8`}},
+		{"\tAnswer-Head 3\n\tMax-Answers-Per-Query 5\n", []string{`192.0.2.10`, `192.0.2.9`, `192.0.2.8`}},
+		//rdata sorts as text
+		{"\tAnswer-Head 3\n\tNormalize-Answer-Order true\n", []string{`192.0.2.10`, `192.0.2.3`, `192.0.2.4`}},
+	} {
+		cfg := mustParse(t, testConfigBase+tc.lines+"}")
+		bbs := jsonEncoder{perAnswer: true}.Encode(entry.Now(), testLocal, testRemote, newIntrospectorFromMsg(m, cfg.encodeOptions()))
+		if len(bbs) != 3 {
+			t.Fatalf("%q: expected the 3 leading answers, got %d records", tc.lines, len(bbs))
+		}
+		for i, bb := range bbs {
+			var v struct {
+				dnsBase
+				RR *dns.A
+			}
+			if err := json.Unmarshal(bb, &v); err != nil {
+				t.Fatal(err)
+			} else if v.RR.A.String() != tc.head[i] || v.RR.Hdr.Ttl != 60 {
+				t.Fatalf("%q: record %d is not %s in full: %s", tc.lines, i, tc.head[i], bb)
+			} else if v.DroppedAnswers != 5 || !v.Truncated {
+				t.Fatalf("%q: remainder not counted: %s", tc.lines, bb)
+			}
+		}
+	}
+	//the tighter bound wins either way round
+	if cfg := mustParse(t, testConfigBase+"\tAnswer-Head 50\n\tMax-Answers-Per-Query 5\n}"); cfg.encodeOptions().maxAnswers != 5 {
+		t.Fatalf("bad answer bound %d", cfg.encodeOptions().maxAnswers)
+	}
+}
+
+func TestLogErrors(t *testing.T) {
+	base := "gravwell {\n\tIngest-Secret testing\n\tCleartext-Target 192.168.1.1:4024\n"
+	if cfg, _, err := parseConfig(caddy.NewTestController("dns", base+"}")); err != nil || !cfg.LogErrors {
+		t.Fatal("log-errors should default to true", err)
+	} else if cfg, _, err = parseConfig(caddy.NewTestController("dns", base+"\tLog-Errors false\n}")); err != nil || cfg.LogErrors {
+		t.Fatal("log-errors false not applied", err)
+	} else if _, _, err = parseConfig(caddy.NewTestController("dns", base+"\tLog-Errors sometimes\n}")); err == nil {
+		t.Fatal("accepted a bad log-errors")
+	}
+
+	upstream := errors.New("upstream timed out")
+	failing := plugin.HandlerFunc(func(ctx context.Context, w dns.ResponseWriter, r *dns.Msg) (int, error) {
+		return dns.RcodeServerFailure, upstream
+	})
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+	for _, skip := range []bool{false, true} {
+		dw := &discardWriter{keep: true}
+		gh := gwHandler{
+			Next:          failing,
+			im:            dw,
+			enc:           &jsonEncoder{},
+			skipErrors:    skip,
+			encodeOptions: encodeOptions{maxQuestions: defaultMaxQuestions},
+		}
+		//the chain still sees the error either way
+		if rcode, err := gh.ServeDNS(context.Background(), &test.ResponseWriter{}, req); err != upstream || rcode != dns.RcodeServerFailure {
+			t.Fatalf("error not returned: %d %v", rcode, err)
+		} else if skip && len(dw.ents) != 0 {
+			t.Fatalf("log-errors false wrote %d entries", len(dw.ents))
+		} else if !skip && (len(dw.ents) != 1 || !bytes.Contains(dw.ents[0].Data, []byte(upstream.Error()))) {
+			t.Fatalf("missing error record %v", dw.ents)
+		}
+		//successful requests are unaffected
+		gh.Next = answerHandler(false)
+		if _, err := gh.ServeDNS(context.Background(), &test.ResponseWriter{}, req); err != nil {
+			t.Fatal(err)
+		} else if n := len(dw.ents); (skip && n != 1) || (!skip && n != 2) {
+			t.Fatalf("successful request not logged, %d entries", n)
+		}
+	}
+}
+
+func TestSkipCacheHits(t *testing.T) {
+	dw := &discardWriter{keep: true}
+	gh := gwHandler{
+		im:            dw,
+		enc:           &jsonEncoder{},
+		skipCacheHits: true,
+		encodeOptions: encodeOptions{maxQuestions: defaultMaxQuestions},
+	}
+	for _, status := range []string{`hit`, `miss`, ``, `HIT`} {
+		next := answerHandler(false)
+		gh.Next = plugin.HandlerFunc(func(ctx context.Context, w dns.ResponseWriter, r *dns.Msg) (int, error) {
+			if status != `` {
+				metadata.SetValueFunc(ctx, cacheStatusMetadataKey, func() string { return status })
+			}
+			return next.ServeDNS(ctx, w, r)
+		})
+		req := new(dns.Msg)
+		req.SetQuestion("example.com.", dns.TypeA)
+		if _, err := gh.ServeDNS(metadata.ContextWithMetadata(context.Background()), &test.ResponseWriter{}, req); err != nil {
+			t.Fatal(err)
+		}
+	}
+	//hits are dropped, misses and missing metadata are logged
+	if len(dw.ents) != 2 {
+		t.Fatalf("expected 2 entries, got %d", len(dw.ents))
+	} else if !bytes.Contains(dw.ents[0].Data, []byte(`"CacheStatus":"miss"`)) {
+		t.Fatalf("missing cache status %s", dw.ents[0].Data)
+	} else if bytes.Contains(dw.ents[1].Data, []byte(`CacheStatus`)) {
+		t.Fatalf("cache status without metadata %s", dw.ents[1].Data)
+	}
+}
+
+func TestFilterDebug(t *testing.T) {
+	dw := &discardWriter{keep: true}
+	gh := gwHandler{
+		im:            dw,
+		enc:           &jsonEncoder{},
+		skipCacheHits: true,
+		filterDebug:   true,
+		encodeOptions: encodeOptions{maxQuestions: defaultMaxQuestions},
+	}
+	serve := func(status string) (v dnsBase) {
+		t.Helper()
+		dw.ents = nil
+		next := answerHandler(false)
+		gh.Next = plugin.HandlerFunc(func(ctx context.Context, w dns.ResponseWriter, r *dns.Msg) (int, error) {
+			metadata.SetValueFunc(ctx, cacheStatusMetadataKey, func() string { return status })
+			return next.ServeDNS(ctx, w, r)
+		})
+		req := new(dns.Msg)
+		req.SetQuestion("example.com.", dns.TypeA)
+		if _, err := gh.ServeDNS(metadata.ContextWithMetadata(context.Background()), &test.ResponseWriter{}, req); err != nil {
+			t.Fatal(err)
+		} else if len(dw.ents) != 1 {
+			t.Fatalf("expected 1 entry, got %d", len(dw.ents))
+		} else if err = json.Unmarshal(dw.ents[0].Data, &v); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	//the test client port is 40212
+	allow, err := newPortFilter(filterModeAllow, []string{`40000-40999`})
+	if err != nil {
+		t.Fatal(err)
+	}
+	deny, err := newPortFilter(filterModeDeny, []string{`40212`})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now().UTC()
+	lw, err := parseLogWindow([]string{now.Add(time.Hour).Format(logWindowClock) + `-` + now.Add(2*time.Hour).Format(logWindowClock), `UTC`})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		name    string
+		ports   *portFilter
+		window  *logWindow
+		status  string
+		rule    string
+		dropped bool
+	}{
+		{`unfiltered`, nil, nil, `miss`, ``, false},
+		{`allow match`, allow, nil, `miss`, `client-port-filter allow 40000-40999`, false},
+		{`allow match then cache hit`, allow, nil, `hit`, `skip-cache-hits`, true},
+		{`deny match`, deny, nil, `miss`, `client-port-filter deny 40212`, true},
+		{`deny match and cache hit`, deny, nil, `hit`, `client-port-filter deny 40212`, true},
+		{`outside the window`, deny, lw, `hit`, lw.String(), true},
+	} {
+		gh.ports, gh.window = tt.ports, tt.window
+		if v := serve(tt.status); v.FilterRule != tt.rule || v.FilterDropped != tt.dropped {
+			t.Fatalf("%s: got %q %v expected %q %v", tt.name, v.FilterRule, v.FilterDropped, tt.rule, tt.dropped)
+		}
+	}
+
+	//without filter-debug the same requests are dropped and nothing is marked
+	gh.filterDebug, gh.ports, gh.window = false, allow, nil
+	if v := serve(`miss`); v.FilterRule != `` {
+		t.Fatalf("rule without filter-debug %q", v.FilterRule)
+	}
+	gh.ports = deny
+	dw.ents = nil
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+	gh.Next = answerHandler(false)
+	if _, err = gh.ServeDNS(context.Background(), &test.ResponseWriter{}, req); err != nil {
+		t.Fatal(err)
+	} else if len(dw.ents) != 0 {
+		t.Fatal("denied request logged without filter-debug")
+	}
+}
+
+func TestLogTiming(t *testing.T) {
+	type rec struct {
+		EventType string
+		EventID   string
+	}
+	for _, tt := range []struct {
+		timing string
+		exp    []string
+	}{
+		{``, []string{eventAnswer}},
+		{logTimingPre, []string{eventRequest}},
+		{logTimingBoth, []string{eventRequest, eventAnswer}},
+	} {
+		dw := &discardWriter{keep: true}
+		var before int
+		next := answerHandler(false)
+		gh := gwHandler{
+			Next: plugin.HandlerFunc(func(ctx context.Context, w dns.ResponseWriter, r *dns.Msg) (int, error) {
+				//entries already written when the chain runs
+				before = len(dw.ents)
+				return next.ServeDNS(ctx, w, r)
+			}),
+			im:            dw,
+			tag:           1,
+			rcodeTags:     map[int]entry.EntryTag{dns.RcodeSuccess: 2},
+			enc:           &jsonEncoder{},
+			timing:        tt.timing,
+			encodeOptions: encodeOptions{maxQuestions: defaultMaxQuestions},
+		}
+		req := new(dns.Msg)
+		req.SetQuestion("example.com.", dns.TypeA)
+		if _, err := gh.ServeDNS(context.Background(), &test.ResponseWriter{}, req); err != nil {
+			t.Fatal(err)
+		} else if len(dw.ents) != len(tt.exp) {
+			t.Fatalf("%q: expected %d entries, got %d", tt.timing, len(tt.exp), len(dw.ents))
+		} else if tt.timing != `` && before != 1 {
+			t.Fatalf("%q: request record not written before the plugin chain", tt.timing)
+		}
+		var recs []rec
+		for i, ent := range dw.ents {
+			var v rec
+			if err := json.Unmarshal(ent.Data, &v); err != nil {
+				t.Fatal(err)
+			} else if v.EventType != tt.exp[i] {
+				t.Fatalf("%q: entry %d EventType %q != %q", tt.timing, i, v.EventType, tt.exp[i])
+			}
+			//request records have no rcode, so they skip tag-on-rcode
+			if v.EventType == eventRequest && ent.Tag != 1 {
+				t.Fatalf("%q: request record tag %d", tt.timing, ent.Tag)
+			} else if v.EventType == eventAnswer && ent.Tag != 2 {
+				t.Fatalf("%q: answer record tag %d", tt.timing, ent.Tag)
+			}
+			recs = append(recs, v)
+		}
+		if tt.timing == logTimingBoth {
+			if recs[0].EventID == `` || recs[0].EventID != recs[1].EventID {
+				t.Fatalf("pre and post records do not share an EventID: %+v", recs)
+			}
+		} else if recs[0].EventID != `` {
+			t.Fatalf("%q: EventID without log-timing both", tt.timing)
+		}
+	}
+
+	//with pre the request record is the only one, the audit tag gets it ahead of the filters
+	dw := &discardWriter{keep: true}
+	pf, err := newPortFilter(filterModeDeny, []string{`40212`})
+	if err != nil {
+		t.Fatal(err)
+	}
+	gh := gwHandler{
+		Next:          answerHandler(false),
+		im:            dw,
+		tag:           1,
+		audit:         true,
+		auditTag:      3,
+		enc:           &jsonEncoder{},
+		timing:        logTimingPre,
+		encodeOptions: encodeOptions{maxQuestions: defaultMaxQuestions},
+	}
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+	if _, err = gh.ServeDNS(context.Background(), &test.ResponseWriter{}, req); err != nil {
+		t.Fatal(err)
+	} else if len(dw.ents) != 2 || dw.ents[0].Tag != 1 || dw.ents[1].Tag != 3 || !bytes.Equal(dw.ents[0].Data, dw.ents[1].Data) {
+		t.Fatalf("expected identical request and audit records, got %d", len(dw.ents))
+	}
+	dw.ents = nil
+	gh.ports = pf
+	if _, err = gh.ServeDNS(context.Background(), &test.ResponseWriter{}, req); err != nil {
+		t.Fatal(err)
+	} else if len(dw.ents) != 1 || dw.ents[0].Tag != 3 {
+		t.Fatalf("filtered request record should only reach the audit tag %+v", dw.ents)
+	}
+
+	//the request carries no response, log-negative must not read it as NODATA
+	for _, enc := range []encoder{&jsonEncoder{}, &textEncoder{}} {
+		dw = &discardWriter{keep: true}
+		gh = gwHandler{
+			Next:          answerHandler(true),
+			im:            dw,
+			enc:           enc,
+			timing:        logTimingBoth,
+			encodeOptions: encodeOptions{maxQuestions: defaultMaxQuestions, logNegative: true},
+		}
+		if _, err = gh.ServeDNS(context.Background(), &test.ResponseWriter{}, req); err != nil {
+			t.Fatal(err)
+		} else if len(dw.ents) != 2 {
+			t.Fatalf("%s: expected request and response records, got %d", enc.Name(), len(dw.ents))
+		}
+		pre, post := dw.ents[0].Data, dw.ents[1].Data
+		for _, field := range []string{`Negative`, `Rcode`, `NOERROR`, eventNegative} {
+			if bytes.Contains(pre, []byte(field)) {
+				t.Fatalf("%s: request record carries %s: %s", enc.Name(), field, pre)
+			}
+		}
+		if !bytes.Contains(post, []byte(eventNegative)) {
+			t.Fatalf("%s: NXDOMAIN response not negative: %s", enc.Name(), post)
+		}
+	}
+}
+
+func TestZoneMetadata(t *testing.T) {
+	local := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 53}
+	remote := &net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 40000}
+	q := []dns.Question{{Name: "a.example.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET}}
+
+	is := &introspector{q: q}
+	is.readMetadata(context.Background())
+	if bb := (jsonEncoder{}).Encode(entry.Now(), local, remote, is)[0]; bytes.Contains(bb, []byte(`Zone`)) || bytes.Contains(bb, []byte(`Wildcard`)) {
+		t.Fatalf("zone fields present without metadata: %s", bb)
+	}
+
+	ctx := metadata.ContextWithMetadata(context.Background())
+	metadata.SetValueFunc(ctx, zoneMetadataKey, func() string { return `example.com.` })
+	metadata.SetValueFunc(ctx, wildcardMetadataKey, func() string { return `*.example.com.` })
+	is = &introspector{q: q}
+	is.readMetadata(ctx)
+	var v dnsBase
+	if err := json.Unmarshal(jsonEncoder{}.Encode(entry.Now(), local, remote, is)[0], &v); err != nil {
+		t.Fatal(err)
+	} else if v.Zone != `example.com.` || v.Wildcard != `*.example.com.` {
+		t.Fatalf("bad zone fields: %q %q", v.Zone, v.Wildcard)
+	}
+}
+
+// stalledWriter never accepts an entry, like a muxer with every indexer down and no cache
+type stalledWriter struct {
+	timeouts []time.Duration
+}
+
+func (s *stalledWriter) WriteEntry(*entry.Entry) error {
+	panic("unbounded write with an ingest deadline")
+}
+
+func (s *stalledWriter) WriteEntryTimeout(_ *entry.Entry, to time.Duration) error {
+	s.timeouts = append(s.timeouts, to)
+	time.Sleep(to)
+	return ingest.ErrWriteTimeout
+}
+
+func TestIngestDeadline(t *testing.T) {
+	sw := &stalledWriter{}
+	gh := gwHandler{
+		Next:          answerHandler(false),
+		im:            sw,
+		enc:           &textEncoder{},
+		to:            time.Second,
+		deadline:      20 * time.Millisecond,
+		encodeOptions: encodeOptions{maxQuestions: defaultMaxQuestions},
+	}
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+	base := testutil.ToFloat64(droppedEntries)
+	start := time.Now()
+	if _, err := gh.ServeDNS(context.Background(), &test.ResponseWriter{}, req); err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d > 500*time.Millisecond {
+		t.Fatalf("ingest deadline not enforced, ServeDNS took %v", d)
+	} else if len(sw.timeouts) != 1 || sw.timeouts[0] > gh.deadline {
+		t.Fatalf("write timeout not bounded by the deadline %v", sw.timeouts)
+	} else if testutil.ToFloat64(droppedEntries)-base != 1 {
+		t.Fatal("dropped entry not counted")
+	}
+}
+
+// partialWriter accepts the first accept entries and rejects every one after
+type partialWriter struct {
+	accept int
+	ents   []*entry.Entry
+	tries  int
+}
+
+func (p *partialWriter) WriteEntry(ent *entry.Entry) error {
+	if p.tries++; len(p.ents) >= p.accept {
+		return errors.New("indexer went away")
+	}
+	p.ents = append(p.ents, ent)
+	return nil
+}
+
+func (p *partialWriter) WriteEntryTimeout(ent *entry.Entry, _ time.Duration) error {
+	return p.WriteEntry(ent)
+}
+
+func TestWriteEntriesPartialFailure(t *testing.T) {
+	bbs := [][]byte{[]byte(`a`), []byte(`b`), []byte(`c`), []byte(`d`)}
+	tags := make([]entry.EntryTag, len(bbs))
+	for accept := 0; accept <= len(bbs); accept++ {
+		pw := &partialWriter{accept: accept}
+		gh := gwHandler{im: pw}
+		base := testutil.ToFloat64(droppedEntries)
+		gh.writeEntries(entry.Now(), bbs, tags)
+		//the first failure drops it and the rest of the request without trying them
+		if len(pw.ents) != accept {
+			t.Fatalf("accept %d: %d entries written", accept, len(pw.ents))
+		} else if d := testutil.ToFloat64(droppedEntries) - base; d != float64(len(bbs)-accept) {
+			t.Fatalf("accept %d: %v entries counted as dropped", accept, d)
+		} else if exp := min(accept+1, len(bbs)); pw.tries != exp {
+			t.Fatalf("accept %d: %d writes tried, expected %d", accept, pw.tries, exp)
+		}
+	}
+}
+
+func TestIncludeSequence(t *testing.T) {
+	_, enc, err := parseConfig(caddy.NewTestController("dns", testConfigBase+"\tInclude-Sequence true\n\tEncoding json\n\tEncoding text {\n\t\ttag dns-text\n\t}\n}"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := testMsg(`example.com.`, dns.TypeA, test.A(`example.com. 60 IN A 1.2.3.4`))
+	m.Question = append(m.Question, dns.Question{Name: `example.org.`, Qtype: dns.TypeA, Qclass: dns.ClassINET})
+	//concurrent requests still draw unique, gapless numbers
+	const workers, reqs = 4, 25
+	seen := make(chan uint64, workers*reqs*2)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < reqs; i++ {
+				for _, bb := range enc.Encode(entry.Now(), testLocal, testRemote, newIntrospectorFromMsg(m, testOpts)) {
+					var v struct{ Seq uint64 }
+					if json.Unmarshal(bb, &v) == nil {
+						seen <- v.Seq
+					} else if bytes.Contains(bb, []byte(`Seq`)) {
+						t.Errorf("sequence in a text record %s", bb)
+					}
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(seen)
+	got := map[uint64]bool{}
+	for v := range seen {
+		if got[v] {
+			t.Fatalf("duplicate sequence %d", v)
+		}
+		got[v] = true
+	}
+	for i := uint64(1); i <= workers*reqs*2; i++ {
+		if !got[i] {
+			t.Fatalf("gap at sequence %d", i)
+		}
+	}
+
+	//without the directive nothing is stamped
+	rec := jsonEncoder{}.Encode(entry.Now(), testLocal, testRemote, newIntrospectorFromMsg(m, testOpts))
+	if bytes.Contains(rec[0], []byte(`"Seq"`)) {
+		t.Fatalf("sequence without include-sequence %s", rec[0])
+	}
+}
+
+func TestServerBlock(t *testing.T) {
+	cfg := "gravwell {\n\tKafka-Broker 127.0.0.1:9092\n\tKafka-Topic dns\n\tInclude-Server-Block true\n}"
+	c := caddy.NewTestController("dns", cfg)
+	c.ServerBlockKeys = []string{`example.com:53`, `example.org:53`}
+	start, err := setupInstance(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chain := dnsserver.GetConfig(c).Plugin
+	h := chain[len(chain)-1](nil).(*gwHandler)
+	commitPending() //references other tests took directly
+	if err = start(); err != nil {
+		t.Fatal(err)
+	}
+	defer releasePending()
+	if h.serverBlock != `example.com:53,example.org:53` {
+		t.Fatalf("bad server block %q", h.serverBlock)
+	}
+	tr := newIntrospectorFromMsg(testMsg(`example.com.`, dns.TypeA), h.encodeOptions)
+	var v struct{ ServerBlock string }
+	if err := json.Unmarshal(jsonEncoder{}.Encode(entry.Now(), testLocal, testRemote, tr)[0], &v); err != nil {
+		t.Fatal(err)
+	} else if v.ServerBlock != h.serverBlock {
+		t.Fatalf("bad ServerBlock %q", v.ServerBlock)
+	}
+	tr.encodeOptions.serverBlock = ``
+	if bb := (jsonEncoder{}).Encode(entry.Now(), testLocal, testRemote, tr)[0]; bytes.Contains(bb, []byte(`ServerBlock`)) {
+		t.Fatalf("ServerBlock emitted without the option %s", bb)
+	}
+}
+
+func TestNextPlugin(t *testing.T) {
+	cfg := "gravwell {\n\tKafka-Broker 127.0.0.1:9092\n\tKafka-Topic dns\n\tInclude-Next-Plugin true\n}"
+	c := caddy.NewTestController("dns", cfg)
+	start, err := setupInstance(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chain := dnsserver.GetConfig(c).Plugin
+	next := answerHandler(false)
+	h := chain[len(chain)-1](next).(*gwHandler)
+	commitPending() //references other tests took directly
+	if err = start(); err != nil {
+		t.Fatal(err)
+	}
+	defer releasePending()
+	if h.nextPlugin != next.Name() {
+		t.Fatalf("bad next plugin %q", h.nextPlugin)
+	}
+	var v dnsBase
+	if err := json.Unmarshal(jsonEncoder{}.Encode(entry.Now(), testLocal, testRemote, newIntrospectorFromMsg(testMsg(`example.com.`, dns.TypeA), h.encodeOptions))[0], &v); err != nil {
+		t.Fatal(err)
+	} else if v.NextPlugin != next.Name() {
+		t.Fatalf("bad NextPlugin %q", v.NextPlugin)
+	}
+	//gravwell last in the chain has no next plugin
+	if h = chain[len(chain)-1](nil).(*gwHandler); h.nextPlugin != `` {
+		t.Fatalf("next plugin %q without one", h.nextPlugin)
+	}
+
+	if pos := chainPosition(nil); pos != `gravwell is not in the compiled directive order, the next plugin is none` {
+		t.Fatalf("bad position %q", pos)
+	}
+	defer func(d []string) { dnsserver.Directives = d }(dnsserver.Directives)
+	dnsserver.Directives = []string{`metadata`, `gravwell`, `cache`, `forward`}
+	if pos := chainPosition(next); pos != `gravwell is directive 2 of 4, the next plugin is `+next.Name() {
+		t.Fatalf("bad position %q", pos)
+	}
+}
+
+func TestCacheValidation(t *testing.T) {
+	for directive, line := range map[string]string{
+		`Max-Cache-Size-MB`:   "Max-Cache-Size-MB 64",
+		`Cache-Depth`:         "Cache-Depth 128",
+		`On-Disconnect-Cache`: "On-Disconnect-Cache true",
+		`Cache-Max-Age`:       "Cache-Max-Age 1h",
+	} {
+		_, _, err := parseConfig(caddy.NewTestController("dns", testConfigBase+"\t"+line+"\n}"))
+		if err == nil {
+			t.Fatalf("accepted %s without a cache path", directive)
+		} else if !strings.Contains(err.Error(), directive) || !strings.Contains(err.Error(), `Ingest-Cache-Path`) {
+			t.Fatalf("error does not name %s: %v", directive, err)
+		}
+		if _, _, err = parseConfig(caddy.NewTestController("dns", testConfigBase+"\t"+line+"\n\tIngest-Cache-Path /tmp/cache\n}")); err != nil {
+			t.Fatalf("%s with a cache path: %v", directive, err)
+		}
+	}
+
+	dir := t.TempDir()
+	if err := checkCacheDir(filepath.Join(dir, `cache`)); err != nil {
+		t.Fatal(err)
+	} else if ents, _ := os.ReadDir(filepath.Join(dir, `cache`)); len(ents) != 0 {
+		t.Fatalf("write test left files behind %v", ents)
+	}
+	//a file where the cache directory should be
+	blocker := filepath.Join(dir, `file`)
+	if err := os.WriteFile(blocker, nil, 0640); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkCacheDir(filepath.Join(blocker, `cache`)); err == nil || !strings.Contains(err.Error(), `Ingest-Cache-Path`) {
+		t.Fatalf("unusable cache path not detected: %v", err)
+	}
+	if _, err := startSinks(mustParse(t, testConfigBase+"\tIngest-Cache-Path "+filepath.Join(blocker, `cache`)+"\n}"), nil); err == nil {
+		t.Fatal("setup accepted an unusable cache path")
+	}
+}
+
+func TestSyntheticMetadata(t *testing.T) {
+	q := []dns.Question{{Name: "a.example.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET}}
+	synthetic := func(is *introspector) *bool {
+		var v dnsBase
+		if err := json.Unmarshal(jsonEncoder{}.Encode(entry.Now(), testLocal, testRemote, is)[0], &v); err != nil {
+			t.Fatal(err)
+		}
+		return v.Synthetic
+	}
+
+	is := &introspector{q: q}
+	is.readMetadata(context.Background())
+	if synthetic(is) != nil {
+		t.Fatal("Synthetic present without metadata")
+	}
+	for _, val := range []bool{true, false} {
+		ctx := metadata.ContextWithMetadata(context.Background())
+		metadata.SetValueFunc(ctx, synthesizedMetadataKey, func() string { return strconv.FormatBool(val) })
+		is = &introspector{q: q}
+		is.readMetadata(ctx)
+		if v := synthetic(is); v == nil || *v != val {
+			t.Fatalf("bad Synthetic for %v: %v", val, v)
+		}
+	}
+	//an RFC 8914 Synthesized extended error stands in for the metadata
+	is = &introspector{q: q, edeCodes: []uint16{dns.ExtendedErrorCodeSynthesized}}
+	is.readMetadata(context.Background())
+	if v := synthetic(is); v == nil || !*v {
+		t.Fatalf("Synthesized extended error not detected: %v", v)
+	}
+	//garbage is treated as absent
+	ctx := metadata.ContextWithMetadata(context.Background())
+	metadata.SetValueFunc(ctx, synthesizedMetadataKey, func() string { return `maybe` })
+	is = &introspector{q: q}
+	is.readMetadata(ctx)
+	if synthetic(is) != nil {
+		t.Fatal("Synthetic set from an unparseable label")
+	}
+}
+
+func TestBlockedMetadata(t *testing.T) {
+	q := []dns.Question{{Name: "ads.example.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET}}
+	decode := func(ctx context.Context) (v dnsBase, raw []byte) {
+		is := &introspector{q: q}
+		is.readMetadata(ctx)
+		raw = jsonEncoder{}.Encode(entry.Now(), testLocal, testRemote, is)[0]
+		if err := json.Unmarshal(raw, &v); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	if _, raw := decode(context.Background()); bytes.Contains(raw, []byte(`Block`)) {
+		t.Fatalf("block fields present without metadata: %s", raw)
+	}
+	for _, tt := range []struct {
+		blocked, reason string
+		exp             bool
+	}{
+		{`true`, `oisd-big`, true},
+		{`true`, ``, true},
+		{``, `rpz:malware`, true}, //a reason implies blocked
+		{`false`, `allowlisted`, false},
+	} {
+		ctx := metadata.ContextWithMetadata(context.Background())
+		if tt.blocked != `` {
+			metadata.SetValueFunc(ctx, blockedMetadataKey, func() string { return tt.blocked })
+		}
+		if tt.reason != `` {
+			metadata.SetValueFunc(ctx, blockReasonMetadataKey, func() string { return tt.reason })
+		}
+		if v, raw := decode(ctx); v.Blocked != tt.exp || v.BlockReason != tt.reason {
+			t.Fatalf("bad block fields for %q %q: %s", tt.blocked, tt.reason, raw)
+		}
+	}
+}
+
+func TestAuthoritative(t *testing.T) {
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+	req.RecursionDesired = true
+	authoritative := func(aa bool) bool {
+		t.Helper()
+		rw := &test.ResponseWriter{}
+		resp := new(dns.Msg)
+		resp.SetReply(req)
+		resp.Authoritative = aa
+		resp.RecursionAvailable = !aa
+		resp.Answer = append(resp.Answer, test.A("example.com. 300 IN A 1.2.3.4"))
+		is := newIntrospector(rw, req)
+		if err := is.WriteMsg(resp); err != nil {
+			t.Fatal(err)
+		}
+		var v dnsBase
+		if err := json.Unmarshal(jsonEncoder{}.Encode(entry.Now(), rw.LocalAddr(), rw.RemoteAddr(), is)[0], &v); err != nil {
+			t.Fatal(err)
+		}
+		return v.Authoritative
+	}
+	//an answer from a zone this server is authoritative for, then one forwarded upstream
+	if !authoritative(true) {
+		t.Fatal("authoritative answer without Authoritative")
+	} else if authoritative(false) {
+		t.Fatal("forwarded answer marked Authoritative")
+	}
+}
+
+// TestServeDNSEntries drives the whole handler path against the in-memory writer and checks the
+// exact entries, so any change to the bytes a default configuration produces shows up here
+func TestServeDNSEntries(t *testing.T) {
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+	for _, tc := range []struct {
+		enc encoder
+		exp string // formatted with the entry timestamp
+	}{
+		{
+			enc: &jsonEncoder{},
+			exp: `{"TS":"%s","EventType":"answer","Proto":"udp","Local":"127.0.0.1:53","Remote":"10.240.0.1:40212",` +
+				`"RecursionDesired":true,"RecursionAvailable":false,"Authoritative":false,"ResolvedIP":"1.2.3.4",` +
+				`"RequestBytes":29,"ResponseBytes":56,"AmplificationFactor":1.9310344827586208,` +
+				`"Question":{"Hdr":{"Name":"example.com.","Rrtype":1,"Class":1,"Ttl":300,"Rdlength":0},"A":"1.2.3.4"}}`,
+		},
+		{
+			enc: &textEncoder{},
+			exp: "%s udp 127.0.0.1:53 10.240.0.1:40212 example.com.\t300\tIN\tA\t1.2.3.4 EventType=answer",
+		},
+	} {
+		dw := &discardWriter{keep: true}
+		gh := gwHandler{
+			Next:          answerHandler(false),
+			im:            dw,
+			tag:           3,
+			enc:           tc.enc,
+			encodeOptions: encodeOptions{maxQuestions: defaultMaxQuestions},
+		}
+		if rcode, err := gh.ServeDNS(context.Background(), &test.ResponseWriter{}, req); err != nil || rcode != dns.RcodeSuccess {
+			t.Fatal(rcode, err)
+		} else if len(dw.ents) != 1 {
+			t.Fatalf("%s: got %d entries", tc.enc.Name(), len(dw.ents))
+		}
+		ent := dw.ents[0]
+		if ent.Tag != 3 {
+			t.Fatalf("%s: bad tag %d", tc.enc.Name(), ent.Tag)
+		} else if exp := fmt.Sprintf(tc.exp, ent.TS.String()); string(ent.Data) != exp {
+			t.Fatalf("%s: bad entry\n%s\n!=\n%s", tc.enc.Name(), ent.Data, exp)
+		}
+	}
+}
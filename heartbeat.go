@@ -0,0 +1,119 @@
+/*************************************************************************
+ * Copyright 2017 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package gravwellcoredns
+
+import (
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/gravwell/gravwell/v3/ingest/entry"
+)
+
+// heartbeatRecord is a periodic liveness entry carrying cheap process health stats, it is
+// always JSON regardless of the configured encoding
+type heartbeatRecord struct {
+	TS         entry.Timestamp
+	EventType  string
+	Heartbeat  bool
+	Uptime     string
+	Goroutines int
+	HeapAlloc  uint64 // bytes of allocated heap objects
+	Sys        uint64 // bytes obtained from the OS
+
+	MuxerConnectedFor string   `json:",omitempty"` // time the live indexer connections have been unchanged, empty with none live
+	ConnectionsHot    int      `json:",omitempty"`
+	ConnectionsDead   int      `json:",omitempty"`
+	EntriesWritten    uint64   `json:",omitempty"` // totals since the muxer started, not since the last heartbeat
+	BytesWritten      uint64   `json:",omitempty"`
+	WriteErrors       uint64   `json:",omitempty"`
+	ClockOffsetMS     *float64 `json:",omitempty"` // local clock offset from ntp-check-server, nil when unknown
+}
+
+type heartbeat struct {
+	interval time.Duration
+	tag      entry.EntryTag
+	start    time.Time
+	write    func(*entry.Entry) error
+	lg       *pluginLogger
+	cw       *connWatcher  // nil when there is no ingest muxer
+	st       *writeStats   // nil when there is no ingest muxer
+	clock    *clockChecker // nil unless ntp-check-server
+	done     chan struct{}
+	wg       sync.WaitGroup
+}
+
+func newHeartbeat(interval time.Duration, tag entry.EntryTag, write func(*entry.Entry) error, cw *connWatcher, st *writeStats, clock *clockChecker, lg *pluginLogger) *heartbeat {
+	hb := &heartbeat{
+		interval: interval,
+		tag:      tag,
+		start:    time.Now(),
+		write:    write,
+		lg:       lg,
+		cw:       cw,
+		st:       st,
+		clock:    clock,
+		done:     make(chan struct{}),
+	}
+	hb.wg.Add(1)
+	go hb.run()
+	return hb
+}
+
+func (hb *heartbeat) run() {
+	defer hb.wg.Done()
+	tckr := time.NewTicker(hb.interval)
+	defer tckr.Stop()
+	for {
+		select {
+		case <-hb.done:
+			return
+		case <-tckr.C:
+			if err := hb.write(hb.entry(entry.Now())); err != nil {
+				hb.lg.Warningf("failed to write heartbeat: %v", err)
+			}
+		}
+	}
+}
+
+// entry samples the runtime, memstats are read exactly once per heartbeat
+func (hb *heartbeat) entry(ts entry.Timestamp) *entry.Entry {
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	rec := heartbeatRecord{
+		TS:            ts,
+		EventType:     eventHeartbeat,
+		Heartbeat:     true,
+		Uptime:        time.Since(hb.start).Round(time.Second).String(),
+		Goroutines:    runtime.NumGoroutine(),
+		HeapAlloc:     ms.Alloc,
+		Sys:           ms.Sys,
+		ClockOffsetMS: hb.clock.offsetMS(),
+	}
+	if hb.cw != nil {
+		//left out rather than reported as 0s while no indexer connection is live
+		if d := hb.cw.connectedFor(); d > 0 {
+			rec.MuxerConnectedFor = d.Round(time.Second).String()
+		}
+		rec.ConnectionsHot, rec.ConnectionsDead = hb.cw.connections()
+	}
+	if hb.st != nil {
+		rec.EntriesWritten, rec.BytesWritten, rec.WriteErrors = hb.st.entries.Load(), hb.st.bytes.Load(), hb.st.errors.Load()
+	}
+	return &entry.Entry{
+		TS:   ts,
+		Tag:  hb.tag,
+		Data: marshalRecord(ts, rec),
+	}
+}
+
+func (hb *heartbeat) close() {
+	close(hb.done)
+	hb.wg.Wait()
+}
@@ -0,0 +1,189 @@
+/*************************************************************************
+ * Copyright 2017 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package gravwellcoredns
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/coredns/caddy"
+	"github.com/gravwell/gravwell/v3/ingest/entry"
+)
+
+func TestHeartbeat(t *testing.T) {
+	var mtx sync.Mutex
+	var ents []*entry.Entry
+	hb := newHeartbeat(10*time.Millisecond, 3, func(ent *entry.Entry) error {
+		mtx.Lock()
+		ents = append(ents, ent)
+		mtx.Unlock()
+		return nil
+	}, nil, nil, nil, nil)
+	time.Sleep(55 * time.Millisecond)
+	hb.close()
+
+	mtx.Lock()
+	defer mtx.Unlock()
+	if len(ents) == 0 {
+		t.Fatal("no heartbeats written")
+	}
+	var v heartbeatRecord
+	if ents[0].Tag != 3 {
+		t.Fatalf("bad heartbeat tag %d", ents[0].Tag)
+	} else if err := json.Unmarshal(ents[0].Data, &v); err != nil {
+		t.Fatal(err)
+	} else if !v.Heartbeat || v.EventType != eventHeartbeat || v.Goroutines == 0 || v.HeapAlloc == 0 || v.Sys == 0 {
+		t.Fatalf("bad heartbeat %+v", v)
+	}
+	//nothing is written after close
+	n := len(ents)
+	time.Sleep(20 * time.Millisecond)
+	if len(ents) != n {
+		t.Fatal("heartbeat written after close")
+	}
+}
+
+type fakeHot struct {
+	n, dead  atomic.Int64
+	hotAfter time.Duration
+}
+
+func (f *fakeHot) Hot() (int, error) {
+	return int(f.n.Load()), nil
+}
+
+func (f *fakeHot) Dead() (int, error) {
+	return int(f.dead.Load()), nil
+}
+
+// WaitForHot takes hotAfter to see the first connection, which is already counted in n
+func (f *fakeHot) WaitForHot(timeout time.Duration) error {
+	if f.hotAfter > timeout {
+		time.Sleep(timeout)
+		return errors.New("timed out")
+	}
+	time.Sleep(f.hotAfter)
+	return nil
+}
+
+func TestConnWatcher(t *testing.T) {
+	var fh fakeHot
+	cw := newConnWatcher(&fh, 5*time.Millisecond)
+	defer cw.close()
+	if cw.connectedFor() != 0 {
+		t.Fatal("connected with no live connections")
+	}
+	fh.n.Store(2)
+	time.Sleep(30 * time.Millisecond)
+	first := cw.connectedFor()
+	if first <= 0 {
+		t.Fatal("connection not observed")
+	}
+	//losing one connection restarts the clock
+	fh.n.Store(1)
+	time.Sleep(15 * time.Millisecond)
+	if d := cw.connectedFor(); d <= 0 || d >= first+15*time.Millisecond {
+		t.Fatalf("clock not restarted on a connection change: %v then %v", first, d)
+	}
+	fh.n.Store(0)
+	time.Sleep(15 * time.Millisecond)
+	if cw.connectedFor() != 0 {
+		t.Fatal("connected after every connection dropped")
+	}
+	var nilcw *connWatcher
+	if nilcw.connectedFor() != 0 {
+		t.Fatal("nil watcher is connected")
+	}
+}
+
+func TestHeartbeatStats(t *testing.T) {
+	var fh fakeHot
+	fh.n.Store(2)
+	fh.dead.Store(1)
+	cw := newConnWatcher(&fh, time.Hour)
+	defer cw.close()
+	st := &writeStats{}
+	w := countingWriter{entryWriter: &discardWriter{}, st: st}
+	for i := 0; i < 3; i++ {
+		w.WriteEntry(&entry.Entry{Data: []byte(`abcd`)})
+	}
+	countingWriter{entryWriter: &stalledWriter{}, st: st}.WriteEntryTimeout(&entry.Entry{Data: []byte(`abcd`)}, time.Millisecond)
+
+	hb := &heartbeat{start: time.Now(), cw: cw, st: st}
+	var v heartbeatRecord
+	if err := json.Unmarshal(hb.entry(entry.Now()).Data, &v); err != nil {
+		t.Fatal(err)
+	} else if v.ConnectionsHot != 2 || v.ConnectionsDead != 1 {
+		t.Fatalf("bad connection counts %+v", v)
+	} else if v.EntriesWritten != 3 || v.BytesWritten != 12 || v.WriteErrors != 1 {
+		t.Fatalf("bad write stats %+v", v)
+	} else if v.MuxerConnectedFor == `` {
+		t.Fatalf("missing MuxerConnectedFor with live connections %+v", v)
+	}
+
+	//no live connections, no connected time
+	var down fakeHot
+	dcw := newConnWatcher(&down, time.Hour)
+	defer dcw.close()
+	hb.cw = dcw
+	if bb := hb.entry(entry.Now()).Data; bytes.Contains(bb, []byte(`MuxerConnectedFor`)) {
+		t.Fatalf("MuxerConnectedFor without a live connection %s", bb)
+	}
+}
+
+func TestWaitForConnections(t *testing.T) {
+	var fh fakeHot
+	fh.n.Store(1)
+	if err := waitForConnections(&fh, 0, time.Now().Add(time.Millisecond)); err != nil {
+		t.Fatal("min-connections unset waited", err)
+	} else if err = waitForConnections(&fh, 1, time.Now().Add(time.Millisecond)); err != nil {
+		t.Fatal(err)
+	}
+	//a second connection arriving before the timeout satisfies the wait
+	go func() {
+		time.Sleep(30 * time.Millisecond)
+		fh.n.Store(2)
+	}()
+	start := time.Now()
+	if err := waitForConnections(&fh, 2, time.Now().Add(time.Second)); err != nil {
+		t.Fatal(err)
+	} else if time.Since(start) < 30*time.Millisecond {
+		t.Fatal("returned before the second connection came up")
+	}
+	//too few connections times out
+	if err := waitForConnections(&fh, 3, time.Now().Add(50*time.Millisecond)); err == nil {
+		t.Fatal("two connections satisfied min-connections 3")
+	}
+	//the first connection and min-connections share one timeout
+	fh.hotAfter = 80 * time.Millisecond
+	start = time.Now()
+	if err := waitForHot(&fh, 3, 100*time.Millisecond); err == nil {
+		t.Fatal("two connections satisfied min-connections 3")
+	} else if d := time.Since(start); d > 150*time.Millisecond {
+		t.Fatalf("waited %v past a 100ms timeout", d)
+	}
+	if err := waitForHot(&fh, 2, 100*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+
+	//min-connections is bounded by the configured targets
+	if _, _, err := parseConfig(caddy.NewTestController("dns", `gravwell {
+	Ingest-Secret testing
+	Cleartext-Target 192.168.1.1:4024
+	Cleartext-Target 192.168.1.2:4024
+	Min-Connections 3
+	}`)); err == nil {
+		t.Fatal("accepted min-connections above the target count")
+	}
+}
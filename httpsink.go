@@ -0,0 +1,224 @@
+/*************************************************************************
+ * Copyright 2017 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package gravwellcoredns
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gravwell/gravwell/v3/ingest/entry"
+)
+
+const (
+	httpBatchTimeout       time.Duration = 10 * time.Millisecond // how long a batch waits for more entries
+	httpBatchMaxBytes      int           = 1 << 20               // a batch this large is posted immediately
+	httpMaxInFlight        int           = 4                     // posts outstanding, retries included, before writes fail
+	httpRequestTimeout     time.Duration = 30 * time.Second
+	httpRetryBackoff       time.Duration = 250 * time.Millisecond // multiplied by the attempt number
+	defaultHTTPSinkRetries int           = 2
+	httpSinkName           string        = `http`
+)
+
+var (
+	errHTTPSinkClosed = errors.New("http-sink is closed")
+	errHTTPSinkBusy   = errors.New("http-sink has too many requests in flight")
+)
+
+// parseHTTPSink validates an http-sink URL, only http and https with a host are accepted
+func parseHTTPSink(v string) (string, error) {
+	u, err := url.Parse(v)
+	if err != nil {
+		return ``, fmt.Errorf("Invalid http-sink %q - %w", v, err)
+	}
+	switch strings.ToLower(u.Scheme) {
+	case `http`, `https`:
+	default:
+		return ``, fmt.Errorf("Invalid http-sink %q, the scheme must be http or https", v)
+	}
+	if u.Hostname() == `` {
+		return ``, fmt.Errorf("Invalid http-sink %q, missing host", v)
+	}
+	return u.String(), nil
+}
+
+// parseHTTPSinkHeader parses an http-sink-header Name: value directive, the value may contain
+// spaces so the arguments are rejoined before splitting on the first colon
+func parseHTTPSinkHeader(args []string) (string, error) {
+	name, val, ok := strings.Cut(strings.Join(args, ` `), `:`)
+	name, val = strings.TrimSpace(name), strings.TrimSpace(val)
+	if !ok || name == `` || strings.ContainsAny(name, " \t") {
+		return ``, fmt.Errorf("Invalid http-sink-header %q, must be Name: value", strings.Join(args, ` `))
+	}
+	return textproto.CanonicalMIMEHeaderKey(name) + `: ` + val, nil
+}
+
+// redactURL strips the userinfo and query from a URL before it is logged, either may carry credentials
+func redactURL(v string) string {
+	u, err := url.Parse(v)
+	if err != nil {
+		return `<unparseable>`
+	}
+	u.User, u.RawQuery, u.ForceQuery, u.Fragment = nil, ``, false, ``
+	return u.String()
+}
+
+// httpBatch is one pending POST
+type httpBatch struct {
+	body    []byte
+	entries int
+}
+
+// httpSink POSTs encoded entries as newline delimited bodies.  Writes are asynchronous like the
+// Kafka sink, entries arriving within httpBatchTimeout of each other share a request that is
+// posted in the background.  At most httpMaxInFlight requests are outstanding, beyond that a
+// write fails immediately instead of queueing behind a slow endpoint.  A non-2xx response is a
+// failure, 5xx, 429, and transport errors are retried, and a batch that still fails is counted
+// as http drops.
+type httpSink struct {
+	url     string
+	headers http.Header
+	retries int
+	client  *http.Client
+	errlog  *errorLog
+
+	mtx      sync.Mutex
+	cur      *httpBatch
+	inflight int
+	closed   bool
+	wg       sync.WaitGroup
+}
+
+func newHTTPSink(u string, headers []string, retries int, el *errorLog) *httpSink {
+	h := &httpSink{
+		url:     u,
+		headers: http.Header{},
+		retries: retries,
+		client:  &http.Client{Timeout: httpRequestTimeout},
+		errlog:  el,
+	}
+	for _, v := range headers {
+		name, val, _ := strings.Cut(v, `: `) //validated by parseHTTPSinkHeader
+		h.headers.Add(name, val)
+	}
+	if h.headers.Get(`Content-Type`) == `` {
+		h.headers.Set(`Content-Type`, `application/x-ndjson`)
+	}
+	return h
+}
+
+func (h *httpSink) WriteEntry(ent *entry.Entry) error {
+	return h.add(ent.Data)
+}
+
+// WriteEntryTimeout never waits on the endpoint, so the timeout does not apply
+func (h *httpSink) WriteEntryTimeout(ent *entry.Entry, _ time.Duration) error {
+	return h.add(ent.Data)
+}
+
+func (h *httpSink) add(data []byte) error {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	if h.closed {
+		return errHTTPSinkClosed
+	}
+	b := h.cur
+	if b == nil {
+		//the open batch is posted once a slot frees up, so only open one when a slot is free
+		if h.inflight >= httpMaxInFlight {
+			return errHTTPSinkBusy
+		}
+		b = &httpBatch{}
+		h.cur = b
+		time.AfterFunc(httpBatchTimeout, func() {
+			h.mtx.Lock()
+			h.send(b)
+			h.mtx.Unlock()
+		})
+	}
+	b.body = append(append(b.body, data...), '\n')
+	b.entries++
+	if len(b.body) >= httpBatchMaxBytes {
+		h.send(b)
+	}
+	return nil
+}
+
+// send starts posting b if it is still the open batch, the caller holds the lock
+func (h *httpSink) send(b *httpBatch) {
+	if h.cur != b {
+		return //already sent by size or by close
+	}
+	h.cur = nil
+	h.inflight++
+	h.wg.Add(1)
+	go func() {
+		defer h.wg.Done()
+		var err error
+		for attempt := 0; ; attempt++ {
+			var retry bool
+			if retry, err = h.post(b.body); err == nil || !retry || attempt >= h.retries {
+				break
+			}
+			time.Sleep(time.Duration(attempt+1) * httpRetryBackoff)
+		}
+		if err != nil {
+			sinkDroppedEntries.WithLabelValues(httpSinkName).Add(float64(b.entries))
+			h.errlog.log(fmt.Errorf("http-sink post of %d entries failed: %w", b.entries, err))
+		}
+		h.mtx.Lock()
+		h.inflight--
+		h.mtx.Unlock()
+	}()
+}
+
+// post makes a single request, retry reports whether the failure is worth another attempt
+func (h *httpSink) post(body []byte) (retry bool, err error) {
+	req, err := http.NewRequest(http.MethodPost, h.url, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header = h.headers.Clone()
+	resp, err := h.client.Do(req)
+	if err != nil {
+		//the error is logged and carries the URL
+		var ue *url.Error
+		if errors.As(err, &ue) {
+			ue.URL = redactURL(ue.URL)
+		}
+		return true, err
+	}
+	//drain a bounded amount so the connection can be reused
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		retry = resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests
+		return retry, fmt.Errorf("http-sink %s returned %s", redactURL(h.url), resp.Status)
+	}
+	return false, nil
+}
+
+// close posts the open batch and waits for every outstanding request, later writes fail
+func (h *httpSink) close() error {
+	h.mtx.Lock()
+	h.closed = true
+	if h.cur != nil {
+		h.send(h.cur)
+	}
+	h.mtx.Unlock()
+	h.wg.Wait()
+	return nil
+}
@@ -0,0 +1,165 @@
+/*************************************************************************
+ * Copyright 2017 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package gravwellcoredns
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/gravwell/gravwell/v3/ingest/entry"
+	"github.com/segmentio/kafka-go"
+)
+
+const (
+	kafkaBatchTimeout  time.Duration = 10 * time.Millisecond // how long a produce waits for other entries to batch with
+	kafkaLookupTimeout time.Duration = time.Second           // bound on the partition lookup when no write-timeout is set
+	kafkaSinkName      string        = `kafka`
+)
+
+// kafkaMessageWriter is the subset of the kafka writer used by the sink
+type kafkaMessageWriter interface {
+	WriteMessages(context.Context, ...kafka.Message) error
+	Close() error
+}
+
+// kafkaSink produces encoded entries to a Kafka topic.  Produces are asynchronous, a write only
+// waits for the partition lookup, which the transport caches, and batches are delivered in the
+// background.  Delivery failures are reported to the completion callback, which counts them as
+// kafka drops, since the request that wrote the entry has long since returned.
+type kafkaSink struct {
+	w      kafkaMessageWriter
+	errlog *errorLog
+}
+
+func newKafkaSink(brokers []string, topic string, el *errorLog, lg *pluginLogger) *kafkaSink {
+	k := &kafkaSink{errlog: el}
+	k.w = &kafka.Writer{
+		Addr:         kafka.TCP(brokers...),
+		Topic:        topic,
+		Balancer:     &kafka.LeastBytes{},
+		RequiredAcks: kafka.RequireOne,
+		BatchTimeout: kafkaBatchTimeout,
+		Async:        true,
+		Completion:   k.completed,
+		ErrorLogger:  kafka.LoggerFunc(func(f string, v ...interface{}) { lg.Errorf(f, v...) }),
+	}
+	return k
+}
+
+func (k *kafkaSink) message(ent *entry.Entry) kafka.Message {
+	return kafka.Message{
+		Value: ent.Data,
+		Time:  ent.TS.StandardTime(),
+	}
+}
+
+// completed accounts for a delivered or failed batch
+func (k *kafkaSink) completed(msgs []kafka.Message, err error) {
+	if err != nil {
+		sinkDroppedEntries.WithLabelValues(kafkaSinkName).Add(float64(len(msgs)))
+		k.errlog.log(fmt.Errorf("kafka produce of %d entries failed: %w", len(msgs), err))
+	}
+}
+
+func (k *kafkaSink) WriteEntry(ent *entry.Entry) error {
+	return k.WriteEntryTimeout(ent, kafkaLookupTimeout)
+}
+
+func (k *kafkaSink) WriteEntryTimeout(ent *entry.Entry, to time.Duration) error {
+	ctx, cf := context.WithTimeout(context.Background(), to)
+	defer cf()
+	return k.w.WriteMessages(ctx, k.message(ent))
+}
+
+// close flushes any pending batch, waiting on the completion of every outstanding produce
+func (k *kafkaSink) close() error {
+	return k.w.Close()
+}
+
+// addWriter adds a named sink to the writer chain, fanning out once there is more than one
+func addWriter(im entryWriter, name string, w entryWriter) entryWriter {
+	switch v := im.(type) {
+	case nil:
+		return w
+	case fanoutWriter:
+		return append(v, namedWriter{name: name, entryWriter: w})
+	}
+	return fanoutWriter{{name: gravwellSinkName, entryWriter: im}, {name: name, entryWriter: w}}
+}
+
+const gravwellSinkName string = `gravwell`
+
+// namedWriter is a fanned out sink, the name labels its drops
+type namedWriter struct {
+	name string
+	entryWriter
+}
+
+// partialWriteError is a fanout write that some sinks failed and at least one took, the
+// failing sinks have counted their own drops so the entry is not dropped for the request
+type partialWriteError struct {
+	err error
+}
+
+func (e *partialWriteError) Error() string {
+	return e.err.Error()
+}
+
+func (e *partialWriteError) Unwrap() error {
+	return e.err
+}
+
+// droppedAll reports whether a write error means the entry reached no sink at all
+func droppedAll(err error) bool {
+	var pe *partialWriteError
+	return err != nil && !errors.As(err, &pe)
+}
+
+// fanoutWriter writes every entry to each sink concurrently, so a slow sink does not add its
+// latency to the others and a failure on one sink does not stop the others
+type fanoutWriter []namedWriter
+
+func (f fanoutWriter) WriteEntry(ent *entry.Entry) error {
+	return f.write(func(w entryWriter) error { return w.WriteEntry(ent) })
+}
+
+func (f fanoutWriter) WriteEntryTimeout(ent *entry.Entry, to time.Duration) error {
+	return f.write(func(w entryWriter) error { return w.WriteEntryTimeout(ent, to) })
+}
+
+func (f fanoutWriter) write(fn func(entryWriter) error) error {
+	errs := make([]error, len(f))
+	var wg sync.WaitGroup
+	for i := 1; i < len(f); i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = fn(f[i])
+		}(i)
+	}
+	errs[0] = fn(f[0])
+	wg.Wait()
+	var failed int
+	for i, err := range errs {
+		if err != nil {
+			failed++
+			sinkDroppedEntries.WithLabelValues(f[i].name).Inc()
+			errs[i] = fmt.Errorf("%s: %w", f[i].name, err)
+		}
+	}
+	if failed == 0 {
+		return nil
+	} else if failed < len(f) {
+		return &partialWriteError{err: errors.Join(errs...)}
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,172 @@
+/*************************************************************************
+ * Copyright 2017 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package gravwellcoredns
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/coredns/caddy"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/gravwell/gravwell/v3/ingest/entry"
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/segmentio/kafka-go"
+)
+
+// fakeKafka may sit behind several fanout sinks, which write to it concurrently
+type fakeKafka struct {
+	mtx       sync.Mutex
+	msgs      []kafka.Message
+	deadlines []bool
+	err       error
+	closed    bool
+}
+
+func (f *fakeKafka) WriteMessages(ctx context.Context, msgs ...kafka.Message) error {
+	_, ok := ctx.Deadline()
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	f.deadlines = append(f.deadlines, ok)
+	if f.err != nil {
+		return f.err
+	}
+	f.msgs = append(f.msgs, msgs...)
+	return nil
+}
+
+func (f *fakeKafka) Close() error {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	f.closed = true
+	return nil
+}
+
+func TestKafkaSink(t *testing.T) {
+	fk := &fakeKafka{}
+	ks := &kafkaSink{w: fk}
+	ts := entry.Now()
+	if err := ks.WriteEntry(&entry.Entry{TS: ts, Data: []byte(`one`)}); err != nil {
+		t.Fatal(err)
+	} else if err = ks.WriteEntryTimeout(&entry.Entry{TS: ts, Data: []byte(`two`)}, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if len(fk.msgs) != 2 || string(fk.msgs[0].Value) != `one` || string(fk.msgs[1].Value) != `two` {
+		t.Fatalf("bad messages %+v", fk.msgs)
+	} else if !fk.msgs[0].Time.Equal(ts.StandardTime()) {
+		t.Fatalf("bad message time %v", fk.msgs[0].Time)
+	} else if !fk.deadlines[0] || !fk.deadlines[1] {
+		t.Fatalf("partition lookup not bounded %v", fk.deadlines)
+	}
+
+	//produces are asynchronous, failed deliveries are counted when the batch completes
+	base := testutil.ToFloat64(sinkDroppedEntries.WithLabelValues(kafkaSinkName))
+	ks.completed(fk.msgs, nil)
+	ks.completed(fk.msgs, errors.New(`broker down`))
+	if d := testutil.ToFloat64(sinkDroppedEntries.WithLabelValues(kafkaSinkName)) - base; d != 2 {
+		t.Fatalf("failed delivery counted %v drops", d)
+	}
+
+	if err := ks.close(); err != nil || !fk.closed {
+		t.Fatal("sink not closed")
+	}
+}
+
+// rendezvousWriter only succeeds when every writer sharing wg is writing at the same time
+type rendezvousWriter struct {
+	wg *sync.WaitGroup
+}
+
+func (r rendezvousWriter) WriteEntry(ent *entry.Entry) error {
+	r.wg.Done()
+	done := make(chan struct{})
+	go func() {
+		r.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-time.After(time.Second):
+		return errors.New(`sinks written one at a time`)
+	}
+}
+
+func (r rendezvousWriter) WriteEntryTimeout(ent *entry.Entry, _ time.Duration) error {
+	return r.WriteEntry(ent)
+}
+
+func TestFanoutWriter(t *testing.T) {
+	ent := &entry.Entry{TS: entry.Now(), Data: []byte(`one`)}
+	var wg sync.WaitGroup
+	wg.Add(2)
+	if err := addWriter(rendezvousWriter{wg: &wg}, `syslog`, rendezvousWriter{wg: &wg}).WriteEntry(ent); err != nil {
+		t.Fatal(err)
+	}
+
+	//a failing sink does not stop the others, counts its own drop, and does not drop the entry
+	dw := &discardWriter{keep: true}
+	fk := &fakeKafka{err: errors.New(`broker down`)}
+	fw := addWriter(dw, kafkaSinkName, &kafkaSink{w: fk})
+	base := testutil.ToFloat64(sinkDroppedEntries.WithLabelValues(kafkaSinkName))
+	if err := fw.WriteEntry(ent); err == nil {
+		t.Fatal("producer error was swallowed")
+	} else if droppedAll(err) {
+		t.Fatalf("entry that reached a sink counted as dropped: %v", err)
+	} else if len(dw.ents) != 1 {
+		t.Fatal("failing sink prevented the other sink from receiving the entry")
+	} else if d := testutil.ToFloat64(sinkDroppedEntries.WithLabelValues(kafkaSinkName)) - base; d != 1 {
+		t.Fatalf("sink drop counted %v times", d)
+	}
+
+	//the handler keeps writing the request's entries and leaves dropped_entries alone
+	gh := gwHandler{
+		Next:          answerHandler(false),
+		im:            fw,
+		enc:           &textEncoder{},
+		encodeOptions: encodeOptions{maxQuestions: defaultMaxQuestions},
+	}
+	drops := testutil.ToFloat64(droppedEntries)
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+	if _, err := gh.ServeDNS(context.Background(), &test.ResponseWriter{}, req); err != nil {
+		t.Fatal(err)
+	} else if len(dw.ents) != 2 || testutil.ToFloat64(droppedEntries) != drops {
+		t.Fatalf("partial write dropped the request, %d entries written", len(dw.ents))
+	}
+
+	//an entry no sink took is dropped
+	fw = addWriter(&kafkaSink{w: fk}, kafkaSinkName, &kafkaSink{w: fk})
+	if err := fw.WriteEntry(ent); !droppedAll(err) {
+		t.Fatalf("entry no sink took not dropped: %v", err)
+	}
+}
+
+func TestKafkaConfig(t *testing.T) {
+	cfg, _, err := parseConfig(caddy.NewTestController("dns", "gravwell {\n\tKafka-Broker 10.0.0.1:9092\n\tKafka-Broker 10.0.0.2:9092\n\tKafka-Topic dns\n}"))
+	if err != nil {
+		t.Fatal(err)
+	} else if len(cfg.KafkaBrokers) != 2 || cfg.KafkaTopic != `dns` || cfg.gravwellTargets() {
+		t.Fatalf("bad kafka config %+v", cfg)
+	}
+	for _, bad := range []string{
+		"gravwell {\n\tKafka-Broker 10.0.0.1:9092\n}",
+		"gravwell {\n\tKafka-Topic dns\n}",
+		"gravwell {\n\tKafka-Broker 10.0.0.1\n\tKafka-Topic dns\n}",
+		"gravwell {\n\tKafka-Broker 10.0.0.1:9092\n\tKafka-Topic dns\n\tTag-On-Rcode SERVFAIL dns-errors\n}",
+		"gravwell {\n\tKafka-Broker 10.0.0.1:9092\n\tKafka-Topic dns\n\tCleartext-Target 10.0.0.1:4023\n}", //targets still need a secret
+	} {
+		if _, _, err = parseConfig(caddy.NewTestController("dns", bad)); err == nil {
+			t.Fatalf("accepted bad config %q", bad)
+		}
+	}
+}
@@ -0,0 +1,79 @@
+/*************************************************************************
+ * Copyright 2017 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package gravwellcoredns
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	latencySamples  int = 512 // recent latencies kept for the percentile
+	latencyRecalc   int = 64  // observations between percentile recalculations
+	latencyMinCount int = 64  // observations before anything is flagged
+)
+
+// latencyTracker flags requests slower than a rolling percentile of recent request latencies.
+// The last latencySamples latencies are kept in a ring and the threshold is recomputed every
+// latencyRecalc observations, so the sort cost is amortized across requests.
+type latencyTracker struct {
+	sync.Mutex
+	pct       float64 // 0-100 exclusive
+	ring      []time.Duration
+	next      int
+	seen      int
+	threshold time.Duration // 0 until latencyMinCount observations
+	scratch   []time.Duration
+}
+
+func newLatencyTracker(pct float64) *latencyTracker {
+	return &latencyTracker{
+		pct:     pct,
+		ring:    make([]time.Duration, 0, latencySamples),
+		scratch: make([]time.Duration, 0, latencySamples),
+	}
+}
+
+// parsePercentile validates a slow-outlier-percentile, which must be strictly between 0 and 100
+func parsePercentile(v string) (p float64, err error) {
+	if p, err = strconv.ParseFloat(v, 64); err != nil || p <= 0 || p >= 100 {
+		err = fmt.Errorf("Invalid slow-outlier-percentile %q, must be between 0 and 100 exclusive", v)
+	}
+	return
+}
+
+// observe records a latency and reports whether it exceeded the threshold in effect before it was recorded
+func (lt *latencyTracker) observe(d time.Duration) (slow bool) {
+	lt.Lock()
+	defer lt.Unlock()
+	slow = lt.threshold > 0 && d > lt.threshold
+	if len(lt.ring) < latencySamples {
+		lt.ring = append(lt.ring, d)
+	} else {
+		lt.ring[lt.next] = d
+		lt.next = (lt.next + 1) % latencySamples
+	}
+	if lt.seen++; lt.seen >= latencyMinCount && lt.seen%latencyRecalc == 0 {
+		lt.recalc()
+	}
+	return
+}
+
+func (lt *latencyTracker) recalc() {
+	lt.scratch = append(lt.scratch[:0], lt.ring...)
+	slices.Sort(lt.scratch)
+	idx := int(float64(len(lt.scratch)) * lt.pct / 100)
+	if idx >= len(lt.scratch) {
+		idx = len(lt.scratch) - 1
+	}
+	lt.threshold = lt.scratch[idx]
+}
@@ -0,0 +1,56 @@
+/*************************************************************************
+ * Copyright 2017 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package gravwellcoredns
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLatencyTracker(t *testing.T) {
+	lt := newLatencyTracker(95)
+	//nothing is flagged while warming up
+	for i := 0; i < latencyMinCount-1; i++ {
+		if lt.observe(time.Hour) {
+			t.Fatal("flagged before warm up")
+		}
+	}
+	lt = newLatencyTracker(95)
+	//1ms-100ms uniformly, p95 lands around 95ms
+	for i := 0; i < latencySamples; i++ {
+		lt.observe(time.Duration(i%100+1) * time.Millisecond)
+	}
+	if lt.threshold < 90*time.Millisecond || lt.threshold > 100*time.Millisecond {
+		t.Fatalf("bad p95 threshold %v", lt.threshold)
+	}
+	if lt.observe(50 * time.Millisecond) {
+		t.Fatal("median latency flagged")
+	} else if !lt.observe(time.Second) {
+		t.Fatal("slow latency not flagged")
+	}
+
+	//the threshold follows the recent window
+	for i := 0; i < latencySamples; i++ {
+		lt.observe(time.Duration(i%100+1) * time.Second)
+	}
+	if lt.observe(time.Second) {
+		t.Fatal("threshold did not move with recent latencies")
+	}
+}
+
+func TestParsePercentile(t *testing.T) {
+	if p, err := parsePercentile(`99.9`); err != nil || p != 99.9 {
+		t.Fatalf("bad percentile %v %v", p, err)
+	}
+	for _, bad := range []string{`0`, `100`, `-5`, `p95`} {
+		if _, err := parsePercentile(bad); err == nil {
+			t.Fatalf("accepted percentile %s", bad)
+		}
+	}
+}
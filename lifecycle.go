@@ -0,0 +1,44 @@
+/*************************************************************************
+ * Copyright 2017 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package gravwellcoredns
+
+import (
+	"time"
+
+	"github.com/gravwell/gravwell/v3/ingest/entry"
+)
+
+// lifecycleWriteTimeout bounds a marker write so a dead sink cannot hold up startup or shutdown
+const lifecycleWriteTimeout time.Duration = 2 * time.Second
+
+// lifecycleRecord marks where logging began and ended for a set of sinks.  A reload that reuses
+// the running sinks writes neither, logging never stopped.  Like the heartbeat it is always
+// JSON and goes to the default tag.
+type lifecycleRecord struct {
+	TS        entry.Timestamp
+	EventType string
+	Config    string `json:",omitempty"` // plugin_start only, the configuration summary with secrets redacted
+	Uptime    string `json:",omitempty"` // plugin_stop only, time since the plugin_start
+}
+
+// writeMarker writes a lifecycle record directly to the sinks, bypassing the ingest queue so a
+// plugin_stop is not dropped by a queue that is already full
+func (gh gwHandler) writeMarker(rec lifecycleRecord) {
+	ts := entry.Now()
+	rec.TS = ts
+	to := lifecycleWriteTimeout
+	if gh.to > 0 && gh.to < to {
+		to = gh.to
+	}
+	gh.errlog.log(gh.im.WriteEntryTimeout(&entry.Entry{
+		TS:   ts,
+		Tag:  gh.tag,
+		Data: marshalRecord(ts, rec),
+	}, to))
+}
@@ -0,0 +1,129 @@
+/*************************************************************************
+ * Copyright 2017 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package gravwellcoredns
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/crewjam/rfc5424"
+)
+
+const (
+	logLevelOff int = iota
+	logLevelError
+	logLevelWarn
+	logLevelInfo
+)
+
+// pluginLogger gates the plugin's own diagnostics on the configured log-level, each server
+// block gets its own.  A nil logger logs everything, matching the clog defaults.
+type pluginLogger struct {
+	level int
+}
+
+func newPluginLogger(v string) *pluginLogger {
+	l := &pluginLogger{level: logLevelInfo}
+	switch strings.TrimSpace(strings.ToLower(v)) {
+	case `off`:
+		l.level = logLevelOff
+	case `error`:
+		l.level = logLevelError
+	case `warn`:
+		l.level = logLevelWarn
+	}
+	return l
+}
+
+func (l *pluginLogger) enabled(level int) bool {
+	return l == nil || l.level >= level
+}
+
+func (l *pluginLogger) Infof(format string, v ...interface{}) error {
+	if l.enabled(logLevelInfo) {
+		log.Infof(format, v...)
+	}
+	return nil
+}
+
+func (l *pluginLogger) Warningf(format string, v ...interface{}) error {
+	if l.enabled(logLevelWarn) {
+		log.Warningf(format, v...)
+	}
+	return nil
+}
+
+func (l *pluginLogger) Errorf(format string, v ...interface{}) error {
+	if l.enabled(logLevelError) {
+		log.Errorf(format, v...)
+	}
+	return nil
+}
+
+// The remaining methods satisfy ingest.Logger so muxer connection events go through the same gate
+
+func (l *pluginLogger) Warnf(format string, v ...interface{}) error {
+	return l.Warningf(format, v...)
+}
+
+func (l *pluginLogger) Info(msg string, sds ...rfc5424.SDParam) error {
+	return l.Infof("%s", sdMessage(msg, sds))
+}
+
+func (l *pluginLogger) Warn(msg string, sds ...rfc5424.SDParam) error {
+	return l.Warningf("%s", sdMessage(msg, sds))
+}
+
+func (l *pluginLogger) Error(msg string, sds ...rfc5424.SDParam) error {
+	return l.Errorf("%s", sdMessage(msg, sds))
+}
+
+func (l *pluginLogger) InfofWithDepth(_ int, format string, v ...interface{}) error {
+	return l.Infof(format, v...)
+}
+
+func (l *pluginLogger) WarnfWithDepth(_ int, format string, v ...interface{}) error {
+	return l.Warningf(format, v...)
+}
+
+func (l *pluginLogger) ErrorfWithDepth(_ int, format string, v ...interface{}) error {
+	return l.Errorf(format, v...)
+}
+
+func (l *pluginLogger) InfoWithDepth(_ int, msg string, sds ...rfc5424.SDParam) error {
+	return l.Info(msg, sds...)
+}
+
+func (l *pluginLogger) WarnWithDepth(_ int, msg string, sds ...rfc5424.SDParam) error {
+	return l.Warn(msg, sds...)
+}
+
+func (l *pluginLogger) ErrorWithDepth(_ int, msg string, sds ...rfc5424.SDParam) error {
+	return l.Error(msg, sds...)
+}
+
+func (l *pluginLogger) Hostname() string {
+	h, _ := os.Hostname()
+	return h
+}
+
+func (l *pluginLogger) Appname() string {
+	return coreDNSPackageName
+}
+
+// sdMessage flattens structured data parameters onto a log line
+func sdMessage(msg string, sds []rfc5424.SDParam) string {
+	var sb strings.Builder
+	sb.WriteString(msg)
+	for _, sd := range sds {
+		fmt.Fprintf(&sb, " %s=%q", sd.Name, sd.Value)
+	}
+	return sb.String()
+}
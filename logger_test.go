@@ -0,0 +1,51 @@
+/*************************************************************************
+ * Copyright 2017 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package gravwellcoredns
+
+import (
+	"bytes"
+	golog "log"
+	"os"
+	"strings"
+	"testing"
+)
+
+func captureLog(t *testing.T, fn func()) string {
+	var buf bytes.Buffer
+	golog.SetOutput(&buf)
+	defer golog.SetOutput(os.Stderr)
+	fn()
+	return buf.String()
+}
+
+func TestPluginLoggerLevels(t *testing.T) {
+	if out := captureLog(t, func() {
+		lg := newPluginLogger(`off`)
+		lg.Infof("info %d", 1)
+		lg.Warningf("warn %d", 1)
+		lg.Errorf("error %d", 1)
+	}); out != `` {
+		t.Fatalf("off logged output: %q", out)
+	}
+
+	out := captureLog(t, func() {
+		lg := newPluginLogger(`WARN`)
+		lg.Infof("suppressed info")
+		lg.Warnf("visible warning")
+	})
+	if strings.Contains(out, `suppressed`) || !strings.Contains(out, `visible warning`) {
+		t.Fatalf("bad warn level output: %q", out)
+	}
+
+	//nil loggers behave like plain clog
+	var lg *pluginLogger
+	if out = captureLog(t, func() { lg.Infof("plain info") }); !strings.Contains(out, `plain info`) {
+		t.Fatalf("nil logger suppressed output: %q", out)
+	}
+}
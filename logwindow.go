@@ -0,0 +1,76 @@
+/*************************************************************************
+ * Copyright 2017 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package gravwellcoredns
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+const logWindowClock string = `15:04`
+
+// logWindow is a daily time of day range requests are logged in, start is inclusive and end
+// exclusive, both in minutes after midnight.  A start after the end wraps midnight.
+type logWindow struct {
+	start, end int
+	loc        *time.Location
+	spec       string // the directive arguments, for filter-debug
+}
+
+// parseLogWindow parses a log-window HH:MM-HH:MM [timezone] directive, the timezone is an IANA
+// name such as America/Denver and defaults to the local time of the host
+func parseLogWindow(args []string) (lw *logWindow, err error) {
+	if len(args) != 1 && len(args) != 2 {
+		return nil, fmt.Errorf("log-window requires a HH:MM-HH:MM range and an optional timezone")
+	}
+	lo, hi, ok := strings.Cut(args[0], `-`)
+	if !ok {
+		return nil, fmt.Errorf("Invalid log-window %q, must be HH:MM-HH:MM", args[0])
+	}
+	lw = &logWindow{loc: time.Local, spec: strings.Join(args, ` `)}
+	if lw.start, err = parseClock(lo); err != nil {
+		return nil, err
+	} else if lw.end, err = parseClock(hi); err != nil {
+		return nil, err
+	} else if lw.start == lw.end {
+		return nil, fmt.Errorf("Invalid log-window %q, the start and end may not be equal", args[0])
+	}
+	if len(args) == 2 {
+		if lw.loc, err = time.LoadLocation(args[1]); err != nil {
+			return nil, fmt.Errorf("Invalid log-window timezone %q - %v", args[1], err)
+		}
+	}
+	return
+}
+
+func parseClock(v string) (int, error) {
+	t, err := time.Parse(logWindowClock, v)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid log-window time %q, must be HH:MM", v)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+func (lw *logWindow) String() string {
+	return `log-window ` + lw.spec
+}
+
+// contains reports whether t falls inside the window, a nil window is always open
+func (lw *logWindow) contains(t time.Time) bool {
+	if lw == nil {
+		return true
+	}
+	t = t.In(lw.loc)
+	m := t.Hour()*60 + t.Minute()
+	if lw.start < lw.end {
+		return m >= lw.start && m < lw.end
+	}
+	return m >= lw.start || m < lw.end
+}
@@ -0,0 +1,103 @@
+/*************************************************************************
+ * Copyright 2017 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package gravwellcoredns
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/miekg/dns"
+)
+
+func TestLogWindow(t *testing.T) {
+	lw, err := parseLogWindow([]string{`08:00-18:00`, `UTC`})
+	if err != nil {
+		t.Fatal(err)
+	}
+	day := func(h, m int) time.Time { return time.Date(2024, 3, 9, h, m, 0, 0, time.UTC) }
+	for _, tt := range []struct {
+		t   time.Time
+		exp bool
+	}{
+		{day(7, 59), false},
+		{day(8, 0), true},
+		{day(12, 0), true},
+		{day(17, 59), true},
+		{day(18, 0), false},
+		{day(23, 0), false},
+	} {
+		if lw.contains(tt.t) != tt.exp {
+			t.Fatalf("%v in window %v", tt.t, !tt.exp)
+		}
+	}
+
+	//a window wrapping midnight in another timezone, 22:00-06:00 Denver is 05:00-13:00 UTC in March
+	if lw, err = parseLogWindow([]string{`22:00-06:00`, `America/Denver`}); err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		t   time.Time
+		exp bool
+	}{
+		{day(4, 59), false},
+		{day(5, 0), true},
+		{day(9, 0), true},
+		{day(12, 59), true},
+		{day(13, 0), false},
+	} {
+		if lw.contains(tt.t) != tt.exp {
+			t.Fatalf("%v in wrapped window %v", tt.t, !tt.exp)
+		}
+	}
+	if !(*logWindow)(nil).contains(day(3, 0)) {
+		t.Fatal("nil window should always be open")
+	}
+
+	for _, bad := range [][]string{
+		nil,
+		{`08:00`},
+		{`8am-6pm`},
+		{`08:00-24:30`},
+		{`08:00-08:00`},
+		{`08:00-18:00`, `Mars/Olympus_Mons`},
+		{`08:00-18:00`, `UTC`, `extra`},
+	} {
+		if _, err = parseLogWindow(bad); err == nil {
+			t.Fatalf("accepted bad log-window %v", bad)
+		}
+	}
+}
+
+func TestLogWindowClosed(t *testing.T) {
+	//a closed window still answers the client but records nothing
+	now := time.Now().UTC()
+	start := now.Add(time.Hour)
+	lw, err := parseLogWindow([]string{start.Format(logWindowClock) + `-` + start.Add(time.Hour).Format(logWindowClock), `UTC`})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dw := &discardWriter{keep: true}
+	gh := gwHandler{
+		Next:          answerHandler(false),
+		im:            dw,
+		enc:           &jsonEncoder{},
+		window:        lw,
+		encodeOptions: encodeOptions{maxQuestions: defaultMaxQuestions},
+	}
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+	rw := &test.ResponseWriter{}
+	if rc, err := gh.ServeDNS(context.Background(), rw, req); err != nil || rc != dns.RcodeSuccess {
+		t.Fatalf("request not served %d %v", rc, err)
+	} else if len(dw.ents) != 0 {
+		t.Fatalf("%d entries written outside the window", len(dw.ents))
+	}
+}
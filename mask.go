@@ -0,0 +1,71 @@
+/*************************************************************************
+ * Copyright 2017 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package gravwellcoredns
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"strconv"
+)
+
+// ipMask zeroes the host bits of client addresses, a zero prefix leaves that family untouched
+type ipMask struct {
+	v4, v6 int // prefix bits kept
+}
+
+func (m ipMask) enabled() bool {
+	return m.v4 > 0 || m.v6 > 0
+}
+
+// parseMaskBits validates a mask-client-ip prefix length for an address family of size bits
+func parseMaskBits(name, v string, size int) (bits int, err error) {
+	if bits, err = strconv.Atoi(v); err != nil || bits < 1 || bits > size {
+		err = fmt.Errorf("Invalid %s %q, must be a prefix length between 1 and %d", name, v, size)
+	}
+	return
+}
+
+// mask returns addr with the host bits zeroed, IPv4-mapped IPv6 addresses are masked with the
+// IPv4 prefix and keep their mapped form.  Addresses that are not ip:port pairs are returned as is.
+func (m ipMask) mask(addr net.Addr) net.Addr {
+	if !m.enabled() || addr == nil {
+		return addr
+	}
+	ap, err := netip.ParseAddrPort(addr.String())
+	if err != nil {
+		return addr
+	}
+	ip := ap.Addr()
+	switch {
+	case ip.Is4() || ip.Is4In6():
+		if m.v4 == 0 {
+			return addr
+		}
+		p, _ := ip.Unmap().Prefix(m.v4)
+		if ip = p.Addr(); ap.Addr().Is4In6() {
+			ip = netip.AddrFrom16(ip.As16())
+		}
+	default:
+		if m.v6 == 0 {
+			return addr
+		}
+		p, _ := ip.WithZone(``).Prefix(m.v6)
+		ip = p.Addr()
+	}
+	return maskedAddr{network: addr.Network(), addr: netip.AddrPortFrom(ip, ap.Port()).String()}
+}
+
+// maskedAddr stands in for a client address after masking
+type maskedAddr struct {
+	network, addr string
+}
+
+func (a maskedAddr) Network() string { return a.network }
+func (a maskedAddr) String() string  { return a.addr }
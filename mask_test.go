@@ -0,0 +1,49 @@
+/*************************************************************************
+ * Copyright 2017 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package gravwellcoredns
+
+import (
+	"net"
+	"testing"
+)
+
+func TestIPMask(t *testing.T) {
+	m := ipMask{v4: 24, v6: 48}
+	for _, tc := range []struct {
+		addr net.Addr
+		want string
+	}{
+		{&net.UDPAddr{IP: net.ParseIP(`10.1.2.3`), Port: 40000}, `10.1.2.0:40000`},
+		{&net.TCPAddr{IP: net.ParseIP(`192.168.77.200`), Port: 53}, `192.168.77.0:53`},
+		{&net.UDPAddr{IP: net.ParseIP(`2001:db8:aaaa:bbbb::1`), Port: 53}, `[2001:db8:aaaa::]:53`},
+		{&net.UDPAddr{IP: net.ParseIP(`fe80::1:2:3`), Port: 53, Zone: `eth0`}, `[fe80::]:53`},
+		//mapped addresses use the IPv4 prefix and keep their mapped form
+		{staticAddr{network: `udp`, addr: `[::ffff:10.1.2.3]:53`}, `[::ffff:10.1.2.0]:53`},
+		//not an ip:port, left alone
+		{staticAddr{network: `unix`, addr: `/tmp/dns.sock`}, `/tmp/dns.sock`},
+	} {
+		if got := m.mask(tc.addr); got.String() != tc.want {
+			t.Fatalf("%v masked to %v, expected %v", tc.addr, got, tc.want)
+		} else if got.Network() != tc.addr.Network() {
+			t.Fatalf("network changed %s != %s", got.Network(), tc.addr.Network())
+		}
+	}
+
+	//an unset family is untouched
+	v6 := &net.UDPAddr{IP: net.ParseIP(`2001:db8::1`), Port: 53}
+	if got := (ipMask{v4: 8}).mask(v6); got != v6 {
+		t.Fatalf("IPv6 masked without a prefix %v", got)
+	}
+	v4 := &net.UDPAddr{IP: net.ParseIP(`10.1.2.3`), Port: 53}
+	if got := (ipMask{v6: 64}).mask(v4); got != v4 {
+		t.Fatalf("IPv4 masked without a prefix %v", got)
+	} else if got = (ipMask{}).mask(v4); got != v4 {
+		t.Fatalf("disabled mask changed address %v", got)
+	}
+}
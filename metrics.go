@@ -0,0 +1,90 @@
+/*************************************************************************
+ * Copyright 2017 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package gravwellcoredns
+
+import (
+	"github.com/coredns/coredns/plugin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	// queueDepth is the number of entries waiting in ingest queues across all server blocks.
+	queueDepth = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: coreDNSPackageName,
+		Name:      "queue_depth",
+		Help:      "The number of entries waiting in the ingest queue.",
+	})
+	// droppedEntries is the number of entries that were never handed to the ingest muxer.
+	droppedEntries = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: coreDNSPackageName,
+		Name:      "dropped_entries_total",
+		Help:      "The count of entries dropped because the ingest queue was full, the ingest deadline expired, or the write failed.",
+	})
+	// entriesWritten and bytesWritten count what was handed to ingest muxers, the muxer does not export its own counters.
+	entriesWritten = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: coreDNSPackageName,
+		Name:      "entries_written_total",
+		Help:      "The count of entries handed to the ingest muxer.",
+	})
+	bytesWritten = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: coreDNSPackageName,
+		Name:      "bytes_written_total",
+		Help:      "The count of entry data bytes handed to the ingest muxer.",
+	})
+	writeErrors = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: coreDNSPackageName,
+		Name:      "write_errors_total",
+		Help:      "The count of entries the ingest muxer failed to accept.",
+	})
+	// writeLimitRejections counts writes refused because max-concurrent-writes were already in flight.
+	writeLimitRejections = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: coreDNSPackageName,
+		Name:      "write_limit_rejections_total",
+		Help:      "The count of entries dropped because the maximum number of concurrent writes were in flight.",
+	})
+	// shadowEntries and shadowBytes count what shadow-mode would have written.
+	shadowEntries = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: coreDNSPackageName,
+		Name:      "shadow_entries_total",
+		Help:      "The count of entries encoded in shadow mode that would have been written.",
+	})
+	shadowBytes = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: coreDNSPackageName,
+		Name:      "shadow_bytes_total",
+		Help:      "The count of entry data bytes encoded in shadow mode that would have been written.",
+	})
+	// sinkDroppedEntries is the per sink share of fanned out writes and Kafka deliveries that failed.
+	sinkDroppedEntries = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: coreDNSPackageName,
+		Name:      "sink_dropped_entries_total",
+		Help:      "The count of entries a sink failed to write, by sink.  Entries no sink took are also counted in dropped_entries_total.",
+	}, []string{"sink"})
+	// indexerConnections is polled from the ingest muxers every stats-interval.
+	indexerConnections = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: coreDNSPackageName,
+		Name:      "indexer_connections",
+		Help:      "The number of indexer connections by state.",
+	}, []string{"state"})
+)
+
+const (
+	connStateHot  string = `hot`
+	connStateDead string = `dead`
+)
@@ -0,0 +1,149 @@
+/*************************************************************************
+ * Copyright 2017 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package gravwellcoredns
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultNTPInterval time.Duration = 5 * time.Minute
+	ntpTimeout         time.Duration = 5 * time.Second
+	ntpPort            string        = `123`
+	ntpPacketSize      int           = 48
+	ntpEpochOffset     int64         = 2208988800 // seconds from the NTP era 0 epoch (1900) to the unix epoch
+)
+
+// parseNTPServer validates an ntp-check-server, a host or host:port with the port defaulting to 123
+func parseNTPServer(v string) (string, error) {
+	if _, _, err := net.SplitHostPort(v); err == nil {
+		return v, nil
+	} else if v == `` {
+		return ``, fmt.Errorf("Invalid ntp-check-server, a host is required")
+	}
+	return net.JoinHostPort(v, ntpPort), nil
+}
+
+// clockChecker measures the offset of the local clock against an NTP server every interval,
+// off the request path.  Requests only ever load the cached result, which is unknown until the
+// first check completes and again after any failed check.
+type clockChecker struct {
+	server string
+	offset atomic.Pointer[float64] // milliseconds the local clock is behind the server, nil when unknown
+	lg     *pluginLogger
+	done   chan struct{}
+	wg     sync.WaitGroup
+}
+
+func newClockChecker(server string, interval time.Duration, lg *pluginLogger) *clockChecker {
+	ck := &clockChecker{
+		server: server,
+		lg:     lg,
+		done:   make(chan struct{}),
+	}
+	ck.wg.Add(1)
+	go ck.run(interval)
+	return ck
+}
+
+func (ck *clockChecker) run(interval time.Duration) {
+	defer ck.wg.Done()
+	tckr := time.NewTicker(interval)
+	defer tckr.Stop()
+	for {
+		ck.check()
+		select {
+		case <-ck.done:
+			return
+		case <-tckr.C:
+		}
+	}
+}
+
+func (ck *clockChecker) check() {
+	off, err := sntpOffset(ck.server, ntpTimeout)
+	if err != nil {
+		ck.offset.Store(nil)
+		ck.lg.Warningf("clock check against %s failed: %v", ck.server, err)
+		return
+	}
+	ms := math.Round(float64(off)/float64(time.Millisecond)*1000) / 1000
+	ck.offset.Store(&ms)
+}
+
+// offsetMS returns the last measured offset in milliseconds, nil when unknown or unchecked
+func (ck *clockChecker) offsetMS() *float64 {
+	if ck == nil {
+		return nil
+	}
+	return ck.offset.Load()
+}
+
+func (ck *clockChecker) close() {
+	close(ck.done)
+	ck.wg.Wait()
+}
+
+// sntpOffset sends a single SNTP client request and returns the clock offset from RFC 4330,
+// ((t2 - t1) + (t3 - t4)) / 2, positive when the local clock is behind the server
+func sntpOffset(server string, timeout time.Duration) (off time.Duration, err error) {
+	conn, err := net.DialTimeout(`udp`, server, timeout)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	if err = conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+		return
+	}
+	req := make([]byte, ntpPacketSize)
+	req[0] = 0x23 //leap indicator 0, version 4, mode 3 (client)
+	t1 := time.Now()
+	binary.BigEndian.PutUint64(req[40:], ntpTime(t1))
+	if _, err = conn.Write(req); err != nil {
+		return
+	}
+	resp := make([]byte, ntpPacketSize)
+	n, err := conn.Read(resp)
+	t4 := time.Now()
+	if err != nil {
+		return
+	} else if n < ntpPacketSize {
+		return 0, errors.New("short NTP response")
+	} else if mode := resp[0] & 0x7; mode != 4 {
+		return 0, fmt.Errorf("unexpected NTP mode %d", mode)
+	} else if resp[1] == 0 {
+		//stratum 0 is a kiss of death, the server is refusing or rate limiting us
+		return 0, fmt.Errorf("NTP server sent kiss code %q", resp[12:16])
+	} else if binary.BigEndian.Uint64(resp[24:]) != binary.BigEndian.Uint64(req[40:]) {
+		return 0, errors.New("NTP response does not match the request")
+	}
+	t2 := fromNTPTime(binary.BigEndian.Uint64(resp[32:]))
+	t3 := fromNTPTime(binary.BigEndian.Uint64(resp[40:]))
+	return (t2.Sub(t1) + t3.Sub(t4)) / 2, nil
+}
+
+// ntpTime converts to the 64 bit NTP timestamp, 32 bits of seconds and 32 of fraction
+func ntpTime(t time.Time) uint64 {
+	sec := uint64(t.Unix() + ntpEpochOffset)
+	frac := uint64(t.Nanosecond()) << 32 / uint64(time.Second)
+	return sec<<32 | frac
+}
+
+func fromNTPTime(v uint64) time.Time {
+	sec := int64(v>>32) - ntpEpochOffset
+	nsec := int64((v & 0xffffffff) * uint64(time.Second) >> 32)
+	return time.Unix(sec, nsec)
+}
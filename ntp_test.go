@@ -0,0 +1,90 @@
+/*************************************************************************
+ * Copyright 2017 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package gravwellcoredns
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+)
+
+// fakeNTP answers SNTP requests with a clock skew ahead of the local one, a stratum of 0 sends
+// a kiss of death instead
+func fakeNTP(t *testing.T, skew time.Duration, stratum byte) string {
+	t.Helper()
+	pc, err := net.ListenPacket(`udp`, `127.0.0.1:0`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pc.Close() })
+	go func() {
+		buf := make([]byte, 128)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			} else if n < ntpPacketSize {
+				continue
+			}
+			resp := make([]byte, ntpPacketSize)
+			resp[0] = 0x24 //version 4, mode 4 (server)
+			resp[1] = stratum
+			copy(resp[12:16], `RATE`)
+			copy(resp[24:32], buf[40:48])
+			now := ntpTime(time.Now().Add(skew))
+			binary.BigEndian.PutUint64(resp[32:], now)
+			binary.BigEndian.PutUint64(resp[40:], now)
+			pc.WriteTo(resp, addr)
+		}
+	}()
+	return pc.LocalAddr().String()
+}
+
+func TestSNTPOffset(t *testing.T) {
+	off, err := sntpOffset(fakeNTP(t, 2*time.Second, 2), time.Second)
+	if err != nil {
+		t.Fatal(err)
+	} else if off < 1900*time.Millisecond || off > 2100*time.Millisecond {
+		t.Fatalf("bad offset %v", off)
+	}
+	if _, err = sntpOffset(fakeNTP(t, 0, 0), time.Second); err == nil {
+		t.Fatal("accepted a kiss of death")
+	}
+
+	ts := time.Date(2026, 10, 14, 5, 30, 0, 123456789, time.UTC)
+	if got := fromNTPTime(ntpTime(ts)); got.Sub(ts).Abs() > time.Nanosecond {
+		t.Fatalf("NTP timestamp round trip %v != %v", got, ts)
+	}
+}
+
+func TestClockChecker(t *testing.T) {
+	lg := newPluginLogger(`off`)
+	ck := newClockChecker(fakeNTP(t, -500*time.Millisecond, 2), time.Hour, lg)
+	defer ck.close()
+	deadline := time.Now().Add(time.Second)
+	for ck.offsetMS() == nil && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if off := ck.offsetMS(); off == nil || *off > -400 || *off < -600 {
+		t.Fatalf("bad cached offset %v", off)
+	}
+
+	//a failed check fails open to unknown
+	bad := newClockChecker(fakeNTP(t, 0, 0), time.Hour, lg)
+	defer bad.close()
+	time.Sleep(50 * time.Millisecond)
+	if off := bad.offsetMS(); off != nil {
+		t.Fatalf("offset %v after a failed check", *off)
+	}
+	var none *clockChecker
+	if none.offsetMS() != nil {
+		t.Fatal("offset without a checker")
+	}
+}
@@ -0,0 +1,138 @@
+/*************************************************************************
+ * Copyright 2017 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package gravwellcoredns
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/coredns/coredns/plugin"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/gravwell/gravwell/v3/ingest/entry"
+	"github.com/miekg/dns"
+)
+
+type discardWriter struct {
+	ents []*entry.Entry
+	keep bool
+}
+
+func (d *discardWriter) WriteEntry(ent *entry.Entry) error {
+	if d.keep {
+		d.ents = append(d.ents, ent)
+	}
+	return nil
+}
+
+func (d *discardWriter) WriteEntryTimeout(ent *entry.Entry, _ time.Duration) error {
+	return d.WriteEntry(ent)
+}
+
+// answerHandler responds to every query with a single A record, or with no answers when nx is set
+func answerHandler(nx bool) plugin.Handler {
+	return plugin.HandlerFunc(func(ctx context.Context, w dns.ResponseWriter, r *dns.Msg) (int, error) {
+		m := new(dns.Msg)
+		m.SetReply(r)
+		if nx {
+			m.Rcode = dns.RcodeNameError
+		} else {
+			m.Answer = []dns.RR{test.A(r.Question[0].Name + " 300 IN A 1.2.3.4")}
+		}
+		return m.Rcode, w.WriteMsg(m)
+	})
+}
+
+func TestWriterOutlivesRequest(t *testing.T) {
+	//a cache plugin keeps the writer for prefetch and serve-stale after ServeDNS returns
+	var held []dns.ResponseWriter
+	next := plugin.HandlerFunc(func(ctx context.Context, w dns.ResponseWriter, r *dns.Msg) (int, error) {
+		held = append(held, w)
+		return answerHandler(false).ServeDNS(ctx, w, r)
+	})
+	gh := gwHandler{
+		Next:          next,
+		im:            &discardWriter{},
+		enc:           &textEncoder{},
+		encodeOptions: encodeOptions{maxQuestions: defaultMaxQuestions},
+	}
+	for _, name := range []string{`example.com.`, `example.org.`} {
+		req := new(dns.Msg)
+		req.SetQuestion(name, dns.TypeA)
+		if _, err := gh.ServeDNS(context.Background(), &test.ResponseWriter{}, req); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if held[0] == held[1] {
+		t.Fatal("a writer was reused for a later request")
+	}
+	resp := new(dns.Msg)
+	resp.SetQuestion(`example.com.`, dns.TypeA)
+	if err := held[0].WriteMsg(resp); err != nil {
+		t.Fatal("held writer unusable after the request", err)
+	} else if is := held[0].(*introspector); is.req.Question[0].Name != `example.com.` {
+		t.Fatalf("held writer carries another request %v", is.req.Question)
+	}
+}
+
+func TestServeDNSNoBleed(t *testing.T) {
+	dw := &discardWriter{keep: true}
+	gh := gwHandler{
+		im:            dw,
+		enc:           &textEncoder{},
+		encodeOptions: encodeOptions{maxQuestions: defaultMaxQuestions},
+	}
+	//alternate answered and unanswered requests so stale answers would show up on the NXDOMAIN lines
+	for i := 0; i < 100; i++ {
+		gh.Next = answerHandler(i%2 == 1)
+		req := new(dns.Msg)
+		req.SetQuestion("example.com.", dns.TypeA)
+		if _, err := gh.ServeDNS(context.Background(), &test.ResponseWriter{}, req); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(dw.ents) != 100 {
+		t.Fatalf("expected 100 entries, got %d", len(dw.ents))
+	}
+	for i, ent := range dw.ents {
+		if answered := bytes.Contains(ent.Data, []byte(`1.2.3.4`)); answered != (i%2 == 0) {
+			t.Fatalf("entry %d bled state from another request: %s", i, ent.Data)
+		}
+	}
+}
+
+func benchmarkServeDNS(b *testing.B, enc encoder) {
+	gh := gwHandler{
+		Next:          answerHandler(false),
+		im:            &discardWriter{},
+		enc:           enc,
+		encodeOptions: encodeOptions{maxQuestions: defaultMaxQuestions},
+	}
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+	rw := &test.ResponseWriter{}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		gh.ServeDNS(context.Background(), rw, req)
+	}
+}
+
+func BenchmarkServeDNSText(b *testing.B) {
+	benchmarkServeDNS(b, &textEncoder{})
+}
+
+func BenchmarkServeDNSJSON(b *testing.B) {
+	benchmarkServeDNS(b, &jsonEncoder{})
+}
+
+func BenchmarkServeDNSJSONPretty(b *testing.B) {
+	benchmarkServeDNS(b, &jsonEncoder{pretty: true})
+}
@@ -0,0 +1,145 @@
+/*************************************************************************
+ * Copyright 2017 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package gravwellcoredns
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gravwell/gravwell/v3/ingest"
+	"github.com/gravwell/gravwell/v3/ingest/entry"
+)
+
+const targetPriorityDelim string = `/`
+
+// entryWriter is the subset of the ingest muxer used to ship entries
+type entryWriter interface {
+	WriteEntry(*entry.Entry) error
+	WriteEntryTimeout(*entry.Entry, time.Duration) error
+}
+
+// parseTarget splits an optional integer priority off a target, host:port/priority
+func parseTarget(v string) (target string, priority int, err error) {
+	target = v
+	if i := strings.LastIndex(v, targetPriorityDelim); i >= 0 {
+		target = v[:i]
+		if priority, err = strconv.Atoi(v[i+1:]); err != nil {
+			err = fmt.Errorf("Invalid target priority %q, priorities must be integers", v[i+1:])
+			return
+		}
+	}
+	_, _, err = net.SplitHostPort(target)
+	return
+}
+
+// targetTiers groups the configured targets by priority, highest priority first
+func (c cfgType) targetTiers() (tiers [][]string, err error) {
+	if len(c.TargetPriority) == 0 {
+		var conns []string
+		if conns, err = c.Targets(); err == nil {
+			tiers = [][]string{conns}
+		}
+		return
+	}
+	var prios []int
+	seen := map[int]bool{0: true}
+	prios = append(prios, 0)
+	for _, p := range c.TargetPriority {
+		if !seen[p] {
+			seen[p] = true
+			prios = append(prios, p)
+		}
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(prios)))
+	for _, p := range prios {
+		ic := c.IngestConfig
+		ic.Cleartext_Backend_Target = c.priorityTargets(c.Cleartext_Backend_Target, p)
+		ic.Encrypted_Backend_Target = c.priorityTargets(c.Encrypted_Backend_Target, p)
+		if len(ic.Cleartext_Backend_Target) == 0 && len(ic.Encrypted_Backend_Target) == 0 {
+			continue
+		}
+		var conns []string
+		if conns, err = ic.Targets(); err != nil {
+			return
+		}
+		tiers = append(tiers, conns)
+	}
+	return
+}
+
+func (c cfgType) priorityTargets(targets []string, priority int) (r []string) {
+	for _, t := range targets {
+		if c.TargetPriority[t] == priority {
+			r = append(r, t)
+		}
+	}
+	return
+}
+
+// tieredMuxer sends entries to the highest priority muxer with a live indexer connection.
+// The ingest muxer balances across all of its destinations, so each priority gets its own muxer.
+// When every tier is down entries go to the primary tier, which is the only one with a cache.
+// Every muxer is built with the same tag list so the intermediary tag IDs are identical across tiers.
+type tieredMuxer struct {
+	tiers []*ingest.IngestMuxer // highest priority first
+}
+
+func (t tieredMuxer) pick() *ingest.IngestMuxer {
+	for _, im := range t.tiers {
+		if n, err := im.Hot(); err == nil && n > 0 {
+			return im
+		}
+	}
+	return t.tiers[0]
+}
+
+func (t tieredMuxer) WriteEntry(ent *entry.Entry) error {
+	return t.pick().WriteEntry(ent)
+}
+
+func (t tieredMuxer) WriteEntryTimeout(ent *entry.Entry, to time.Duration) error {
+	return t.pick().WriteEntryTimeout(ent, to)
+}
+
+// Hot is the number of live indexer connections across every tier
+func (t tieredMuxer) Hot() (n int, err error) {
+	for _, im := range t.tiers {
+		var c int
+		if c, err = im.Hot(); err != nil {
+			return
+		}
+		n += c
+	}
+	return
+}
+
+// Dead is the number of failed indexer connections across every tier
+func (t tieredMuxer) Dead() (n int, err error) {
+	for _, im := range t.tiers {
+		var c int
+		if c, err = im.Dead(); err != nil {
+			return
+		}
+		n += c
+	}
+	return
+}
+
+func (t tieredMuxer) Close() error {
+	var errs []error
+	for _, im := range t.tiers {
+		errs = append(errs, im.Close())
+	}
+	return errors.Join(errs...)
+}
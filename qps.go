@@ -0,0 +1,90 @@
+/*************************************************************************
+ * Copyright 2017 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package gravwellcoredns
+
+import (
+	"math"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+const (
+	qpsMaxClients int = 16384 // clients tracked before arbitrary ones are evicted
+	qpsIdleTTL    int = 8     // halflives without a query before a client is forgotten
+)
+
+// qpsTracker keeps an exponentially decayed query count per client.  Each query adds one and
+// the count halves every halflife, so a client at a steady rate r settles at r*halflife/ln2
+// and the rate estimate is the count scaled back by ln2/halflife.
+type qpsTracker struct {
+	sync.Mutex
+	halflife  time.Duration
+	clients   map[netip.Addr]*qpsClient
+	lastSweep time.Time
+}
+
+type qpsClient struct {
+	count float64
+	last  time.Time
+}
+
+func newQPSTracker(halflife time.Duration) *qpsTracker {
+	return &qpsTracker{
+		halflife: halflife,
+		clients:  map[netip.Addr]*qpsClient{},
+	}
+}
+
+// observe records a query from addr and returns the client's estimated queries per second
+func (qt *qpsTracker) observe(addr net.Addr, now time.Time) float64 {
+	ip, ok := clientIP(addr)
+	if !ok {
+		return 0
+	}
+	qt.Lock()
+	defer qt.Unlock()
+	qt.sweep(now)
+	cl, ok := qt.clients[ip]
+	if !ok {
+		qt.makeRoom()
+		cl = &qpsClient{}
+		qt.clients[ip] = cl
+	} else if dt := now.Sub(cl.last); dt > 0 {
+		cl.count *= math.Exp2(-float64(dt) / float64(qt.halflife))
+	}
+	cl.count++
+	cl.last = now
+	return math.Round(cl.count*math.Ln2/qt.halflife.Seconds()*100) / 100
+}
+
+// sweep forgets idle clients, at most once per halflife so the scan cost is amortized
+func (qt *qpsTracker) sweep(now time.Time) {
+	if now.Sub(qt.lastSweep) < qt.halflife {
+		return
+	}
+	qt.lastSweep = now
+	ttl := time.Duration(qpsIdleTTL) * qt.halflife
+	for ip, cl := range qt.clients {
+		if now.Sub(cl.last) > ttl {
+			delete(qt.clients, ip)
+		}
+	}
+}
+
+// makeRoom keeps the map under qpsMaxClients when every tracked client is still active
+func (qt *qpsTracker) makeRoom() {
+	for ip := range qt.clients {
+		if len(qt.clients) < qpsMaxClients {
+			break
+		}
+		delete(qt.clients, ip)
+	}
+}
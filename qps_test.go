@@ -0,0 +1,83 @@
+/*************************************************************************
+ * Copyright 2017 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package gravwellcoredns
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/miekg/dns"
+)
+
+func TestQPSTracker(t *testing.T) {
+	qt := newQPSTracker(10 * time.Second)
+	now := time.Now()
+	client := staticAddr{network: `udp`, addr: `10.0.0.1:40000`}
+	//a steady 50 qps for several halflives settles near 50
+	var qps float64
+	for i := 0; i < 50*60; i++ {
+		qps = qt.observe(client, now.Add(time.Duration(i)*20*time.Millisecond))
+	}
+	if qps < 48 || qps > 52 {
+		t.Fatalf("steady 50qps estimated at %v", qps)
+	}
+	//a quiet client stays low
+	if v := qt.observe(staticAddr{network: `udp`, addr: `10.0.0.2:40000`}, now.Add(time.Minute)); v > 1 {
+		t.Fatalf("single query estimated at %v", v)
+	}
+	//the rate decays once the client stops, one more query after two halflives is about a quarter
+	if v := qt.observe(client, now.Add(time.Minute+20*time.Second)); v < 11 || v > 14 {
+		t.Fatalf("decayed rate %v", v)
+	}
+	if v := qt.observe(staticAddr{network: `unix`, addr: `/run/dns.sock`}, now); v != 0 {
+		t.Fatalf("non ip client tracked %v", v)
+	}
+}
+
+func TestQPSTrackerEviction(t *testing.T) {
+	qt := newQPSTracker(time.Second)
+	now := time.Now()
+	for i := 0; i < qpsMaxClients+100; i++ {
+		qt.observe(staticAddr{network: `udp`, addr: fmt.Sprintf("10.%d.%d.1:53", i/256, i%256)}, now)
+	}
+	if len(qt.clients) > qpsMaxClients {
+		t.Fatalf("tracker grew to %d clients", len(qt.clients))
+	}
+	//idle clients are forgotten after qpsIdleTTL halflives
+	qt.observe(staticAddr{network: `udp`, addr: `192.168.0.1:53`}, now.Add(time.Duration(qpsIdleTTL+1)*time.Second))
+	if len(qt.clients) != 1 {
+		t.Fatalf("idle clients not evicted, %d left", len(qt.clients))
+	}
+}
+
+func TestClientQPS(t *testing.T) {
+	dw := &discardWriter{keep: true}
+	gh := gwHandler{
+		Next:          answerHandler(false),
+		im:            dw,
+		enc:           &jsonEncoder{},
+		qps:           newQPSTracker(time.Minute),
+		encodeOptions: encodeOptions{maxQuestions: defaultMaxQuestions},
+	}
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+	if _, err := gh.ServeDNS(context.Background(), &test.ResponseWriter{}, req); err != nil {
+		t.Fatal(err)
+	}
+	var v struct{ ClientQPS float64 }
+	if err := json.Unmarshal(dw.ents[0].Data, &v); err != nil {
+		t.Fatal(err)
+	} else if v.ClientQPS <= 0 {
+		t.Fatalf("missing ClientQPS %s", dw.ents[0].Data)
+	}
+}
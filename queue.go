@@ -0,0 +1,104 @@
+/*************************************************************************
+ * Copyright 2017 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package gravwellcoredns
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gravwell/gravwell/v3/ingest/entry"
+)
+
+const (
+	defaultQueueWarnPercent int           = 80
+	queueWarnInterval       time.Duration = 10 * time.Second
+)
+
+// writeQueue decouples DNS handling from indexer writes.  Entries are dropped rather
+// than blocking the DNS path when the queue is full.
+type writeQueue struct {
+	sync.RWMutex
+	closed    bool
+	ch        chan *entry.Entry
+	warnDepth int
+	lastWarn  atomic.Int64 // unix nanoseconds of the last high-watermark warning
+	write     func(*entry.Entry) error
+	lg        *pluginLogger
+	wg        sync.WaitGroup
+}
+
+func newWriteQueue(depth, warnPercent int, write func(*entry.Entry) error, lg *pluginLogger) *writeQueue {
+	q := &writeQueue{
+		ch:        make(chan *entry.Entry, depth),
+		warnDepth: depth * warnPercent / 100,
+		write:     write,
+		lg:        lg,
+	}
+	if q.warnDepth < 1 {
+		q.warnDepth = 1
+	}
+	q.wg.Add(1)
+	go q.run()
+	return q
+}
+
+// push enqueues an entry without blocking, returning false if it was dropped
+func (q *writeQueue) push(ent *entry.Entry) bool {
+	q.RLock()
+	defer q.RUnlock()
+	if q.closed {
+		droppedEntries.Inc()
+		return false
+	}
+	select {
+	case q.ch <- ent:
+		queueDepth.Inc()
+	default:
+		droppedEntries.Inc()
+		return false
+	}
+	if d := len(q.ch); d >= q.warnDepth {
+		q.warn(d)
+	}
+	return true
+}
+
+// warn logs that the queue crossed its high-watermark, at most once per queueWarnInterval
+func (q *writeQueue) warn(depth int) bool {
+	now := time.Now().UnixNano()
+	last := q.lastWarn.Load()
+	if now-last < int64(queueWarnInterval) || !q.lastWarn.CompareAndSwap(last, now) {
+		return false
+	}
+	q.lg.Warningf("ingest queue depth %d of %d has crossed the high-watermark of %d, entries will be dropped when full",
+		depth, cap(q.ch), q.warnDepth)
+	return true
+}
+
+func (q *writeQueue) run() {
+	defer q.wg.Done()
+	for ent := range q.ch {
+		queueDepth.Dec()
+		if err := q.write(ent); droppedAll(err) {
+			droppedEntries.Inc()
+		}
+	}
+}
+
+// close stops accepting entries and waits for the queue to drain
+func (q *writeQueue) close() {
+	q.Lock()
+	if !q.closed {
+		q.closed = true
+		close(q.ch)
+	}
+	q.Unlock()
+	q.wg.Wait()
+}
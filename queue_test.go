@@ -0,0 +1,73 @@
+/*************************************************************************
+ * Copyright 2017 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package gravwellcoredns
+
+import (
+	"sync/atomic"
+	"testing"
+
+	"github.com/gravwell/gravwell/v3/ingest/entry"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestWriteQueue(t *testing.T) {
+	var written atomic.Int32
+	block := make(chan struct{})
+	q := newWriteQueue(4, 50, func(*entry.Entry) error {
+		<-block
+		written.Add(1)
+		return nil
+	}, nil)
+	defer q.close()
+	baseDrops := testutil.ToFloat64(droppedEntries)
+	released := false
+	defer func() {
+		if !released {
+			close(block)
+		}
+	}()
+
+	//the writer holds one entry while blocked, the channel holds the rest
+	for i := 0; i < 5; i++ {
+		if !q.push(&entry.Entry{}) {
+			//the worker may not have picked up the first entry yet
+			if i < 4 {
+				t.Fatalf("dropped entry %d before the queue was full", i)
+			}
+		}
+	}
+	if q.push(&entry.Entry{}) {
+		t.Fatal("queue accepted an entry while full")
+	}
+	if d := testutil.ToFloat64(droppedEntries) - baseDrops; d < 1 {
+		t.Fatalf("drop counter did not increment: %v", d)
+	}
+	//the worker may be holding one entry outside of the queue
+	if testutil.ToFloat64(queueDepth) < 3 {
+		t.Fatalf("bad queue depth gauge %v", testutil.ToFloat64(queueDepth))
+	}
+
+	//the high-watermark warning is throttled
+	if q.warn(4) {
+		t.Fatal("high-watermark warning was not throttled")
+	}
+
+	close(block)
+	released = true
+	q.close()
+	if testutil.ToFloat64(queueDepth) != 0 {
+		t.Fatalf("queue depth gauge did not drain %v", testutil.ToFloat64(queueDepth))
+	}
+	if written.Load() < 4 {
+		t.Fatalf("queue did not drain on close: %d", written.Load())
+	}
+	if q.push(&entry.Entry{}) {
+		t.Fatal("closed queue accepted an entry")
+	}
+}
@@ -0,0 +1,55 @@
+/*************************************************************************
+ * Copyright 2017 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package gravwellcoredns
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// redactQtypes holds the qtypes whose answers are redacted as if redact-answers were on
+type redactQtypes struct {
+	types map[uint16]bool
+}
+
+// parseRedactQtypes parses response-redact-qtype arguments, each a qtype or a comma separated
+// list of them, returning the qtypes in canonical form for the configuration
+func parseRedactQtypes(args []string) (rq *redactQtypes, names []string, err error) {
+	rq = &redactQtypes{types: map[uint16]bool{}}
+	for _, arg := range args {
+		for _, name := range strings.Split(arg, `,`) {
+			if name = strings.TrimSpace(name); name == `` {
+				continue
+			}
+			qt, ok := dns.StringToType[strings.ToUpper(name)]
+			if !ok {
+				return nil, nil, fmt.Errorf("Invalid response-redact-qtype %q, unknown qtype", name)
+			} else if rq.types[qt] {
+				return nil, nil, fmt.Errorf("Invalid response-redact-qtype %q, %s is already listed", name, dns.TypeToString[qt])
+			}
+			rq.types[qt] = true
+			names = append(names, dns.TypeToString[qt])
+		}
+	}
+	if len(names) == 0 {
+		return nil, nil, fmt.Errorf("response-redact-qtype requires at least one qtype")
+	}
+	return
+}
+
+// redacts reports whether answers to qs are redacted, only the first question is consulted
+// since legitimate messages carry one
+func (rq *redactQtypes) redacts(qs []dns.Question) bool {
+	if rq == nil || len(qs) == 0 {
+		return false
+	}
+	return rq.types[qs[0].Qtype]
+}
@@ -0,0 +1,101 @@
+/*************************************************************************
+ * Copyright 2017 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package gravwellcoredns
+
+import (
+	"bytes"
+	"encoding/json"
+	"slices"
+	"testing"
+
+	"github.com/coredns/caddy"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/gravwell/gravwell/v3/ingest/entry"
+	"github.com/miekg/dns"
+)
+
+func TestParseRedactQtypes(t *testing.T) {
+	rq, names, err := parseRedactQtypes([]string{`ptr,TXT`, `hinfo`})
+	if err != nil {
+		t.Fatal(err)
+	} else if !slices.Equal(names, []string{`PTR`, `TXT`, `HINFO`}) {
+		t.Fatalf("bad qtypes %v", names)
+	}
+	for qt, want := range map[uint16]bool{dns.TypePTR: true, dns.TypeTXT: true, dns.TypeHINFO: true, dns.TypeA: false} {
+		if rq.redacts([]dns.Question{{Name: `example.com.`, Qtype: qt, Qclass: dns.ClassINET}}) != want {
+			t.Fatalf("bad redaction for %s", dns.TypeToString[qt])
+		}
+	}
+	if rq.redacts(nil) || (*redactQtypes)(nil).redacts([]dns.Question{{Qtype: dns.TypePTR}}) {
+		t.Fatal("redacted without a question or a list")
+	}
+	for _, bad := range [][]string{nil, {`,`}, {`BOGUS`}, {`PTR,ptr`}} {
+		if _, _, err = parseRedactQtypes(bad); err == nil {
+			t.Fatalf("accepted response-redact-qtype %v", bad)
+		}
+	}
+	cfg, _, err := parseConfig(caddy.NewTestController("dns", "gravwell {\n\tStdout-Sink true\n\tResponse-Redact-Qtype PTR,TXT\n}"))
+	if err != nil {
+		t.Fatal(err)
+	} else if cfg.encodeOptions().redactQtypes == nil {
+		t.Fatal("response-redact-qtype did not reach the encode options")
+	}
+	//a qtype repeated on a second line is caught as well
+	if _, _, err = parseConfig(caddy.NewTestController("dns", "gravwell {\n\tStdout-Sink true\n\tResponse-Redact-Qtype PTR\n\tResponse-Redact-Qtype TXT PTR\n}")); err == nil {
+		t.Fatal("accepted a repeated qtype")
+	}
+}
+
+func TestResponseRedactQtype(t *testing.T) {
+	opts := testOpts
+	opts.redactQtypes, _, _ = parseRedactQtypes([]string{`PTR,TXT`})
+	for _, tc := range []struct {
+		name   string
+		qtype  uint16
+		rr     dns.RR
+		rdata  string
+		redact bool
+	}{
+		{name: `4.3.2.1.in-addr.arpa.`, qtype: dns.TypePTR, rr: test.PTR(`4.3.2.1.in-addr.arpa. 60 IN PTR host.example.com.`), rdata: `host.example.com`, redact: true},
+		{name: `example.com.`, qtype: dns.TypeTXT, rr: test.TXT(`example.com. 60 IN TXT "v=spf1 -all"`), rdata: `v=spf1`, redact: true},
+		{name: `example.com.`, qtype: dns.TypeA, rr: test.A(`example.com. 60 IN A 1.2.3.4`), rdata: `1.2.3.4`},
+	} {
+		qt := dns.TypeToString[tc.qtype]
+		resp := testMsg(tc.name, tc.qtype, tc.rr)
+		is := newIntrospectorFromMsg(resp, opts)
+		if !bytes.Contains([]byte(resp.Answer[0].String()), []byte(tc.rdata)) {
+			t.Fatalf("%s: redaction modified the response sent to the client", qt)
+		}
+		for _, name := range []string{`json`, `json-per-answer`, `text`, `hec`, `passivedns`, `zeek`} {
+			enc, err := getEncoder(name, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, bb := range enc.Encode(entry.Now(), testLocal, testRemote, is) {
+				if leaked := bytes.Contains(bb, []byte(tc.rdata)); leaked == tc.redact {
+					t.Fatalf("%s %s: rdata present %v: %s", qt, name, leaked, bb)
+				}
+			}
+		}
+		//the question is logged in full either way
+		bbs := jsonEncoder{}.Encode(entry.Now(), testLocal, testRemote, is)
+		var v struct {
+			Question struct{ Hdr dns.RR_Header }
+		}
+		if len(bbs) != 1 {
+			t.Fatalf("%s: got %d records", qt, len(bbs))
+		} else if err := json.Unmarshal(bbs[0], &v); err != nil {
+			t.Fatal(err)
+		} else if v.Question.Hdr.Name != tc.name || v.Question.Hdr.Rrtype != tc.qtype {
+			t.Fatalf("%s: bad question %+v", qt, v.Question.Hdr)
+		} else if tc.redact && !bytes.Contains(bbs[0], []byte(redactedRdata)) {
+			t.Fatalf("%s: missing placeholder %s", qt, bbs[0])
+		}
+	}
+}
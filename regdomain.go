@@ -0,0 +1,36 @@
+/*************************************************************************
+ * Copyright 2017 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package gravwellcoredns
+
+import (
+	"strings"
+
+	"golang.org/x/net/publicsuffix"
+)
+
+// registeredDomain returns the lowercased eTLD+1 of a question name using the public suffix
+// list compiled into x/net, e.g. www.example.co.uk is example.co.uk.  Names that are a public
+// suffix themselves, and names whose TLD is not on the list at all (internal, local, corp),
+// have no registered domain and return empty.
+func registeredDomain(name string) string {
+	name = strings.ToLower(strings.TrimSuffix(name, `.`))
+	if name == `` {
+		return ``
+	}
+	//a suffix found only by the list's default rule is a single label with icann unset,
+	//private suffixes such as blogspot.com are on the list and keep their dot
+	if ps, icann := publicsuffix.PublicSuffix(name); !icann && !strings.Contains(ps, `.`) {
+		return ``
+	}
+	rd, err := publicsuffix.EffectiveTLDPlusOne(name)
+	if err != nil {
+		return ``
+	}
+	return rd
+}
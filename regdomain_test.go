@@ -0,0 +1,52 @@
+/*************************************************************************
+ * Copyright 2017 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package gravwellcoredns
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/gravwell/gravwell/v3/ingest/entry"
+	"github.com/miekg/dns"
+)
+
+func TestRegisteredDomain(t *testing.T) {
+	for name, exp := range map[string]string{
+		`www.example.co.uk.`:     `example.co.uk`,
+		`WWW.Example.COM.`:       `example.com`,
+		`example.com`:            `example.com`,
+		`a.b.c.example.org.`:     `example.org`,
+		`foo.blogspot.com.`:      `foo.blogspot.com`, //private suffixes count
+		`co.uk.`:                 ``,                 //a public suffix alone
+		`com.`:                   ``,
+		`printer.corp.internal.`: ``, //not on the list at all
+		`localhost.`:             ``,
+		`.`:                      ``,
+	} {
+		if rd := registeredDomain(name); rd != exp {
+			t.Fatalf("%q: got %q, expected %q", name, rd, exp)
+		}
+	}
+
+	opts := testOpts
+	opts.regDomain = true
+	m := testMsg(`www.example.co.uk.`, dns.TypeA)
+	var v dnsBase
+	if err := json.Unmarshal(jsonEncoder{}.Encode(entry.Now(), testLocal, testRemote, newIntrospectorFromMsg(m, opts))[0], &v); err != nil {
+		t.Fatal(err)
+	} else if v.RegisteredDomain != `example.co.uk` {
+		t.Fatalf("bad RegisteredDomain %q", v.RegisteredDomain)
+	}
+	v = dnsBase{}
+	if err := json.Unmarshal(jsonEncoder{}.Encode(entry.Now(), testLocal, testRemote, newIntrospectorFromMsg(m, testOpts))[0], &v); err != nil {
+		t.Fatal(err)
+	} else if v.RegisteredDomain != `` {
+		t.Fatal("RegisteredDomain without registered-domain")
+	}
+}
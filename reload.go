@@ -0,0 +1,318 @@
+/*************************************************************************
+ * Copyright 2017 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package gravwellcoredns
+
+import (
+	"errors"
+	"os"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gravwell/gravwell/v3/ingest"
+	"github.com/gravwell/gravwell/v3/ingest/entry"
+)
+
+// active holds the running sinks so a reload with an unchanged configuration keeps its
+// muxers and queues.  CoreDNS starts the new instance before it shuts down the old one,
+// so a reused set picks up a reference before the old instance drops its own.
+var active struct {
+	sync.Mutex
+	sinks   []*activeSinks
+	pending []*activeSinks  // references taken by an instance that has not finished starting
+	pruned  map[string]bool // cache paths already checked by cache-max-age, once per process
+}
+
+// activeSinks is everything that outlives a single plugin instance, the handler carries no
+// encoder or next plugin so each instance fills those in from its own configuration
+type activeSinks struct {
+	cfg     cfgType
+	gh      gwHandler
+	primary *ingest.IngestMuxer // nil when there are no Gravwell targets
+	closers []func() error      // run in order when the last reference is released
+	refs    int
+}
+
+// acquireSinks returns the running sinks for an identical configuration, starting new ones
+// when nothing matches
+func acquireSinks(cfg cfgType, lg *pluginLogger) (as *activeSinks, err error) {
+	active.Lock()
+	defer active.Unlock()
+	for _, v := range active.sinks {
+		if reflect.DeepEqual(v.cfg, cfg.sinkKey()) {
+			lg.Infof("configuration unchanged, reusing the running ingest muxer")
+			v.refs++
+			active.pending = append(active.pending, v)
+			return v, nil
+		}
+	}
+	if as, err = startSinks(cfg, lg); err != nil {
+		return
+	}
+	as.refs = 1
+	active.sinks = append(active.sinks, as)
+	active.pending = append(active.pending, as)
+	return
+}
+
+// commitPending keeps the references taken while an instance started, it runs once CoreDNS
+// reports the instance started
+func commitPending() {
+	active.Lock()
+	active.pending = nil
+	active.Unlock()
+}
+
+// releasePending drops the references taken by an instance that failed to start, CoreDNS never
+// shuts a failed instance down so its OnShutdown callbacks would never release them
+func releasePending() error {
+	active.Lock()
+	pending := active.pending
+	active.pending = nil
+	active.Unlock()
+	var errs []error
+	for _, as := range pending {
+		errs = append(errs, as.release())
+	}
+	return errors.Join(errs...)
+}
+
+// release drops a reference, tearing the sinks down once no instance is using them
+func (as *activeSinks) release() error {
+	active.Lock()
+	defer active.Unlock()
+	if as.refs--; as.refs > 0 {
+		return nil
+	}
+	for i, v := range active.sinks {
+		if v == as {
+			active.sinks = append(active.sinks[:i], active.sinks[i+1:]...)
+			break
+		}
+	}
+	var errs []error
+	for _, fn := range as.closers {
+		errs = append(errs, fn())
+	}
+	return errors.Join(errs...)
+}
+
+func startSinks(cfg cfgType, lg *pluginLogger) (as *activeSinks, err error) {
+	if cfg.CacheMaxAge > 0 && !active.pruned[cfg.Ingest_Cache_Path] {
+		//a leftover cache only exists at process start, after that the files are a live muxer's
+		if active.pruned == nil {
+			active.pruned = map[string]bool{}
+		}
+		active.pruned[cfg.Ingest_Cache_Path] = true
+		if !cacheInUse(cfg.Ingest_Cache_Path) {
+			if err = pruneStaleCache(cfg.Ingest_Cache_Path, cfg.CacheMaxAge); err != nil {
+				return
+			}
+		}
+	}
+	as = &activeSinks{cfg: cfg.sinkKey()}
+	//sinks close last so queued entries and the final heartbeat are flushed first, the muxers
+	//after every other sink.  A failure tears down everything started so far.
+	var sinks []func() error
+	var closeMuxers func() error
+	defer func() {
+		if closeMuxers != nil {
+			sinks = append(sinks, closeMuxers)
+		}
+		if err == nil {
+			as.closers = append(as.closers, sinks...)
+			return
+		}
+		for _, fn := range append(as.closers, sinks...) {
+			fn()
+		}
+		as = nil
+	}()
+	//as.cfg keeps any auto sentinel so an unchanged reload still matches these sinks
+	cfg.Ingester_UUID = resolveIngesterUUID(cfg.Ingester_UUID, lg)
+	if cfg.IngesterUUIDFile != `` && cfg.gravwellTargets() && !cfg.ShadowMode {
+		if cfg.Ingester_UUID, err = loadOrCreateUUID(cfg.IngesterUUIDFile); err != nil {
+			return
+		}
+	}
+	//the files may have changed since parseConfig checked them, read them before dialing anything
+	var cm *countryMap
+	if cfg.CountryCIDRMap != `` {
+		if cm, err = newCountryMap(cfg.CountryCIDRMap, lg); err != nil {
+			return
+		}
+		as.closers = append(as.closers, func() error {
+			cm.close()
+			return nil
+		})
+	}
+	var bd *badDomains
+	if cfg.BadDomainList != `` {
+		if bd, err = newBadDomains(cfg.BadDomainList, lg); err != nil {
+			return
+		}
+		as.closers = append(as.closers, func() error {
+			bd.close()
+			return nil
+		})
+	}
+	el := newErrorLog(cfg.ErrorLogInterval, lg)
+	var im entryWriter
+	var tg entry.EntryTag
+	var rcodeTags map[int]entry.EntryTag
+	var auditTag entry.EntryTag
+	var muxers entryWriter
+	var cw *connWatcher
+	var st *writeStats
+	if cfg.ShadowMode {
+		//the full encode path runs but entries stop here, no connections are made
+		lg.Infof("shadow mode enabled, entries are encoded and counted but never written")
+		st = &writeStats{}
+		im = shadowWriter{st: st}
+	} else if cfg.gravwellTargets() {
+		if cfg.Ingest_Cache_Path != `` {
+			if err = checkCacheDir(cfg.Ingest_Cache_Path); err != nil {
+				return
+			}
+		}
+		if im, as.primary, err = startMuxers(cfg, lg); err != nil {
+			return
+		}
+		if mc, ok := im.(interface{ Close() error }); ok {
+			closeMuxers = mc.Close
+		}
+		if tg, err = as.primary.GetTag(cfg.Tag); err != nil {
+			return
+		} else if rcodeTags, err = resolveRcodeTags(as.primary, cfg.RcodeTags); err != nil {
+			return
+		}
+		if cfg.AuditTag != `` {
+			if auditTag, err = as.primary.GetTag(cfg.AuditTag); err != nil {
+				return
+			}
+		}
+		muxers = im
+		st = &writeStats{}
+		im = countingWriter{entryWriter: muxers, st: st}
+		if hc, ok := muxers.(connCounter); ok {
+			cw = newConnWatcher(hc, cfg.StatsInterval)
+			as.closers = append(as.closers, func() error {
+				cw.close()
+				return nil
+			})
+		}
+	}
+	if len(cfg.KafkaBrokers) > 0 && !cfg.ShadowMode {
+		ks := newKafkaSink(cfg.KafkaBrokers, cfg.KafkaTopic, el, lg)
+		im = addWriter(im, kafkaSinkName, ks)
+		sinks = append(sinks, ks.close)
+	}
+	if cfg.SyslogRemote != `` && !cfg.ShadowMode {
+		network, addr, _ := parseSyslogRemote(cfg.SyslogRemote) //validated by parseConfig
+		ss := newSyslogSink(network, addr)
+		im = addWriter(im, `syslog`, ss)
+		sinks = append(sinks, ss.close)
+	}
+	if cfg.UnixSink != `` && !cfg.ShadowMode {
+		us := newUnixSink(cfg.UnixSink)
+		im = addWriter(im, `unix`, us)
+		sinks = append(sinks, us.close)
+	}
+	if cfg.HTTPSink != `` && !cfg.ShadowMode {
+		hs := newHTTPSink(cfg.HTTPSink, cfg.HTTPSinkHeaders, cfg.HTTPSinkRetries, el)
+		im = addWriter(im, httpSinkName, hs)
+		sinks = append(sinks, hs.close)
+	}
+	if cfg.StdoutSink && !cfg.ShadowMode {
+		im = addWriter(im, `stdout`, newStdoutSink(os.Stdout))
+	}
+	if cfg.MaxConcurrentWrites > 0 && im != nil {
+		im = newLimitWriter(im, cfg.MaxConcurrentWrites)
+	}
+
+	as.gh = gwHandler{
+		im:            im,
+		tag:           tg,
+		rcodeTags:     rcodeTags,
+		audit:         cfg.AuditTag != ``,
+		auditTag:      auditTag,
+		to:            cfg.WriteTimeout,
+		deadline:      cfg.IngestDeadline,
+		timing:        cfg.LogTiming,
+		mask:          ipMask{v4: cfg.MaskClientIPv4, v6: cfg.MaskClientIPv6},
+		metadataKeys:  cfg.MetadataKeys,
+		encodeOptions: cfg.encodeOptions(),
+		errlog:        el,
+		countries:     cm,
+	}
+	as.gh.badDomains = bd
+	if cfg.NTPCheckServer != `` {
+		ck := newClockChecker(cfg.NTPCheckServer, cfg.NTPCheckInterval, lg)
+		as.gh.clock = ck
+		as.closers = append(as.closers, func() error {
+			ck.close()
+			return nil
+		})
+	}
+	if cfg.SlowOutlierPercentile > 0 {
+		as.gh.latency = newLatencyTracker(cfg.SlowOutlierPercentile)
+	}
+	if cfg.ClientQPSHalflife > 0 {
+		as.gh.qps = newQPSTracker(cfg.ClientQPSHalflife)
+	}
+	if cfg.NXDomainThreshold > 0 {
+		as.gh.nx = newNXTracker(cfg.NXDomainThreshold, cfg.NXDomainWindow)
+	}
+	if cfg.QueueDepth > 0 {
+		q := newWriteQueue(cfg.QueueDepth, cfg.QueueWarnPercent, as.gh.writeLogged, lg)
+		as.gh.q = q
+		as.closers = append(as.closers, func() error {
+			q.close()
+			return nil
+		})
+	}
+	if cfg.HeartbeatInterval > 0 {
+		hb := newHeartbeat(cfg.HeartbeatInterval, as.gh.tag, as.gh.writeLogged, cw, st, as.gh.clock, lg)
+		as.closers = append(as.closers, func() error {
+			hb.close()
+			return nil
+		})
+	}
+	if cfg.LifecycleMarkers {
+		start := time.Now()
+		as.gh.writeMarker(lifecycleRecord{EventType: eventPluginStart, Config: cfg.String()})
+		//after the queue has drained so the marker follows every logged request
+		as.closers = append(as.closers, func() error {
+			as.gh.writeMarker(lifecycleRecord{EventType: eventPluginStop, Uptime: time.Since(start).Round(time.Second).String()})
+			return nil
+		})
+	}
+	return
+}
+
+// cacheInUse reports whether running sinks own a cache path, the caller holds active
+func cacheInUse(p string) bool {
+	for _, v := range active.sinks {
+		if v.cfg.Ingest_Cache_Path == p {
+			return true
+		}
+	}
+	return false
+}
+
+// resolveIngesterUUID replaces the ingester-uuid auto sentinel with a fresh UUID
+func resolveIngesterUUID(id string, lg *pluginLogger) string {
+	if id != ingesterUUIDAuto {
+		return id
+	}
+	id = uuid.New().String()
+	lg.Infof("generated ingester-uuid %s", id)
+	return id
+}
@@ -0,0 +1,185 @@
+/*************************************************************************
+ * Copyright 2017 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package gravwellcoredns
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/coredns/caddy"
+	"github.com/coredns/coredns/core/dnsserver"
+)
+
+const reloadConfig = "gravwell {\n\tKafka-Broker 127.0.0.1:9092\n\tKafka-Topic dns\n\tIngest-Queue-Depth 16\n"
+
+func activeCount() int {
+	active.Lock()
+	defer active.Unlock()
+	return len(active.sinks)
+}
+
+func TestReloadReusesSinks(t *testing.T) {
+	a, err := acquireSinks(mustParse(t, reloadConfig+"}"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	//an identical reload, including a changed encoder option, keeps the running sinks
+	b, err := acquireSinks(mustParse(t, reloadConfig+"\tEncoding json {\n\t\tstyle pretty\n\t}\n}"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a != b || a.gh.im != b.gh.im || a.gh.q != b.gh.q || a.refs != 2 {
+		t.Fatal("identical configuration did not reuse the running sinks")
+	}
+	//the old instance shutting down leaves the sinks running for the new one
+	if err = a.release(); err != nil {
+		t.Fatal(err)
+	} else if activeCount() != 1 {
+		t.Fatal("sinks torn down while still referenced")
+	}
+
+	c, err := acquireSinks(mustParse(t, reloadConfig+"\tKafka-Topic dns2\n}"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c == b || c.gh.im == b.gh.im {
+		t.Fatal("changed configuration reused the running sinks")
+	}
+	b.release()
+	c.release()
+	if activeCount() != 0 {
+		t.Fatal("released sinks still active")
+	}
+}
+
+func TestReloadKeepsSinksForFilters(t *testing.T) {
+	commitPending() //references other tests took directly
+	//editing a filter reuses the sinks, each instance filters with its own settings
+	var handlers []*gwHandler
+	for _, filters := range []string{``, "\tFilter-Client-Port 53\n\tLog-Window 08:00-18:00 UTC\n\tSample-Rate 0.5\n\tLog-Errors false\n"} {
+		c := caddy.NewTestController("dns", reloadConfig+filters+"}")
+		start, err := setupInstance(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		chain := dnsserver.GetConfig(c).Plugin
+		h := chain[len(chain)-1](answerHandler(false)).(*gwHandler)
+		if err = start(); err != nil {
+			t.Fatal(err)
+		}
+		handlers = append(handlers, h)
+	}
+	defer releasePending()
+	if activeCount() != 1 {
+		t.Fatal("a filter edit started new sinks")
+	}
+	a, b := handlers[0], handlers[1]
+	if a.im != b.im || a.q != b.q {
+		t.Fatal("instances do not share the sinks")
+	} else if a.ports != nil || a.window != nil || a.sample != nil || a.skipErrors {
+		t.Fatalf("unfiltered instance picked up filters %+v", a)
+	} else if b.ports == nil || b.window == nil || b.sample == nil || !b.skipErrors {
+		t.Fatalf("filters not applied %+v", b)
+	}
+}
+
+func TestSetupReload(t *testing.T) {
+	commitPending() //references other tests took directly
+	//nothing is started until CoreDNS starts the servers
+	if err := setup(caddy.NewTestController("dns", reloadConfig+"}")); err != nil {
+		t.Fatal(err)
+	} else if activeCount() != 0 {
+		t.Fatal("setup started sinks before the servers started")
+	}
+	startA, err := setupInstance(caddy.NewTestController("dns", reloadConfig+"}"))
+	if err != nil {
+		t.Fatal(err)
+	} else if err = startA(); err != nil {
+		t.Fatal(err)
+	}
+	commitPending()
+	startB, err := setupInstance(caddy.NewTestController("dns", reloadConfig+"}"))
+	if err != nil {
+		t.Fatal(err)
+	} else if err = startB(); err != nil {
+		t.Fatal(err)
+	}
+	active.Lock()
+	if len(active.sinks) != 1 || active.sinks[0].refs != 2 {
+		active.Unlock()
+		t.Fatal("reload did not reuse the running sinks")
+	}
+	as := active.sinks[0]
+	active.Unlock()
+
+	//a reload that fails after starting gives back the references it took
+	if err = releasePending(); err != nil {
+		t.Fatal(err)
+	} else if as.refs != 1 || activeCount() != 1 {
+		t.Fatalf("failed reload left %d references", as.refs)
+	}
+	startC, err := setupInstance(caddy.NewTestController("dns", reloadConfig+"\tKafka-Topic dns2\n}"))
+	if err != nil {
+		t.Fatal(err)
+	} else if err = startC(); err != nil {
+		t.Fatal(err)
+	} else if activeCount() != 2 {
+		t.Fatal("changed configuration reused the running sinks")
+	}
+	releasePending()
+	if activeCount() != 1 {
+		t.Fatal("sinks started by a failed reload still active")
+	}
+	as.release()
+	if activeCount() != 0 {
+		t.Fatal("released sinks still active")
+	}
+}
+
+func TestStartSinksCleanup(t *testing.T) {
+	//files that went missing after parsing fail before anything is started, and a file read
+	//after another started its watcher tears that watcher down
+	dir := t.TempDir()
+	cm := filepath.Join(dir, `countries`)
+	if err := os.WriteFile(cm, []byte(testCountryMap), 0600); err != nil {
+		t.Fatal(err)
+	}
+	base := runtime.NumGoroutine()
+	for _, files := range [][2]string{{filepath.Join(dir, `missing`), ``}, {cm, filepath.Join(dir, `missing`)}} {
+		cfg := mustParse(t, reloadConfig+"\tNTP-Check-Server 127.0.0.1\n\tLifecycle-Markers false\n}")
+		cfg.CountryCIDRMap, cfg.BadDomainList = files[0], files[1]
+		if _, err := startSinks(cfg, nil); err == nil {
+			t.Fatalf("started sinks with missing files %v", files)
+		}
+		waitGoroutines(t, base)
+	}
+}
+
+// waitGoroutines fails unless the goroutine count drops back to base
+func waitGoroutines(t *testing.T, base int) {
+	t.Helper()
+	for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); time.Sleep(5 * time.Millisecond) {
+		if runtime.NumGoroutine() <= base {
+			return
+		}
+	}
+	t.Fatalf("%d goroutines left running", runtime.NumGoroutine()-base)
+}
+
+func mustParse(t *testing.T, v string) cfgType {
+	t.Helper()
+	cfg, _, err := parseConfig(caddy.NewTestController("dns", v))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cfg
+}
@@ -0,0 +1,90 @@
+/*************************************************************************
+ * Copyright 2017 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package gravwellcoredns
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math"
+	"math/rand/v2"
+	"net"
+	"strings"
+)
+
+// sample-key values, query samples each request independently and client keeps or drops
+// every request from a client together
+const (
+	sampleKeyQuery  string = `query`
+	sampleKeyClient string = `client`
+)
+
+// sampler keeps a sample-rate fraction of requests.  Client sampling hashes the client address
+// so the decision is the same for every request from it, on every restart, and on every
+// CoreDNS instance configured with the same rate.
+type sampler struct {
+	rate      float64
+	byClient  bool
+	threshold uint64 // client hashes below this are kept
+}
+
+func parseSampleKey(v string) (string, error) {
+	switch k := strings.ToLower(v); k {
+	case sampleKeyQuery, sampleKeyClient:
+		return k, nil
+	}
+	return ``, fmt.Errorf("Invalid sample-key %q, must be %s or %s", v, sampleKeyClient, sampleKeyQuery)
+}
+
+// newSampler returns nil for a rate of 1 or more, which keeps everything
+func newSampler(rate float64, key string) *sampler {
+	if rate >= 1 {
+		return nil
+	}
+	return &sampler{
+		rate:      rate,
+		byClient:  key == sampleKeyClient,
+		threshold: uint64(rate * math.MaxUint64),
+	}
+}
+
+// keep reports whether a request from addr is sampled in, a nil sampler keeps everything.
+// Client sampling keeps requests from addresses that are not ip:port pairs.
+func (s *sampler) keep(addr net.Addr) bool {
+	if s == nil {
+		return true
+	} else if !s.byClient {
+		return rand.Float64() < s.rate
+	}
+	ip, ok := clientIP(addr)
+	if !ok {
+		return true
+	}
+	h := fnv.New64a()
+	h.Write(ip.AsSlice())
+	return mix64(h.Sum64()) < s.threshold
+}
+
+// mix64 is the murmur3 finalizer, FNV of a handful of address bytes leaves the high bits
+// the threshold compares poorly distributed
+func mix64(h uint64) uint64 {
+	h ^= h >> 33
+	h *= 0xff51afd7ed558ccd
+	h ^= h >> 33
+	h *= 0xc4ceb9fe1a85ec53
+	h ^= h >> 33
+	return h
+}
+
+func (s *sampler) String() string {
+	key := sampleKeyQuery
+	if s.byClient {
+		key = sampleKeyClient
+	}
+	return fmt.Sprintf("sample-rate %g sample-key %s", s.rate, key)
+}
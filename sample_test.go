@@ -0,0 +1,66 @@
+/*************************************************************************
+ * Copyright 2017 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package gravwellcoredns
+
+import (
+	"net"
+	"testing"
+)
+
+func TestSampleKeyClient(t *testing.T) {
+	s := newSampler(0.25, sampleKeyClient)
+	const clients = 4000
+	var kept int
+	for i := 0; i < clients; i++ {
+		ip := net.IPv4(10, byte(i>>16), byte(i>>8), byte(i))
+		first := s.keep(&net.UDPAddr{IP: ip, Port: 1024 + i})
+		for port := 0; port < 8; port++ {
+			//the source port and address family do not change the decision
+			if s.keep(&net.UDPAddr{IP: ip, Port: 40000 + port}) != first || s.keep(&net.TCPAddr{IP: ip.To16(), Port: port + 1}) != first {
+				t.Fatalf("inconsistent decision for %v", ip)
+			}
+		}
+		if first {
+			kept++
+		}
+	}
+	if f := float64(kept) / clients; f < 0.2 || f > 0.3 {
+		t.Fatalf("kept %.3f of clients at a rate of 0.25", f)
+	}
+	//identical configurations agree
+	other := newSampler(0.25, sampleKeyClient)
+	for i := 0; i < 64; i++ {
+		a := &net.UDPAddr{IP: net.IPv4(192, 168, 1, byte(i)), Port: 53}
+		if s.keep(a) != other.keep(a) {
+			t.Fatalf("samplers disagree on %v", a)
+		}
+	}
+	if !s.keep(staticAddr{network: `unix`, addr: `@dns`}) {
+		t.Fatal("dropped a client without an address")
+	}
+}
+
+func TestSampleKeyQuery(t *testing.T) {
+	s := newSampler(0.25, sampleKeyQuery)
+	a := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 40000}
+	const requests = 10000
+	var kept int
+	for i := 0; i < requests; i++ {
+		if s.keep(a) {
+			kept++
+		}
+	}
+	if f := float64(kept) / requests; f < 0.22 || f > 0.28 {
+		t.Fatalf("kept %.3f of one client's requests at a rate of 0.25", f)
+	}
+	var nilSampler *sampler
+	if newSampler(1, sampleKeyQuery) != nil || !nilSampler.keep(a) {
+		t.Fatal("a rate of 1 should keep everything")
+	}
+}
@@ -0,0 +1,111 @@
+/*************************************************************************
+ * Copyright 2017 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package gravwellcoredns
+
+import (
+	"errors"
+	"sync/atomic"
+	"time"
+
+	"github.com/gravwell/gravwell/v3/ingest/entry"
+)
+
+// writeStats counts what was handed to the ingest muxers, the muxer keeps equivalent
+// counters but does not export them
+type writeStats struct {
+	entries atomic.Uint64
+	bytes   atomic.Uint64
+	errors  atomic.Uint64
+}
+
+func (st *writeStats) record(ent *entry.Entry, err error) {
+	if err != nil {
+		st.errors.Add(1)
+		writeErrors.Inc()
+		return
+	}
+	st.entries.Add(1)
+	st.bytes.Add(uint64(len(ent.Data)))
+	entriesWritten.Inc()
+	bytesWritten.Add(float64(len(ent.Data)))
+}
+
+// countingWriter records every write to the wrapped writer in st
+type countingWriter struct {
+	entryWriter
+	st *writeStats
+}
+
+func (cw countingWriter) WriteEntry(ent *entry.Entry) (err error) {
+	err = cw.entryWriter.WriteEntry(ent)
+	cw.st.record(ent, err)
+	return
+}
+
+func (cw countingWriter) WriteEntryTimeout(ent *entry.Entry, to time.Duration) (err error) {
+	err = cw.entryWriter.WriteEntryTimeout(ent, to)
+	cw.st.record(ent, err)
+	return
+}
+
+// shadowWriter counts entries that would have been written without sending them anywhere
+type shadowWriter struct {
+	st *writeStats
+}
+
+func (sw shadowWriter) WriteEntry(ent *entry.Entry) error {
+	sw.st.entries.Add(1)
+	sw.st.bytes.Add(uint64(len(ent.Data)))
+	shadowEntries.Inc()
+	shadowBytes.Add(float64(len(ent.Data)))
+	return nil
+}
+
+func (sw shadowWriter) WriteEntryTimeout(ent *entry.Entry, _ time.Duration) error {
+	return sw.WriteEntry(ent)
+}
+
+var errWriteLimit = errors.New("max-concurrent-writes in flight")
+
+// limitWriter bounds the writes in flight to the wrapped writer, a write that finds every slot
+// taken fails immediately instead of queueing up behind a slow indexer
+type limitWriter struct {
+	entryWriter
+	sem chan struct{}
+}
+
+func newLimitWriter(w entryWriter, n int) limitWriter {
+	return limitWriter{entryWriter: w, sem: make(chan struct{}, n)}
+}
+
+func (lw limitWriter) acquire() bool {
+	select {
+	case lw.sem <- struct{}{}:
+		return true
+	default:
+		writeLimitRejections.Inc()
+		return false
+	}
+}
+
+func (lw limitWriter) WriteEntry(ent *entry.Entry) error {
+	if !lw.acquire() {
+		return errWriteLimit
+	}
+	defer func() { <-lw.sem }()
+	return lw.entryWriter.WriteEntry(ent)
+}
+
+func (lw limitWriter) WriteEntryTimeout(ent *entry.Entry, to time.Duration) error {
+	if !lw.acquire() {
+		return errWriteLimit
+	}
+	defer func() { <-lw.sem }()
+	return lw.entryWriter.WriteEntryTimeout(ent, to)
+}
@@ -0,0 +1,104 @@
+/*************************************************************************
+ * Copyright 2017 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package gravwellcoredns
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/coredns/caddy"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/gravwell/gravwell/v3/ingest/entry"
+	"github.com/miekg/dns"
+)
+
+func TestShadowMode(t *testing.T) {
+	//targets are never dialed, so an unreachable one does not fail setup
+	cfg, enc, err := parseConfig(caddy.NewTestController("dns", "gravwell {\n\tCleartext-Target 127.0.0.1:1\n\tShadow-Mode true\n\tTag-On-Rcode SERVFAIL dns-errors\n\tLifecycle-Markers false\n}"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	as, err := acquireSinks(cfg, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer as.release()
+	if as.primary != nil {
+		t.Fatal("muxer started in shadow mode")
+	}
+	sw, ok := as.gh.im.(shadowWriter)
+	if !ok {
+		t.Fatalf("shadow mode writer is %T", as.gh.im)
+	}
+
+	gh := as.gh
+	gh.enc = enc
+	gh.Next = answerHandler(false)
+	for i := 0; i < 3; i++ {
+		req := new(dns.Msg)
+		req.SetQuestion("example.com.", dns.TypeA)
+		if _, err = gh.ServeDNS(context.Background(), &test.ResponseWriter{}, req); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := sw.st.entries.Load(); n != 3 {
+		t.Fatalf("expected 3 shadow entries, got %d", n)
+	} else if sw.st.bytes.Load() == 0 {
+		t.Fatal("no shadow bytes counted")
+	}
+
+	//shadow mode still needs the kafka pair to be consistent
+	if _, _, err = parseConfig(caddy.NewTestController("dns", "gravwell {\n\tShadow-Mode true\n\tKafka-Topic dns\n}")); err == nil {
+		t.Fatal("accepted kafka-topic without brokers")
+	}
+}
+
+// blockingWriter holds every write until release is closed
+type blockingWriter struct {
+	entered chan struct{}
+	release chan struct{}
+}
+
+func (b *blockingWriter) WriteEntry(*entry.Entry) error {
+	b.entered <- struct{}{}
+	<-b.release
+	return nil
+}
+
+func (b *blockingWriter) WriteEntryTimeout(ent *entry.Entry, _ time.Duration) error {
+	return b.WriteEntry(ent)
+}
+
+func TestMaxConcurrentWrites(t *testing.T) {
+	bw := &blockingWriter{entered: make(chan struct{}, 4), release: make(chan struct{})}
+	lw := newLimitWriter(bw, 2)
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := lw.WriteEntry(&entry.Entry{}); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	<-bw.entered
+	<-bw.entered
+	//both slots are held, the next write is refused rather than piling up
+	if err := lw.WriteEntryTimeout(&entry.Entry{}, time.Second); err != errWriteLimit {
+		t.Fatalf("expected the write limit, got %v", err)
+	}
+	close(bw.release)
+	wg.Wait()
+	if err := lw.WriteEntry(&entry.Entry{}); err != nil {
+		t.Fatalf("slots not released: %v", err)
+	}
+}
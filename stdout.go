@@ -0,0 +1,44 @@
+/*************************************************************************
+ * Copyright 2017 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package gravwellcoredns
+
+import (
+	"io"
+	"sync"
+	"time"
+
+	"github.com/gravwell/gravwell/v3/ingest/entry"
+)
+
+// stdoutSink writes each encoded entry followed by a newline to the process stdout for
+// container log collection.  Every entry goes out in a single locked write, so concurrent
+// requests never interleave partial lines.
+type stdoutSink struct {
+	mtx sync.Mutex
+	w   io.Writer
+}
+
+func newStdoutSink(w io.Writer) *stdoutSink {
+	return &stdoutSink{w: w}
+}
+
+func (s *stdoutSink) WriteEntry(ent *entry.Entry) error {
+	bb := make([]byte, 0, len(ent.Data)+1)
+	bb = append(append(bb, ent.Data...), '\n')
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	_, err := s.w.Write(bb)
+	return err
+}
+
+// WriteEntryTimeout ignores the timeout, a blocked stdout means the container runtime has
+// stopped reading and there is nowhere else for the line to go
+func (s *stdoutSink) WriteEntryTimeout(ent *entry.Entry, to time.Duration) error {
+	return s.WriteEntry(ent)
+}
@@ -0,0 +1,79 @@
+/*************************************************************************
+ * Copyright 2017 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package gravwellcoredns
+
+import (
+	"bytes"
+	"fmt"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/coredns/caddy"
+	"github.com/gravwell/gravwell/v3/ingest/entry"
+)
+
+// chunkWriter hands each Write to the buffer one byte at a time, so any unsynchronized
+// writers would interleave their lines
+type chunkWriter struct {
+	bytes.Buffer
+}
+
+func (c *chunkWriter) Write(b []byte) (int, error) {
+	for i := range b {
+		c.Buffer.WriteByte(b[i])
+		if i%16 == 0 {
+			runtime.Gosched()
+		}
+	}
+	return len(b), nil
+}
+
+func TestStdoutSink(t *testing.T) {
+	var cw chunkWriter
+	s := newStdoutSink(&cw)
+	const writers, lines = 8, 50
+	var wg sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < lines; i++ {
+				data := []byte(fmt.Sprintf("writer %d line %d %s", w, i, strings.Repeat(`x`, 64)))
+				if err := s.WriteEntryTimeout(&entry.Entry{TS: entry.Now(), Data: data}, time.Second); err != nil {
+					t.Error(err)
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	got := strings.Split(strings.TrimSuffix(cw.String(), "\n"), "\n")
+	if len(got) != writers*lines {
+		t.Fatalf("expected %d lines, got %d", writers*lines, len(got))
+	}
+	for _, l := range got {
+		var w, i int
+		var pad string
+		if n, err := fmt.Sscanf(l, "writer %d line %d %s", &w, &i, &pad); n != 3 || err != nil || pad != strings.Repeat(`x`, 64) {
+			t.Fatalf("interleaved line %q", l)
+		}
+	}
+
+	//stdout alone is a valid destination
+	if cfg, _, err := parseConfig(caddy.NewTestController("dns", "gravwell {\n\tStdout-Sink true\n}")); err != nil {
+		t.Fatal(err)
+	} else if !cfg.StdoutSink {
+		t.Fatal("stdout-sink not set")
+	}
+	if _, _, err := parseConfig(caddy.NewTestController("dns", "gravwell {\n\tStdout-Sink maybe\n}")); err == nil {
+		t.Fatal("accepted bad stdout-sink")
+	}
+}
@@ -0,0 +1,136 @@
+/*************************************************************************
+ * Copyright 2017 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package gravwellcoredns
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	redialMinBackoff time.Duration = 250 * time.Millisecond
+	redialMaxBackoff time.Duration = 30 * time.Second
+)
+
+var (
+	errStreamDown   = errors.New("not connected, redialing in the background")
+	errStreamClosed = errors.New("sink is closed")
+)
+
+// redialConn is a connection that is never dialed on the request path.  A write while the
+// connection is down fails immediately, and a failed write drops the connection and wakes a
+// background dialer.  The dialer waits before every attempt, redialMinBackoff at first and twice
+// as long after each failed dial up to redialMaxBackoff, so neither a dead server nor one that
+// accepts and immediately drops the connection turns into a dial storm.
+type redialConn struct {
+	dial   func(context.Context) (net.Conn, error)
+	ctx    context.Context
+	cancel context.CancelFunc
+	kick   chan struct{}
+	wg     sync.WaitGroup
+
+	mtx    sync.Mutex
+	conn   net.Conn
+	closed bool
+}
+
+// newRedialConn makes the first dial before returning so a reachable server takes the first
+// entries, the caller is starting up rather than serving a request
+func newRedialConn(dial func(context.Context) (net.Conn, error)) *redialConn {
+	rc := &redialConn{
+		dial: dial,
+		kick: make(chan struct{}, 1),
+	}
+	rc.ctx, rc.cancel = context.WithCancel(context.Background())
+	var err error
+	if rc.conn, err = dial(rc.ctx); err != nil {
+		rc.conn = nil
+		rc.redial()
+	}
+	rc.wg.Add(1)
+	go rc.run()
+	return rc
+}
+
+func (rc *redialConn) write(bb []byte, deadline time.Time) (err error) {
+	rc.mtx.Lock()
+	defer rc.mtx.Unlock()
+	if rc.closed {
+		return errStreamClosed
+	} else if rc.conn == nil {
+		return errStreamDown
+	}
+	if err = rc.conn.SetWriteDeadline(deadline); err == nil {
+		if _, err = rc.conn.Write(bb); err == nil {
+			return
+		}
+	}
+	//drop the connection, the background dialer picks the server back up
+	rc.conn.Close()
+	rc.conn = nil
+	rc.redial()
+	return
+}
+
+// redial wakes the background dialer, a wake up that is already pending covers this one
+func (rc *redialConn) redial() {
+	select {
+	case rc.kick <- struct{}{}:
+	default:
+	}
+}
+
+func (rc *redialConn) run() {
+	defer rc.wg.Done()
+	backoff := redialMinBackoff
+	for {
+		select {
+		case <-rc.ctx.Done():
+			return
+		case <-rc.kick:
+		}
+		for {
+			select {
+			case <-rc.ctx.Done():
+				return
+			case <-time.After(backoff):
+			}
+			conn, err := rc.dial(rc.ctx)
+			if err != nil {
+				backoff = min(2*backoff, redialMaxBackoff)
+				continue
+			}
+			rc.mtx.Lock()
+			if rc.closed {
+				conn.Close()
+			} else {
+				rc.conn = conn
+			}
+			rc.mtx.Unlock()
+			backoff = redialMinBackoff
+			break
+		}
+	}
+}
+
+func (rc *redialConn) close() (err error) {
+	rc.mtx.Lock()
+	rc.closed = true
+	if rc.conn != nil {
+		err = rc.conn.Close()
+		rc.conn = nil
+	}
+	rc.mtx.Unlock()
+	rc.cancel()
+	rc.wg.Wait()
+	return
+}
@@ -0,0 +1,60 @@
+/*************************************************************************
+ * Copyright 2017 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package gravwellcoredns
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gravwell/gravwell/v3/ingest/entry"
+)
+
+// writeEventually retries a write until the sink has reconnected
+func writeEventually(t *testing.T, w entryWriter, data string) {
+	t.Helper()
+	for deadline := time.Now().Add(2 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		err := w.WriteEntryTimeout(&entry.Entry{TS: entry.Now(), Data: []byte(data)}, time.Second)
+		if err == nil {
+			return
+		} else if time.Now().After(deadline) {
+			t.Fatalf("sink never reconnected: %v", err)
+		}
+	}
+}
+
+func TestRedialConnBackoff(t *testing.T) {
+	var dials atomic.Int32
+	rc := newRedialConn(func(context.Context) (net.Conn, error) {
+		dials.Add(1)
+		return nil, errors.New(`connection refused`)
+	})
+	//writes fail without dialing while the dialer backs off, 250ms then 500ms then 1s
+	start := time.Now()
+	for i := 0; i < 100; i++ {
+		if err := rc.write([]byte(`x`), time.Time{}); err != errStreamDown {
+			t.Fatalf("write on a down connection: %v", err)
+		}
+	}
+	if d := time.Since(start); d > 100*time.Millisecond {
+		t.Fatalf("writes waited %v on a down connection", d)
+	}
+	time.Sleep(time.Second)
+	if n := dials.Load(); n < 2 || n > 3 {
+		t.Fatalf("%d dials in the first second", n)
+	}
+	if err := rc.close(); err != nil {
+		t.Fatal(err)
+	} else if err = rc.write([]byte(`x`), time.Time{}); err != errStreamClosed {
+		t.Fatalf("write after close: %v", err)
+	}
+}
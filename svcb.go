@@ -0,0 +1,45 @@
+/*************************************************************************
+ * Copyright 2017 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package gravwellcoredns
+
+import (
+	"github.com/miekg/dns"
+)
+
+// svcbRecord is the structured form of an SVCB or HTTPS answer, the dns package marshals the
+// parameters as a list of anonymous objects so the key names would otherwise be lost
+type svcbRecord struct {
+	Priority uint16
+	Target   string
+	Params   map[string]string `json:",omitempty"` // key name to presentation value, e.g. alpn: h2,h3
+}
+
+// svcbParams returns the structured form of SVCB and HTTPS answers, nil for every other type
+func svcbParams(rr dns.RR) *svcbRecord {
+	var v *dns.SVCB
+	switch t := rr.(type) {
+	case *dns.SVCB:
+		v = t
+	case *dns.HTTPS:
+		v = &t.SVCB
+	default:
+		return nil
+	}
+	r := &svcbRecord{
+		Priority: v.Priority,
+		Target:   v.Target,
+	}
+	for _, kv := range v.Value {
+		if r.Params == nil {
+			r.Params = make(map[string]string, len(v.Value))
+		}
+		r.Params[kv.Key().String()] = kv.String()
+	}
+	return r
+}
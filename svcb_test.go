@@ -0,0 +1,59 @@
+/*************************************************************************
+ * Copyright 2017 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package gravwellcoredns
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/gravwell/gravwell/v3/ingest/entry"
+	"github.com/miekg/dns"
+)
+
+func TestSVCBParams(t *testing.T) {
+	rr, err := dns.NewRR(`example.com. 300 IN HTTPS 1 . alpn="h3,h2" port=8443 ipv4hint="192.0.2.1,192.0.2.2"`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := &svcbRecord{
+		Priority: 1,
+		Target:   `.`,
+		Params: map[string]string{
+			`alpn`:     `h3,h2`,
+			`port`:     `8443`,
+			`ipv4hint`: `192.0.2.1,192.0.2.2`,
+		},
+	}
+	if got := svcbParams(rr); !reflect.DeepEqual(got, exp) {
+		t.Fatalf("bad params %+v", got)
+	}
+
+	//alias mode SVCB without parameters
+	alias, err := dns.NewRR(`_dns.example.com. 300 IN SVCB 0 dns.example.net.`)
+	if err != nil {
+		t.Fatal(err)
+	} else if got := svcbParams(alias); got == nil || got.Priority != 0 || got.Target != `dns.example.net.` || got.Params != nil {
+		t.Fatalf("bad alias params %+v", got)
+	}
+	if svcbParams(test.A(`example.com. 60 IN A 1.2.3.4`)) != nil {
+		t.Fatal("params for an A record")
+	}
+
+	m := testMsg(`example.com.`, dns.TypeHTTPS, rr)
+	for _, enc := range []encoder{jsonEncoder{}, jsonEncoder{perAnswer: true}} {
+		var v struct{ SVCB *svcbRecord }
+		if err := json.Unmarshal(enc.Encode(entry.Now(), testLocal, testRemote, newIntrospectorFromMsg(m, testOpts))[0], &v); err != nil {
+			t.Fatal(err)
+		} else if !reflect.DeepEqual(v.SVCB, exp) {
+			t.Fatalf("%s: bad SVCB %+v", enc.Name(), v.SVCB)
+		}
+	}
+}
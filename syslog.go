@@ -0,0 +1,116 @@
+/*************************************************************************
+ * Copyright 2017 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package gravwellcoredns
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/crewjam/rfc5424"
+	"github.com/gravwell/gravwell/v3/ingest/entry"
+)
+
+const (
+	syslogDefaultPort string        = `514`
+	syslogDialTimeout time.Duration = 5 * time.Second
+	syslogAppName     string        = `coredns`
+	syslogMsgID       string        = `dns`
+	syslogPriority                  = rfc5424.Daemon | rfc5424.Info
+)
+
+// parseSyslogRemote validates a syslog-remote URL, udp://host[:port] or tcp://host[:port]
+func parseSyslogRemote(v string) (network, addr string, err error) {
+	u, err := url.Parse(v)
+	if err != nil {
+		err = fmt.Errorf("Invalid syslog-remote %q - %w", v, err)
+		return
+	}
+	switch network = strings.ToLower(u.Scheme); network {
+	case `udp`, `tcp`:
+	default:
+		err = fmt.Errorf("Invalid syslog-remote %q, the scheme must be udp or tcp", v)
+		return
+	}
+	if u.Hostname() == `` || (u.Path != `` && u.Path != `/`) {
+		err = fmt.Errorf("Invalid syslog-remote %q, must be %s://host[:port]", v, network)
+		return
+	}
+	port := u.Port()
+	if port == `` {
+		port = syslogDefaultPort
+	} else if _, err = parsePort(port); err != nil {
+		err = fmt.Errorf("Invalid syslog-remote %q - %w", v, err)
+		return
+	}
+	addr = net.JoinHostPort(u.Hostname(), port)
+	return
+}
+
+// syslogSink ships each encoded entry as the MSG of an RFC 5424 message.  UDP sends one
+// message per datagram, TCP uses octet counting framing (RFC 6587).  The connection is only
+// dialed in the background, see redialConn, so a write never waits on an unreachable server.
+type syslogSink struct {
+	network  string
+	hostname string
+	rc       *redialConn
+}
+
+func newSyslogSink(network, addr string) *syslogSink {
+	hostname, _ := os.Hostname()
+	return &syslogSink{
+		network:  network,
+		hostname: hostname,
+		rc: newRedialConn(func(ctx context.Context) (net.Conn, error) {
+			d := net.Dialer{Timeout: syslogDialTimeout}
+			return d.DialContext(ctx, network, addr)
+		}),
+	}
+}
+
+// frame builds the on the wire form of an entry
+func (s *syslogSink) frame(ent *entry.Entry) ([]byte, error) {
+	m := rfc5424.Message{
+		Priority:  syslogPriority,
+		Timestamp: ent.TS.StandardTime(),
+		Hostname:  s.hostname,
+		AppName:   syslogAppName,
+		MessageID: syslogMsgID,
+		Message:   ent.Data,
+	}
+	bb, err := m.MarshalBinary()
+	if err != nil || s.network == `udp` {
+		return bb, err
+	}
+	return append([]byte(fmt.Sprintf("%d ", len(bb))), bb...), nil
+}
+
+func (s *syslogSink) WriteEntry(ent *entry.Entry) error {
+	return s.write(ent, time.Time{})
+}
+
+func (s *syslogSink) WriteEntryTimeout(ent *entry.Entry, to time.Duration) error {
+	return s.write(ent, time.Now().Add(to))
+}
+
+func (s *syslogSink) write(ent *entry.Entry, deadline time.Time) error {
+	bb, err := s.frame(ent)
+	if err != nil {
+		return err
+	}
+	return s.rc.write(bb, deadline)
+}
+
+func (s *syslogSink) close() error {
+	return s.rc.close()
+}
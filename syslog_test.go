@@ -0,0 +1,121 @@
+/*************************************************************************
+ * Copyright 2017 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package gravwellcoredns
+
+import (
+	"bufio"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/coredns/caddy"
+	"github.com/crewjam/rfc5424"
+	"github.com/gravwell/gravwell/v3/ingest/entry"
+)
+
+func TestParseSyslogRemote(t *testing.T) {
+	for v, want := range map[string]string{
+		`udp://10.0.0.1:514`:   `10.0.0.1:514`,
+		`tcp://syslog.example`: `syslog.example:514`,
+		`UDP://[::1]:1514`:     `[::1]:1514`,
+	} {
+		if _, addr, err := parseSyslogRemote(v); err != nil {
+			t.Fatal(err)
+		} else if addr != want {
+			t.Fatalf("%s parsed to %s, expected %s", v, addr, want)
+		}
+	}
+	for _, bad := range []string{`10.0.0.1:514`, `http://10.0.0.1`, `udp://`, `tcp://host:0`, `tcp://host:99999`, `udp://host/path`} {
+		if _, _, err := parseSyslogRemote(bad); err == nil {
+			t.Fatalf("accepted syslog-remote %s", bad)
+		}
+	}
+	//a syslog only config needs no gravwell targets
+	if _, _, err := parseConfig(caddy.NewTestController("dns", "gravwell {\n\tSyslog-Remote udp://127.0.0.1:514\n}")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSyslogSinkUDP(t *testing.T) {
+	pc, err := net.ListenPacket(`udp`, `127.0.0.1:0`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	s := newSyslogSink(`udp`, pc.LocalAddr().String())
+	defer s.close()
+	if err = s.WriteEntryTimeout(&entry.Entry{TS: entry.Now(), Data: []byte(`{"Question":1}`)}, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 4096)
+	pc.SetReadDeadline(time.Now().Add(time.Second))
+	n, _, err := pc.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var m rfc5424.Message
+	if err = m.UnmarshalBinary(buf[:n]); err != nil {
+		t.Fatal(err)
+	} else if string(m.Message) != `{"Question":1}` || m.AppName != syslogAppName || m.MessageID != syslogMsgID {
+		t.Fatalf("bad syslog message %+v", m)
+	}
+}
+
+func TestSyslogSinkTCPReconnect(t *testing.T) {
+	l, err := net.Listen(`tcp`, `127.0.0.1:0`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	msgs := make(chan string, 4)
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func(c net.Conn) {
+				defer c.Close()
+				r := bufio.NewReader(c)
+				for {
+					var m rfc5424.Message
+					if _, err := m.ReadFrom(r); err != nil {
+						return
+					}
+					msgs <- string(m.Message)
+				}
+			}(c)
+		}
+	}()
+	s := newSyslogSink(`tcp`, l.Addr().String())
+	defer s.close()
+	recv := func(want string) {
+		t.Helper()
+		select {
+		case v := <-msgs:
+			if v != want {
+				t.Fatalf("got %q expected %q", v, want)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("%q never arrived", want)
+		}
+	}
+	if err = s.WriteEntry(&entry.Entry{TS: entry.Now(), Data: []byte(`first`)}); err != nil {
+		t.Fatal(err)
+	}
+	recv(`first`)
+	//break the connection out from under the sink, the write that finds it fails without
+	//dialing and the background dialer picks the server back up
+	s.rc.conn.Close()
+	if err = s.WriteEntry(&entry.Entry{TS: entry.Now(), Data: []byte(`lost`)}); err == nil {
+		t.Fatal("write on a closed connection succeeded")
+	}
+	writeEventually(t, s, `second`)
+	recv(`second`)
+}
@@ -0,0 +1,42 @@
+/*************************************************************************
+ * Copyright 2017 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package gravwellcoredns
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/gravwell/gravwell/v3/ingest/entry"
+)
+
+// timestamp-json formats, the empty format keeps the entry.Timestamp encoding (RFC 3339 with nanoseconds)
+const (
+	timestampUnixMilli   string = `unixmilli`
+	timestampRFC3339     string = `rfc3339`
+	timestampNanoseconds string = `nanoseconds`
+)
+
+// recordTime is the TS of a JSON record, serialized according to the timestamp-json format.
+// Decoding is left to the embedded timestamp, so only the default and rfc3339 formats round trip.
+type recordTime struct {
+	entry.Timestamp
+	format string
+}
+
+func (rt recordTime) MarshalJSON() ([]byte, error) {
+	switch rt.format {
+	case timestampUnixMilli:
+		return strconv.AppendInt(nil, rt.StandardTime().UnixMilli(), 10), nil
+	case timestampNanoseconds:
+		return strconv.AppendInt(nil, rt.StandardTime().UnixNano(), 10), nil
+	case timestampRFC3339:
+		return strconv.AppendQuote(nil, rt.StandardTime().Format(time.RFC3339)), nil
+	}
+	return rt.Timestamp.MarshalJSON()
+}
@@ -0,0 +1,45 @@
+/*************************************************************************
+ * Copyright 2017 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package gravwellcoredns
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/gravwell/gravwell/v3/ingest/entry"
+	"github.com/miekg/dns"
+)
+
+func TestTimestampJSON(t *testing.T) {
+	ts := entry.FromStandard(time.Date(2024, 3, 9, 12, 30, 45, 123456789, time.UTC))
+	for format, exp := range map[string]string{
+		``:                   `"2024-03-09T12:30:45.123456789Z"`,
+		timestampRFC3339:     `"2024-03-09T12:30:45Z"`,
+		timestampUnixMilli:   `1709987445123`,
+		timestampNanoseconds: `1709987445123456789`,
+	} {
+		opts := testOpts
+		opts.tsFormat = format
+		var v struct{ TS json.RawMessage }
+		is := newIntrospectorFromMsg(testMsg(`example.com.`, dns.TypeA), opts)
+		if err := json.Unmarshal(jsonEncoder{}.Encode(ts, testLocal, testRemote, is)[0], &v); err != nil {
+			t.Fatal(err)
+		} else if string(v.TS) != exp {
+			t.Fatalf("%q format: %s != %s", format, v.TS, exp)
+		}
+		//error records share the format
+		if err := json.Unmarshal(jsonEncoder{}.EncodeError(ts, testLocal, testRemote, is, errors.New(`timeout`))[0], &v); err != nil {
+			t.Fatal(err)
+		} else if string(v.TS) != exp {
+			t.Fatalf("%q format error record: %s != %s", format, v.TS, exp)
+		}
+	}
+}
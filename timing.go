@@ -0,0 +1,42 @@
+/*************************************************************************
+ * Copyright 2017 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package gravwellcoredns
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"strconv"
+	"strings"
+)
+
+// log-timing values, pre writes a record of the request before the plugin chain runs, post
+// writes the usual record once the response is known, and both writes the two
+const (
+	logTimingPre  string = `pre`
+	logTimingPost string = `post`
+	logTimingBoth string = `both`
+)
+
+// parseLogTiming normalizes a log-timing value, post is stored as empty so the default and an
+// explicit post compare equal on reload
+func parseLogTiming(v string) (string, error) {
+	switch t := strings.ToLower(v); t {
+	case logTimingPost:
+		return ``, nil
+	case logTimingPre, logTimingBoth:
+		return t, nil
+	}
+	return ``, fmt.Errorf("Invalid log-timing %q, must be pre, post, or both", v)
+}
+
+// newEventID returns a random 64 bit identifier in hex, unique enough to pair the records of
+// one request without coordinating between CoreDNS instances
+func newEventID() string {
+	return strconv.FormatUint(rand.Uint64(), 16)
+}
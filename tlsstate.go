@@ -0,0 +1,41 @@
+/*************************************************************************
+ * Copyright 2017 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package gravwellcoredns
+
+import (
+	"crypto/tls"
+	"net/http"
+
+	"github.com/miekg/dns"
+)
+
+// httpRequester is satisfied by the CoreDNS DoH writer, the HTTP request carries the TLS state
+type httpRequester interface {
+	Request() *http.Request
+}
+
+// clientTLS returns the negotiated TLS version and cipher suite of a DoT or DoH client.  Plain
+// transports, and plugins ahead of gravwell that wrap the writer without passing the state
+// through, report nothing.
+func clientTLS(rw dns.ResponseWriter) (version, cipher string) {
+	var cs *tls.ConnectionState
+	switch v := rw.(type) {
+	case dns.ConnectionStater:
+		//DoT, the miekg writer returns nil for UDP and plain TCP
+		cs = v.ConnectionState()
+	case httpRequester:
+		if r := v.Request(); r != nil {
+			cs = r.TLS
+		}
+	}
+	if cs == nil || !cs.HandshakeComplete {
+		return
+	}
+	return tls.VersionName(cs.Version), tls.CipherSuiteName(cs.CipherSuite)
+}
@@ -0,0 +1,87 @@
+/*************************************************************************
+ * Copyright 2017 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package gravwellcoredns
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/miekg/dns"
+)
+
+// dotWriter stands in for the miekg writer of a DoT connection, cs is nil on plain TCP
+type dotWriter struct {
+	test.ResponseWriter
+	cs *tls.ConnectionState
+}
+
+func (d *dotWriter) ConnectionState() *tls.ConnectionState {
+	return d.cs
+}
+
+// dohWriter stands in for the CoreDNS DoH writer
+type dohWriter struct {
+	test.ResponseWriter
+	r *http.Request
+}
+
+func (d *dohWriter) Request() *http.Request {
+	return d.r
+}
+
+func TestClientTLS(t *testing.T) {
+	tls13 := &tls.ConnectionState{Version: tls.VersionTLS13, CipherSuite: tls.TLS_AES_128_GCM_SHA256, HandshakeComplete: true}
+	tls12 := &tls.ConnectionState{Version: tls.VersionTLS12, CipherSuite: tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384, HandshakeComplete: true}
+	for _, tc := range []struct {
+		name            string
+		rw              dns.ResponseWriter
+		version, cipher string
+	}{
+		{name: `udp`, rw: &test.ResponseWriter{}},
+		{name: `tcp`, rw: &dotWriter{}},
+		{name: `dot`, rw: &dotWriter{cs: tls13}, version: `TLS 1.3`, cipher: `TLS_AES_128_GCM_SHA256`},
+		{name: `doh`, rw: &dohWriter{r: &http.Request{TLS: tls12}}, version: `TLS 1.2`, cipher: `TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384`},
+		{name: `doh cleartext`, rw: &dohWriter{r: &http.Request{}}},
+		{name: `doh no request`, rw: &dohWriter{}},
+		{name: `incomplete handshake`, rw: &dotWriter{cs: &tls.ConnectionState{Version: tls.VersionTLS13}}},
+	} {
+		if v, c := clientTLS(tc.rw); v != tc.version || c != tc.cipher {
+			t.Fatalf("%s: got %q %q, expected %q %q", tc.name, v, c, tc.version, tc.cipher)
+		}
+	}
+
+	dw := &discardWriter{keep: true}
+	gh := gwHandler{
+		Next:          answerHandler(false),
+		im:            dw,
+		enc:           &jsonEncoder{},
+		encodeOptions: encodeOptions{maxQuestions: defaultMaxQuestions},
+	}
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+	for _, rw := range []dns.ResponseWriter{&dotWriter{cs: tls13}, &test.ResponseWriter{}} {
+		if _, err := gh.ServeDNS(context.Background(), rw, req); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var dot, udp dnsBase
+	if err := json.Unmarshal(dw.ents[0].Data, &dot); err != nil {
+		t.Fatal(err)
+	} else if err = json.Unmarshal(dw.ents[1].Data, &udp); err != nil {
+		t.Fatal(err)
+	} else if dot.ClientTLSVersion != `TLS 1.3` || dot.ClientCipher != `TLS_AES_128_GCM_SHA256` {
+		t.Fatalf("bad DoT record %+v", dot)
+	} else if udp.ClientTLSVersion != `` || udp.ClientCipher != `` {
+		t.Fatalf("TLS fields on a UDP record %+v", udp)
+	}
+}
@@ -0,0 +1,63 @@
+/*************************************************************************
+ * Copyright 2017 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package gravwellcoredns
+
+import (
+	"math"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// tunnelThresholds flag query names that look like DNS tunneling, a zero threshold is not checked
+type tunnelThresholds struct {
+	length  int     // presentation length of the qname
+	labels  int     // number of labels
+	entropy float64 // shannon entropy in bits per character, ignoring dots
+}
+
+func (t tunnelThresholds) enabled() bool {
+	return t.length > 0 || t.labels > 0 || t.entropy > 0
+}
+
+// match is true when the name exceeds any configured threshold
+func (t tunnelThresholds) match(name string) bool {
+	if !t.enabled() {
+		return false
+	}
+	name = strings.TrimSuffix(name, `.`)
+	if t.length > 0 && len(name) > t.length {
+		return true
+	} else if t.labels > 0 && dns.CountLabel(name) > t.labels {
+		return true
+	} else if t.entropy > 0 && nameEntropy(name) > t.entropy {
+		return true
+	}
+	return false
+}
+
+// nameEntropy computes the shannon entropy of the characters in a name, label separators are ignored
+func nameEntropy(name string) (e float64) {
+	var counts [256]int
+	var total int
+	for i := 0; i < len(name); i++ {
+		if name[i] == '.' {
+			continue
+		}
+		counts[name[i]]++
+		total++
+	}
+	for _, c := range counts {
+		if c > 0 {
+			p := float64(c) / float64(total)
+			e -= p * math.Log2(p)
+		}
+	}
+	return
+}
@@ -0,0 +1,60 @@
+/*************************************************************************
+ * Copyright 2017 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package gravwellcoredns
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/gravwell/gravwell/v3/ingest/entry"
+	"github.com/miekg/dns"
+)
+
+const tunnelName = `mzxw6ytboi2gk4tjnzsxg2lpnzsxe3tfmvxgs3thnvqxi5dfoi.ojsxg.t.example.com.`
+
+func TestTunnelThresholds(t *testing.T) {
+	if (tunnelThresholds{}).match(tunnelName) {
+		t.Fatal("disabled thresholds matched")
+	}
+	tests := []struct {
+		th   tunnelThresholds
+		name string
+		exp  bool
+	}{
+		{tunnelThresholds{length: 50}, `www.example.com.`, false},
+		{tunnelThresholds{length: 50}, tunnelName, true},
+		{tunnelThresholds{labels: 4}, `www.example.com.`, false},
+		{tunnelThresholds{labels: 4}, tunnelName, true},
+		{tunnelThresholds{entropy: 3.8}, `www.example.com.`, false},
+		{tunnelThresholds{entropy: 3.8}, tunnelName, true},
+	}
+	for i, tt := range tests {
+		if r := tt.th.match(tt.name); r != tt.exp {
+			t.Fatalf("%d: %+v match %s = %v (entropy %.2f)", i, tt.th, tt.name, r, nameEntropy(tt.name))
+		}
+	}
+}
+
+func TestPossibleTunnelRecord(t *testing.T) {
+	opts := testOpts
+	opts.tunnel = tunnelThresholds{length: 50}
+	var v dnsBase
+	for _, tt := range []struct {
+		name string
+		exp  bool
+	}{{`www.example.com.`, false}, {tunnelName, true}} {
+		is := newIntrospectorFromMsg(testMsg(tt.name, dns.TypeTXT), opts)
+		v = dnsBase{}
+		if err := json.Unmarshal(jsonEncoder{}.Encode(entry.Now(), testLocal, testRemote, is)[0], &v); err != nil {
+			t.Fatal(err)
+		} else if v.PossibleTunnel != tt.exp {
+			t.Fatalf("%s: PossibleTunnel %v != %v", tt.name, v.PossibleTunnel, tt.exp)
+		}
+	}
+}
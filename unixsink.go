@@ -0,0 +1,69 @@
+/*************************************************************************
+ * Copyright 2017 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package gravwellcoredns
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"path/filepath"
+	"time"
+
+	"github.com/gravwell/gravwell/v3/ingest/entry"
+)
+
+const unixDialTimeout time.Duration = 5 * time.Second
+
+// parseUnixSink validates a unix-sink path, the socket itself may not exist until the
+// collector starts so only the form of the path is checked
+func parseUnixSink(v string) (string, error) {
+	if !filepath.IsAbs(v) {
+		return ``, fmt.Errorf("Invalid unix-sink %q, must be an absolute path", v)
+	}
+	p := filepath.Clean(v)
+	//sun_path is 108 bytes on Linux including the terminator, less on the BSDs
+	if len(p) > 103 {
+		return ``, fmt.Errorf("Invalid unix-sink %q, socket paths are limited to 103 bytes", v)
+	}
+	return p, nil
+}
+
+// unixSink writes each encoded entry followed by a newline to a UNIX stream socket.  Like the
+// syslog sink the connection is only dialed in the background, a collector that restarted
+// shows up as EPIPE or ECONNRESET on the old connection and is picked back up by redialConn.
+type unixSink struct {
+	rc *redialConn
+}
+
+func newUnixSink(path string) *unixSink {
+	return &unixSink{
+		rc: newRedialConn(func(ctx context.Context) (net.Conn, error) {
+			d := net.Dialer{Timeout: unixDialTimeout}
+			return d.DialContext(ctx, `unix`, path)
+		}),
+	}
+}
+
+func (u *unixSink) WriteEntry(ent *entry.Entry) error {
+	return u.write(ent, time.Time{})
+}
+
+func (u *unixSink) WriteEntryTimeout(ent *entry.Entry, to time.Duration) error {
+	return u.write(ent, time.Now().Add(to))
+}
+
+func (u *unixSink) write(ent *entry.Entry, deadline time.Time) error {
+	bb := make([]byte, 0, len(ent.Data)+1)
+	bb = append(append(bb, ent.Data...), '\n')
+	return u.rc.write(bb, deadline)
+}
+
+func (u *unixSink) close() error {
+	return u.rc.close()
+}
@@ -0,0 +1,113 @@
+/*************************************************************************
+ * Copyright 2017 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package gravwellcoredns
+
+import (
+	"bufio"
+	"net"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/coredns/caddy"
+	"github.com/gravwell/gravwell/v3/ingest/entry"
+)
+
+func TestParseUnixSink(t *testing.T) {
+	if p, err := parseUnixSink(`/var/run/../run/dns.sock`); err != nil || p != `/var/run/dns.sock` {
+		t.Fatalf("bad path %q %v", p, err)
+	}
+	for _, bad := range []string{`dns.sock`, `./run/dns.sock`, `/` + strings.Repeat(`a`, 110)} {
+		if _, err := parseUnixSink(bad); err == nil {
+			t.Fatalf("accepted unix-sink %q", bad)
+		}
+	}
+	//a unix sink alone is a valid destination
+	if _, _, err := parseConfig(caddy.NewTestController("dns", "gravwell {\n\tUnix-Sink /var/run/dns.sock\n}")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// listenUnix accepts connections on p and sends every line it reads to lines, stop closes the
+// listener and every accepted connection as a collector exiting would
+func listenUnix(t *testing.T, p string, lines chan string) (stop func()) {
+	t.Helper()
+	l, err := net.Listen(`unix`, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var mtx sync.Mutex
+	var conns []net.Conn
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			mtx.Lock()
+			conns = append(conns, c)
+			mtx.Unlock()
+			go func(c net.Conn) {
+				defer c.Close()
+				sc := bufio.NewScanner(c)
+				for sc.Scan() {
+					lines <- sc.Text()
+				}
+			}(c)
+		}
+	}()
+	return func() {
+		l.Close()
+		mtx.Lock()
+		defer mtx.Unlock()
+		for _, c := range conns {
+			c.Close()
+		}
+	}
+}
+
+func TestUnixSinkReconnect(t *testing.T) {
+	p := filepath.Join(t.TempDir(), `dns.sock`)
+	lines := make(chan string, 4)
+	stop := listenUnix(t, p, lines)
+	u := newUnixSink(p)
+	defer u.close()
+	recv := func(want string) {
+		t.Helper()
+		select {
+		case v := <-lines:
+			if v != want {
+				t.Fatalf("got %q expected %q", v, want)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("%q never arrived", want)
+		}
+	}
+	if err := u.WriteEntry(&entry.Entry{TS: entry.Now(), Data: []byte(`first`)}); err != nil {
+		t.Fatal(err)
+	}
+	recv(`first`)
+
+	//restart the collector, the stale connection fails with EPIPE and the sink redials in the
+	//background, depending on buffering the first write or two after the restart are lost
+	stop()
+	time.Sleep(10 * time.Millisecond) //let the close reach the sink's end
+	stop = listenUnix(t, p, lines)
+	writeEventually(t, u, `second`)
+	recv(`second`)
+
+	//nothing listening is an error rather than a hang
+	stop()
+	u.close()
+	if err := u.WriteEntryTimeout(&entry.Entry{TS: entry.Now(), Data: []byte(`third`)}, time.Second); err == nil {
+		t.Fatal("write succeeded without a collector")
+	}
+}
@@ -0,0 +1,199 @@
+/*************************************************************************
+ * Copyright 2017 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package gravwellcoredns
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/gravwell/gravwell/v3/ingest/entry"
+	"github.com/miekg/dns"
+)
+
+const (
+	zeekUnset    string = `-`
+	zeekSetDelim string = `,`
+)
+
+var (
+	zeekFields = []string{
+		`ts`, `uid`, `id.orig_h`, `id.orig_p`, `id.resp_h`, `id.resp_p`, `proto`, `trans_id`, `rtt`,
+		`query`, `qclass`, `qclass_name`, `qtype`, `qtype_name`, `rcode`, `rcode_name`,
+		`AA`, `TC`, `RD`, `RA`, `Z`, `answers`, `TTLs`, `rejected`, `event_type`,
+	}
+	zeekTypes = []string{
+		`time`, `string`, `addr`, `port`, `addr`, `port`, `enum`, `count`, `interval`,
+		`string`, `count`, `string`, `count`, `string`, `count`, `string`,
+		`bool`, `bool`, `bool`, `bool`, `count`, `vector[string]`, `vector[interval]`, `bool`, `string`,
+	}
+)
+
+// zeekHeaderSent is process wide, encoders are rebuilt on every reload and a header repeated
+// mid-stream would read as a new log to Zeek tooling
+var zeekHeaderSent atomic.Bool
+
+// zeekEncoder emits Zeek dns.log compatible TSV lines, one per question.  There is no
+// connection tracking so the uid and rtt columns are always unset.  When the header
+// option is enabled the Zeek log header is emitted as its own entry ahead of the first line
+// the process writes.
+type zeekEncoder struct {
+	header bool
+}
+
+func (z *zeekEncoder) setOption(name string, args []string) (err error) {
+	switch name {
+	case `header`:
+		if len(args) != 1 {
+			return errors.New("header requires a single boolean argument")
+		}
+		z.header, err = strconv.ParseBool(args[0])
+	default:
+		err = errors.New("unknown option")
+	}
+	return
+}
+
+func (z *zeekEncoder) Encode(ts entry.Timestamp, local, remote net.Addr, tr *introspector) (bb [][]byte) {
+	bb = z.headerEntry()
+	var answers, ttls []string
+	for _, rr := range tr.a {
+		answers = append(answers, zeekEscape(rdata(rr)))
+		ttls = append(ttls, fmt.Sprintf("%d.000000", rr.Header().Ttl))
+	}
+	qs, _ := tr.questions()
+	for i, q := range qs {
+		bb = append(bb, z.line(ts, local, remote, tr, q, tr.rcode, answers, ttls, tr.questionEvent(i)))
+	}
+	return
+}
+
+func (z *zeekEncoder) EncodeError(ts entry.Timestamp, l, r net.Addr, tr *introspector, err error) (bb [][]byte) {
+	bb = z.headerEntry()
+	qs, _ := tr.requestQuestions()
+	for _, q := range qs {
+		bb = append(bb, z.line(ts, l, r, tr, q, dns.RcodeServerFailure, nil, nil, eventError))
+	}
+	return
+}
+
+func (z *zeekEncoder) Name() string {
+	return `zeek`
+}
+
+func (z *zeekEncoder) headerEntry() (bb [][]byte) {
+	if z.header && zeekHeaderSent.CompareAndSwap(false, true) {
+		bb = append(bb, []byte(zeekHeader()))
+	}
+	return
+}
+
+func zeekHeader() string {
+	return strings.Join([]string{
+		`#separator \x09`,
+		`#set_separator	` + zeekSetDelim,
+		`#empty_field	(empty)`,
+		`#unset_field	` + zeekUnset,
+		`#path	dns`,
+		`#fields	` + strings.Join(zeekFields, "\t"),
+		`#types	` + strings.Join(zeekTypes, "\t"),
+	}, "\n")
+}
+
+func (z *zeekEncoder) line(ts entry.Timestamp, local, remote net.Addr, tr *introspector, q dns.Question, rcode int, answers, ttls []string, eventType string) []byte {
+	var id uint16
+	if tr.req != nil {
+		id = tr.req.Id
+	} else {
+		id = tr.hdr.Id
+	}
+	origPort, _ := addrPort(remote)
+	respPort, _ := addrPort(local)
+	flds := []string{
+		epochString(ts),
+		zeekUnset,
+		addrHost(remote),
+		strconv.Itoa(origPort),
+		addrHost(local),
+		strconv.Itoa(respPort),
+		local.Network(),
+		strconv.Itoa(int(id)),
+		zeekUnset,
+		zeekString(stripFQDNDot(q.Name)), //zeek logs names without the root dot
+		strconv.Itoa(int(q.Qclass)),
+		zeekClassName(q.Qclass),
+		strconv.Itoa(int(q.Qtype)),
+		zeekString(dns.TypeToString[q.Qtype]),
+		strconv.Itoa(rcode),
+		zeekString(dns.RcodeToString[rcode]),
+		zeekBool(tr.hdr.Authoritative),
+		zeekBool(tr.hdr.Truncated),
+		zeekBool(tr.rd),
+		zeekBool(tr.ra),
+		strconv.Itoa(zeekZ(tr.hdr)),
+		zeekSet(answers),
+		zeekSet(ttls),
+		zeekBool(rcode == dns.RcodeRefused),
+		eventType, //not a Zeek column, the header names it for Zeek tooling
+	}
+	return []byte(strings.Join(flds, "\t"))
+}
+
+func zeekZ(h dns.MsgHdr) int {
+	if h.Zero {
+		return 1
+	}
+	return 0
+}
+
+func zeekBool(v bool) string {
+	if v {
+		return `T`
+	}
+	return `F`
+}
+
+func zeekString(v string) string {
+	if v == `` {
+		return zeekUnset
+	}
+	return zeekEscape(v)
+}
+
+func zeekSet(v []string) string {
+	if len(v) == 0 {
+		return zeekUnset
+	}
+	return strings.Join(v, zeekSetDelim)
+}
+
+// zeekClassName uses the Zeek naming for the internet class and the miekg/dns names otherwise
+func zeekClassName(c uint16) string {
+	if c == dns.ClassINET {
+		return `C_INTERNET`
+	}
+	return zeekString(dns.ClassToString[c])
+}
+
+// zeekEscape hex escapes separators and non-printable bytes the same way Zeek does
+func zeekEscape(v string) string {
+	var sb strings.Builder
+	for i := 0; i < len(v); i++ {
+		c := v[i]
+		if c < 0x20 || c > 0x7e || c == ',' || c == '\\' {
+			fmt.Fprintf(&sb, `\x%02x`, c)
+		} else {
+			sb.WriteByte(c)
+		}
+	}
+	return sb.String()
+}
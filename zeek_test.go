@@ -0,0 +1,95 @@
+/*************************************************************************
+ * Copyright 2017 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package gravwellcoredns
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/gravwell/gravwell/v3/ingest/entry"
+	"github.com/miekg/dns"
+)
+
+func TestZeekEncoder(t *testing.T) {
+	ts := entry.UnixTime(1700000000, 500000000)
+	local := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 53}
+	remote := &net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 40000}
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+	req.Id = 1234
+	resp := new(dns.Msg)
+	resp.SetReply(req)
+	resp.RecursionAvailable = true
+	resp.Answer = []dns.RR{
+		test.A("example.com. 300 IN A 1.2.3.4"),
+		test.A("example.com. 60 IN A 5.6.7.8"),
+	}
+	is := newIntrospector(&test.ResponseWriter{}, req)
+	if err := is.WriteMsg(resp); err != nil {
+		t.Fatal(err)
+	}
+
+	enc, err := getEncoder(`zeek`, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bbs := enc.Encode(ts, local, remote, is)
+	if len(bbs) != 1 {
+		t.Fatalf("invalid record count %d", len(bbs))
+	}
+	flds := strings.Split(string(bbs[0]), "\t")
+	if len(flds) != len(zeekFields) {
+		t.Fatalf("bad column count %d != %d", len(flds), len(zeekFields))
+	}
+	exp := []string{
+		`1700000000.500000`, `-`, `10.0.0.1`, `40000`, `127.0.0.1`, `53`, `udp`, `1234`, `-`,
+		`example.com`, `1`, `C_INTERNET`, `1`, `A`, `0`, `NOERROR`,
+		`F`, `F`, `T`, `T`, `0`, `1.2.3.4,5.6.7.8`, `300.000000,60.000000`, `F`, eventAnswer,
+	}
+	for i := range exp {
+		if flds[i] != exp[i] {
+			t.Fatalf("bad %s column %q != %q", zeekFields[i], flds[i], exp[i])
+		}
+	}
+
+	//errors report SERVFAIL with unset answers
+	bbs = enc.EncodeError(ts, local, remote, is, errors.New("upstream failed"))
+	if len(bbs) != 1 {
+		t.Fatalf("invalid record count %d", len(bbs))
+	}
+	if flds = strings.Split(string(bbs[0]), "\t"); flds[15] != `SERVFAIL` || flds[21] != zeekUnset || flds[24] != eventError {
+		t.Fatalf("bad error line %q", bbs[0])
+	}
+
+	//the header is emitted exactly once per process
+	zeekHeaderSent.Store(false)
+	if enc, err = getEncoder(`zeek`, [][]string{{`header`, `true`}}); err != nil {
+		t.Fatal(err)
+	}
+	if bbs = enc.Encode(ts, local, remote, is); len(bbs) != 2 {
+		t.Fatalf("missing header entry, got %d records", len(bbs))
+	} else if !strings.HasPrefix(string(bbs[0]), `#separator`) || !strings.Contains(string(bbs[0]), "#fields\tts\tuid") || !strings.Contains(string(bbs[0]), "\tevent_type\n#types") {
+		t.Fatalf("bad header %q", bbs[0])
+	}
+	if bbs = enc.Encode(ts, local, remote, is); len(bbs) != 1 {
+		t.Fatalf("header emitted more than once, got %d records", len(bbs))
+	}
+	//a reload rebuilds the encoder, the stream already has its header
+	if enc, err = getEncoder(`zeek`, [][]string{{`header`, `true`}}); err != nil {
+		t.Fatal(err)
+	} else if bbs = enc.Encode(ts, local, remote, is); len(bbs) != 1 {
+		t.Fatalf("header emitted again after a reload, got %d records", len(bbs))
+	}
+	if v := zeekEscape("a,b\tc"); v != `a\x2cb\x09c` {
+		t.Fatalf("bad escape %q", v)
+	}
+}